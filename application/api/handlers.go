@@ -11,9 +11,10 @@ type APIHandler struct {
 }
 
 type DeviceRegistration struct {
-    ID       string `json:"id"`
-    Location string `json:"location"`
-    ZoneID   string `json:"zoneId"`
+    ID        string `json:"id"`
+    Location  string `json:"location"`
+    ZoneID    string `json:"zoneId"`
+    SponsorID string `json:"sponsorId"`
 }
 
 type ReputationUpdate struct {
@@ -33,7 +34,7 @@ func (h *APIHandler) RegisterDevice(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    err := h.fabricClient.RegisterDevice(reg.ID, reg.Location, reg.ZoneID)
+    err := h.fabricClient.RegisterDevice(reg.ID, reg.Location, reg.ZoneID, reg.SponsorID)
     if err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
         return
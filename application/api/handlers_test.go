@@ -15,8 +15,8 @@ type MockFabricClient struct {
     mock.Mock
 }
 
-func (m *MockFabricClient) RegisterDevice(id, location, zoneId string) error {
-    args := m.Called(id, location, zoneId)
+func (m *MockFabricClient) RegisterDevice(id, location, zoneId, sponsorId string) error {
+    args := m.Called(id, location, zoneId, sponsorId)
     return args.Error(0)
 }
 
@@ -37,12 +37,13 @@ func TestAPIHandlers(t *testing.T) {
             mockClient := new(MockFabricClient)
             handler := NewAPIHandler(mockClient)
 
-            mockClient.On("RegisterDevice", "test-device", "test-zone", "Z1").Return(nil)
+            mockClient.On("RegisterDevice", "test-device", "test-zone", "Z1", "sponsor-device").Return(nil)
 
             body := DeviceRegistration{
                 ID: "test-device",
                 Location: "test-zone",
                 ZoneID: "Z1",
+                SponsorID: "sponsor-device",
             }
             bodyJSON, _ := json.Marshal(body)
 
@@ -0,0 +1,53 @@
+package main
+
+import (
+    "fmt"
+    "github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Roles carried in the "role" attribute of a client certificate
+const (
+    RoleAdmin    = "admin"
+    RoleResolver = "resolver"
+)
+
+// assertRole checks that the invoking client carries the given role attribute
+func assertRole(ctx contractapi.TransactionContextInterface, role string) error {
+    if err := ctx.GetClientIdentity().AssertAttributeValue("role", role); err != nil {
+        return fmt.Errorf("caller is not authorized as %s: %v", role, err)
+    }
+    return nil
+}
+
+// callerID returns the identity of the invoking client
+func callerID(ctx contractapi.TransactionContextInterface) (string, error) {
+    id, err := ctx.GetClientIdentity().GetID()
+    if err != nil {
+        return "", fmt.Errorf("failed to read caller identity: %v", err)
+    }
+    return id, nil
+}
+
+// assertDeviceOwner checks that the invoking client registered the device and
+// so may act on its behalf
+func assertDeviceOwner(ctx contractapi.TransactionContextInterface, device *DeviceState) error {
+    caller, err := callerID(ctx)
+    if err != nil {
+        return err
+    }
+    if device.Owner == "" || device.Owner != caller {
+        return fmt.Errorf("caller does not operate device %s", device.ID)
+    }
+    return nil
+}
+
+// assertDeviceOperator checks that the invoking client owns the device or is an admin
+func assertDeviceOperator(ctx contractapi.TransactionContextInterface, device *DeviceState) error {
+    if err := assertDeviceOwner(ctx, device); err == nil {
+        return nil
+    }
+    if err := assertRole(ctx, RoleAdmin); err != nil {
+        return fmt.Errorf("caller does not operate device %s: %v", device.ID, err)
+    }
+    return nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const configObjectType = "config"
+
+const sponsorshipObjectType = "sponsorship"
+
+// BootstrapPolicy controls how new devices enter the network
+type BootstrapPolicy struct {
+    InitialReputation     float64 `json:"initialReputation"`     // Probationary score new devices start at
+    MinSponsorReputation  float64 `json:"minSponsorReputation"`  // Reputation a device needs to vouch for another
+    MinLeaderAge          int64   `json:"minLeaderAge"`          // Seconds since registration before leadership
+    MinLeaderTransactions int     `json:"minLeaderTransactions"` // Recorded transactions before leadership
+    MaxSponsorships       int     `json:"maxSponsorships"`       // Devices one sponsor may vouch for
+}
+
+// defaultBootstrapPolicy applies until an admin stores a policy on the ledger
+var defaultBootstrapPolicy = BootstrapPolicy{
+    InitialReputation:     0.3,
+    MinSponsorReputation:  0.8,
+    MinLeaderAge:          7 * 24 * 60 * 60,
+    MinLeaderTransactions: 100,
+    MaxSponsorships:       5,
+}
+
+// sponsorRecord is the subset of a device record needed to vouch for another
+type sponsorRecord struct {
+    Reputation   float64 `json:"reputation"`
+    Status       string  `json:"status"`
+    UnderDispute bool    `json:"underDispute"`
+    Owner        string  `json:"owner"`
+}
+
+// GetBootstrapPolicy returns the onboarding policy in force
+func (dm *DeviceManager) GetBootstrapPolicy(ctx contractapi.TransactionContextInterface) (*BootstrapPolicy, error) {
+    return getBootstrapPolicy(ctx)
+}
+
+// SetBootstrapPolicy stores a new onboarding policy. Admin only.
+func (dm *DeviceManager) SetBootstrapPolicy(ctx contractapi.TransactionContextInterface, policyJSON string) error {
+    if err := assertRole(ctx, RoleAdmin); err != nil {
+        return err
+    }
+
+    var policy BootstrapPolicy
+    if err := json.Unmarshal([]byte(policyJSON), &policy); err != nil {
+        return fmt.Errorf("invalid bootstrap policy: %v", err)
+    }
+    if policy.InitialReputation < 0 || policy.InitialReputation > 1 {
+        return fmt.Errorf("initial reputation must be between 0 and 1")
+    }
+    if policy.MinSponsorReputation < 0 || policy.MinSponsorReputation > 1 {
+        return fmt.Errorf("minimum sponsor reputation must be between 0 and 1")
+    }
+    if policy.MinLeaderAge < 0 || policy.MinLeaderTransactions < 0 {
+        return fmt.Errorf("leadership requirements must not be negative")
+    }
+    if policy.MaxSponsorships < 1 {
+        return fmt.Errorf("sponsors must be allowed at least one sponsorship")
+    }
+
+    return putBootstrapPolicy(ctx, &policy)
+}
+
+// IsLeadershipEligible reports whether a device has completed probation.
+// Transactions are counted by RecordTransaction for devices of either
+// contract; records written before both contracts shared a schema carry no
+// status and count as active, as they do when sponsoring.
+func (dm *DeviceManager) IsLeadershipEligible(ctx contractapi.TransactionContextInterface, id string) (bool, error) {
+    device, err := dm.GetDevice(ctx, id)
+    if err != nil {
+        return false, err
+    }
+    policy, err := getBootstrapPolicy(ctx)
+    if err != nil {
+        return false, err
+    }
+    timestamp, err := ctx.GetStub().GetTxTimestamp()
+    if err != nil {
+        return false, err
+    }
+
+    if (device.Status != "" && device.Status != "active") || device.UnderDispute {
+        return false, nil
+    }
+    age := timestamp.Seconds - device.RegisteredAt
+    return age >= policy.MinLeaderAge && device.TransactionCount >= policy.MinLeaderTransactions, nil
+}
+
+// checkSponsor verifies that a new device is vouched for, either by an
+// established device the caller owns or, when sponsorId is empty, by an org
+// admin. A device's vouch counts against its sponsorship cap.
+func checkSponsor(ctx contractapi.TransactionContextInterface, sponsorId string, policy *BootstrapPolicy) error {
+    if sponsorId == "" {
+        if err := assertRole(ctx, RoleAdmin); err != nil {
+            return fmt.Errorf("new devices need a sponsor device or an admin: %v", err)
+        }
+        return nil
+    }
+
+    sponsorJSON, err := ctx.GetStub().GetState(sponsorId)
+    if err != nil {
+        return fmt.Errorf("failed to read sponsor: %v", err)
+    }
+    if sponsorJSON == nil {
+        return fmt.Errorf("sponsor does not exist: %s", sponsorId)
+    }
+
+    var sponsor sponsorRecord
+    if err := json.Unmarshal(sponsorJSON, &sponsor); err != nil {
+        return err
+    }
+    if sponsor.Status != "" && sponsor.Status != "active" {
+        return fmt.Errorf("sponsor %s is %s", sponsorId, sponsor.Status)
+    }
+    if sponsor.UnderDispute {
+        return fmt.Errorf("sponsor %s is under dispute", sponsorId)
+    }
+    if sponsor.Reputation < policy.MinSponsorReputation {
+        return fmt.Errorf("sponsor %s reputation %.2f is below %.2f", sponsorId, sponsor.Reputation, policy.MinSponsorReputation)
+    }
+
+    // Only the sponsor's owner can vouch with it
+    caller, err := callerID(ctx)
+    if err != nil {
+        return err
+    }
+    if sponsor.Owner == "" || sponsor.Owner != caller {
+        return fmt.Errorf("caller does not operate sponsor %s", sponsorId)
+    }
+
+    return countSponsorship(ctx, sponsorId, policy)
+}
+
+// countSponsorship records one more device vouched for by a sponsor, failing
+// once the sponsor has reached the policy's cap
+func countSponsorship(ctx contractapi.TransactionContextInterface, sponsorId string, policy *BootstrapPolicy) error {
+    key, err := ctx.GetStub().CreateCompositeKey(sponsorshipObjectType, []string{sponsorId})
+    if err != nil {
+        return err
+    }
+    countJSON, err := ctx.GetStub().GetState(key)
+    if err != nil {
+        return fmt.Errorf("failed to read sponsorships: %v", err)
+    }
+
+    count := 0
+    if len(countJSON) != 0 {
+        if err := json.Unmarshal(countJSON, &count); err != nil {
+            return err
+        }
+    }
+    if count >= policy.MaxSponsorships {
+        return fmt.Errorf("sponsor %s has already vouched for %d devices", sponsorId, count)
+    }
+
+    countJSON, err = json.Marshal(count + 1)
+    if err != nil {
+        return err
+    }
+    return ctx.GetStub().PutState(key, countJSON)
+}
+
+// getBootstrapPolicy reads the stored policy, falling back to the default
+func getBootstrapPolicy(ctx contractapi.TransactionContextInterface) (*BootstrapPolicy, error) {
+    key, err := ctx.GetStub().CreateCompositeKey(configObjectType, []string{"bootstrap"})
+    if err != nil {
+        return nil, err
+    }
+    policyJSON, err := ctx.GetStub().GetState(key)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read bootstrap policy: %v", err)
+    }
+
+    policy := defaultBootstrapPolicy
+    if policyJSON != nil {
+        if err := json.Unmarshal(policyJSON, &policy); err != nil {
+            return nil, err
+        }
+    }
+
+    return &policy, nil
+}
+
+// putBootstrapPolicy writes the policy to the world state
+func putBootstrapPolicy(ctx contractapi.TransactionContextInterface, policy *BootstrapPolicy) error {
+    key, err := ctx.GetStub().CreateCompositeKey(configObjectType, []string{"bootstrap"})
+    if err != nil {
+        return err
+    }
+    policyJSON, err := json.Marshal(policy)
+    if err != nil {
+        return err
+    }
+
+    return ctx.GetStub().PutState(key, policyJSON)
+}
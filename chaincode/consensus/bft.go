@@ -0,0 +1,959 @@
+package consensus
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "sort"
+)
+
+// A BFT zone checkpoints its executed state every bftCheckpointInterval
+// sequence numbers. A primary assigns sequence numbers at most bftWindow past
+// the last checkpoint a quorum has attested, so that no member falls further
+// behind than a checkpoint can bring it.
+const (
+    bftCheckpointInterval = 16
+    bftWindow             = 4 * bftCheckpointInterval
+)
+
+// ErrRejected wraps the reason a BFT member refused a message
+var ErrRejected = errors.New("message rejected")
+
+// isBFT reports whether messages of the type are exchanged by BFT zones
+func (t MessageType) isBFT() bool {
+    return t >= MsgRequest && t <= MsgFetchResponse
+}
+
+// bftSlot is the agreement on the request at one sequence number
+type bftSlot struct {
+    view       uint64
+    digest     []byte
+    prePrepare *Message
+    prepares   map[string]Message // Member -> its latest Prepare
+    commits    map[string]Message // Member -> its latest Commit
+    prepared   bool
+    committed  bool
+
+    // The PrePrepare and Prepares of the latest view the slot was prepared
+    // in, reported on a view change even once a later view re-proposes it
+    certificate []Message
+}
+
+// bftPending is a request a member knows of but has not executed
+type bftPending struct {
+    request Message
+    waited  int // Ticks since the request arrived, or since the view last changed
+}
+
+// bftReady is the work a BFT member's driver must carry out: send Messages,
+// apply CommittedEntries, and release the proposers waiting on Executed
+type bftReady struct {
+    Messages         []Message
+    CommittedEntries []LogEntry
+    Executed         []string // Keys of the requests executed, duplicates included
+}
+
+// bftNode is the state of one member of a Byzantine fault tolerant zone,
+// following PBFT. Members are fixed; with n of them the zone tolerates f =
+// (n-1)/3 faulty ones, and every quorum is n-f members, so any two quorums
+// share a correct member.
+//
+// A request is broadcast by the member it was submitted to. The primary of
+// the current view assigns it a sequence number in a PrePrepare; the other
+// members accept the assignment with a Prepare and, once a quorum agrees,
+// announce a Commit. A request is executed once a quorum has committed it and
+// every request before it has been executed. A member that waits too long
+// for a request moves to the next view, whose primary re-proposes whatever
+// a quorum may have committed in earlier views.
+//
+// Every message is signed by its sender, and members check the signatures
+// of the messages others embed as proof, so no faulty member can speak for
+// a correct one. Like raftNode it is a pure state machine: input arrives
+// through step, propose and tick, output leaves through ready.
+type bftNode struct {
+    id      string
+    zoneID  string
+    members []string // Sorted
+    f       int
+    keys    *keyring
+
+    view     uint64
+    changing bool   // Sent a ViewChange for view and waiting for its NewView
+    attempts int    // View changes since a view was last installed
+    assigned uint64 // Last sequence number assigned as primary
+    slots    map[uint64]*bftSlot
+    proposed map[string]uint64 // Request key -> sequence number pre-prepared at in this view
+    pending  map[string]*bftPending
+
+    executed uint64
+    state    []byte          // Digest of every request executed, chained
+    history  []Message       // Requests executed, from sequence number 1; null requests are empty
+    done     map[string]bool // Keys of the requests executed
+
+    stable      uint64    // Last checkpoint a quorum attested
+    stableProof []Message // The quorum's Checkpoints
+    checkpoints map[uint64]map[string]Message
+    viewChanges map[uint64]map[string]Message // View -> member -> its ViewChange
+
+    timeoutTicks int // How long a request waits before the primary is replaced
+    changeTicks  int // Ticks since the view change began
+    fetchTicks   int // Ticks since missing requests were last fetched
+
+    msgs         []Message
+    entries      []LogEntry
+    executedKeys []string
+}
+
+func newBFTNode(id, zoneID string, members []string, keys *keyring) *bftNode {
+    sorted := append([]string{}, members...)
+    sort.Strings(sorted)
+    return &bftNode{
+        id:           id,
+        zoneID:       zoneID,
+        members:      sorted,
+        f:            (len(sorted) - 1) / 3,
+        keys:         keys,
+        slots:        make(map[uint64]*bftSlot),
+        proposed:     make(map[string]uint64),
+        pending:      make(map[string]*bftPending),
+        state:        make([]byte, sha256.Size),
+        done:         make(map[string]bool),
+        checkpoints:  make(map[uint64]map[string]Message),
+        viewChanges:  make(map[uint64]map[string]Message),
+        timeoutTicks: defaultElectionTicks,
+    }
+}
+
+// quorum is how many members must agree for a decision to stand
+func (b *bftNode) quorum() int {
+    return len(b.members) - b.f
+}
+
+// primaryOf returns the member that proposes in a view
+func (b *bftNode) primaryOf(view uint64) string {
+    return b.members[view%uint64(len(b.members))]
+}
+
+// primary returns the primary of the current view, or none while the view is changing
+func (b *bftNode) primary() string {
+    if b.changing {
+        return ""
+    }
+    return b.primaryOf(b.view)
+}
+
+func (b *bftNode) isMember(nodeID string) bool {
+    return containsString(b.members, nodeID)
+}
+
+// inWindow reports whether a sequence number may be agreed on
+func (b *bftNode) inWindow(seq uint64) bool {
+    return seq > b.stable && seq <= b.stable+bftWindow
+}
+
+// requestKey identifies a request by the member it was submitted to and its ID there
+func requestKey(request Message) string {
+    return fmt.Sprintf("%s/%d", request.From, request.Proposal)
+}
+
+// requestDigest identifies the content of a request; a null request has none
+func requestDigest(request Message) []byte {
+    if request.From == "" {
+        return nil
+    }
+    data, _ := json.Marshal(struct {
+        From     string
+        Proposal uint64
+        Entries  []LogEntry
+    }{request.From, request.Proposal, request.Entries})
+    digest := sha256.Sum256(data)
+    return digest[:]
+}
+
+// chainDigest returns the state digest after executing a request with the given digest
+func chainDigest(state, digest []byte) []byte {
+    next := sha256.Sum256(append(append([]byte{}, state...), digest...))
+    return next[:]
+}
+
+// setTimeout sets how many ticks a request may wait before the primary is replaced
+func (b *bftNode) setTimeout(ticks int) {
+    if ticks > 0 {
+        b.timeoutTicks = ticks
+    }
+}
+
+// signed stamps a message as from this member and signs it
+func (b *bftNode) signed(m *Message) {
+    m.From = b.id
+    m.Group = b.zoneID
+    // Without its key a member sends unsigned messages, which the others
+    // refuse; the driver checks the key is held before starting it
+    b.keys.sign(m)
+}
+
+// sendTo queues a signed message for one member
+func (b *bftNode) sendTo(m Message, to string) {
+    m.To = to
+    b.msgs = append(b.msgs, m)
+}
+
+// broadcast queues a signed message for every other member
+func (b *bftNode) broadcast(m Message) {
+    for _, member := range b.members {
+        if member != b.id {
+            b.sendTo(m, member)
+        }
+    }
+}
+
+// ready returns the work outstanding since the last call
+func (b *bftNode) ready() bftReady {
+    rd := bftReady{Messages: b.msgs, CommittedEntries: b.entries, Executed: b.executedKeys}
+    b.msgs, b.entries, b.executedKeys = nil, nil, nil
+    return rd
+}
+
+// propose submits a request for the zone to execute and returns its key
+func (b *bftNode) propose(id uint64, entryType EntryType, data []byte) string {
+    request := Message{Type: MsgRequest, Proposal: id, Entries: []LogEntry{{Type: entryType, Data: data}}}
+    b.signed(&request)
+    b.broadcast(request)
+    b.admit(request)
+    return requestKey(request)
+}
+
+// step handles a message from another member, returning why it was refused
+func (b *bftNode) step(m Message) error {
+    if !b.isMember(m.From) || m.From == b.id {
+        return fmt.Errorf("%w: %s is not another member of zone %s", ErrRejected, m.From, b.zoneID)
+    }
+    if m.Group != b.zoneID {
+        return fmt.Errorf("%w: %s for zone %s", ErrRejected, m.Type, m.Group)
+    }
+    if err := b.keys.verify(m); err != nil {
+        return err
+    }
+
+    switch m.Type {
+    case MsgRequest:
+        if err := b.checkRequest(m); err != nil {
+            return err
+        }
+        b.admit(m)
+    case MsgPrePrepare:
+        return b.handlePrePrepare(m)
+    case MsgPrepare, MsgCommit:
+        return b.handleVote(m)
+    case MsgCheckpoint:
+        b.handleCheckpoint(m)
+    case MsgViewChange:
+        return b.handleViewChange(m)
+    case MsgNewView:
+        return b.handleNewView(m)
+    case MsgFetch:
+        b.handleFetch(m)
+    case MsgFetchResponse:
+        return b.handleFetchResponse(m)
+    default:
+        return fmt.Errorf("%w: unexpected %s", ErrRejected, m.Type)
+    }
+    return nil
+}
+
+// checkRequest checks that a request was submitted to the member it names
+func (b *bftNode) checkRequest(request Message) error {
+    if request.Type != MsgRequest || !b.isMember(request.From) || request.Group != b.zoneID || len(request.Entries) != 1 {
+        return fmt.Errorf("%w: malformed request from %s", ErrRejected, request.From)
+    }
+    return b.keys.verify(request)
+}
+
+// admit records a request to be executed, and has the primary assign it a
+// sequence number
+func (b *bftNode) admit(request Message) {
+    key := requestKey(request)
+    if b.done[key] {
+        return
+    }
+    if _, exists := b.pending[key]; !exists {
+        b.pending[key] = &bftPending{request: request}
+    }
+    if b.primary() == b.id {
+        b.assignPending()
+    }
+}
+
+// assignPending has the primary assign sequence numbers to the requests it
+// has yet to propose in this view, as far as the window allows
+func (b *bftNode) assignPending() {
+    keys := make([]string, 0, len(b.pending))
+    for key := range b.pending {
+        if _, exists := b.proposed[key]; !exists {
+            keys = append(keys, key)
+        }
+    }
+    sort.Strings(keys)
+    if b.assigned < b.stable {
+        b.assigned = b.stable
+    }
+    for _, key := range keys {
+        if !b.inWindow(b.assigned + 1) {
+            return
+        }
+        b.assigned++
+        request := b.pending[key].request
+        pp := Message{Type: MsgPrePrepare, View: b.view, Sequence: b.assigned, Digest: requestDigest(request), Requests: []Message{request}}
+        b.signed(&pp)
+        b.broadcast(pp)
+        b.accept(pp)
+    }
+}
+
+// handlePrePrepare accepts the primary's assignment of a sequence number
+func (b *bftNode) handlePrePrepare(m Message) error {
+    if m.View != b.view || b.changing || m.From != b.primaryOf(m.View) {
+        return fmt.Errorf("%w: PrePrepare for view %d from %s in view %d", ErrRejected, m.View, m.From, b.view)
+    }
+    if !b.inWindow(m.Sequence) {
+        return fmt.Errorf("%w: sequence number %d outside the window", ErrRejected, m.Sequence)
+    }
+    if err := b.checkPrePrepare(m); err != nil {
+        return err
+    }
+    if slot := b.slots[m.Sequence]; slot != nil && slot.view == m.View && slot.prePrepare != nil {
+        if !bytes.Equal(slot.digest, m.Digest) {
+            return fmt.Errorf("%w: primary %s assigned sequence number %d twice", ErrRejected, m.From, m.Sequence)
+        }
+        return nil
+    }
+    b.accept(m)
+    return nil
+}
+
+// checkPrePrepare checks that a PrePrepare carries the request it claims to.
+// Only a NewView may assign a null request.
+func (b *bftNode) checkPrePrepare(m Message) error {
+    if len(m.Requests) != 1 {
+        return fmt.Errorf("%w: PrePrepare without a request", ErrRejected)
+    }
+    if err := b.checkRequest(m.Requests[0]); err != nil {
+        return err
+    }
+    if !bytes.Equal(requestDigest(m.Requests[0]), m.Digest) {
+        return fmt.Errorf("%w: PrePrepare digest does not match its request", ErrRejected)
+    }
+    return nil
+}
+
+// accept installs a PrePrepare of the current view and, unless this member
+// is the primary, agrees to it with a Prepare
+func (b *bftNode) accept(pp Message) {
+    slot := b.slot(pp.Sequence)
+    slot.view = pp.View
+    slot.digest = pp.Digest
+    slot.prePrepare = &pp
+    slot.prepared = false
+    slot.committed = false
+    for _, request := range pp.Requests {
+        b.proposed[requestKey(request)] = pp.Sequence
+        if !b.done[requestKey(request)] && b.pending[requestKey(request)] == nil {
+            b.pending[requestKey(request)] = &bftPending{request: request}
+        }
+    }
+
+    if pp.From != b.id {
+        prepare := Message{Type: MsgPrepare, View: pp.View, Sequence: pp.Sequence, Digest: pp.Digest}
+        b.signed(&prepare)
+        b.broadcast(prepare)
+        slot.prepares[b.id] = prepare
+    }
+    b.advanceSlot(pp.Sequence)
+}
+
+// slot returns the agreement on a sequence number, starting it if need be
+func (b *bftNode) slot(seq uint64) *bftSlot {
+    slot, exists := b.slots[seq]
+    if !exists {
+        slot = &bftSlot{prepares: make(map[string]Message), commits: make(map[string]Message)}
+        b.slots[seq] = slot
+    }
+    return slot
+}
+
+// handleVote records a Prepare or Commit of the current view
+func (b *bftNode) handleVote(m Message) error {
+    if m.View != b.view || b.changing {
+        return fmt.Errorf("%w: %s for view %d in view %d", ErrRejected, m.Type, m.View, b.view)
+    }
+    if !b.inWindow(m.Sequence) {
+        return fmt.Errorf("%w: sequence number %d outside the window", ErrRejected, m.Sequence)
+    }
+    if m.Type == MsgPrepare {
+        if m.From == b.primaryOf(m.View) {
+            return fmt.Errorf("%w: Prepare from the primary", ErrRejected)
+        }
+        b.slot(m.Sequence).prepares[m.From] = m
+    } else {
+        b.slot(m.Sequence).commits[m.From] = m
+    }
+    b.advanceSlot(m.Sequence)
+    return nil
+}
+
+// matching counts the votes for a slot's request in its view
+func matching(votes map[string]Message, slot *bftSlot) int {
+    count := 0
+    for _, vote := range votes {
+        if vote.View == slot.view && bytes.Equal(vote.Digest, slot.digest) {
+            count++
+        }
+    }
+    return count
+}
+
+// advanceSlot commits to a slot's request once a quorum has accepted it,
+// and executes it once a quorum has committed to it
+func (b *bftNode) advanceSlot(seq uint64) {
+    slot := b.slots[seq]
+    if slot == nil || slot.prePrepare == nil || slot.view != b.view || b.changing {
+        return
+    }
+    // The primary's PrePrepare stands for its Prepare
+    if !slot.prepared && matching(slot.prepares, slot) >= b.quorum()-1 {
+        slot.prepared = true
+        slot.certificate = []Message{*slot.prePrepare}
+        for _, member := range b.members {
+            if prepare, exists := slot.prepares[member]; exists && prepare.View == slot.view && bytes.Equal(prepare.Digest, slot.digest) {
+                slot.certificate = append(slot.certificate, prepare)
+            }
+        }
+        commit := Message{Type: MsgCommit, View: slot.view, Sequence: seq, Digest: slot.digest}
+        b.signed(&commit)
+        b.broadcast(commit)
+        slot.commits[b.id] = commit
+    }
+    if slot.prepared && !slot.committed && matching(slot.commits, slot) >= b.quorum() {
+        slot.committed = true
+        b.execute()
+    }
+}
+
+// execute runs the committed requests that follow the last one executed
+func (b *bftNode) execute() {
+    for {
+        slot := b.slots[b.executed+1]
+        if slot == nil || !slot.committed {
+            return
+        }
+        var request Message
+        if len(slot.prePrepare.Requests) > 0 {
+            request = slot.prePrepare.Requests[0]
+        }
+        b.executeRequest(b.executed+1, slot.view, request)
+    }
+}
+
+// executeRequest runs the request at the next sequence number. A request
+// executed before is skipped; a null request only advances the sequence.
+func (b *bftNode) executeRequest(seq, view uint64, request Message) {
+    b.executed = seq
+    b.state = chainDigest(b.state, requestDigest(request))
+    b.history = append(b.history, request)
+    if request.From != "" {
+        key := requestKey(request)
+        if !b.done[key] {
+            b.done[key] = true
+            entry := request.Entries[0]
+            b.entries = append(b.entries, LogEntry{Index: seq, Term: view, Type: entry.Type, Data: entry.Data})
+        }
+        b.executedKeys = append(b.executedKeys, key)
+        delete(b.pending, key)
+        delete(b.proposed, key)
+    }
+
+    if seq%bftCheckpointInterval == 0 {
+        checkpoint := Message{Type: MsgCheckpoint, View: b.view, Sequence: seq, Digest: b.state}
+        b.signed(&checkpoint)
+        b.broadcast(checkpoint)
+        b.recordCheckpoint(checkpoint)
+    }
+}
+
+// handleCheckpoint records another member's attestation of its state
+func (b *bftNode) handleCheckpoint(m Message) {
+    if m.Sequence > b.stable && m.Sequence%bftCheckpointInterval == 0 {
+        b.recordCheckpoint(m)
+    }
+}
+
+// recordCheckpoint adds an attestation, making its checkpoint stable once a
+// quorum agrees on the state
+func (b *bftNode) recordCheckpoint(m Message) {
+    votes, exists := b.checkpoints[m.Sequence]
+    if !exists {
+        votes = make(map[string]Message)
+        b.checkpoints[m.Sequence] = votes
+    }
+    votes[m.From] = m
+
+    proof := make([]Message, 0, len(votes))
+    for _, vote := range votes {
+        if bytes.Equal(vote.Digest, m.Digest) {
+            proof = append(proof, vote)
+        }
+    }
+    if len(proof) >= b.quorum() {
+        sort.Slice(proof, func(i, j int) bool { return proof[i].From < proof[j].From })
+        b.stabilize(m.Sequence, proof)
+    }
+}
+
+// stabilize moves the last stable checkpoint forward, discarding what it
+// covers, and fetches the requests it covers that were never executed here
+func (b *bftNode) stabilize(seq uint64, proof []Message) {
+    if seq <= b.stable {
+        return
+    }
+    b.stable = seq
+    b.stableProof = proof
+    for s := range b.slots {
+        if s <= seq {
+            delete(b.slots, s)
+        }
+    }
+    for s := range b.checkpoints {
+        if s <= seq {
+            delete(b.checkpoints, s)
+        }
+    }
+    if b.executed < seq {
+        b.fetch()
+    }
+    if b.primary() == b.id {
+        b.assignPending()
+    }
+}
+
+// checkCheckpointProof checks that a quorum of members attested the same
+// state at a checkpoint, and returns that state
+func (b *bftNode) checkCheckpointProof(seq uint64, proof []Message) ([]byte, error) {
+    if seq == 0 {
+        return make([]byte, sha256.Size), nil
+    }
+    seen := make(map[string]bool)
+    var digest []byte
+    for _, m := range proof {
+        if m.Type != MsgCheckpoint || m.Sequence != seq || !b.isMember(m.From) || seen[m.From] || m.Group != b.zoneID {
+            continue
+        }
+        if digest != nil && !bytes.Equal(digest, m.Digest) {
+            return nil, fmt.Errorf("%w: checkpoint %d attested with different states", ErrRejected, seq)
+        }
+        if err := b.keys.verify(m); err != nil {
+            return nil, err
+        }
+        digest = m.Digest
+        seen[m.From] = true
+    }
+    if len(seen) < b.quorum() {
+        return nil, fmt.Errorf("%w: checkpoint %d attested by %d members, want %d", ErrRejected, seq, len(seen), b.quorum())
+    }
+    return digest, nil
+}
+
+// fetch asks the members that attested the last stable checkpoint for the
+// requests it covers that were never executed here
+func (b *bftNode) fetch() {
+    b.fetchTicks = 0
+    for _, m := range b.stableProof {
+        if m.From != b.id {
+            request := Message{Type: MsgFetch, Sequence: b.executed}
+            b.signed(&request)
+            b.sendTo(request, m.From)
+        }
+    }
+}
+
+// handleFetch sends a member that has fallen behind the requests executed
+// up to the last stable checkpoint, with the checkpoint's proof
+func (b *bftNode) handleFetch(m Message) {
+    if m.Sequence >= b.stable || b.executed < b.stable {
+        return
+    }
+    response := Message{
+        Type:     MsgFetchResponse,
+        Sequence: b.stable,
+        Requests: b.history[m.Sequence:b.stable],
+        Proof:    b.stableProof,
+    }
+    b.signed(&response)
+    b.sendTo(response, m.From)
+}
+
+// handleFetchResponse executes the requests fetched from another member once
+// they are shown to lead to a state a quorum attested
+func (b *bftNode) handleFetchResponse(m Message) error {
+    if m.Sequence <= b.executed {
+        return nil
+    }
+    start := m.Sequence - uint64(len(m.Requests))
+    if uint64(len(m.Requests)) > m.Sequence || start > b.executed {
+        return fmt.Errorf("%w: fetched requests do not follow sequence number %d", ErrRejected, b.executed)
+    }
+    digest, err := b.checkCheckpointProof(m.Sequence, m.Proof)
+    if err != nil {
+        return err
+    }
+    requests := m.Requests[b.executed-start:]
+    state := b.state
+    for _, request := range requests {
+        if request.From != "" && len(request.Entries) != 1 {
+            return fmt.Errorf("%w: malformed fetched request", ErrRejected)
+        }
+        state = chainDigest(state, requestDigest(request))
+    }
+    if !bytes.Equal(state, digest) {
+        return fmt.Errorf("%w: fetched requests do not lead to checkpoint %d", ErrRejected, m.Sequence)
+    }
+
+    for _, request := range requests {
+        b.executeRequest(b.executed+1, b.view, request)
+    }
+    b.stabilize(m.Sequence, m.Proof)
+    b.execute()
+    return nil
+}
+
+// tick advances the member's clock. A request that waits a timeout without
+// executing has the member move to the next view; a view change that does
+// not complete in twice that, doubling with each attempt, moves on again.
+func (b *bftNode) tick() {
+    if b.executed < b.stable {
+        b.fetchTicks++
+        if b.fetchTicks >= b.timeoutTicks/2 {
+            b.fetch()
+        }
+    }
+
+    if b.changing {
+        b.changeTicks++
+        if b.changeTicks >= b.timeoutTicks<<minInt(b.attempts, 4) {
+            b.startViewChange(b.view + 1)
+        }
+        return
+    }
+    for _, p := range b.pending {
+        p.waited++
+        if p.waited >= b.timeoutTicks {
+            b.startViewChange(b.view + 1)
+            return
+        }
+    }
+}
+
+func minInt(a, b int) int {
+    if a < b {
+        return a
+    }
+    return b
+}
+
+// startViewChange stops agreeing in the current view and asks to move to a
+// later one, reporting the last stable checkpoint and every request
+// prepared after it
+func (b *bftNode) startViewChange(view uint64) {
+    b.view = view
+    b.changing = true
+    b.attempts++
+    b.changeTicks = 0
+
+    vc := Message{Type: MsgViewChange, View: view, Sequence: b.stable, Proof: append([]Message{}, b.stableProof...)}
+    seqs := make([]uint64, 0, len(b.slots))
+    for seq, slot := range b.slots {
+        if slot.certificate != nil {
+            seqs = append(seqs, seq)
+        }
+    }
+    sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+    for _, seq := range seqs {
+        vc.Proof = append(vc.Proof, b.slots[seq].certificate...)
+    }
+    b.signed(&vc)
+    b.broadcast(vc)
+    b.recordViewChange(vc)
+}
+
+// handleViewChange records a member's request to move to a later view
+func (b *bftNode) handleViewChange(m Message) error {
+    if m.View < b.view || (m.View == b.view && !b.changing) {
+        return nil
+    }
+    if _, err := b.checkViewChange(m); err != nil {
+        return err
+    }
+    b.recordViewChange(m)
+
+    // Once f+1 members want a later view, at least one correct member
+    // does; join the earliest of them rather than wait out a timeout
+    later := make(map[string]uint64)
+    for view, changes := range b.viewChanges {
+        if view <= b.view {
+            continue
+        }
+        for member := range changes {
+            if earliest, exists := later[member]; !exists || view < earliest {
+                later[member] = view
+            }
+        }
+    }
+    if len(later) > b.f {
+        views := make([]uint64, 0, len(later))
+        for _, view := range later {
+            views = append(views, view)
+        }
+        sort.Slice(views, func(i, j int) bool { return views[i] < views[j] })
+        b.startViewChange(views[0])
+    }
+    return nil
+}
+
+// recordViewChange adds a ViewChange, and has the primary of its view
+// install the view once a quorum has asked for it
+func (b *bftNode) recordViewChange(m Message) {
+    changes, exists := b.viewChanges[m.View]
+    if !exists {
+        changes = make(map[string]Message)
+        b.viewChanges[m.View] = changes
+    }
+    changes[m.From] = m
+
+    if m.View != b.view || !b.changing || b.primaryOf(m.View) != b.id || len(changes) < b.quorum() {
+        return
+    }
+    vcs := make([]Message, 0, len(changes))
+    for _, member := range b.members {
+        if vc, exists := changes[member]; exists {
+            vcs = append(vcs, vc)
+        }
+    }
+    stable, proof, requests, err := b.reproposals(vcs)
+    if err != nil {
+        // Only checked ViewChanges are recorded
+        return
+    }
+    nv := Message{Type: MsgNewView, View: m.View, Proof: vcs}
+    var pps []Message
+    for i, request := range requests {
+        pp := Message{Type: MsgPrePrepare, View: m.View, Sequence: stable + uint64(i) + 1, Digest: requestDigest(request)}
+        if request.From != "" {
+            pp.Requests = []Message{request}
+        }
+        b.signed(&pp)
+        pps = append(pps, pp)
+    }
+    nv.Proof = append(nv.Proof, pps...)
+    b.signed(&nv)
+    b.broadcast(nv)
+    b.enterView(m.View, stable, proof, pps)
+}
+
+// preparedRequest is a request a member shows was prepared at a sequence number
+type preparedRequest struct {
+    view    uint64
+    request Message
+}
+
+// checkViewChange checks a ViewChange's checkpoint and the certificate of
+// every request it reports prepared, returning those requests by sequence
+// number
+func (b *bftNode) checkViewChange(m Message) (map[uint64]preparedRequest, error) {
+    if m.Type != MsgViewChange || !b.isMember(m.From) || m.Group != b.zoneID {
+        return nil, fmt.Errorf("%w: malformed ViewChange", ErrRejected)
+    }
+    var checkpoints []Message
+    pps := make(map[uint64]Message)
+    prepares := make(map[uint64][]Message)
+    for _, p := range m.Proof {
+        switch p.Type {
+        case MsgCheckpoint:
+            checkpoints = append(checkpoints, p)
+        case MsgPrePrepare:
+            if _, exists := pps[p.Sequence]; exists || p.Sequence <= m.Sequence || p.View >= m.View {
+                return nil, fmt.Errorf("%w: ViewChange from %s reports sequence number %d wrongly", ErrRejected, m.From, p.Sequence)
+            }
+            pps[p.Sequence] = p
+        case MsgPrepare:
+            prepares[p.Sequence] = append(prepares[p.Sequence], p)
+        }
+    }
+    if _, err := b.checkCheckpointProof(m.Sequence, checkpoints); err != nil {
+        return nil, err
+    }
+
+    prepared := make(map[uint64]preparedRequest)
+    for seq, pp := range pps {
+        if pp.From != b.primaryOf(pp.View) || pp.Group != b.zoneID {
+            return nil, fmt.Errorf("%w: PrePrepare for view %d not from its primary", ErrRejected, pp.View)
+        }
+        if err := b.keys.verify(pp); err != nil {
+            return nil, err
+        }
+        var request Message
+        if len(pp.Requests) > 0 {
+            if err := b.checkPrePrepare(pp); err != nil {
+                return nil, err
+            }
+            request = pp.Requests[0]
+        } else if pp.Digest != nil {
+            return nil, fmt.Errorf("%w: null PrePrepare with a digest", ErrRejected)
+        }
+        voters := make(map[string]bool)
+        for _, prepare := range prepares[seq] {
+            if prepare.View != pp.View || !bytes.Equal(prepare.Digest, pp.Digest) || prepare.From == pp.From || !b.isMember(prepare.From) || voters[prepare.From] || prepare.Group != b.zoneID {
+                continue
+            }
+            if err := b.keys.verify(prepare); err != nil {
+                return nil, err
+            }
+            voters[prepare.From] = true
+        }
+        if len(voters) < b.quorum()-1 {
+            return nil, fmt.Errorf("%w: sequence number %d reported prepared by %d members, want %d", ErrRejected, seq, len(voters), b.quorum()-1)
+        }
+        prepared[seq] = preparedRequest{view: pp.View, request: request}
+    }
+    return prepared, nil
+}
+
+// reproposals works out what the primary of a new view must propose from a
+// quorum of ViewChanges: everything after the latest stable checkpoint any
+// of them reports, up to the last sequence number any reports prepared.
+// Each sequence number gets the request prepared in the latest view, or a
+// null request if none was.
+func (b *bftNode) reproposals(vcs []Message) (uint64, []Message, []Message, error) {
+    var stable, last uint64
+    var proof []Message
+    chosen := make(map[uint64]preparedRequest)
+    for _, vc := range vcs {
+        prepared, err := b.checkViewChange(vc)
+        if err != nil {
+            return 0, nil, nil, err
+        }
+        if vc.Sequence > stable || proof == nil {
+            stable = vc.Sequence
+            proof = nil
+            for _, p := range vc.Proof {
+                if p.Type == MsgCheckpoint {
+                    proof = append(proof, p)
+                }
+            }
+        }
+        for seq, p := range prepared {
+            if current, exists := chosen[seq]; !exists || p.view > current.view {
+                chosen[seq] = p
+            }
+            if seq > last {
+                last = seq
+            }
+        }
+    }
+
+    var requests []Message
+    for seq := stable + 1; seq <= last; seq++ {
+        requests = append(requests, chosen[seq].request)
+    }
+    return stable, proof, requests, nil
+}
+
+// handleNewView installs a view its primary shows a quorum asked for,
+// checking that it re-proposes what the quorum reported
+func (b *bftNode) handleNewView(m Message) error {
+    if m.View < b.view || (m.View == b.view && !b.changing) {
+        return nil
+    }
+    if m.From != b.primaryOf(m.View) {
+        return fmt.Errorf("%w: NewView for view %d not from its primary", ErrRejected, m.View)
+    }
+    var vcs, pps []Message
+    seen := make(map[string]bool)
+    for _, p := range m.Proof {
+        switch p.Type {
+        case MsgViewChange:
+            if p.View != m.View || seen[p.From] {
+                return fmt.Errorf("%w: NewView carries a ViewChange for another view", ErrRejected)
+            }
+            if err := b.keys.verify(p); err != nil {
+                return err
+            }
+            seen[p.From] = true
+            vcs = append(vcs, p)
+        case MsgPrePrepare:
+            pps = append(pps, p)
+        }
+    }
+    if len(vcs) < b.quorum() {
+        return fmt.Errorf("%w: NewView shows %d ViewChanges, want %d", ErrRejected, len(vcs), b.quorum())
+    }
+    stable, proof, requests, err := b.reproposals(vcs)
+    if err != nil {
+        return err
+    }
+    if len(pps) != len(requests) {
+        return fmt.Errorf("%w: NewView re-proposes %d requests, want %d", ErrRejected, len(pps), len(requests))
+    }
+    for i, pp := range pps {
+        if pp.From != m.From || pp.View != m.View || pp.Sequence != stable+uint64(i)+1 || !bytes.Equal(pp.Digest, requestDigest(requests[i])) {
+            return fmt.Errorf("%w: NewView re-proposes sequence number %d wrongly", ErrRejected, stable+uint64(i)+1)
+        }
+        if err := b.keys.verify(pp); err != nil {
+            return err
+        }
+        if requests[i].From == "" && len(pp.Requests) > 0 {
+            return fmt.Errorf("%w: NewView fills null sequence number %d", ErrRejected, pp.Sequence)
+        }
+        if requests[i].From != "" {
+            if err := b.checkPrePrepare(pp); err != nil {
+                return err
+            }
+        }
+    }
+
+    b.view = m.View
+    b.enterView(m.View, stable, proof, pps)
+    return nil
+}
+
+// enterView starts agreeing in a view, beginning with the PrePrepares its
+// NewView carries
+func (b *bftNode) enterView(view, stable uint64, proof []Message, pps []Message) {
+    b.changing = false
+    b.attempts = 0
+    b.proposed = make(map[string]uint64)
+    for v := range b.viewChanges {
+        if v <= view {
+            delete(b.viewChanges, v)
+        }
+    }
+    for _, p := range b.pending {
+        p.waited = 0
+    }
+    if stable > b.stable {
+        b.stabilize(stable, proof)
+    }
+
+    b.assigned = b.stable
+    for _, pp := range pps {
+        if pp.Sequence > b.assigned {
+            b.assigned = pp.Sequence
+        }
+        if b.inWindow(pp.Sequence) {
+            b.accept(pp)
+        }
+    }
+    if b.primaryOf(view) == b.id {
+        b.assignPending()
+    }
+}
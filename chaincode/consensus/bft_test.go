@@ -0,0 +1,334 @@
+package consensus
+
+import (
+    "crypto/ed25519"
+    "crypto/sha256"
+    "errors"
+    "fmt"
+    "strings"
+    "testing"
+)
+
+var bftMembers = []string{"n1", "n2", "n3", "n4"}
+
+// testKey derives a node's key from its ID
+func testKey(nodeID string) ed25519.PrivateKey {
+    seed := sha256.Sum256([]byte(nodeID))
+    return ed25519.NewKeyFromSeed(seed[:])
+}
+
+// newTestKeyring holds the signing keys of every listed node
+func newTestKeyring(t *testing.T, ids ...string) *keyring {
+    keys := newKeyring()
+    for _, id := range ids {
+        if err := keys.setPrivate(id, testKey(id)); err != nil {
+            t.Fatalf("setPrivate(%s): %v", id, err)
+        }
+    }
+    return keys
+}
+
+// bftNet delivers messages between BFT members in order, dropping those
+// its filter refuses
+type bftNet struct {
+    nodes    map[string]*bftNode
+    queue    []Message
+    drop     func(m Message) bool
+    executed map[string][]string
+    nextID   uint64
+}
+
+func newBFTNet(t *testing.T) *bftNet {
+    keys := newTestKeyring(t, bftMembers...)
+    net := &bftNet{nodes: make(map[string]*bftNode), executed: make(map[string][]string)}
+    for _, id := range bftMembers {
+        net.nodes[id] = newBFTNode(id, "Z1", bftMembers, keys)
+    }
+    return net
+}
+
+// collect queues the messages every member has sent and records what each executed
+func (net *bftNet) collect() {
+    for _, id := range bftMembers {
+        rd := net.nodes[id].ready()
+        net.queue = append(net.queue, rd.Messages...)
+        for _, entry := range rd.CommittedEntries {
+            net.executed[id] = append(net.executed[id], string(entry.Data))
+        }
+    }
+}
+
+// run delivers messages until none are left
+func (net *bftNet) run() {
+    net.collect()
+    for len(net.queue) > 0 {
+        m := net.queue[0]
+        net.queue = net.queue[1:]
+        if net.drop == nil || !net.drop(m) {
+            net.nodes[m.To].step(m)
+        }
+        net.collect()
+    }
+}
+
+// tick advances every member's clock by a request timeout and delivers what follows
+func (net *bftNet) tick() {
+    for i := 0; i < defaultElectionTicks; i++ {
+        for _, id := range bftMembers {
+            net.nodes[id].tick()
+        }
+        net.run()
+    }
+}
+
+func (net *bftNet) propose(nodeID, data string) {
+    net.nextID++
+    net.nodes[nodeID].propose(net.nextID, EntryNormal, []byte(data))
+    net.run()
+}
+
+// isolate drops every message to or from the listed members
+func (net *bftNet) isolate(ids ...string) {
+    net.drop = func(m Message) bool {
+        return containsString(ids, m.From) || containsString(ids, m.To)
+    }
+}
+
+func (net *bftNet) checkExecuted(t *testing.T, nodeID string, want ...string) {
+    t.Helper()
+    if got := net.executed[nodeID]; !equalStrings(got, want) {
+        t.Errorf("%s executed %q, want %q", nodeID, got, want)
+    }
+}
+
+func TestBFTToleratesSilentMember(t *testing.T) {
+    net := newBFTNet(t)
+    net.isolate("n4")
+    net.propose("n2", "tx1")
+    net.propose("n3", "tx2")
+    for _, id := range []string{"n1", "n2", "n3"} {
+        net.checkExecuted(t, id, "tx1", "tx2")
+    }
+    net.checkExecuted(t, "n4")
+}
+
+func TestBFTRejectsForgedMessages(t *testing.T) {
+    net := newBFTNet(t)
+    backup := net.nodes["n2"]
+    request := Message{Type: MsgRequest, From: "n3", Group: "Z1", Proposal: 1, Entries: []LogEntry{{Data: []byte("tx")}}}
+    net.nodes["n3"].keys.sign(&request)
+    prePrepare := func(from string, request Message) Message {
+        pp := Message{Type: MsgPrePrepare, From: from, To: "n2", Group: "Z1", View: 0, Sequence: 1, Digest: requestDigest(request), Requests: []Message{request}}
+        net.nodes[from].keys.sign(&pp)
+        return pp
+    }
+
+    // Only the primary of the view may assign sequence numbers
+    if err := backup.step(prePrepare("n3", request)); !errors.Is(err, ErrRejected) {
+        t.Errorf("PrePrepare from a backup = %v, want ErrRejected", err)
+    }
+    // A message altered after signing does not verify
+    forged := prePrepare("n1", request)
+    forged.Sequence = 2
+    if err := backup.step(forged); !errors.Is(err, ErrBadSignature) {
+        t.Errorf("altered PrePrepare = %v, want ErrBadSignature", err)
+    }
+    // Nor does a request the primary made up in another member's name
+    madeUp := request
+    madeUp.Entries = []LogEntry{{Data: []byte("theft")}}
+    if err := backup.step(prePrepare("n1", madeUp)); !errors.Is(err, ErrBadSignature) {
+        t.Errorf("PrePrepare of a forged request = %v, want ErrBadSignature", err)
+    }
+    // Nodes outside the zone are not heard
+    outsider := Message{Type: MsgPrepare, From: "n9", To: "n2", Group: "Z1", Sequence: 1}
+    if err := backup.step(outsider); !errors.Is(err, ErrRejected) {
+        t.Errorf("Prepare from an outsider = %v, want ErrRejected", err)
+    }
+
+    if err := backup.step(prePrepare("n1", request)); err != nil {
+        t.Fatalf("PrePrepare from the primary: %v", err)
+    }
+    other := Message{Type: MsgRequest, From: "n3", Group: "Z1", Proposal: 2, Entries: []LogEntry{{Data: []byte("tx2")}}}
+    net.nodes["n3"].keys.sign(&other)
+    if err := backup.step(prePrepare("n1", other)); !errors.Is(err, ErrRejected) {
+        t.Errorf("second PrePrepare for sequence number 1 = %v, want ErrRejected", err)
+    }
+}
+
+func TestBFTEquivocatingPrimaryCannotSplitMembers(t *testing.T) {
+    net := newBFTNet(t)
+    primary := net.nodes["n1"]
+    requests := make([]Message, 2)
+    for i := range requests {
+        requests[i] = Message{Type: MsgRequest, Proposal: uint64(i + 1), Entries: []LogEntry{{Data: []byte(fmt.Sprintf("tx%d", i))}}}
+        primary.signed(&requests[i])
+    }
+
+    // The primary tells n2 one thing and n3 and n4 another
+    pps := make([]Message, 2)
+    for i, request := range requests {
+        pps[i] = Message{Type: MsgPrePrepare, View: 0, Sequence: 1, Digest: requestDigest(request), Requests: []Message{request}}
+        primary.signed(&pps[i])
+    }
+    primary.accept(pps[1])
+    primary.assigned = 1
+    net.queue = append(net.queue, pps[0], pps[1], pps[1])
+    net.queue[0].To, net.queue[1].To, net.queue[2].To = "n2", "n3", "n4"
+    net.run()
+
+    for _, id := range []string{"n1", "n3", "n4"} {
+        net.checkExecuted(t, id, "tx1")
+    }
+    net.checkExecuted(t, "n2")
+
+    // n2 learns the zone's decision from the next checkpoint rather than
+    // acting on what it was told
+    want := []string{"tx1"}
+    for i := 0; i < bftCheckpointInterval; i++ {
+        tx := fmt.Sprintf("later%d", i)
+        net.propose("n3", tx)
+        want = append(want, tx)
+    }
+    for _, id := range bftMembers {
+        net.checkExecuted(t, id, want...)
+    }
+}
+
+func TestBFTViewChangeReplacesSilentPrimary(t *testing.T) {
+    net := newBFTNet(t)
+    net.isolate("n1")
+    net.propose("n2", "tx1")
+    net.checkExecuted(t, "n2")
+
+    net.tick()
+    if view, primary := net.nodes["n2"].view, net.nodes["n2"].primary(); view != 1 || primary != "n2" {
+        t.Fatalf("n2 is in view %d under %q, want view 1 under n2", view, primary)
+    }
+    for _, id := range []string{"n2", "n3", "n4"} {
+        net.checkExecuted(t, id, "tx1")
+    }
+    net.propose("n3", "tx2")
+    for _, id := range []string{"n2", "n3", "n4"} {
+        net.checkExecuted(t, id, "tx1", "tx2")
+    }
+}
+
+func TestBFTViewChangeKeepsCommittedRequests(t *testing.T) {
+    net := newBFTNet(t)
+    // Only n2 hears the commits, so only n2 executes
+    net.drop = func(m Message) bool {
+        return m.Type == MsgCommit && m.To != "n2"
+    }
+    net.propose("n3", "tx1")
+    net.checkExecuted(t, "n2", "tx1")
+    net.checkExecuted(t, "n3")
+
+    // The new primary must re-propose the request, not fill its sequence
+    // number with another
+    net.isolate("n1")
+    net.propose("n4", "tx2")
+    net.tick()
+    for _, id := range []string{"n2", "n3", "n4"} {
+        net.checkExecuted(t, id, "tx1", "tx2")
+    }
+}
+
+func TestBFTCheckpointCatchesUpLaggingMember(t *testing.T) {
+    net := newBFTNet(t)
+    net.isolate("n4")
+    var want []string
+    for i := 0; i < 2*bftCheckpointInterval; i++ {
+        tx := fmt.Sprintf("tx%d", i)
+        net.propose("n2", tx)
+        want = append(want, tx)
+    }
+    net.checkExecuted(t, "n4")
+
+    net.drop = nil
+    for i := 0; i < bftCheckpointInterval; i++ {
+        tx := fmt.Sprintf("after%d", i)
+        net.propose("n2", tx)
+        want = append(want, tx)
+    }
+    for _, id := range bftMembers {
+        net.checkExecuted(t, id, want...)
+    }
+}
+
+func TestBFTZoneCommitsThroughPropagateTransaction(t *testing.T) {
+    sm := newTestStateMachine()
+    l := newTestConsensus(t, bftMembers, withApply(sm.apply), withBFT(), withFastTiming(), withRegisteredMembers())
+    defer l.Stop()
+
+    primary, err := l.ElectZoneLeader("Z1")
+    if err != nil || primary != "n1" {
+        t.Fatalf("ElectZoneLeader = %q, %v; want n1", primary, err)
+    }
+    if err := l.PropagateTransaction([]byte("tx1"), "Z1"); err != nil {
+        t.Fatalf("PropagateTransaction: %v", err)
+    }
+
+    // The primary fails; the zone moves to a view led by another member
+    group := l.bftGroups["Z1"]
+    group.mu.Lock()
+    failed := group.replicas["n1"]
+    delete(group.replicas, "n1")
+    group.mu.Unlock()
+    failed.Stop()
+    if err := l.PropagateTransaction([]byte("tx2"), "Z1"); err != nil {
+        t.Fatalf("PropagateTransaction after the primary failed: %v", err)
+    }
+    l.mu.RLock()
+    leaderID := l.ZoneLeaders["Z1"]
+    l.mu.RUnlock()
+    if leaderID == "" || leaderID == "n1" {
+        t.Errorf("zone leader = %q, want a new primary", leaderID)
+    }
+    checkLeaderFlags(t, l, "Z1")
+    for _, id := range []string{"n2", "n3", "n4"} {
+        sm.waitFor(t, id, "tx1", "tx2")
+    }
+}
+
+func TestSetZoneModeChecksMembers(t *testing.T) {
+    l := NewLHRaftConsensus(0.5)
+    defer l.Stop()
+
+    if err := l.SetZoneMode("Z1", ZoneBFT); err == nil {
+        t.Error("zone without an initial cluster made BFT")
+    }
+    if err := l.SetInitialCluster("Z1", []string{"n1", "n2", "n3"}); err != nil {
+        t.Fatalf("SetInitialCluster: %v", err)
+    }
+    if err := l.SetZoneMode("Z1", ZoneBFT); err == nil {
+        t.Error("three member zone made BFT")
+    }
+
+    if err := l.SetInitialCluster("Z2", bftMembers); err != nil {
+        t.Fatalf("SetInitialCluster: %v", err)
+    }
+    if err := l.SetZoneMode("Z2", ZoneBFT); err != nil {
+        t.Fatalf("SetZoneMode: %v", err)
+    }
+    if err := l.RegisterNode("n1", "Z2", 0.9); err == nil || !strings.Contains(err.Error(), ErrNoNodeKey.Error()) {
+        t.Errorf("RegisterNode without a key = %v, want %v", err, ErrNoNodeKey)
+    }
+    if err := l.SetNodePublicKey("n2", testKey("n2").Public().(ed25519.PublicKey)); err != nil {
+        t.Fatalf("SetNodePublicKey: %v", err)
+    }
+    if err := l.RegisterNode("n2", "Z2", 0.9); err == nil {
+        t.Error("node hosted without its signing key registered")
+    }
+    if err := l.RegisterRemoteNode("n2", "Z2", 0.9); err != nil {
+        t.Errorf("RegisterRemoteNode: %v", err)
+    }
+    if err := l.SetNodeKey("n5", testKey("n5")); err != nil {
+        t.Fatalf("SetNodeKey: %v", err)
+    }
+    if err := l.RegisterNode("n5", "Z2", 0.9); err == nil {
+        t.Error("node outside the initial cluster joined a BFT zone")
+    }
+    if err := l.SetZoneMode("Z2", ZoneRaft); err == nil {
+        t.Error("mode changed after the zone started")
+    }
+}
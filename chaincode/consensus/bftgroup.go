@@ -0,0 +1,248 @@
+package consensus
+
+import (
+    "context"
+    "fmt"
+    "sort"
+    "sync"
+)
+
+// ZoneMode selects the protocol a zone agrees on transactions with
+type ZoneMode int
+
+const (
+    // ZoneRaft tolerates members that crash, and lets membership change
+    ZoneRaft ZoneMode = iota
+    // ZoneBFT tolerates members that lie, at the cost of an extra round of
+    // messages and a fixed membership of at least 3f+1 for f faults
+    ZoneBFT
+)
+
+// minBFTMembers is the smallest zone that tolerates a faulty member
+const minBFTMembers = 4
+
+// SetZoneMode selects the protocol a zone runs. It must be called after
+// SetInitialCluster and before any node of the zone is registered, the same
+// in every process hosting the zone. A BFT zone's members are its initial
+// cluster and never change; each must have a public key, and those hosted
+// here a signing key, before it is registered. Transactions reach either
+// kind of zone through PropagateTransaction, but BFT zones are not split,
+// merged, read through ReadZone or enlisted in cross-zone transactions.
+func (l *LHRaftConsensus) SetZoneMode(zoneID string, mode ZoneMode) error {
+    if mode != ZoneRaft && mode != ZoneBFT {
+        return fmt.Errorf("unknown zone mode: %d", mode)
+    }
+
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    initialCluster, configured := l.initialClusters[zoneID]
+    if !configured {
+        return fmt.Errorf("zone %s has no initial cluster; call SetInitialCluster first", zoneID)
+    }
+    if l.groups[zoneID] != nil || l.bftGroups[zoneID] != nil {
+        return fmt.Errorf("zone %s already has a consensus group", zoneID)
+    }
+    if mode == ZoneBFT && len(initialCluster) < minBFTMembers {
+        return fmt.Errorf("BFT zone %s has %d members, want at least %d", zoneID, len(initialCluster), minBFTMembers)
+    }
+    l.zoneModes[zoneID] = mode
+    return nil
+}
+
+// bftGroup is the group formed by the members of a BFT zone. Members hosted
+// in this process run a bftReplica; the rest only take part over the
+// transport.
+type bftGroup struct {
+    zoneID    string
+    members   []string
+    replicas  map[string]*bftReplica // Locally hosted members
+    transport Transport
+    cfg       bftConfig
+    mu        sync.Mutex
+
+    // The primary as last reported by a local replica. Guarded by viewMu,
+    // which replicas take while locked.
+    primaryID      string
+    view           uint64
+    primaryChanged chan struct{} // Closed and replaced on every change
+    viewMu         sync.Mutex
+}
+
+// bftConfig carries what a bftGroup hands to its replicas
+type bftConfig struct {
+    apply    ApplyFunc
+    keys     *keyring
+    onLeader func(zoneID, leaderID string, term uint64)
+    timing   ZoneTiming
+}
+
+func newBFTGroup(zoneID string, members []string, transport Transport, cfg bftConfig) *bftGroup {
+    sorted := append([]string{}, members...)
+    sort.Strings(sorted)
+    return &bftGroup{
+        zoneID:         zoneID,
+        members:        sorted,
+        replicas:       make(map[string]*bftReplica),
+        transport:      transport,
+        cfg:            cfg,
+        primaryChanged: make(chan struct{}),
+    }
+}
+
+// addMember admits one of the zone's members, starting a replica for it
+// when it is hosted locally
+func (g *bftGroup) addMember(nodeID string, local bool) error {
+    if !containsString(g.members, nodeID) {
+        return fmt.Errorf("node %s is not a member of BFT zone %s", nodeID, g.zoneID)
+    }
+    if !g.cfg.keys.canVerify(nodeID) {
+        return fmt.Errorf("%w: %s", ErrNoNodeKey, nodeID)
+    }
+    if local && !g.cfg.keys.canSign(nodeID) {
+        return fmt.Errorf("no signing key for node hosted here: %s", nodeID)
+    }
+
+    g.mu.Lock()
+    defer g.mu.Unlock()
+
+    if _, running := g.replicas[nodeID]; running || !local {
+        return nil
+    }
+    replica, err := newBFTReplica(bftReplicaConfig{
+        NodeID:        nodeID,
+        ZoneID:        g.zoneID,
+        Members:       g.members,
+        Keys:          g.cfg.keys,
+        Transport:     g.transport,
+        Apply:         g.cfg.apply,
+        OnStateChange: g.observe,
+        TickInterval:  g.cfg.timing.TickInterval,
+        TimeoutTicks:  g.cfg.timing.ElectionTicks,
+    })
+    if err != nil {
+        return err
+    }
+    g.replicas[nodeID] = replica
+    return nil
+}
+
+// observe records the primary reported by a local replica. It is the
+// replicas' OnStateChange callback; onLeader runs under viewMu so that
+// changes are reported in view order.
+func (g *bftGroup) observe(status bftStatus) {
+    g.viewMu.Lock()
+    defer g.viewMu.Unlock()
+
+    newView := status.View > g.view
+    learntPrimary := status.View == g.view && g.primaryID == "" && status.Primary != ""
+    if !newView && !learntPrimary {
+        return
+    }
+    g.primaryID = status.Primary
+    g.view = status.View
+    close(g.primaryChanged)
+    g.primaryChanged = make(chan struct{})
+
+    if g.cfg.onLeader != nil {
+        g.cfg.onLeader(g.zoneID, status.Primary, status.View)
+    }
+}
+
+// leader returns the primary last reported and its view. The primary is
+// empty while the view is changing.
+func (g *bftGroup) leader() (string, uint64) {
+    g.viewMu.Lock()
+    defer g.viewMu.Unlock()
+
+    return g.primaryID, g.view
+}
+
+// waitForLeader waits until the primary of a view is known
+func (g *bftGroup) waitForLeader(ctx context.Context) (string, error) {
+    for {
+        g.viewMu.Lock()
+        primaryID, changed := g.primaryID, g.primaryChanged
+        g.viewMu.Unlock()
+
+        if primaryID != "" {
+            return primaryID, nil
+        }
+        select {
+        case <-changed:
+        case <-ctx.Done():
+            return "", ctx.Err()
+        }
+    }
+}
+
+// replicate submits data through a local member and returns once that
+// member has executed it
+func (g *bftGroup) replicate(ctx context.Context, data []byte) error {
+    g.mu.Lock()
+    ids := make([]string, 0, len(g.replicas))
+    for id := range g.replicas {
+        ids = append(ids, id)
+    }
+    sort.Strings(ids)
+    var proposer *bftReplica
+    if len(ids) > 0 {
+        proposer = g.replicas[ids[0]]
+    }
+    g.mu.Unlock()
+
+    if proposer == nil {
+        return fmt.Errorf("zone %s has no member hosted locally", g.zoneID)
+    }
+    return proposer.Propose(ctx, EntryNormal, data)
+}
+
+// setTiming changes the tick interval and request timeout of every local replica
+func (g *bftGroup) setTiming(timing ZoneTiming) {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+
+    g.cfg.timing = timing
+    for _, replica := range g.replicas {
+        replica.setTiming(timing.TickInterval, timing.ElectionTicks)
+    }
+}
+
+// stop stops every local replica
+func (g *bftGroup) stop() {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+
+    for _, replica := range g.replicas {
+        replica.Stop()
+    }
+}
+
+// newBFTZone creates the group of a BFT zone. Callers hold l.mu.
+func (l *LHRaftConsensus) newBFTZone(zoneID string, members []string) *bftGroup {
+    group := newBFTGroup(zoneID, members, l.transport.group(zoneID), bftConfig{
+        apply:    l.applyEntry,
+        keys:     l.keys,
+        onLeader: l.observeLeader,
+        timing:   l.zoneTiming(zoneID),
+    })
+    l.bftGroups[zoneID] = group
+    return group
+}
+
+// electPrimary returns the primary of a BFT zone's current view. Leadership
+// rotates with the view, so there is no election to hold; a faulty primary
+// is replaced by a view change.
+func (l *LHRaftConsensus) electPrimary(group *bftGroup) (string, error) {
+    l.mu.RLock()
+    timeout := l.ProposalTimeout
+    l.mu.RUnlock()
+
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    primaryID, err := group.waitForLeader(ctx)
+    if err != nil {
+        return "", fmt.Errorf("no primary in zone: %s: %v", group.zoneID, err)
+    }
+    return primaryID, nil
+}
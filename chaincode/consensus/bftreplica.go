@@ -0,0 +1,238 @@
+package consensus
+
+import (
+    "context"
+    "sync"
+    "time"
+)
+
+// bftStatus is a point-in-time view of a BFT member's state
+type bftStatus struct {
+    NodeID   string
+    View     uint64
+    Primary  string // Empty while the view is changing
+    Executed uint64
+}
+
+// bftReplica runs one member of a BFT zone. It feeds messages from the
+// transport and local proposals into its bftNode and carries out the
+// resulting work. Its state is kept in memory only; a restarted member
+// catches up from the others' checkpoints.
+type bftReplica struct {
+    zoneID    string
+    node      *bftNode
+    transport Transport
+    apply     ApplyFunc
+    onChange  func(status bftStatus)
+    last      bftStatus
+    waiting   map[string]chan error // Request key -> proposer waiting for it to execute
+    nextID    uint64                // Last request ID issued
+    stopped   bool
+    tickStop  chan struct{} // Closed to stop the ticker, nil when not ticking
+    mu        sync.Mutex
+}
+
+// bftReplicaConfig configures a bftReplica
+type bftReplicaConfig struct {
+    NodeID    string
+    ZoneID    string
+    Members   []string // Every member of the zone, this node included
+    Keys      *keyring // Holds this node's signing key and every member's public key
+    Transport Transport
+    Apply     ApplyFunc
+    // OnStateChange is called whenever the member's view or primary changes.
+    // It runs with the replica locked and must not call back into it.
+    OnStateChange func(status bftStatus)
+
+    TickInterval time.Duration // Length of a tick; zero leaves ticking to the caller
+    TimeoutTicks int           // How long a request waits before the primary is replaced; zero uses the default
+}
+
+func newBFTReplica(cfg bftReplicaConfig) (*bftReplica, error) {
+    rp := &bftReplica{
+        zoneID:    cfg.ZoneID,
+        node:      newBFTNode(cfg.NodeID, cfg.ZoneID, cfg.Members, cfg.Keys),
+        transport: cfg.Transport,
+        apply:     cfg.Apply,
+        onChange:  cfg.OnStateChange,
+        waiting:   make(map[string]chan error),
+        // IDs start from the clock so that a restarted member does not
+        // reuse those of requests the zone has already executed
+        nextID: uint64(time.Now().UnixNano()),
+    }
+    rp.node.setTimeout(cfg.TimeoutTicks)
+    if err := cfg.Transport.Register(cfg.NodeID, rp.handle); err != nil {
+        return nil, err
+    }
+
+    rp.mu.Lock()
+    defer rp.mu.Unlock()
+
+    rp.processReady()
+    rp.startTicker(cfg.TickInterval)
+    return rp, nil
+}
+
+// ID returns the node ID of the replica
+func (rp *bftReplica) ID() string {
+    return rp.node.id
+}
+
+// Propose submits data to the zone and returns once this member has
+// executed it, by which time a quorum has committed it
+func (rp *bftReplica) Propose(ctx context.Context, entryType EntryType, data []byte) error {
+    rp.mu.Lock()
+    if rp.stopped {
+        rp.mu.Unlock()
+        return ErrReplicaStopped
+    }
+    rp.nextID++
+    key := rp.node.propose(rp.nextID, entryType, data)
+    done := make(chan error, 1)
+    rp.waiting[key] = done
+    rp.processReady()
+    rp.mu.Unlock()
+
+    select {
+    case err := <-done:
+        return err
+    case <-ctx.Done():
+        rp.mu.Lock()
+        delete(rp.waiting, key)
+        rp.mu.Unlock()
+        return ctx.Err()
+    }
+}
+
+// Tick advances the member's clock, replacing a primary that leaves a
+// request waiting too long
+func (rp *bftReplica) Tick() {
+    rp.mu.Lock()
+    defer rp.mu.Unlock()
+
+    if rp.stopped {
+        return
+    }
+    rp.node.tick()
+    rp.processReady()
+}
+
+// Status returns the member's current state
+func (rp *bftReplica) Status() bftStatus {
+    rp.mu.Lock()
+    defer rp.mu.Unlock()
+
+    return rp.status()
+}
+
+func (rp *bftReplica) status() bftStatus {
+    return bftStatus{
+        NodeID:   rp.node.id,
+        View:     rp.node.view,
+        Primary:  rp.node.primary(),
+        Executed: rp.node.executed,
+    }
+}
+
+// Stop detaches the replica from its transport and fails waiting proposals
+func (rp *bftReplica) Stop() {
+    rp.mu.Lock()
+    defer rp.mu.Unlock()
+
+    if rp.stopped {
+        return
+    }
+    rp.stopped = true
+    rp.startTicker(0)
+    rp.transport.Unregister(rp.node.id)
+    for key, done := range rp.waiting {
+        done <- ErrReplicaStopped
+        delete(rp.waiting, key)
+    }
+}
+
+// setTiming changes how often the replica ticks and how long requests wait
+func (rp *bftReplica) setTiming(interval time.Duration, timeoutTicks int) {
+    rp.mu.Lock()
+    defer rp.mu.Unlock()
+
+    if rp.stopped {
+        return
+    }
+    rp.node.setTimeout(timeoutTicks)
+    rp.startTicker(interval)
+}
+
+// startTicker replaces the replica's ticker with one firing every interval,
+// or none when interval is zero. Callers hold rp.mu.
+func (rp *bftReplica) startTicker(interval time.Duration) {
+    if rp.tickStop != nil {
+        close(rp.tickStop)
+        rp.tickStop = nil
+    }
+    if interval <= 0 {
+        return
+    }
+
+    stop := make(chan struct{})
+    rp.tickStop = stop
+    go func() {
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+
+        for {
+            select {
+            case <-ticker.C:
+                rp.Tick()
+            case <-stop:
+                return
+            }
+        }
+    }()
+}
+
+// handle is the transport callback for messages addressed to this replica.
+// Messages the member refuses, forged or from faulty members, are dropped.
+func (rp *bftReplica) handle(m Message) {
+    if m.Group != rp.zoneID {
+        return
+    }
+
+    rp.mu.Lock()
+    defer rp.mu.Unlock()
+
+    if rp.stopped {
+        return
+    }
+    rp.node.step(m)
+    rp.processReady()
+}
+
+// processReady carries out the member's outstanding work and reports state
+// changes. Callers hold rp.mu.
+func (rp *bftReplica) processReady() {
+    if status := rp.status(); status.View != rp.last.View || status.Primary != rp.last.Primary {
+        rp.last = status
+        if rp.onChange != nil {
+            rp.onChange(status)
+        }
+    }
+
+    rd := rp.node.ready()
+    for _, m := range rd.Messages {
+        // Delivery is best effort; lost messages are made up for by view
+        // changes and checkpoints
+        rp.transport.Send(m)
+    }
+    for _, entry := range rd.CommittedEntries {
+        if rp.apply != nil {
+            rp.apply(rp.zoneID, rp.node.id, entry)
+        }
+    }
+    for _, key := range rd.Executed {
+        if done, exists := rp.waiting[key]; exists {
+            done <- nil
+            delete(rp.waiting, key)
+        }
+    }
+}
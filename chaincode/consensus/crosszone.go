@@ -0,0 +1,428 @@
+package consensus
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+)
+
+// ErrCrossZoneAborted is returned when a cross-zone transaction is aborted
+var ErrCrossZoneAborted = errors.New("cross-zone transaction aborted")
+
+// CrossZonePhase is the step of a cross-zone transaction a record carries
+type CrossZonePhase int
+
+const (
+    CrossZoneBegin   CrossZonePhase = iota // Global log: the coordinator has started
+    CrossZonePrepare                       // Zone log: stage the transaction and hold it
+    CrossZoneCommit                        // Both logs: make the staged transaction durable
+    CrossZoneAbort                         // Both logs: discard the staged transaction
+    CrossZoneDone                          // Global log: every zone has the decision
+)
+
+// CrossZoneRecord is the data of an EntryCrossZone. Zones apply a Prepare,
+// then the Commit or Abort for the same TxID; either may be applied more
+// than once, and an Abort may arrive for a transaction never prepared, so
+// state machines must handle them idempotently. The global group's records
+// are kept by the coordinator and are not passed to the ApplyFunc.
+type CrossZoneRecord struct {
+    TxID        string
+    Phase       CrossZonePhase
+    Zones       []string `json:",omitempty"` // On Begin
+    Transaction []byte   `json:",omitempty"` // On Prepare
+    Started     int64    `json:",omitempty"` // On Begin: the coordinator's clock, in Unix nanoseconds
+}
+
+// DecodeCrossZoneRecord decodes the data of an EntryCrossZone
+func DecodeCrossZoneRecord(data []byte) (CrossZoneRecord, error) {
+    var record CrossZoneRecord
+    if err := json.Unmarshal(data, &record); err != nil {
+        return CrossZoneRecord{}, fmt.Errorf("corrupt cross-zone record: %v", err)
+    }
+    return record, nil
+}
+
+// crossZoneTx is what a global replica knows of an unfinished cross-zone
+// transaction. The first decision applied stands; later ones are ignored.
+type crossZoneTx struct {
+    Zones    []string
+    Started  int64
+    Decision CrossZonePhase // CrossZoneBegin until decided
+}
+
+// coordinatorLog holds the unfinished cross-zone transactions of each local
+// global replica, built by applying the global group's records
+type coordinatorLog struct {
+    txs    map[string]map[string]*crossZoneTx // Global replica -> TxID -> transaction
+    active map[string]bool                    // Transactions this process is coordinating
+    mu     sync.Mutex
+}
+
+func newCoordinatorLog() *coordinatorLog {
+    return &coordinatorLog{
+        txs:    make(map[string]map[string]*crossZoneTx),
+        active: make(map[string]bool),
+    }
+}
+
+// coordinate marks a transaction as being coordinated by this process, or
+// no longer, so that recovery leaves it alone
+func (c *coordinatorLog) coordinate(txID string, active bool) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if active {
+        c.active[txID] = true
+    } else {
+        delete(c.active, txID)
+    }
+}
+
+// apply applies a record committed by the global group to nodeID's view
+func (c *coordinatorLog) apply(nodeID string, record CrossZoneRecord) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    txs, exists := c.txs[nodeID]
+    if !exists {
+        txs = make(map[string]*crossZoneTx)
+        c.txs[nodeID] = txs
+    }
+    tx := txs[record.TxID]
+
+    switch record.Phase {
+    case CrossZoneBegin:
+        if tx == nil {
+            txs[record.TxID] = &crossZoneTx{Zones: record.Zones, Started: record.Started, Decision: CrossZoneBegin}
+        }
+    case CrossZoneCommit, CrossZoneAbort:
+        if tx != nil && tx.Decision == CrossZoneBegin {
+            tx.Decision = record.Phase
+        }
+    case CrossZoneDone:
+        delete(txs, record.TxID)
+    }
+}
+
+// decision returns the decision any local replica has applied for a transaction
+func (c *coordinatorLog) decision(txID string) (CrossZonePhase, bool) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    for _, txs := range c.txs {
+        if tx, exists := txs[txID]; exists && tx.Decision != CrossZoneBegin {
+            return tx.Decision, true
+        }
+    }
+    return CrossZoneBegin, false
+}
+
+// unfinished returns a copy of nodeID's unfinished transactions
+func (c *coordinatorLog) unfinished(nodeID string) map[string]crossZoneTx {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    out := make(map[string]crossZoneTx)
+    for txID, tx := range c.txs[nodeID] {
+        out[txID] = *tx
+    }
+    return out
+}
+
+// inDoubt returns a copy of nodeID's unfinished transactions that no one in
+// this process is coordinating
+func (c *coordinatorLog) inDoubt(nodeID string) map[string]crossZoneTx {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    out := make(map[string]crossZoneTx)
+    for txID, tx := range c.txs[nodeID] {
+        if !c.active[txID] {
+            out[txID] = *tx
+        }
+    }
+    return out
+}
+
+// restore replaces nodeID's view with one taken from a snapshot
+func (c *coordinatorLog) restore(nodeID string, txs map[string]*crossZoneTx) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if txs == nil {
+        txs = make(map[string]*crossZoneTx)
+    }
+    c.txs[nodeID] = txs
+}
+
+// globalSnapshot is the snapshot of a global replica: its unfinished
+// cross-zone transactions alongside the state machine's own snapshot
+type globalSnapshot struct {
+    Transactions map[string]crossZoneTx
+    State        []byte
+}
+
+// snapshotGlobal captures a global replica's state
+func (l *LHRaftConsensus) snapshotGlobal(groupID, nodeID string) ([]byte, error) {
+    state, err := l.snapshotState(groupID, nodeID)
+    if err != nil {
+        return nil, err
+    }
+    l.mu.RLock()
+    global := l.global
+    l.mu.RUnlock()
+
+    return json.Marshal(globalSnapshot{Transactions: global.coordinator.unfinished(nodeID), State: state})
+}
+
+// restoreGlobal loads a snapshot taken by snapshotGlobal into a global replica
+func (l *LHRaftConsensus) restoreGlobal(groupID, nodeID string, data []byte) error {
+    var snapshot globalSnapshot
+    if err := json.Unmarshal(data, &snapshot); err != nil {
+        return fmt.Errorf("corrupt global snapshot: %v", err)
+    }
+    if err := l.restoreState(groupID, nodeID, snapshot.State); err != nil {
+        return err
+    }
+    l.mu.RLock()
+    global := l.global
+    l.mu.RUnlock()
+
+    txs := make(map[string]*crossZoneTx, len(snapshot.Transactions))
+    for txID, tx := range snapshot.Transactions {
+        tx := tx
+        txs[txID] = &tx
+    }
+    global.coordinator.restore(nodeID, txs)
+    return nil
+}
+
+// applyCoordinatorRecord applies a cross-zone record committed by the global group
+func (l *LHRaftConsensus) applyCoordinatorRecord(nodeID string, entry LogEntry) {
+    record, err := DecodeCrossZoneRecord(entry.Data)
+    if err != nil {
+        return
+    }
+    l.mu.RLock()
+    global := l.global
+    l.mu.RUnlock()
+
+    if global != nil {
+        global.coordinator.apply(nodeID, record)
+    }
+}
+
+// PropagateCrossZone commits a transaction atomically across several zones
+// with two-phase commit. The global group, whose leader is elected among
+// the zone leaders, coordinates: its log records that the transaction
+// began, whether it committed or aborted, and when every zone was told. Each zone first commits a Prepare through
+// its own log; if any zone fails to within the proposal timeout every zone
+// is sent an Abort and ErrCrossZoneAborted is returned. Zones that miss the
+// decision, and transactions whose coordinator crashed before deciding, are
+// resolved by whichever process hosts the global leader. This process must
+// host a member of every zone involved.
+func (l *LHRaftConsensus) PropagateCrossZone(transaction []byte, zoneIDs []string) error {
+    zones, err := l.crossZoneGroups(zoneIDs)
+    if err != nil {
+        return err
+    }
+    l.mu.RLock()
+    global := l.global
+    timeout := l.ProposalTimeout
+    l.mu.RUnlock()
+
+    if global == nil {
+        return fmt.Errorf("cross-zone transactions need a global cluster; call SetGlobalCluster first")
+    }
+
+    txID, err := newTxID()
+    if err != nil {
+        return err
+    }
+    global.coordinator.coordinate(txID, true)
+    defer global.coordinator.coordinate(txID, false)
+    zoneList := make([]string, 0, len(zones))
+    for zoneID := range zones {
+        zoneList = append(zoneList, zoneID)
+    }
+    sort.Strings(zoneList)
+
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    begin := CrossZoneRecord{TxID: txID, Phase: CrossZoneBegin, Zones: zoneList, Started: time.Now().UnixNano()}
+    if err := global.record(ctx, begin); err != nil {
+        return fmt.Errorf("failed to begin cross-zone transaction: %v", err)
+    }
+
+    prepare := CrossZoneRecord{TxID: txID, Phase: CrossZonePrepare, Transaction: transaction}
+    prepareErr := l.sendToZones(ctx, zoneList, prepare)
+    cancel()
+
+    decision := CrossZoneCommit
+    if prepareErr != nil {
+        decision = CrossZoneAbort
+    }
+    ctx, cancel = context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    decision, err = global.decide(ctx, txID, decision)
+    if err != nil {
+        // Recovery aborts the transaction once it is old enough
+        return fmt.Errorf("failed to decide cross-zone transaction %s: %v", txID, err)
+    }
+
+    // Zones missed now are told by recovery
+    l.finishCrossZone(ctx, global, txID, zoneList, decision)
+    if decision == CrossZoneAbort {
+        if prepareErr == nil {
+            prepareErr = fmt.Errorf("aborted by recovery")
+        }
+        return fmt.Errorf("%w: %s: %v", ErrCrossZoneAborted, txID, prepareErr)
+    }
+    return nil
+}
+
+// crossZoneGroups returns the groups of the distinct zones listed
+func (l *LHRaftConsensus) crossZoneGroups(zoneIDs []string) (map[string]*zoneGroup, error) {
+    l.mu.RLock()
+    defer l.mu.RUnlock()
+
+    if len(zoneIDs) == 0 {
+        return nil, fmt.Errorf("cross-zone transaction names no zones")
+    }
+    groups := make(map[string]*zoneGroup)
+    for _, zoneID := range zoneIDs {
+        group, exists := l.groups[zoneID]
+        if !exists || zoneID == GlobalGroupID {
+            return nil, fmt.Errorf("no consensus group for zone: %s", zoneID)
+        }
+        groups[zoneID] = group
+    }
+    return groups, nil
+}
+
+// sendToZones commits a record through every zone's log in parallel
+func (l *LHRaftConsensus) sendToZones(ctx context.Context, zoneIDs []string, record CrossZoneRecord) error {
+    data, err := json.Marshal(record)
+    if err != nil {
+        return err
+    }
+    groups, err := l.crossZoneGroups(zoneIDs)
+    if err != nil {
+        return err
+    }
+
+    errs := make(chan error, len(zoneIDs))
+    for _, zoneID := range zoneIDs {
+        go func(zoneID string) {
+            if err := groups[zoneID].replicateEntry(ctx, EntryCrossZone, data); err != nil {
+                errs <- fmt.Errorf("zone %s: %v", zoneID, err)
+                return
+            }
+            errs <- nil
+        }(zoneID)
+    }
+
+    var failed error
+    for range zoneIDs {
+        if err := <-errs; err != nil && failed == nil {
+            failed = err
+        }
+    }
+    return failed
+}
+
+// finishCrossZone sends the decision to every zone and, once all have it,
+// records in the global log that the transaction is finished
+func (l *LHRaftConsensus) finishCrossZone(ctx context.Context, global *globalTier, txID string, zoneIDs []string, decision CrossZonePhase) error {
+    if err := l.sendToZones(ctx, zoneIDs, CrossZoneRecord{TxID: txID, Phase: decision}); err != nil {
+        return err
+    }
+    return global.record(ctx, CrossZoneRecord{TxID: txID, Phase: CrossZoneDone})
+}
+
+// resolveInDoubt finishes the cross-zone transactions left unfinished in the
+// global log, when a local replica leads the global group. Transactions
+// still undecided after twice the proposal timeout are aborted; their
+// coordinator can no longer be preparing them. It returns an error while
+// any transaction is left unfinished.
+func (l *LHRaftConsensus) resolveInDoubt(global *globalTier) error {
+    leaderID, _ := global.group.leader()
+    if leaderID == "" || !global.group.hosts(leaderID) {
+        return nil
+    }
+    l.mu.RLock()
+    timeout := l.ProposalTimeout
+    l.mu.RUnlock()
+
+    txs := global.coordinator.inDoubt(leaderID)
+    txIDs := make([]string, 0, len(txs))
+    for txID := range txs {
+        txIDs = append(txIDs, txID)
+    }
+    sort.Strings(txIDs)
+
+    var pending error
+    for _, txID := range txIDs {
+        tx := txs[txID]
+        ctx, cancel := context.WithTimeout(context.Background(), timeout)
+        err := l.resolve(ctx, global, txID, tx, timeout)
+        cancel()
+        if err != nil {
+            pending = fmt.Errorf("cross-zone transaction %s in doubt: %v", txID, err)
+        }
+    }
+    return pending
+}
+
+// resolve decides a transaction found unfinished, if it is old enough, and
+// finishes it
+func (l *LHRaftConsensus) resolve(ctx context.Context, global *globalTier, txID string, tx crossZoneTx, timeout time.Duration) error {
+    decision := tx.Decision
+    if decision == CrossZoneBegin {
+        if time.Since(time.Unix(0, tx.Started)) < 2*timeout {
+            return fmt.Errorf("coordinator may still be preparing")
+        }
+        var err error
+        if decision, err = global.decide(ctx, txID, CrossZoneAbort); err != nil {
+            return err
+        }
+    }
+    return l.finishCrossZone(ctx, global, txID, tx.Zones, decision)
+}
+
+// record commits a cross-zone record through the global group
+func (t *globalTier) record(ctx context.Context, record CrossZoneRecord) error {
+    data, err := json.Marshal(record)
+    if err != nil {
+        return err
+    }
+    return t.group.replicateEntry(ctx, EntryCrossZone, data)
+}
+
+// decide proposes a decision for a transaction and returns the one that
+// stands, which is another's if it reached the global log first
+func (t *globalTier) decide(ctx context.Context, txID string, decision CrossZonePhase) (CrossZonePhase, error) {
+    if err := t.record(ctx, CrossZoneRecord{TxID: txID, Phase: decision}); err != nil {
+        return CrossZoneBegin, err
+    }
+    outcome, decided := t.coordinator.decision(txID)
+    if !decided {
+        return CrossZoneBegin, fmt.Errorf("transaction already finished by recovery")
+    }
+    return outcome, nil
+}
+
+// newTxID returns a random cross-zone transaction ID
+func newTxID() (string, error) {
+    id := make([]byte, 16)
+    if _, err := rand.Read(id); err != nil {
+        return "", fmt.Errorf("failed to generate transaction ID: %v", err)
+    }
+    return hex.EncodeToString(id), nil
+}
@@ -0,0 +1,160 @@
+package consensus
+
+import (
+    "context"
+    "errors"
+    "sync"
+    "testing"
+    "time"
+)
+
+// crossZoneLog records the cross-zone records each zone member applies, as
+// "prepare:transaction", "commit" or "abort", along with their TxIDs
+type crossZoneLog struct {
+    applied map[string][]string
+    txIDs   map[string][]string
+    mu      sync.Mutex
+}
+
+func newCrossZoneLog() *crossZoneLog {
+    return &crossZoneLog{applied: make(map[string][]string), txIDs: make(map[string][]string)}
+}
+
+func (c *crossZoneLog) apply(zoneID, nodeID string, entry LogEntry) {
+    if zoneID == GlobalGroupID || entry.Type != EntryCrossZone {
+        return
+    }
+    record, err := DecodeCrossZoneRecord(entry.Data)
+    if err != nil {
+        return
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    label := map[CrossZonePhase]string{CrossZonePrepare: "prepare:" + string(record.Transaction), CrossZoneCommit: "commit", CrossZoneAbort: "abort"}[record.Phase]
+    c.applied[nodeID] = append(c.applied[nodeID], label)
+    c.txIDs[nodeID] = append(c.txIDs[nodeID], record.TxID)
+}
+
+// waitFor waits until nodeID has applied exactly the given records of the
+// transaction txID, or of every transaction when txID is empty
+func (c *crossZoneLog) waitFor(t *testing.T, nodeID, txID string, want ...string) {
+    t.Helper()
+
+    deadline := time.Now().Add(3 * time.Second)
+    for {
+        c.mu.Lock()
+        got := make([]string, 0)
+        for i, label := range c.applied[nodeID] {
+            if txID == "" || c.txIDs[nodeID][i] == txID {
+                got = append(got, label)
+            }
+        }
+        c.mu.Unlock()
+
+        if equalStrings(got, want) {
+            return
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("node %s applied %q, want %q", nodeID, got, want)
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+}
+
+// waitForFinished waits until the global group holds no unfinished
+// cross-zone transactions
+func waitForFinished(t *testing.T, l *LHRaftConsensus) {
+    t.Helper()
+
+    deadline := time.Now().Add(3 * time.Second)
+    for {
+        leaderID, _ := l.global.group.leader()
+        if leaderID != "" && len(l.global.coordinator.unfinished(leaderID)) == 0 {
+            return
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("global leader %q still holds unfinished transactions", leaderID)
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+}
+
+func TestCrossZoneTransactionCommitsInEveryZone(t *testing.T) {
+    log := newCrossZoneLog()
+    l := newTestConsensus(t, nil, withZones(map[string][]string{"Z1": {"n1"}, "Z2": {"n2"}}), withGlobalCluster(),
+        withApply(log.apply), withRegisteredMembers(), withElectedLeaders())
+    defer l.Stop()
+
+    if err := l.PropagateCrossZone([]byte("move"), []string{"Z1", "Z2"}); err != nil {
+        t.Fatalf("PropagateCrossZone: %v", err)
+    }
+    for _, id := range []string{"n1", "n2"} {
+        log.waitFor(t, id, "", "prepare:move", "commit")
+    }
+    waitForFinished(t, l)
+}
+
+func TestCrossZoneTransactionAbortsWhenZoneCannotPrepare(t *testing.T) {
+    log := newCrossZoneLog()
+    l := newTestConsensus(t, nil, withZones(map[string][]string{"Z1": {"n1"}, "Z2": {"n2"}}), withGlobalCluster(),
+        withApply(log.apply), withRegisteredMembers(), withElectedLeaders())
+    defer l.Stop()
+    l.mu.Lock()
+    l.ProposalTimeout = 300 * time.Millisecond
+    l.mu.Unlock()
+
+    // Z3 has lost its quorum: only one of its two members is up
+    if err := l.SetInitialCluster("Z3", []string{"n3", "n4"}); err != nil {
+        t.Fatalf("SetInitialCluster: %v", err)
+    }
+    if err := l.RegisterNode("n3", "Z3", 0.9); err != nil {
+        t.Fatalf("RegisterNode: %v", err)
+    }
+
+    err := l.PropagateCrossZone([]byte("move"), []string{"Z1", "Z3"})
+    if !errors.Is(err, ErrCrossZoneAborted) {
+        t.Fatalf("PropagateCrossZone = %v, want ErrCrossZoneAborted", err)
+    }
+    log.waitFor(t, "n1", "", "prepare:move", "abort")
+}
+
+func TestInDoubtCrossZoneTransactionsAreResolved(t *testing.T) {
+    log := newCrossZoneLog()
+    l := newTestConsensus(t, nil, withZones(map[string][]string{"Z1": {"n1"}, "Z2": {"n2"}}), withGlobalCluster(),
+        withApply(log.apply), withRegisteredMembers(), withElectedLeaders())
+    defer l.Stop()
+
+    ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+    defer cancel()
+    zones := []string{"Z1", "Z2"}
+
+    // A coordinator crashed after preparing, before deciding. Once old
+    // enough the transaction is aborted.
+    stale := time.Now().Add(-time.Minute).UnixNano()
+    if err := l.global.record(ctx, CrossZoneRecord{TxID: "a", Phase: CrossZoneBegin, Zones: zones, Started: stale}); err != nil {
+        t.Fatalf("record: %v", err)
+    }
+    if err := l.sendToZones(ctx, zones, CrossZoneRecord{TxID: "a", Phase: CrossZonePrepare, Transaction: []byte("a")}); err != nil {
+        t.Fatalf("sendToZones: %v", err)
+    }
+
+    // Another crashed after deciding to commit, before telling the zones
+    if err := l.global.record(ctx, CrossZoneRecord{TxID: "b", Phase: CrossZoneBegin, Zones: zones, Started: time.Now().UnixNano()}); err != nil {
+        t.Fatalf("record: %v", err)
+    }
+    if err := l.sendToZones(ctx, zones, CrossZoneRecord{TxID: "b", Phase: CrossZonePrepare, Transaction: []byte("b")}); err != nil {
+        t.Fatalf("sendToZones: %v", err)
+    }
+    if _, err := l.global.decide(ctx, "b", CrossZoneCommit); err != nil {
+        t.Fatalf("decide: %v", err)
+    }
+
+    l.global.wake()
+    for _, id := range []string{"n1", "n2"} {
+        log.waitFor(t, id, "a", "prepare:a", "abort")
+        log.waitFor(t, id, "b", "prepare:b", "commit")
+    }
+    waitForFinished(t, l)
+}
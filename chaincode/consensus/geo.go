@@ -0,0 +1,338 @@
+package consensus
+
+import (
+    "fmt"
+    "math"
+    "sort"
+)
+
+// earthRadius is the mean radius of the earth in metres
+const earthRadius = 6371000.0
+
+// geohashAlphabet is the base32 alphabet of geohash cells
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// maxGeohashPrecision is the longest geohash cell, about 4cm across
+const maxGeohashPrecision = 12
+
+// GeoPoint is a position in degrees
+type GeoPoint struct {
+    Latitude  float64
+    Longitude float64
+}
+
+// GroupingPolicy sets how candidates are grouped by position. Candidates are
+// joined when they lie within Radius metres of one another, directly or
+// through other candidates; with a GeohashPrecision they are grouped by the
+// geohash cell of that many characters instead. Groups larger than MaxSize
+// are split and groups smaller than MinSize merged into their nearest
+// neighbour. A zero size is not enforced.
+type GroupingPolicy struct {
+    Radius           float64
+    GeohashPrecision int
+    MinSize          int
+    MaxSize          int
+}
+
+// CandidateGroup is a group of candidates close to one another, best ranked
+// first. Diameter is the greatest distance between two members, in metres.
+type CandidateGroup struct {
+    Members  []string
+    Centroid GeoPoint
+    Diameter float64
+}
+
+// validate checks that a policy selects one grouping and that its sizes can
+// be met: splitting a group larger than MaxSize into even parts leaves each
+// with at least MinSize members only if MaxSize is at least 2*MinSize-1
+func (p GroupingPolicy) validate() error {
+    switch {
+    case p.Radius < 0 || math.IsNaN(p.Radius):
+        return fmt.Errorf("invalid grouping radius: %v", p.Radius)
+    case p.GeohashPrecision < 0 || p.GeohashPrecision > maxGeohashPrecision:
+        return fmt.Errorf("geohash precision must be between 1 and %d: %d", maxGeohashPrecision, p.GeohashPrecision)
+    case p.Radius == 0 && p.GeohashPrecision == 0:
+        return fmt.Errorf("grouping needs a radius or a geohash precision")
+    case p.Radius > 0 && p.GeohashPrecision > 0:
+        return fmt.Errorf("grouping takes a radius or a geohash precision, not both")
+    case p.MinSize < 0 || p.MaxSize < 0:
+        return fmt.Errorf("invalid group sizes: %d to %d", p.MinSize, p.MaxSize)
+    case p.MaxSize > 0 && p.MaxSize < 2*p.MinSize-1:
+        return fmt.Errorf("maximum group size %d must be at least %d for a minimum of %d", p.MaxSize, 2*p.MinSize-1, p.MinSize)
+    }
+    return nil
+}
+
+// SetNodePosition records where a node is
+func (l *LHRaftConsensus) SetNodePosition(nodeID string, latitude, longitude float64) error {
+    if latitude < -90 || latitude > 90 || longitude < -180 || longitude > 180 {
+        return fmt.Errorf("invalid position: %v, %v", latitude, longitude)
+    }
+
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    node, exists := l.Nodes[nodeID]
+    if !exists {
+        return fmt.Errorf("node not found: %s", nodeID)
+    }
+    node.Latitude = latitude
+    node.Longitude = longitude
+    node.Positioned = true
+    return nil
+}
+
+// FormGeoCandidateGroups groups the nodes eligible to lead by their
+// positions rather than their Location labels, so that neighbouring nodes
+// in differently labelled locations group together. Nodes without a
+// position are left out. Groups are ordered by their best ranked member. A
+// lone group smaller than MinSize has nothing to merge with and is kept.
+func (l *LHRaftConsensus) FormGeoCandidateGroups(policy GroupingPolicy) ([]CandidateGroup, error) {
+    if err := policy.validate(); err != nil {
+        return nil, err
+    }
+
+    l.mu.RLock()
+    ids := make([]string, 0)
+    points := make(map[string]GeoPoint)
+    rank := make(map[string]float64)
+    for id, node := range l.Nodes {
+        if !node.Positioned || node.Reputation < l.Threshold || !l.canLead(node) {
+            continue
+        }
+        ids = append(ids, id)
+        points[id] = GeoPoint{node.Latitude, node.Longitude}
+        rank[id] = l.rankScore(node)
+    }
+    l.mu.RUnlock()
+    sort.Strings(ids)
+
+    var clusters [][]string
+    if policy.GeohashPrecision > 0 {
+        clusters = clusterByGeohash(ids, points, policy.GeohashPrecision)
+    } else {
+        clusters = clusterByRadius(ids, points, policy.Radius)
+    }
+    if policy.MaxSize > 0 {
+        clusters = splitClusters(clusters, points, policy.MaxSize)
+    }
+    if policy.MinSize > 0 {
+        clusters = mergeClusters(clusters, points, policy.MinSize, policy.MaxSize)
+    }
+
+    byRank := func(a, b string) bool {
+        if rank[a] != rank[b] {
+            return rank[a] > rank[b]
+        }
+        return a < b
+    }
+    groups := make([]CandidateGroup, 0, len(clusters))
+    for _, members := range clusters {
+        sort.Slice(members, func(i, j int) bool { return byRank(members[i], members[j]) })
+        groups = append(groups, CandidateGroup{
+            Members:  members,
+            Centroid: centroid(members, points),
+            Diameter: diameter(members, points),
+        })
+    }
+    sort.Slice(groups, func(i, j int) bool { return byRank(groups[i].Members[0], groups[j].Members[0]) })
+    return groups, nil
+}
+
+// clusterByRadius joins candidates within radius of one another, directly or
+// through a chain of others
+func clusterByRadius(ids []string, points map[string]GeoPoint, radius float64) [][]string {
+    parent := make([]int, len(ids))
+    for i := range parent {
+        parent[i] = i
+    }
+    var find func(i int) int
+    find = func(i int) int {
+        if parent[i] != i {
+            parent[i] = find(parent[i])
+        }
+        return parent[i]
+    }
+
+    for i := range ids {
+        for j := i + 1; j < len(ids); j++ {
+            if geoDistance(points[ids[i]], points[ids[j]]) <= radius {
+                parent[find(j)] = find(i)
+            }
+        }
+    }
+
+    roots := make(map[int]int)
+    var clusters [][]string
+    for i, id := range ids {
+        root := find(i)
+        if _, exists := roots[root]; !exists {
+            roots[root] = len(clusters)
+            clusters = append(clusters, nil)
+        }
+        clusters[roots[root]] = append(clusters[roots[root]], id)
+    }
+    return clusters
+}
+
+// clusterByGeohash groups candidates by the geohash cell they lie in
+func clusterByGeohash(ids []string, points map[string]GeoPoint, precision int) [][]string {
+    cells := make(map[string]int)
+    var clusters [][]string
+    for _, id := range ids {
+        cell := geohash(points[id], precision)
+        if _, exists := cells[cell]; !exists {
+            cells[cell] = len(clusters)
+            clusters = append(clusters, nil)
+        }
+        clusters[cells[cell]] = append(clusters[cells[cell]], id)
+    }
+    return clusters
+}
+
+// splitClusters divides every cluster larger than maxSize into the fewest
+// even parts that fit, cutting along the axis the cluster spreads furthest
+func splitClusters(clusters [][]string, points map[string]GeoPoint, maxSize int) [][]string {
+    var out [][]string
+    for _, members := range clusters {
+        if len(members) <= maxSize {
+            out = append(out, members)
+            continue
+        }
+
+        // Longitude is scaled by the cluster's latitude so both axes are in
+        // comparable distances
+        scale := math.Cos(centroid(members, points).Latitude * math.Pi / 180)
+        minLat, maxLat, minLon, maxLon := math.Inf(1), math.Inf(-1), math.Inf(1), math.Inf(-1)
+        for _, id := range members {
+            p := points[id]
+            minLat, maxLat = math.Min(minLat, p.Latitude), math.Max(maxLat, p.Latitude)
+            minLon, maxLon = math.Min(minLon, p.Longitude), math.Max(maxLon, p.Longitude)
+        }
+        byLongitude := (maxLon-minLon)*scale > maxLat-minLat
+        sorted := append([]string{}, members...)
+        sort.SliceStable(sorted, func(i, j int) bool {
+            a, b := points[sorted[i]], points[sorted[j]]
+            if byLongitude {
+                return a.Longitude < b.Longitude
+            }
+            return a.Latitude < b.Latitude
+        })
+
+        parts := (len(sorted) + maxSize - 1) / maxSize
+        for i := 0; i < parts; i++ {
+            out = append(out, sorted[i*len(sorted)/parts:(i+1)*len(sorted)/parts])
+        }
+    }
+    return out
+}
+
+// mergeClusters merges each cluster smaller than minSize into the cluster
+// with the nearest centroid, splitting the result again should it exceed
+// maxSize. Each merge leaves fewer undersized clusters, since the policy
+// ensures the parts of a split are never undersized.
+func mergeClusters(clusters [][]string, points map[string]GeoPoint, minSize, maxSize int) [][]string {
+    for len(clusters) > 1 {
+        small := -1
+        for i, members := range clusters {
+            if len(members) < minSize && (small < 0 || len(members) < len(clusters[small])) {
+                small = i
+            }
+        }
+        if small < 0 {
+            break
+        }
+
+        from := centroid(clusters[small], points)
+        nearest := -1
+        var nearestDistance float64
+        for i, members := range clusters {
+            if i == small {
+                continue
+            }
+            if d := geoDistance(from, centroid(members, points)); nearest < 0 || d < nearestDistance {
+                nearest, nearestDistance = i, d
+            }
+        }
+
+        merged := append(append([]string{}, clusters[nearest]...), clusters[small]...)
+        rest := make([][]string, 0, len(clusters))
+        for i, members := range clusters {
+            if i != small && i != nearest {
+                rest = append(rest, members)
+            }
+        }
+        if maxSize > 0 {
+            clusters = append(rest, splitClusters([][]string{merged}, points, maxSize)...)
+        } else {
+            clusters = append(rest, merged)
+        }
+    }
+    return clusters
+}
+
+// centroid returns the mean position of the members on the sphere, which
+// stays correct for groups spanning the antimeridian
+func centroid(members []string, points map[string]GeoPoint) GeoPoint {
+    var x, y, z float64
+    for _, id := range members {
+        lat, lon := points[id].Latitude*math.Pi/180, points[id].Longitude*math.Pi/180
+        x += math.Cos(lat) * math.Cos(lon)
+        y += math.Cos(lat) * math.Sin(lon)
+        z += math.Sin(lat)
+    }
+    return GeoPoint{
+        Latitude:  math.Atan2(z, math.Hypot(x, y)) * 180 / math.Pi,
+        Longitude: math.Atan2(y, x) * 180 / math.Pi,
+    }
+}
+
+// diameter returns the greatest distance between two members, in metres
+func diameter(members []string, points map[string]GeoPoint) float64 {
+    var d float64
+    for i := range members {
+        for j := i + 1; j < len(members); j++ {
+            d = math.Max(d, geoDistance(points[members[i]], points[members[j]]))
+        }
+    }
+    return d
+}
+
+// geoDistance returns the great-circle distance between two points in metres
+func geoDistance(a, b GeoPoint) float64 {
+    toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+    dLat := toRad(b.Latitude - a.Latitude)
+    dLon := toRad(b.Longitude - a.Longitude)
+    h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+        math.Cos(toRad(a.Latitude))*math.Cos(toRad(b.Latitude))*math.Sin(dLon/2)*math.Sin(dLon/2)
+    return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// geohash returns the geohash cell of the given length containing p
+func geohash(p GeoPoint, precision int) string {
+    lat, lon := [2]float64{-90, 90}, [2]float64{-180, 180}
+    hash := make([]byte, 0, precision)
+    bits, ch, even := 0, 0, true
+    for len(hash) < precision {
+        // Bits alternate between longitude and latitude, longitude first
+        interval, value := &lat, p.Latitude
+        if even {
+            interval, value = &lon, p.Longitude
+        }
+        mid := (interval[0] + interval[1]) / 2
+        ch <<= 1
+        if value >= mid {
+            ch |= 1
+            interval[0] = mid
+        } else {
+            interval[1] = mid
+        }
+        even = !even
+
+        if bits++; bits == 5 {
+            hash = append(hash, geohashAlphabet[ch])
+            bits, ch = 0, 0
+        }
+    }
+    return string(hash)
+}
@@ -0,0 +1,100 @@
+package consensus
+
+import (
+    "fmt"
+    "math"
+    "testing"
+)
+
+func TestGeoGroupsJoinNeighboursAcrossLabels(t *testing.T) {
+    // n1 and n2 are about 10m apart but labelled differently; n3 is 50km away
+    l := newTestConsensus(t, nil, withPositions(map[string]GeoPoint{
+        "n1": {51.5000, -0.1200},
+        "n2": {51.5000, -0.11986},
+        "n3": {51.9500, -0.1200},
+    }, map[string]string{"n1": "north-gate", "n2": "market-square"}))
+
+    groups, err := l.FormGeoCandidateGroups(GroupingPolicy{Radius: 100})
+    if err != nil {
+        t.Fatalf("FormGeoCandidateGroups: %v", err)
+    }
+    if len(groups) != 2 || !equalStrings(groups[0].Members, []string{"n1", "n2"}) || !equalStrings(groups[1].Members, []string{"n3"}) {
+        t.Fatalf("groups = %+v, want [n1 n2] and [n3]", groups)
+    }
+    if d := groups[0].Diameter; d < 9 || d > 11 {
+        t.Errorf("diameter = %.1fm, want about 10m", d)
+    }
+    if c := groups[0].Centroid; math.Abs(c.Latitude-51.5) > 1e-6 || math.Abs(c.Longitude+0.11993) > 1e-6 {
+        t.Errorf("centroid = %+v, want the midpoint of n1 and n2", c)
+    }
+    if groups[1].Diameter != 0 {
+        t.Errorf("lone member's diameter = %v, want 0", groups[1].Diameter)
+    }
+}
+
+func TestGeoGroupsByGeohashCell(t *testing.T) {
+    if got := geohash(GeoPoint{57.64911, 10.40744}, 11); got != "u4pruydqqvj" {
+        t.Fatalf("geohash = %s, want u4pruydqqvj", got)
+    }
+
+    l := newTestConsensus(t, nil, withPositions(map[string]GeoPoint{
+        "n1": {57.64911, 10.40744},
+        "n2": {57.64920, 10.40750},
+        "n3": {48.85800, 2.29400},
+    }, nil))
+    groups, err := l.FormGeoCandidateGroups(GroupingPolicy{GeohashPrecision: 5})
+    if err != nil {
+        t.Fatalf("FormGeoCandidateGroups: %v", err)
+    }
+    if len(groups) != 2 || !equalStrings(groups[0].Members, []string{"n1", "n2"}) {
+        t.Fatalf("groups = %+v, want n1 and n2 sharing a cell", groups)
+    }
+}
+
+func TestGeoGroupSizesAreBounded(t *testing.T) {
+    // Eleven nodes 50m apart along a street form one chain within the radius,
+    // and a twelfth sits alone 20km away
+    positions := make(map[string]GeoPoint)
+    for i := 0; i < 11; i++ {
+        positions[fmt.Sprintf("n%02d", i)] = GeoPoint{0, float64(i) * 0.00045}
+    }
+    positions["far"] = GeoPoint{0.18, 0}
+    l := newTestConsensus(t, nil, withPositions(positions, nil))
+
+    groups, err := l.FormGeoCandidateGroups(GroupingPolicy{Radius: 60, MinSize: 2, MaxSize: 4})
+    if err != nil {
+        t.Fatalf("FormGeoCandidateGroups: %v", err)
+    }
+    seen := make(map[string]bool)
+    for _, g := range groups {
+        if len(g.Members) < 2 || len(g.Members) > 4 {
+            t.Errorf("group %v has %d members, want 2 to 4", g.Members, len(g.Members))
+        }
+        for _, id := range g.Members {
+            if seen[id] {
+                t.Errorf("node %s is in more than one group", id)
+            }
+            seen[id] = true
+        }
+    }
+    if len(seen) != len(positions) {
+        t.Errorf("groups cover %d nodes, want %d", len(seen), len(positions))
+    }
+}
+
+func TestGroupingPolicyValidation(t *testing.T) {
+    l := newTestConsensus(t, nil, withPositions(map[string]GeoPoint{"n1": {0, 0}}, nil))
+    for _, policy := range []GroupingPolicy{
+        {},
+        {Radius: 10, GeohashPrecision: 5},
+        {GeohashPrecision: 13},
+        {Radius: 10, MinSize: 3, MaxSize: 4},
+    } {
+        if _, err := l.FormGeoCandidateGroups(policy); err == nil {
+            t.Errorf("policy %+v accepted", policy)
+        }
+    }
+    if err := l.SetNodePosition("n1", 91, 0); err == nil {
+        t.Error("latitude 91 accepted")
+    }
+}
@@ -0,0 +1,369 @@
+package consensus
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+)
+
+// GlobalGroupID names the group formed by the zone leaders. Its committed
+// entries reach the ApplyFunc, and its snapshots the snapshot functions,
+// under this ID in place of a zone ID.
+const GlobalGroupID = "global"
+
+// seatRetryInterval is how often a process retries handing a zone's seat to
+// the zone's leader, or finishing a cross-zone transaction, while the global
+// group or a zone cannot commit it
+const seatRetryInterval = 50 * time.Millisecond
+
+// GlobalBatch is a run of transactions committed by one zone and forwarded
+// to the global group, which orders the batches of every zone in its log
+type GlobalBatch struct {
+    Zone         string
+    Transactions [][]byte
+}
+
+// DecodeGlobalBatch decodes the data of an entry committed by the global
+// group. Entries without data mark the start of a leader's term.
+func DecodeGlobalBatch(data []byte) (GlobalBatch, error) {
+    var batch GlobalBatch
+    if err := json.Unmarshal(data, &batch); err != nil {
+        return GlobalBatch{}, fmt.Errorf("corrupt global batch: %v", err)
+    }
+    return batch, nil
+}
+
+// globalTier is this process's part in the global group: the replicas of
+// local seat holders, the transactions waiting to be forwarded upward, the
+// cross-zone transactions being coordinated and the loop that keeps each
+// zone's seat with the zone's leader and resolves transactions left in doubt
+type globalTier struct {
+    group       *zoneGroup
+    coordinator *coordinatorLog
+    timeout     time.Duration
+    queues      map[string]*batchQueue // ZoneID -> transactions awaiting forwarding
+    notify      chan struct{}
+    done        chan struct{}
+    mu          sync.Mutex
+}
+
+// batchQueue collects the transactions a zone commits while its previous
+// batch is being ordered
+type batchQueue struct {
+    transactions [][]byte
+    waiters      []chan error
+    flushing     bool
+}
+
+// wake asks the maintenance loop to run again. It never blocks.
+func (t *globalTier) wake() {
+    select {
+    case t.notify <- struct{}{}:
+    default:
+    }
+}
+
+func (t *globalTier) stop() {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    select {
+    case <-t.done:
+    default:
+        close(t.done)
+    }
+}
+
+// submit adds a transaction committed by a zone to the zone's next batch and
+// waits for that batch to be committed by the global group. A transaction
+// given up on when ctx ends may still be ordered.
+func (t *globalTier) submit(ctx context.Context, zoneID string, transaction []byte) error {
+    done := make(chan error, 1)
+
+    t.mu.Lock()
+    q, exists := t.queues[zoneID]
+    if !exists {
+        q = &batchQueue{}
+        t.queues[zoneID] = q
+    }
+    q.transactions = append(q.transactions, transaction)
+    q.waiters = append(q.waiters, done)
+    if !q.flushing {
+        q.flushing = true
+        go t.flush(zoneID, q)
+    }
+    t.mu.Unlock()
+
+    select {
+    case err := <-done:
+        return err
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+// flush forwards a zone's queued transactions one batch at a time until the
+// queue is empty
+func (t *globalTier) flush(zoneID string, q *batchQueue) {
+    for {
+        t.mu.Lock()
+        if len(q.transactions) == 0 {
+            q.flushing = false
+            t.mu.Unlock()
+            return
+        }
+        batch := GlobalBatch{Zone: zoneID, Transactions: q.transactions}
+        waiters := q.waiters
+        q.transactions, q.waiters = nil, nil
+        t.mu.Unlock()
+
+        err := t.forward(batch)
+        for _, done := range waiters {
+            done <- err
+        }
+    }
+}
+
+// forward replicates a batch through the global group
+func (t *globalTier) forward(batch GlobalBatch) error {
+    data, err := json.Marshal(batch)
+    if err != nil {
+        return err
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+    defer cancel()
+    return t.group.replicate(ctx, data)
+}
+
+// SetGlobalCluster starts the global group that orders the batches of every
+// zone. seats gives the node holding each zone's seat at first; like
+// SetInitialCluster it must be the same in every process. From then on each
+// zone's seat moves to whichever node leads the zone, and zones without a
+// seat gain one once they have a leader.
+func (l *LHRaftConsensus) SetGlobalCluster(seats map[string]string) error {
+    if len(seats) == 0 {
+        return fmt.Errorf("global cluster has no seats")
+    }
+    holders := make([]string, 0, len(seats))
+    held := make(map[string]string)
+    for zoneID, nodeID := range seats {
+        if other, exists := held[nodeID]; exists {
+            return fmt.Errorf("node %s holds the seats of both zone %s and zone %s", nodeID, other, zoneID)
+        }
+        held[nodeID] = zoneID
+        holders = append(holders, nodeID)
+    }
+
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    if l.global != nil {
+        return fmt.Errorf("global cluster already set")
+    }
+    group := newZoneGroup(GlobalGroupID, holders, l.transport.group(GlobalGroupID), groupConfig{
+        apply:       l.applyEntry,
+        snapshot:    l.snapshotGlobal,
+        restore:     l.restoreGlobal,
+        policy:      l.snapshotPolicy,
+        reads:       l.readPolicy,
+        onLeader:    l.observeGlobalLeader,
+        onHeartbeat: l.observeHeartbeat,
+        timing:      l.zoneTiming(GlobalGroupID),
+        storage:     l.openStorage,
+
+        onMembership: l.observeSeats,
+    })
+    group.membership.Seats = copySeats(seats)
+
+    tier := &globalTier{
+        group:       group,
+        coordinator: newCoordinatorLog(),
+        timeout:     l.ProposalTimeout,
+        queues:      make(map[string]*batchQueue),
+        notify:      make(chan struct{}, 1),
+        done:        make(chan struct{}),
+    }
+    l.groups[GlobalGroupID] = group
+    l.global = tier
+    tier.wake()
+    go l.maintainGlobal(tier)
+    return nil
+}
+
+// GlobalSeats returns the holder of each zone's seat in the global group, as
+// last committed through its log
+func (l *LHRaftConsensus) GlobalSeats() map[string]string {
+    l.mu.RLock()
+    global := l.global
+    l.mu.RUnlock()
+
+    seats := make(map[string]string)
+    if global == nil {
+        return seats
+    }
+    for zoneID, holder := range global.group.view().Seats {
+        seats[zoneID] = holder
+    }
+    return seats
+}
+
+// observeGlobalLeader records the global group's leader as reported by its
+// local replicas. A new leader hosted here resolves the transactions its
+// predecessor left in doubt.
+func (l *LHRaftConsensus) observeGlobalLeader(groupID, leaderID string, term uint64) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    previous := l.GlobalLeader
+    l.GlobalLeader = leaderID
+    if l.global != nil {
+        l.global.wake()
+    }
+    if previous != leaderID {
+        l.leaderChanges.publish(LeaderChange{ZoneID: groupID, Previous: previous, Leader: leaderID, Term: term})
+    }
+}
+
+// observeSeats is told of each committed change to the global group. A seat
+// holder that has just left needs no replica any more, and one that has
+// just joined may be due a seat.
+func (l *LHRaftConsensus) observeSeats(groupID string, membership Membership) {
+    l.mu.RLock()
+    defer l.mu.RUnlock()
+
+    if l.global != nil {
+        l.global.wake()
+    }
+}
+
+// maintainGlobal runs until the tier stops. Whenever the zone leaders or the
+// global group change it reconciles the seats and resolves cross-zone
+// transactions in doubt, retrying while a seat has still to move or a
+// transaction to finish.
+func (l *LHRaftConsensus) maintainGlobal(tier *globalTier) {
+    var retry <-chan time.Time
+    for {
+        select {
+        case <-tier.notify:
+        case <-retry:
+        case <-tier.done:
+            return
+        }
+
+        retry = nil
+        seatsErr := l.reconcileSeats(tier)
+        if err := l.resolveInDoubt(tier); err != nil || seatsErr != nil {
+            retry = time.After(seatRetryInterval)
+        }
+    }
+}
+
+// reconcileSeats brings the global group in line with the zone leaders this
+// process knows of. Local members of the group run a replica, a local zone
+// leader without a seat starts one to join with, and each zone's seat is
+// proposed for its leader: first as a learner, so that it catches up, then
+// by transferring the seat in one change. The seats of zones merged away are
+// released. It returns an error while any seat has still to move.
+func (l *LHRaftConsensus) reconcileSeats(tier *globalTier) error {
+    l.mu.RLock()
+    leaders := make(map[string]string, len(l.ZoneLeaders))
+    leading := make(map[string]bool)
+    for zoneID, leaderID := range l.ZoneLeaders {
+        leaders[zoneID] = leaderID
+        leading[leaderID] = true
+    }
+    local := make([]string, 0)
+    for id, node := range l.Nodes {
+        if !node.Remote {
+            local = append(local, id)
+        }
+    }
+    merged := make(map[string]bool, len(l.mergedZones))
+    for zoneID := range l.mergedZones {
+        merged[zoneID] = true
+    }
+    timeout := l.ProposalTimeout
+    l.mu.RUnlock()
+
+    group := tier.group
+    view := group.view()
+    for _, id := range local {
+        if view.isMember(id) || leading[id] {
+            if err := group.host(id); err != nil {
+                return err
+            }
+        } else {
+            group.abandon(id)
+        }
+    }
+
+    zones := make([]string, 0, len(leaders))
+    for zoneID := range leaders {
+        zones = append(zones, zoneID)
+    }
+    sort.Strings(zones)
+
+    var pending error
+    for _, zoneID := range zones {
+        leaderID := leaders[zoneID]
+        if group.view().Seats[zoneID] == leaderID {
+            continue
+        }
+
+        ctx, cancel := context.WithTimeout(context.Background(), timeout)
+        err := l.moveSeat(ctx, group, zoneID, leaderID)
+        cancel()
+        if err != nil {
+            pending = fmt.Errorf("seat of zone %s not yet with %s: %v", zoneID, leaderID, err)
+        }
+    }
+
+    // Zones merged into others give up their seats
+    for zoneID, holder := range group.view().Seats {
+        if !merged[zoneID] {
+            continue
+        }
+        ctx, cancel := context.WithTimeout(context.Background(), timeout)
+        err := group.proposeConfChange(ctx, ConfChange{Type: ConfReleaseSeat, NodeID: holder, Zone: zoneID})
+        cancel()
+        if err != nil {
+            pending = fmt.Errorf("seat of merged zone %s not yet released: %v", zoneID, err)
+        }
+    }
+    return pending
+}
+
+// moveSeat hands a zone's seat to its leader through the global group's log
+func (l *LHRaftConsensus) moveSeat(ctx context.Context, group *zoneGroup, zoneID, leaderID string) error {
+    if !group.view().isMember(leaderID) {
+        if err := group.proposeConfChange(ctx, ConfChange{Type: ConfAddLearner, NodeID: leaderID}); err != nil {
+            return err
+        }
+    }
+    return group.transferSeat(ctx, zoneID, leaderID)
+}
+
+// propagateToGlobalConsensus forwards a transaction a zone has committed to
+// the global group, returning once the global group has ordered the batch
+// carrying it. Without a global cluster zones are ordered independently.
+func (l *LHRaftConsensus) propagateToGlobalConsensus(zoneID string, transaction []byte) error {
+    l.mu.RLock()
+    global := l.global
+    timeout := l.ProposalTimeout
+    l.mu.RUnlock()
+
+    if global == nil {
+        return nil
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    if err := global.submit(ctx, zoneID, transaction); err != nil {
+        return fmt.Errorf("failed to order transaction of zone %s globally: %v", zoneID, err)
+    }
+    return nil
+}
@@ -0,0 +1,168 @@
+package consensus
+
+import (
+    "sync"
+    "testing"
+    "time"
+)
+
+// fastTiming elects and heartbeats quickly enough for tests
+var fastTiming = ZoneTiming{TickInterval: 5 * time.Millisecond, HeartbeatTicks: 1, ElectionTicks: 10}
+
+// globalOrder records the transactions each seat holder receives from the
+// global group, as "zone:transaction"
+type globalOrder struct {
+    applied map[string][]string
+    mu      sync.Mutex
+}
+
+func newGlobalOrder() *globalOrder {
+    return &globalOrder{applied: make(map[string][]string)}
+}
+
+func (o *globalOrder) apply(zoneID, nodeID string, entry LogEntry) {
+    if zoneID != GlobalGroupID || entry.Data == nil {
+        return
+    }
+    batch, err := DecodeGlobalBatch(entry.Data)
+    if err != nil {
+        return
+    }
+
+    o.mu.Lock()
+    defer o.mu.Unlock()
+
+    for _, transaction := range batch.Transactions {
+        o.applied[nodeID] = append(o.applied[nodeID], batch.Zone+":"+string(transaction))
+    }
+}
+
+// waitFor waits until nodeID has received exactly the given transactions
+func (o *globalOrder) waitFor(t *testing.T, nodeID string, want ...string) {
+    t.Helper()
+
+    deadline := time.Now().Add(2 * time.Second)
+    for {
+        o.mu.Lock()
+        got := append([]string{}, o.applied[nodeID]...)
+        o.mu.Unlock()
+
+        if equalStrings(got, want) {
+            return
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("node %s received %q from the global group, want %q", nodeID, got, want)
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+}
+
+func TestGlobalGroupOrdersZoneBatches(t *testing.T) {
+    l := newTestConsensus(t, nil, withZones(map[string][]string{"Z1": {"n1"}, "Z2": {"n2"}}), withGlobalCluster())
+    defer l.Stop()
+    order := newGlobalOrder()
+    l.SetApplyFunc(order.apply)
+
+    for id, zoneID := range map[string]string{"n1": "Z1", "n2": "Z2"} {
+        if err := l.RegisterNode(id, zoneID, 0.9); err != nil {
+            t.Fatalf("RegisterNode(%s): %v", id, err)
+        }
+        if _, err := l.ElectZoneLeader(zoneID); err != nil {
+            t.Fatalf("ElectZoneLeader(%s): %v", zoneID, err)
+        }
+    }
+
+    for _, tx := range []struct{ zoneID, data string }{{"Z1", "tx1"}, {"Z2", "tx2"}, {"Z1", "tx3"}} {
+        if err := l.PropagateTransaction([]byte(tx.data), tx.zoneID); err != nil {
+            t.Fatalf("PropagateTransaction(%s): %v", tx.data, err)
+        }
+    }
+
+    // Both zone leaders receive the same global order
+    for _, id := range []string{"n1", "n2"} {
+        order.waitFor(t, id, "Z1:tx1", "Z2:tx2", "Z1:tx3")
+    }
+}
+
+func TestGlobalSeatFollowsZoneLeader(t *testing.T) {
+    l := newTestConsensus(t, nil, withZones(map[string][]string{"Z1": {"n1", "n2", "n3"}, "Z2": {"n4"}}), withGlobalCluster())
+    defer l.Stop()
+    order := newGlobalOrder()
+    l.SetApplyFunc(order.apply)
+
+    reputations := map[string]float64{"n1": 0.9, "n2": 0.8, "n3": 0.7, "n4": 0.9}
+    for _, id := range []string{"n1", "n2", "n3", "n4"} {
+        zoneID := "Z1"
+        if id == "n4" {
+            zoneID = "Z2"
+        }
+        if err := l.RegisterNode(id, zoneID, reputations[id]); err != nil {
+            t.Fatalf("RegisterNode(%s): %v", id, err)
+        }
+    }
+    for _, zoneID := range []string{"Z1", "Z2"} {
+        if _, err := l.ElectZoneLeader(zoneID); err != nil {
+            t.Fatalf("ElectZoneLeader(%s): %v", zoneID, err)
+        }
+    }
+    if err := l.PropagateTransaction([]byte("tx1"), "Z1"); err != nil {
+        t.Fatalf("PropagateTransaction: %v", err)
+    }
+
+    // n2 overtakes n1 and wins Z1, taking its seat with it
+    if err := l.UpdateNodeReputation("n1", 0.6); err != nil {
+        t.Fatalf("UpdateNodeReputation: %v", err)
+    }
+    if leaderID, err := l.ElectZoneLeader("Z1"); err != nil || leaderID != "n2" {
+        t.Fatalf("ElectZoneLeader = %s, %v; want n2", leaderID, err)
+    }
+
+    deadline := time.Now().Add(2 * time.Second)
+    for l.GlobalSeats()["Z1"] != "n2" {
+        if time.Now().After(deadline) {
+            t.Fatalf("global seats = %v, want Z1 held by n2", l.GlobalSeats())
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+    view := l.groups[GlobalGroupID].view()
+    if !equalStrings(view.Voters, []string{"n2", "n4"}) || view.isMember("n1") {
+        t.Errorf("global voters = %q, learners = %q; want n2 and n4 only", view.Voters, view.Learners)
+    }
+
+    if err := l.PropagateTransaction([]byte("tx2"), "Z1"); err != nil {
+        t.Fatalf("PropagateTransaction after transfer: %v", err)
+    }
+    for _, id := range []string{"n2", "n4"} {
+        order.waitFor(t, id, "Z1:tx1", "Z1:tx2")
+    }
+}
+
+func TestSeatTransferNeedsBothMajorities(t *testing.T) {
+    node := newRaftNode("a", Membership{Voters: []string{"a"}, Learners: []string{"b"}, Seats: map[string]string{"Z1": "a"}})
+    node.campaign()
+    if node.state != Leader {
+        t.Fatal("single voter did not become leader")
+    }
+    node.advance(node.ready())
+
+    index, _, err := node.proposeConfChange(ConfChange{Type: ConfTransferSeat, NodeID: "b", Zone: "Z1"})
+    if err != nil {
+        t.Fatalf("proposeConfChange: %v", err)
+    }
+    if node.log.committed >= index {
+        t.Fatal("seat transfer committed before the incoming holder stored it")
+    }
+
+    node.step(Message{Type: MsgAppendEntriesResponse, From: "b", To: "a", Term: node.currentTerm, Success: true, MatchIndex: index})
+    if node.log.committed != index {
+        t.Fatalf("committed = %d, want the transfer at %d", node.log.committed, index)
+    }
+
+    node.applyConfChange(ConfChange{Type: ConfTransferSeat, NodeID: "b", Zone: "Z1"})
+    if !equalStrings(node.membership.Voters, []string{"b"}) || node.membership.Seats["Z1"] != "b" {
+        t.Errorf("membership = %+v, want b holding Z1 alone", node.membership)
+    }
+    if node.state == Leader {
+        t.Error("retired seat holder is still leading")
+    }
+}
@@ -0,0 +1,585 @@
+package consensus
+
+import (
+    "context"
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+)
+
+// ApplyFunc is called with each committed entry on each member, in log order
+type ApplyFunc func(zoneID, nodeID string, entry LogEntry)
+
+// SnapshotFunc captures the state a member has applied so far
+type SnapshotFunc func(zoneID, nodeID string) ([]byte, error)
+
+// RestoreFunc replaces a member's state with state captured by a SnapshotFunc
+type RestoreFunc func(zoneID, nodeID string, data []byte) error
+
+// ReadFunc reads the state a member has applied. It runs with the member's
+// replica locked and must not call back into the consensus.
+type ReadFunc func(zoneID, nodeID string) error
+
+// proposalRetryInterval is how often a proposal is retried while a leader is
+// being elected or, for membership changes, while another is in flight
+const proposalRetryInterval = 10 * time.Millisecond
+
+// groupConfig carries the callbacks a zoneGroup hands to its replicas
+type groupConfig struct {
+    apply    ApplyFunc
+    snapshot SnapshotFunc
+    restore  RestoreFunc
+    policy   SnapshotPolicy
+    reads    ReadPolicy
+    eligible func(nodeID string) bool
+    // onLeader is called when a local replica learns of a new leader or term
+    onLeader    func(zoneID, leaderID string, term uint64)
+    onHeartbeat func(nodeID string, at time.Time)
+    onLatency   func(nodeID, peerID string, rtt time.Duration)
+    // onMembership is called when the group's committed membership changes
+    onMembership func(zoneID string, membership Membership)
+    timing       ZoneTiming
+    // storage opens the storage of a local member; nil keeps state in memory
+    storage func(zoneID, nodeID string) (Storage, error)
+}
+
+// zoneGroup is the Raft group formed by the members of one zone. Members
+// hosted in this process run a Replica; remote members only count towards
+// the group's composition. The group starts from an explicit initial
+// cluster, which every process hosting members must agree on; every later
+// change is committed through the group's log.
+type zoneGroup struct {
+    zoneID    string
+    replicas  map[string]*Replica // Locally hosted members
+    joining   map[string]bool     // Local replicas whose addition is not yet committed
+    transport Transport
+    cfg       groupConfig
+    mu        sync.Mutex
+
+    // The group as last reported by a local replica. Guarded by viewMu,
+    // which replicas take while locked, so it is never held across a call
+    // into a replica.
+    leaderID      string
+    leaderTerm    uint64
+    resigned      string        // Leader that stepped down in leaderTerm
+    leaderChanged chan struct{} // Closed and replaced on every change
+    membership    Membership
+    confIndex     uint64 // Log index of the last applied membership change
+    viewMu        sync.Mutex
+}
+
+// newZoneGroup creates a group whose initial voters are initialCluster
+func newZoneGroup(zoneID string, initialCluster []string, transport Transport, cfg groupConfig) *zoneGroup {
+    voters := append([]string{}, initialCluster...)
+    sort.Strings(voters)
+    return &zoneGroup{
+        zoneID:        zoneID,
+        replicas:      make(map[string]*Replica),
+        joining:       make(map[string]bool),
+        transport:     transport,
+        cfg:           cfg,
+        leaderChanged: make(chan struct{}),
+        membership:    Membership{Voters: voters},
+    }
+}
+
+// view returns the group's membership
+func (g *zoneGroup) view() Membership {
+    g.viewMu.Lock()
+    defer g.viewMu.Unlock()
+
+    return g.membership
+}
+
+// addMember adds a node to the group, starting a replica for it when it is
+// hosted locally. Members of the initial cluster, and nodes whose addition
+// has already been committed, take their place straight away. Any other node
+// joins as a learner through the log and must be promoted once it has
+// caught up.
+func (g *zoneGroup) addMember(ctx context.Context, nodeID string, local bool) error {
+    g.mu.Lock()
+    view := g.view()
+    if view.isMember(nodeID) {
+        var err error
+        if local {
+            _, err = g.startReplica(nodeID, view)
+        }
+        g.mu.Unlock()
+        return err
+    }
+    if local {
+        _, err := g.startReplica(nodeID, view.withLearner(nodeID))
+        if err != nil {
+            g.mu.Unlock()
+            return err
+        }
+        g.joining[nodeID] = true
+    }
+    g.mu.Unlock()
+
+    err := g.proposeConfChange(ctx, ConfChange{Type: ConfAddLearner, NodeID: nodeID})
+
+    g.mu.Lock()
+    delete(g.joining, nodeID)
+    replica := g.replicas[nodeID]
+    if err != nil && replica != nil {
+        delete(g.replicas, nodeID)
+    }
+    g.mu.Unlock()
+
+    if err != nil && replica != nil {
+        replica.Stop()
+    }
+    return err
+}
+
+// host starts a local replica for a node the group has admitted or is about
+// to admit, unless one is running. A node that is not yet a member starts as
+// a learner and counts as joining until its addition is applied.
+func (g *zoneGroup) host(nodeID string) error {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+
+    if _, running := g.replicas[nodeID]; running {
+        return nil
+    }
+    view := g.view()
+    if view.isMember(nodeID) {
+        _, err := g.startReplica(nodeID, view)
+        return err
+    }
+    if _, err := g.startReplica(nodeID, view.withLearner(nodeID)); err != nil {
+        return err
+    }
+    g.joining[nodeID] = true
+    return nil
+}
+
+// abandon stops the local replica of a joining node whose addition will no
+// longer be proposed
+func (g *zoneGroup) abandon(nodeID string) {
+    g.mu.Lock()
+    replica := g.replicas[nodeID]
+    if replica == nil || !g.joining[nodeID] || g.view().isMember(nodeID) {
+        g.mu.Unlock()
+        return
+    }
+    delete(g.replicas, nodeID)
+    delete(g.joining, nodeID)
+    g.mu.Unlock()
+
+    replica.Stop()
+}
+
+// startReplica starts a local replica with the given membership. Callers hold g.mu.
+func (g *zoneGroup) startReplica(nodeID string, membership Membership) (*Replica, error) {
+    var storage Storage
+    if g.cfg.storage != nil {
+        s, err := g.cfg.storage(g.zoneID, nodeID)
+        if err != nil {
+            return nil, err
+        }
+        storage = s
+    }
+
+    replica, err := NewReplica(ReplicaConfig{
+        NodeID:        nodeID,
+        ZoneID:        g.zoneID,
+        Peers:         membership.Voters,
+        Learners:      membership.Learners,
+        Seats:         membership.Seats,
+        Transport:     g.transport,
+        Storage:       storage,
+        Apply:         g.cfg.apply,
+        Snapshot:      g.cfg.snapshot,
+        Restore:       g.cfg.restore,
+        Policy:        g.cfg.policy,
+        Reads:         g.cfg.reads,
+        Eligible:      g.cfg.eligible,
+        OnStateChange: g.observe,
+        OnHeartbeat:   g.cfg.onHeartbeat,
+        OnLatency:     g.cfg.onLatency,
+        OnConfChange:  g.observeConfChange,
+
+        TickInterval:   g.cfg.timing.TickInterval,
+        ElectionTicks:  g.cfg.timing.ElectionTicks,
+        HeartbeatTicks: g.cfg.timing.HeartbeatTicks,
+    })
+    if err != nil {
+        if storage != nil {
+            storage.Close()
+        }
+        return nil, err
+    }
+    g.replicas[nodeID] = replica
+    return replica, nil
+}
+
+// promoteMember makes a learner that has caught up a voter
+func (g *zoneGroup) promoteMember(ctx context.Context, nodeID string) error {
+    return g.proposeConfChange(ctx, ConfChange{Type: ConfPromoteLearner, NodeID: nodeID})
+}
+
+// removeMember takes a node out of the group; its local replica is stopped
+// once the removal is applied
+func (g *zoneGroup) removeMember(ctx context.Context, nodeID string) error {
+    return g.proposeConfChange(ctx, ConfChange{Type: ConfRemoveNode, NodeID: nodeID})
+}
+
+// transferSeat gives a zone's seat in the global group to a member, retiring
+// the previous holder in the same committed change
+func (g *zoneGroup) transferSeat(ctx context.Context, zoneID, nodeID string) error {
+    return g.proposeConfChange(ctx, ConfChange{Type: ConfTransferSeat, NodeID: nodeID, Zone: zoneID})
+}
+
+// proposer returns the local replica to propose through: the leader when it
+// is hosted here, otherwise a member that forwards to it. Replicas still
+// joining do not know the leader yet.
+func (g *zoneGroup) proposer() (*Replica, error) {
+    leaderID, _ := g.leader()
+
+    g.mu.Lock()
+    defer g.mu.Unlock()
+
+    if leader, exists := g.replicas[leaderID]; exists {
+        return leader, nil
+    }
+    ids := make([]string, 0, len(g.replicas))
+    for id := range g.replicas {
+        if !g.joining[id] {
+            ids = append(ids, id)
+        }
+    }
+    if len(ids) == 0 {
+        return nil, fmt.Errorf("zone %s has no member hosted locally", g.zoneID)
+    }
+    sort.Strings(ids)
+    return g.replicas[ids[0]], nil
+}
+
+// proposeConfChange commits a membership change through the zone's leader,
+// wherever it is hosted
+func (g *zoneGroup) proposeConfChange(ctx context.Context, cc ConfChange) error {
+    return g.proposeChange(ctx, func(proposer *Replica) error {
+        return proposer.ProposeConfChange(ctx, cc)
+    })
+}
+
+// proposeZoneChange commits a zone change through the zone's leader, wherever
+// it is hosted
+func (g *zoneGroup) proposeZoneChange(ctx context.Context, zc ZoneChange) error {
+    return g.proposeChange(ctx, func(proposer *Replica) error {
+        return proposer.ProposeZoneChange(ctx, zc)
+    })
+}
+
+// proposeChange proposes a membership or zone change through a local replica
+func (g *zoneGroup) proposeChange(ctx context.Context, propose func(*Replica) error) error {
+    // Changes are made one at a time, and only once a leader is known; wait
+    // for the one in flight or the election
+    for {
+        proposer, err := g.proposer()
+        if err != nil {
+            return err
+        }
+        err = propose(proposer)
+        if err != ErrConfChangePending && err != ErrNotLeader {
+            return err
+        }
+        select {
+        case <-time.After(proposalRetryInterval):
+        case <-ctx.Done():
+            return fmt.Errorf("%v: %v", ctx.Err(), err)
+        }
+    }
+}
+
+// observeConfChange records a membership change applied by a local replica.
+// It is the replicas' OnConfChange callback; replicas of removed members are
+// stopped once it returns.
+func (g *zoneGroup) observeConfChange(index uint64, membership Membership) {
+    g.viewMu.Lock()
+    defer g.viewMu.Unlock()
+
+    if index <= g.confIndex {
+        return
+    }
+    g.confIndex = index
+    g.membership = membership
+    if g.cfg.onMembership != nil {
+        g.cfg.onMembership(g.zoneID, membership)
+    }
+    go g.dropRemoved()
+}
+
+// dropRemoved stops the local replicas of nodes no longer in the group
+func (g *zoneGroup) dropRemoved() {
+    membership := g.view()
+
+    g.mu.Lock()
+    removed := make([]*Replica, 0)
+    for id, replica := range g.replicas {
+        if membership.isMember(id) {
+            delete(g.joining, id)
+        } else if !g.joining[id] {
+            removed = append(removed, replica)
+            delete(g.replicas, id)
+        }
+    }
+    g.mu.Unlock()
+
+    for _, replica := range removed {
+        replica.Stop()
+    }
+}
+
+// hosts reports whether a member runs a replica in this process
+func (g *zoneGroup) hosts(nodeID string) bool {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+
+    _, exists := g.replicas[nodeID]
+    return exists
+}
+
+// memberIDs returns every member of the group
+func (g *zoneGroup) memberIDs() []string {
+    return g.view().members()
+}
+
+// setTiming changes the heartbeat and election timing of every local replica
+func (g *zoneGroup) setTiming(timing ZoneTiming) {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+
+    g.cfg.timing = timing
+    for _, replica := range g.replicas {
+        replica.setTiming(timing.TickInterval, timing.ElectionTicks, timing.HeartbeatTicks)
+    }
+}
+
+// setSnapshotPolicy changes when local replicas take snapshots
+func (g *zoneGroup) setSnapshotPolicy(policy SnapshotPolicy) {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+
+    g.cfg.policy = policy
+    for _, replica := range g.replicas {
+        replica.setSnapshotPolicy(policy)
+    }
+}
+
+// setReadPolicy changes how local replicas confirm reads
+func (g *zoneGroup) setReadPolicy(policy ReadPolicy) {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+
+    g.cfg.reads = policy
+    for _, replica := range g.replicas {
+        replica.setReadPolicy(policy)
+    }
+}
+
+// campaign starts an election with a locally hosted node as candidate. It
+// reports false if the node declined to stand, having lost its vote or its
+// eligibility to lead. A sitting leader, wherever it is hosted, hands over to
+// the candidate instead: the candidate catches up first, and voters need not
+// wait out a lease the leader may hold.
+func (g *zoneGroup) campaign(ctx context.Context, nodeID string) (bool, error) {
+    leaderID, _ := g.leader()
+
+    g.mu.Lock()
+    candidate, exists := g.replicas[nodeID]
+    eligible := g.cfg.eligible
+    g.mu.Unlock()
+
+    if !exists {
+        return false, fmt.Errorf("node %s is not hosted locally", nodeID)
+    }
+    if leaderID != "" && leaderID != nodeID {
+        if eligible != nil && !eligible(nodeID) {
+            return false, nil
+        }
+        err := g.transferLeadership(ctx, nodeID)
+        if err == ErrNotEligible {
+            return false, nil
+        }
+        return err == nil, err
+    }
+
+    before := candidate.Status()
+    candidate.Campaign()
+    after := candidate.Status()
+    return after.Term > before.Term || after.State == Leader, nil
+}
+
+// transferLeadership has the group's leader, wherever it is hosted, hand
+// leadership to nodeID, and waits until nodeID leads. The request is
+// repeated every election timeout, as a leader gives up on a member that
+// does not catch up in time and a new leader may be elected meanwhile. A
+// local leader still handing over when ctx expires carries on leading.
+func (g *zoneGroup) transferLeadership(ctx context.Context, nodeID string) error {
+    if !g.view().isVoter(nodeID) {
+        return fmt.Errorf("node %s is not a voter of zone %s", nodeID, g.zoneID)
+    }
+    g.mu.Lock()
+    retry := g.cfg.timing.electionTimeout()
+    g.mu.Unlock()
+
+    for {
+        g.viewMu.Lock()
+        leaderID, changed := g.leaderID, g.leaderChanged
+        g.viewMu.Unlock()
+
+        if leaderID == nodeID {
+            return nil
+        }
+        requester, err := g.proposer()
+        if err != nil {
+            return err
+        }
+        if err := requester.TransferLeadership(nodeID); err != nil && err != ErrNotLeader {
+            return err
+        }
+        select {
+        case <-changed:
+        case <-time.After(retry):
+        case <-ctx.Done():
+            g.mu.Lock()
+            leader := g.replicas[leaderID]
+            g.mu.Unlock()
+            if leader != nil {
+                leader.abortTransfer()
+            }
+            return fmt.Errorf("leadership of zone %s not transferred to %s: %v", g.zoneID, nodeID, ctx.Err())
+        }
+    }
+}
+
+// stepDown has a local replica that leads the group become a follower. The
+// group waits for another member to campaign.
+func (g *zoneGroup) stepDown(nodeID string) {
+    g.mu.Lock()
+    replica := g.replicas[nodeID]
+    g.mu.Unlock()
+
+    if replica != nil {
+        replica.StepDown()
+    }
+}
+
+// observe records the leader reported by a local replica. It is the
+// replicas' OnStateChange callback; onLeader runs under viewMu so that
+// changes are reported in term order.
+func (g *zoneGroup) observe(status ReplicaStatus) {
+    g.viewMu.Lock()
+    defer g.viewMu.Unlock()
+
+    newTerm := status.Term > g.leaderTerm
+    // A follower that has yet to hear of its leader's resignation may still
+    // report it; a node leads at most once per term
+    learntLeader := status.Term == g.leaderTerm && g.leaderID == "" && status.LeaderID != "" && status.LeaderID != g.resigned
+    steppedDown := status.Term == g.leaderTerm && status.NodeID == g.leaderID && status.State != Leader
+    if !newTerm && !learntLeader && !steppedDown {
+        return
+    }
+    if newTerm {
+        g.resigned = ""
+    }
+    if steppedDown {
+        g.resigned = status.NodeID
+    }
+    g.leaderID = status.LeaderID
+    g.leaderTerm = status.Term
+    close(g.leaderChanged)
+    g.leaderChanged = make(chan struct{})
+
+    if g.cfg.onLeader != nil {
+        g.cfg.onLeader(g.zoneID, status.LeaderID, status.Term)
+    }
+}
+
+// leader returns the most recent leader known to the group and its term. The
+// leader is empty while an election is in progress.
+func (g *zoneGroup) leader() (string, uint64) {
+    g.viewMu.Lock()
+    defer g.viewMu.Unlock()
+
+    return g.leaderID, g.leaderTerm
+}
+
+// waitForLeader waits until a leader is known for a term after the given one
+func (g *zoneGroup) waitForLeader(ctx context.Context, after uint64) (string, uint64, error) {
+    for {
+        g.viewMu.Lock()
+        leaderID, term, changed := g.leaderID, g.leaderTerm, g.leaderChanged
+        g.viewMu.Unlock()
+
+        if leaderID != "" && term > after {
+            return leaderID, term, nil
+        }
+        select {
+        case <-changed:
+        case <-ctx.Done():
+            return "", 0, ctx.Err()
+        }
+    }
+}
+
+// replicate proposes data through the zone's leader, wherever it is hosted,
+// returning once a majority of the group has stored it. A proposal refused
+// because leadership changed is retried once a new leader is known.
+func (g *zoneGroup) replicate(ctx context.Context, data []byte) error {
+    return g.replicateEntry(ctx, EntryNormal, data)
+}
+
+// replicateEntry is replicate for an entry of any type but a membership change
+func (g *zoneGroup) replicateEntry(ctx context.Context, entryType EntryType, data []byte) error {
+    for {
+        proposer, err := g.proposer()
+        if err != nil {
+            return err
+        }
+        err = proposer.proposeEntry(ctx, entryType, data)
+        if err != ErrNotLeader {
+            return err
+        }
+        select {
+        case <-time.After(proposalRetryInterval):
+        case <-ctx.Done():
+            return ErrNotLeader
+        }
+    }
+}
+
+// read calls fn with the state of a local member once it reflects every
+// entry the zone committed before the call. A read refused because
+// leadership changed is retried once a new leader is known.
+func (g *zoneGroup) read(ctx context.Context, fn ReadFunc) error {
+    for {
+        reader, err := g.proposer()
+        if err != nil {
+            return err
+        }
+        err = reader.Read(ctx, func() error { return fn(g.zoneID, reader.ID()) })
+        if err != ErrNotLeader {
+            return err
+        }
+        select {
+        case <-time.After(proposalRetryInterval):
+        case <-ctx.Done():
+            return ErrNotLeader
+        }
+    }
+}
+
+// stop stops every local replica
+func (g *zoneGroup) stop() {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+
+    for _, replica := range g.replicas {
+        replica.Stop()
+    }
+}
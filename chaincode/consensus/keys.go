@@ -0,0 +1,251 @@
+package consensus
+
+import (
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/ed25519"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/json"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "sync"
+)
+
+// Errors reported for messages that fail authentication
+var (
+    ErrNoNodeKey    = errors.New("no key known for node")
+    ErrNodeRevoked  = errors.New("node key revoked")
+    ErrBadSignature = errors.New("message signature does not verify")
+    ErrUnsigned     = errors.New("message is not signed")
+)
+
+// keyring holds the public key of every node whose messages are checked and
+// the signing key of every node hosted in this process. Nodes sign with
+// Ed25519 or ECDSA keys, the latter over a SHA-256 digest as devices sign
+// their claims on the ledger.
+type keyring struct {
+    public  map[string]crypto.PublicKey
+    private map[string]crypto.Signer
+    revoked map[string]bool
+    mu      sync.RWMutex
+}
+
+func newKeyring() *keyring {
+    return &keyring{
+        public:  make(map[string]crypto.PublicKey),
+        private: make(map[string]crypto.Signer),
+        revoked: make(map[string]bool),
+    }
+}
+
+// checkPublicKey reports whether nodes may sign with key's kind of key
+func checkPublicKey(key crypto.PublicKey) error {
+    switch key := key.(type) {
+    case ed25519.PublicKey:
+        if len(key) != ed25519.PublicKeySize {
+            return fmt.Errorf("Ed25519 key is %d bytes, want %d", len(key), ed25519.PublicKeySize)
+        }
+    case *ecdsa.PublicKey:
+        if key == nil || key.Curve == nil {
+            return fmt.Errorf("ECDSA key has no curve")
+        }
+    default:
+        return fmt.Errorf("unsupported key type %T, want Ed25519 or ECDSA", key)
+    }
+    return nil
+}
+
+// ParseNodePublicKey decodes a PEM encoded Ed25519 or ECDSA public key, as
+// devices register on the ledger
+func ParseNodePublicKey(publicKeyPEM string) (crypto.PublicKey, error) {
+    block, _ := pem.Decode([]byte(publicKeyPEM))
+    if block == nil {
+        return nil, fmt.Errorf("invalid PEM public key")
+    }
+    key, err := x509.ParsePKIXPublicKey(block.Bytes)
+    if err != nil {
+        return nil, fmt.Errorf("invalid public key: %v", err)
+    }
+    if err := checkPublicKey(key); err != nil {
+        return nil, err
+    }
+    return key, nil
+}
+
+// setPrivate records the signing key of a local node, and its public half
+func (k *keyring) setPrivate(nodeID string, key crypto.Signer) error {
+    if key == nil {
+        return fmt.Errorf("no signing key given for node %s", nodeID)
+    }
+    if err := checkPublicKey(key.Public()); err != nil {
+        return fmt.Errorf("signing key of node %s: %v", nodeID, err)
+    }
+    k.mu.Lock()
+    defer k.mu.Unlock()
+
+    if public, exists := k.public[nodeID]; exists && !samePublicKey(public, key.Public()) {
+        return fmt.Errorf("signing key of node %s does not match its public key", nodeID)
+    }
+    k.private[nodeID] = key
+    k.public[nodeID] = key.Public()
+    return nil
+}
+
+// setPublic records the key messages from a node are checked against. A
+// node hosted here keeps the key it signs with.
+func (k *keyring) setPublic(nodeID string, key crypto.PublicKey) error {
+    if err := checkPublicKey(key); err != nil {
+        return fmt.Errorf("public key of node %s: %v", nodeID, err)
+    }
+    k.mu.Lock()
+    defer k.mu.Unlock()
+
+    if private, exists := k.private[nodeID]; exists && !samePublicKey(private.Public(), key) {
+        return fmt.Errorf("public key of node %s does not match the key it signs with here", nodeID)
+    }
+    k.public[nodeID] = key
+    return nil
+}
+
+// setRevoked withdraws or restores a node's keys. A revoked node neither
+// signs nor is believed.
+func (k *keyring) setRevoked(nodeID string, revoked bool) {
+    k.mu.Lock()
+    defer k.mu.Unlock()
+
+    if revoked {
+        k.revoked[nodeID] = true
+    } else {
+        delete(k.revoked, nodeID)
+    }
+}
+
+// isRevoked reports whether a node's keys have been withdrawn
+func (k *keyring) isRevoked(nodeID string) bool {
+    k.mu.RLock()
+    defer k.mu.RUnlock()
+
+    return k.revoked[nodeID]
+}
+
+// canSign reports whether a node's signing key is held here
+func (k *keyring) canSign(nodeID string) bool {
+    k.mu.RLock()
+    defer k.mu.RUnlock()
+
+    _, exists := k.private[nodeID]
+    return exists && !k.revoked[nodeID]
+}
+
+// canVerify reports whether a node's public key is known
+func (k *keyring) canVerify(nodeID string) bool {
+    k.mu.RLock()
+    defer k.mu.RUnlock()
+
+    _, exists := k.public[nodeID]
+    return exists && !k.revoked[nodeID]
+}
+
+// sign signs m with the key of the node it is from
+func (k *keyring) sign(m *Message) error {
+    k.mu.RLock()
+    key, exists := k.private[m.From]
+    revoked := k.revoked[m.From]
+    k.mu.RUnlock()
+
+    if revoked {
+        return fmt.Errorf("%w: %s", ErrNodeRevoked, m.From)
+    }
+    if !exists {
+        return fmt.Errorf("%w: %s", ErrNoNodeKey, m.From)
+    }
+    data := signingBytes(*m)
+    var err error
+    if _, ok := key.Public().(ed25519.PublicKey); ok {
+        m.Signature, err = key.Sign(rand.Reader, data, crypto.Hash(0))
+    } else {
+        digest := sha256.Sum256(data)
+        m.Signature, err = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+    }
+    if err != nil {
+        return fmt.Errorf("failed to sign %s from %s: %v", m.Type, m.From, err)
+    }
+    return nil
+}
+
+// verify checks that m was signed by the node it claims to be from
+func (k *keyring) verify(m Message) error {
+    if len(m.Signature) == 0 {
+        return fmt.Errorf("%w: %s from %s", ErrUnsigned, m.Type, m.From)
+    }
+    k.mu.RLock()
+    key, exists := k.public[m.From]
+    revoked := k.revoked[m.From]
+    k.mu.RUnlock()
+
+    if revoked {
+        return fmt.Errorf("%w: %s", ErrNodeRevoked, m.From)
+    }
+    if !exists {
+        return fmt.Errorf("%w: %s", ErrNoNodeKey, m.From)
+    }
+    valid := false
+    switch key := key.(type) {
+    case ed25519.PublicKey:
+        valid = ed25519.Verify(key, signingBytes(m), m.Signature)
+    case *ecdsa.PublicKey:
+        digest := sha256.Sum256(signingBytes(m))
+        valid = ecdsa.VerifyASN1(key, digest[:], m.Signature)
+    }
+    if !valid {
+        return fmt.Errorf("%w: %s from %s", ErrBadSignature, m.Type, m.From)
+    }
+    return nil
+}
+
+// samePublicKey reports whether two public keys are equal
+func samePublicKey(a, b crypto.PublicKey) bool {
+    key, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+    return ok && key.Equal(b)
+}
+
+// signingBytes returns what a message's signature covers: every field but
+// the signature. BFT messages are broadcast and embedded in certificates
+// shown to other members, so their recipient is left out too; every other
+// message is bound to the node it was sent to.
+func signingBytes(m Message) []byte {
+    m.Signature = nil
+    if m.Type.isBFT() {
+        m.To = ""
+    }
+    // Messages hold nothing encoding/json cannot encode
+    data, _ := json.Marshal(m)
+    return data
+}
+
+// SetNodeKey records the signing key of a node hosted in this process, an
+// Ed25519 or ECDSA key, which it signs every message it sends with. It must
+// be set before the node is registered.
+func (l *LHRaftConsensus) SetNodeKey(nodeID string, key crypto.Signer) error {
+    return l.keys.setPrivate(nodeID, key)
+}
+
+// RequireSignedMessages sets whether every consensus message must be signed
+// by its sender, which it is by default: nodes hosted here sign what they
+// send and drop messages from nodes whose key is unknown, see SetNodeKey and
+// SyncNodeRecord. Turning it off lets nodes without keys run, as in tests;
+// signatures present are still checked. Messages from revoked nodes are
+// always dropped, and BFT zones always sign.
+func (l *LHRaftConsensus) RequireSignedMessages(required bool) {
+    l.transport.setAuthentication(required)
+}
+
+// SetNodePublicKey records the key a node's messages are checked against.
+// SyncNodeRecord sets it from the key the node's device registered on the
+// ledger.
+func (l *LHRaftConsensus) SetNodePublicKey(nodeID string, key crypto.PublicKey) error {
+    return l.keys.setPublic(nodeID, key)
+}
@@ -0,0 +1,223 @@
+package consensus
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/x509"
+    "encoding/pem"
+    "errors"
+    "testing"
+)
+
+// newDeviceKey creates an ECDSA key like those devices register on the
+// ledger, and its PEM encoded public half
+func newDeviceKey(t *testing.T) (*ecdsa.PrivateKey, string) {
+    t.Helper()
+
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatalf("GenerateKey: %v", err)
+    }
+    der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+    if err != nil {
+        t.Fatalf("MarshalPKIXPublicKey: %v", err)
+    }
+    return key, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func TestKeyringChecksSender(t *testing.T) {
+    key, _ := newDeviceKey(t)
+    keys := newKeyring()
+    if err := keys.setPrivate("n1", key); err != nil {
+        t.Fatalf("setPrivate: %v", err)
+    }
+
+    m := Message{Type: MsgAppendEntries, Group: "Z1", From: "n1", To: "n2", Term: 3}
+    if err := keys.verify(m); !errors.Is(err, ErrUnsigned) {
+        t.Errorf("unsigned message = %v, want ErrUnsigned", err)
+    }
+    if err := keys.sign(&m); err != nil {
+        t.Fatalf("sign: %v", err)
+    }
+    if err := keys.verify(m); err != nil {
+        t.Errorf("signed message: %v", err)
+    }
+
+    // Raft messages are bound to their recipient, so they cannot be replayed
+    // to another node
+    redirected := m
+    redirected.To = "n3"
+    if err := keys.verify(redirected); !errors.Is(err, ErrBadSignature) {
+        t.Errorf("redirected message = %v, want ErrBadSignature", err)
+    }
+    impostor := m
+    impostor.From = "n9"
+    if err := keys.verify(impostor); !errors.Is(err, ErrNoNodeKey) {
+        t.Errorf("message from an unknown node = %v, want ErrNoNodeKey", err)
+    }
+
+    keys.setRevoked("n1", true)
+    if err := keys.verify(m); !errors.Is(err, ErrNodeRevoked) {
+        t.Errorf("message from a revoked node = %v, want ErrNodeRevoked", err)
+    }
+    if err := keys.sign(&m); !errors.Is(err, ErrNodeRevoked) {
+        t.Errorf("signing as a revoked node = %v, want ErrNodeRevoked", err)
+    }
+
+    other, _ := newDeviceKey(t)
+    if err := keys.setPublic("n1", &other.PublicKey); err == nil {
+        t.Error("public key that does not match the signing key held accepted")
+    }
+}
+
+func TestSignedZoneDropsUnknownAndRevokedNodes(t *testing.T) {
+    members := []string{"n1", "n2", "n3"}
+    l := newTestConsensus(t, members)
+    defer l.Stop()
+    sm := newTestStateMachine()
+    l.SetApplyFunc(sm.apply)
+    l.RequireSignedMessages(true)
+
+    deviceKeys := make(map[string]*ecdsa.PrivateKey)
+    for _, id := range members {
+        key, publicKeyPEM := newDeviceKey(t)
+        deviceKeys[id] = key
+        if err := l.SetNodeKey(id, key); err != nil {
+            t.Fatalf("SetNodeKey(%s): %v", id, err)
+        }
+        if err := l.RegisterNode(id, "Z1", 0.9); err != nil {
+            t.Fatalf("RegisterNode(%s): %v", id, err)
+        }
+        if err := l.SyncNodeRecord(id, LedgerRecord{PublicKey: publicKeyPEM}); err != nil {
+            t.Fatalf("SyncNodeRecord(%s): %v", id, err)
+        }
+    }
+    if _, err := l.ElectZoneLeader("Z1"); err != nil {
+        t.Fatalf("ElectZoneLeader: %v", err)
+    }
+    if err := l.PropagateTransaction([]byte("tx1"), "Z1"); err != nil {
+        t.Fatalf("PropagateTransaction: %v", err)
+    }
+    for _, id := range members {
+        sm.waitFor(t, id, "tx1")
+    }
+
+    // A ledger record cannot rebind a key other than the one the node signs with
+    _, otherPEM := newDeviceKey(t)
+    if err := l.SyncNodeRecord("n1", LedgerRecord{PublicKey: otherPEM}); err == nil {
+        t.Error("ledger record with another key accepted for a node hosted here")
+    }
+
+    l.mu.RLock()
+    leaderID := l.ZoneLeaders["Z1"]
+    l.mu.RUnlock()
+    follower := l.groups["Z1"].replicas[members[0]]
+    if follower.ID() == leaderID {
+        follower = l.groups["Z1"].replicas[members[1]]
+    }
+    term := follower.Status().Term
+    deliver := func(m Message) {
+        m.Group, m.To = "Z1", follower.ID()
+        l.transport.deliver(follower.ID(), m)
+    }
+    checkTerm := func(what string) {
+        t.Helper()
+        if got := follower.Status().Term; got != term {
+            t.Errorf("%s moved %s to term %d from %d", what, follower.ID(), got, term)
+        }
+    }
+
+    // A process claiming to be the leader without its key is not heard
+    deliver(Message{Type: MsgAppendEntries, From: leaderID, Term: term + 5})
+    checkTerm("unsigned AppendEntries")
+    outsider, _ := newDeviceKey(t)
+    forged := newKeyring()
+    forged.setPrivate("n9", outsider)
+    m := Message{Type: MsgAppendEntries, Group: "Z1", From: "n9", To: follower.ID(), Term: term + 5}
+    forged.sign(&m)
+    deliver(m)
+    checkTerm("AppendEntries from an unknown node")
+
+    // Nor is a member once its device is revoked, even with its own key
+    var revoked string
+    for _, id := range members {
+        if id != leaderID && id != follower.ID() {
+            revoked = id
+        }
+    }
+    if err := l.SyncNodeRecord(revoked, LedgerRecord{Revoked: true}); err != nil {
+        t.Fatalf("SyncNodeRecord: %v", err)
+    }
+    stolen := newKeyring()
+    stolen.setPrivate(revoked, deviceKeys[revoked])
+    m = Message{Type: MsgAppendEntries, Group: "Z1", From: revoked, To: follower.ID(), Term: term + 5}
+    stolen.sign(&m)
+    deliver(m)
+    checkTerm("AppendEntries from a revoked node")
+
+    // The rest of the zone still commits
+    if err := l.PropagateTransaction([]byte("tx2"), "Z1"); err != nil {
+        t.Fatalf("PropagateTransaction after revocation: %v", err)
+    }
+    sm.waitFor(t, leaderID, "tx1", "tx2")
+    sm.waitFor(t, follower.ID(), "tx1", "tx2")
+}
+
+func TestUnsignedZoneStillChecksSignatures(t *testing.T) {
+    members := []string{"n1", "n2", "n3"}
+    l := newTestConsensus(t, members, withFastTiming(), withRegisteredMembers(), withElectedLeaders())
+    for _, id := range members {
+        if err := l.SetNodePublicKey(id, testKey(id).Public()); err != nil {
+            t.Fatalf("SetNodePublicKey(%s): %v", id, err)
+        }
+    }
+
+    l.mu.RLock()
+    leaderID := l.ZoneLeaders["Z1"]
+    l.mu.RUnlock()
+    var follower, other string
+    for _, id := range members {
+        switch {
+        case id == leaderID:
+        case follower == "":
+            follower = id
+        default:
+            other = id
+        }
+    }
+    replica := l.groups["Z1"].replicas[follower]
+    term := replica.Status().Term
+    checkTerm := func(what string) {
+        t.Helper()
+        if got := replica.Status().Term; got != term {
+            t.Errorf("%s moved %s to term %d from %d", what, follower, got, term)
+        }
+    }
+
+    // A signature that does not verify is never believed, even where
+    // unsigned messages are
+    m := Message{Type: MsgAppendEntries, Group: "Z1", From: other, To: follower, Term: term + 5}
+    forged := newKeyring()
+    forged.setPrivate(other, testKey("n9"))
+    forged.sign(&m)
+    l.transport.deliver(follower, m)
+    checkTerm("AppendEntries with a forged signature")
+
+    // Nor is anything from or to a revoked node
+    m = Message{Type: MsgAppendEntries, Group: "Z1", From: other, To: follower, Term: term + 5}
+    if err := l.SyncNodeRecord(other, LedgerRecord{Revoked: true}); err != nil {
+        t.Fatalf("SyncNodeRecord: %v", err)
+    }
+    l.transport.deliver(follower, m)
+    checkTerm("AppendEntries from a revoked node")
+    if err := l.SyncNodeRecord(other, LedgerRecord{}); err != nil {
+        t.Fatalf("SyncNodeRecord: %v", err)
+    }
+    if err := l.SyncNodeRecord(follower, LedgerRecord{Revoked: true}); err != nil {
+        t.Fatalf("SyncNodeRecord: %v", err)
+    }
+    m.From = leaderID
+    l.transport.deliver(follower, m)
+    checkTerm("AppendEntries to a revoked node")
+}
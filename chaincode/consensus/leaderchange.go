@@ -0,0 +1,125 @@
+package consensus
+
+import (
+    "sync"
+)
+
+// LeaderChange is published whenever a zone's leader, as reported by its
+// local replicas, changes. Leader is empty while the zone elects a new one.
+// Changes to the global group's leader carry GlobalGroupID as the ZoneID.
+type LeaderChange struct {
+    ZoneID   string
+    Previous string
+    Leader   string
+    Term     uint64
+}
+
+// leaderFeed fans leader changes out to subscribers. Each subscriber has its
+// own queue, so a slow receiver neither blocks the replica reporting the
+// change nor misses one.
+type leaderFeed struct {
+    subscribers map[*leaderSubscription]struct{}
+    mu          sync.Mutex
+}
+
+// leaderSubscription delivers queued changes to one subscriber in order
+type leaderSubscription struct {
+    queue  []LeaderChange
+    signal chan struct{}
+    done   chan struct{}
+    out    chan LeaderChange
+    mu     sync.Mutex
+}
+
+// subscribe starts a subscription and returns its channel and the function
+// that ends it
+func (f *leaderFeed) subscribe() (<-chan LeaderChange, func()) {
+    s := &leaderSubscription{
+        signal: make(chan struct{}, 1),
+        done:   make(chan struct{}),
+        out:    make(chan LeaderChange),
+    }
+
+    f.mu.Lock()
+    if f.subscribers == nil {
+        f.subscribers = make(map[*leaderSubscription]struct{})
+    }
+    f.subscribers[s] = struct{}{}
+    f.mu.Unlock()
+
+    go s.deliver()
+    return s.out, func() { f.unsubscribe(s) }
+}
+
+func (f *leaderFeed) unsubscribe(s *leaderSubscription) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    if _, exists := f.subscribers[s]; exists {
+        delete(f.subscribers, s)
+        close(s.done)
+    }
+}
+
+// publish queues a change for every subscriber. It never blocks.
+func (f *leaderFeed) publish(change LeaderChange) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    for s := range f.subscribers {
+        s.mu.Lock()
+        s.queue = append(s.queue, change)
+        s.mu.Unlock()
+
+        select {
+        case s.signal <- struct{}{}:
+        default:
+        }
+    }
+}
+
+// close ends every subscription
+func (f *leaderFeed) close() {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    for s := range f.subscribers {
+        delete(f.subscribers, s)
+        close(s.done)
+    }
+}
+
+// deliver sends queued changes to the subscriber until the subscription
+// ends, then closes its channel
+func (s *leaderSubscription) deliver() {
+    defer close(s.out)
+
+    for {
+        s.mu.Lock()
+        if len(s.queue) == 0 {
+            s.mu.Unlock()
+            select {
+            case <-s.signal:
+                continue
+            case <-s.done:
+                return
+            }
+        }
+        change := s.queue[0]
+        s.queue = s.queue[1:]
+        s.mu.Unlock()
+
+        select {
+        case s.out <- change:
+        case <-s.done:
+            return
+        }
+    }
+}
+
+// SubscribeLeaderChanges returns a channel receiving every leader change
+// from now on, in the order the changes happen, and a function that ends
+// the subscription and closes the channel. Stop ends every subscription.
+func (l *LHRaftConsensus) SubscribeLeaderChanges() (<-chan LeaderChange, func()) {
+    return l.leaderChanges.subscribe()
+}
@@ -1,21 +1,99 @@
 package consensus
 
 import (
-    "time"
-    "math"
+    "context"
+    "fmt"
+    "net/url"
+    "path/filepath"
+    "sort"
     "sync"
+    "sync/atomic"
+    "time"
 )
 
+// defaultProposalTimeout bounds how long PropagateTransaction waits for a zone to commit
+const defaultProposalTimeout = 5 * time.Second
+
+// Default probation before a node may lead, matching the ledger's default
+// bootstrap policy
+const (
+    DefaultMinLeaderAge          = 7 * 24 * time.Hour
+    DefaultMinLeaderTransactions = 100
+)
+
+// LedgerRecord is the on-ledger state of a node's device that decides whether
+// it has served its probation and which key it signs messages with. AsOf is
+// the ledger time the record was read at, so every process given the same
+// record reaches the same verdict.
+type LedgerRecord struct {
+    RegisteredAt     time.Time
+    TransactionCount int
+    AsOf             time.Time
+    PublicKey        string // PEM encoded key registered for the device, empty if none
+    Revoked          bool   // The device is suspended or its key withdrawn
+}
+
+// ZoneTiming sets how quickly a zone detects a failed leader. A leader sends
+// heartbeats every HeartbeatTicks; a follower that hears nothing for between
+// ElectionTicks and twice that campaigns. Zones on high-latency rural links
+// need longer ticks or timeouts than zones on a LAN.
+type ZoneTiming struct {
+    TickInterval   time.Duration
+    HeartbeatTicks int
+    ElectionTicks  int
+}
+
+// DefaultZoneTiming is used by zones without their own timing
+var DefaultZoneTiming = ZoneTiming{
+    TickInterval:   100 * time.Millisecond,
+    HeartbeatTicks: defaultHeartbeatTicks,
+    ElectionTicks:  defaultElectionTicks,
+}
+
+// SnapshotPolicy sets when a replica snapshots its applied state and
+// compacts its log: once either many entries or many bytes have been applied
+// since the last snapshot. A zero threshold is ignored.
+type SnapshotPolicy struct {
+    MaxEntries int
+    MaxBytes   int
+}
+
+// DefaultSnapshotPolicy is used until SetSnapshotPolicy is called
+var DefaultSnapshotPolicy = SnapshotPolicy{
+    MaxEntries: 10000,
+    MaxBytes:   64 << 20,
+}
+
+// due reports whether a snapshot should be taken
+func (p SnapshotPolicy) due(entries, bytes int) bool {
+    return (p.MaxEntries > 0 && entries >= p.MaxEntries) || (p.MaxBytes > 0 && bytes >= p.MaxBytes)
+}
+
+// electionTimeout is how long a zone waits for its leader before campaigning
+func (t ZoneTiming) electionTimeout() time.Duration {
+    return time.Duration(t.ElectionTicks) * t.TickInterval
+}
+
 // ConsensusNode represents a node in the LH-Raft consensus
 type ConsensusNode struct {
-    ID            string
-    Location      string
-    Reputation    float64
-    IsLeader      bool
-    GroupMembers  []string
-    LastHeartbeat time.Time
-    State         NodeState
-    mu            sync.Mutex
+    ID               string
+    Location         string
+    Reputation       float64
+    TrustScore       float64
+    UnderDispute     bool
+    IsLeader         bool
+    IsLearner        bool     // Receives the zone's log but cannot vote or lead until promoted
+    GroupMembers     []string // Committed members of the node's zone group
+    LastHeartbeat    time.Time
+    RegisteredAt     time.Time // From the device's ledger record, see SyncNodeRecord
+    TransactionCount int
+    LedgerTime       time.Time // Ledger time RegisteredAt and TransactionCount were read at
+    Remote           bool      // Hosted by another process; no local replica
+    Latitude         float64
+    Longitude        float64
+    Positioned       bool // Whether Latitude and Longitude are known, see SetNodePosition
+    State            NodeState
+    mu               sync.Mutex
 }
 
 // NodeState represents the state of a node in the consensus
@@ -25,138 +103,775 @@ const (
     Follower NodeState = iota
     Candidate
     Leader
+    PreCandidate // Asking whether it could win an election before starting one
+)
+
+// RankingMetric selects which score orders candidates during leader election
+type RankingMetric int
+
+const (
+    RankByReputation RankingMetric = iota
+    RankByTrust
 )
 
 // LHRaftConsensus is the main consensus structure
 type LHRaftConsensus struct {
-    Nodes         map[string]*ConsensusNode
-    Threshold     float64
-    ZoneLeaders   map[string]string  // ZoneID -> LeaderID
-    mu            sync.RWMutex
+    Nodes                 map[string]*ConsensusNode
+    Threshold             float64
+    Ranking               RankingMetric
+    MinLeaderAge          time.Duration     // Probation before a new node may lead
+    MinLeaderTransactions int               // Transactions a node must process before it may lead
+    ZoneLeaders           map[string]string // ZoneID -> LeaderID
+    GlobalLeader          string            // Leader of the global group, if one is known
+    ProposalTimeout       time.Duration
+    zoneTimings           map[string]ZoneTiming // ZoneID -> timing, if not the default
+    initialClusters       map[string][]string   // ZoneID -> members the zone's group starts with
+    dataDir               string                // Where local replicas keep their WALs; empty keeps them in memory
+    snapshotPolicy        SnapshotPolicy
+    readPolicy            ReadPolicy
+    groups                map[string]*zoneGroup // ZoneID -> replication group, GlobalGroupID included
+    zoneModes             map[string]ZoneMode   // ZoneID -> protocol, if not Raft
+    bftGroups             map[string]*bftGroup  // ZoneID -> group, for zones in ZoneBFT mode
+    keys                  *keyring              // Keys the nodes sign and check messages with
+    mergedZones           map[string]string     // ZoneID -> zone it merged into, see MergeZones
+    global                *globalTier           // Nil until SetGlobalCluster is called
+    transport             *groupMux
+    leaderChanges         leaderFeed
+    leaderWeights         LeaderWeights
+    latencies             map[string]map[string]time.Duration
+    apply                 atomic.Value // ApplyFunc
+    snapshot              atomic.Value // SnapshotFunc
+    restore               atomic.Value // RestoreFunc
+    mu                    sync.RWMutex
 }
 
-// NewLHRaftConsensus creates a new instance of the consensus
+// NewLHRaftConsensus creates a new instance of the consensus whose nodes all
+// run in this process
 func NewLHRaftConsensus(threshold float64) *LHRaftConsensus {
+    return NewLHRaftConsensusWithTransport(threshold, NewInMemoryTransport())
+}
+
+// NewLHRaftConsensusWithTransport creates a new instance of the consensus whose
+// nodes exchange messages over the given transport
+func NewLHRaftConsensusWithTransport(threshold float64, transport Transport) *LHRaftConsensus {
+    keys := newKeyring()
     return &LHRaftConsensus{
-        Nodes:       make(map[string]*ConsensusNode),
-        Threshold:   threshold,
-        ZoneLeaders: make(map[string]string),
+        Nodes:                 make(map[string]*ConsensusNode),
+        Threshold:             threshold,
+        MinLeaderAge:          DefaultMinLeaderAge,
+        MinLeaderTransactions: DefaultMinLeaderTransactions,
+        ZoneLeaders:           make(map[string]string),
+        ProposalTimeout:       defaultProposalTimeout,
+        zoneTimings:           make(map[string]ZoneTiming),
+        initialClusters:       make(map[string][]string),
+        snapshotPolicy:        DefaultSnapshotPolicy,
+        readPolicy:            DefaultReadPolicy,
+        leaderWeights:         DefaultLeaderWeights,
+        latencies:             make(map[string]map[string]time.Duration),
+        groups:                make(map[string]*zoneGroup),
+        zoneModes:             make(map[string]ZoneMode),
+        bftGroups:             make(map[string]*bftGroup),
+        keys:                  keys,
+        mergedZones:           make(map[string]string),
+        transport:             newGroupMux(transport, keys),
     }
 }
 
-// RegisterNode adds a new node to the consensus
-func (l *LHRaftConsensus) RegisterNode(id, location string, reputation float64) error {
+// SetApplyFunc registers the state machine committed entries are applied to.
+// It is called from the replica's goroutine and must not block on the
+// consensus.
+func (l *LHRaftConsensus) SetApplyFunc(apply ApplyFunc) {
+    l.apply.Store(apply)
+}
+
+// applyEntry hands a committed entry to the registered state machine. The
+// global group's cross-zone records are kept by its coordinator instead, and
+// zone changes are followed by the consensus before the state machine sees
+// them.
+func (l *LHRaftConsensus) applyEntry(zoneID, nodeID string, entry LogEntry) {
+    if zoneID == GlobalGroupID && entry.Type == EntryCrossZone {
+        l.applyCoordinatorRecord(nodeID, entry)
+        return
+    }
+    if entry.Type == EntryZoneChange {
+        l.applyZoneChange(nodeID, entry)
+    }
+    if apply, ok := l.apply.Load().(ApplyFunc); ok && apply != nil {
+        apply(zoneID, nodeID, entry)
+    }
+}
+
+// SetSnapshotFuncs registers how the state machine is captured in snapshots
+// and restored from them. Without them zone logs are never compacted. Like
+// the apply function they are called from replica goroutines.
+func (l *LHRaftConsensus) SetSnapshotFuncs(snapshot SnapshotFunc, restore RestoreFunc) {
+    l.snapshot.Store(snapshot)
+    l.restore.Store(restore)
+}
+
+// snapshotState captures a node's applied state with the registered function
+func (l *LHRaftConsensus) snapshotState(zoneID, nodeID string) ([]byte, error) {
+    snapshot, ok := l.snapshot.Load().(SnapshotFunc)
+    if !ok || snapshot == nil {
+        return nil, fmt.Errorf("no snapshot function registered")
+    }
+    return snapshot(zoneID, nodeID)
+}
+
+// restoreState loads a snapshot into a node's state with the registered function
+func (l *LHRaftConsensus) restoreState(zoneID, nodeID string, data []byte) error {
+    restore, ok := l.restore.Load().(RestoreFunc)
+    if !ok || restore == nil {
+        return fmt.Errorf("no restore function registered")
+    }
+    return restore(zoneID, nodeID, data)
+}
+
+// SetSnapshotPolicy sets when every zone snapshots and compacts its log
+func (l *LHRaftConsensus) SetSnapshotPolicy(policy SnapshotPolicy) {
+    l.mu.Lock()
+    l.snapshotPolicy = policy
+    l.mu.Unlock()
+
+    for _, group := range l.zoneGroups() {
+        group.setSnapshotPolicy(policy)
+    }
+}
+
+// Stop shuts down every replica hosted by this process and ends every
+// subscription to leader changes
+func (l *LHRaftConsensus) Stop() {
+    l.mu.RLock()
+    global := l.global
+    l.mu.RUnlock()
+
+    if global != nil {
+        global.stop()
+    }
+    for _, group := range l.zoneGroups() {
+        group.stop()
+    }
+    l.mu.RLock()
+    bftGroups := make([]*bftGroup, 0, len(l.bftGroups))
+    for _, group := range l.bftGroups {
+        bftGroups = append(bftGroups, group)
+    }
+    l.mu.RUnlock()
+    for _, group := range bftGroups {
+        group.stop()
+    }
+    l.leaderChanges.close()
+}
+
+// zoneGroups returns every zone group. Replicas call back into the consensus
+// while locked, so groups are only called once l.mu is released.
+func (l *LHRaftConsensus) zoneGroups() []*zoneGroup {
+    l.mu.RLock()
+    defer l.mu.RUnlock()
+
+    groups := make([]*zoneGroup, 0, len(l.groups))
+    for _, group := range l.groups {
+        groups = append(groups, group)
+    }
+    return groups
+}
+
+// SetInitialCluster sets the voters a zone's group starts with. It must be
+// called before any node of the zone is registered, with the same members in
+// every process hosting the zone, so that no process can form a quorum on
+// its own. Nodes outside the initial cluster join as learners through the
+// zone's log once it has a leader.
+func (l *LHRaftConsensus) SetInitialCluster(zoneID string, nodeIDs []string) error {
+    if zoneID == GlobalGroupID {
+        return fmt.Errorf("zone ID %s is reserved for the global group", zoneID)
+    }
+    if len(nodeIDs) == 0 {
+        return fmt.Errorf("initial cluster of zone %s is empty", zoneID)
+    }
+    seen := make(map[string]bool)
+    for _, id := range nodeIDs {
+        if seen[id] {
+            return fmt.Errorf("node %s listed twice in the initial cluster of zone %s", id, zoneID)
+        }
+        seen[id] = true
+    }
+
     l.mu.Lock()
     defer l.mu.Unlock()
 
+    if l.groups[zoneID] != nil || l.bftGroups[zoneID] != nil {
+        return fmt.Errorf("zone %s already has a consensus group", zoneID)
+    }
+    l.initialClusters[zoneID] = append([]string{}, nodeIDs...)
+    return nil
+}
+
+// RegisterNode adds a new node, hosted by this process, to the consensus.
+// Its signing key must be set first unless signed messages are not required.
+func (l *LHRaftConsensus) RegisterNode(id, location string, reputation float64) error {
+    return l.registerNode(id, location, reputation, false)
+}
+
+// RegisterRemoteNode adds a node hosted by another process. It joins its zone
+// group so that quorums account for it, but runs no replica here.
+func (l *LHRaftConsensus) RegisterRemoteNode(id, location string, reputation float64) error {
+    return l.registerNode(id, location, reputation, true)
+}
+
+func (l *LHRaftConsensus) registerNode(id, location string, reputation float64, remote bool) error {
+    l.mu.Lock()
+    if _, exists := l.Nodes[id]; exists {
+        l.mu.Unlock()
+        return fmt.Errorf("node already registered: %s", id)
+    }
+    initialCluster, configured := l.initialClusters[location]
+    if !configured {
+        l.mu.Unlock()
+        return fmt.Errorf("zone %s has no initial cluster; call SetInitialCluster first", location)
+    }
+    if !remote && l.transport.authenticating() && !l.keys.canSign(id) {
+        l.mu.Unlock()
+        return fmt.Errorf("%w: %s; call SetNodeKey first", ErrNoNodeKey, id)
+    }
     node := &ConsensusNode{
         ID:           id,
         Location:     location,
         Reputation:   reputation,
         IsLeader:     false,
         GroupMembers: make([]string, 0),
+        Remote:       remote,
         State:       Follower,
     }
-
     l.Nodes[id] = node
+
+    var join func() error
+    if l.zoneModes[location] == ZoneBFT {
+        group, exists := l.bftGroups[location]
+        if !exists {
+            group = l.newBFTZone(location, initialCluster)
+        }
+        join = func() error { return group.addMember(id, !remote) }
+    } else {
+        group, exists := l.groups[location]
+        if !exists {
+            group = l.newGroup(location, initialCluster)
+        }
+        timeout := l.ProposalTimeout
+        join = func() error {
+            ctx, cancel := context.WithTimeout(context.Background(), timeout)
+            defer cancel()
+            return group.addMember(ctx, id, !remote)
+        }
+    }
+    l.mu.Unlock()
+
+    if err := join(); err != nil {
+        l.mu.Lock()
+        delete(l.Nodes, id)
+        l.mu.Unlock()
+        return fmt.Errorf("failed to add node %s to zone %s: %v", id, location, err)
+    }
+
+    l.mu.RLock()
+    global := l.global
+    l.mu.RUnlock()
+
+    if global != nil && !remote && global.group.view().isMember(id) {
+        // The node holds a seat in the global group
+        if err := global.group.host(id); err != nil {
+            return fmt.Errorf("failed to seat node %s in the global group: %v", id, err)
+        }
+    }
     return nil
 }
 
-// FormCandidateGroups creates location-based consensus groups
-func (l *LHRaftConsensus) FormCandidateGroups(location string) []string {
+// newGroup creates the group of a zone from its initial cluster. Callers hold l.mu.
+func (l *LHRaftConsensus) newGroup(zoneID string, initialCluster []string) *zoneGroup {
+    group := newZoneGroup(zoneID, initialCluster, l.transport.group(zoneID), groupConfig{
+        apply:       l.applyEntry,
+        snapshot:    l.snapshotState,
+        restore:     l.restoreState,
+        policy:      l.snapshotPolicy,
+        reads:       l.readPolicy,
+        eligible:    l.canVoteFor,
+        onLeader:    l.observeLeader,
+        onHeartbeat: l.observeHeartbeat,
+        onLatency:   l.observeLatency,
+        timing:      l.zoneTiming(zoneID),
+        storage:     l.openStorage,
+
+        onMembership: l.observeMembership,
+    })
+    l.groups[zoneID] = group
+    return group
+}
+
+// PromoteNode makes a learner that has caught up with its zone a voter
+func (l *LHRaftConsensus) PromoteNode(nodeID string) error {
+    group, timeout, err := l.nodeGroup(nodeID)
+    if err != nil {
+        return err
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    return group.promoteMember(ctx, nodeID)
+}
+
+// RemoveNode takes a node out of its zone group and the consensus. The
+// removal is committed through the zone's log; a removed leader steps down.
+func (l *LHRaftConsensus) RemoveNode(nodeID string) error {
+    group, timeout, err := l.nodeGroup(nodeID)
+    if err != nil {
+        return err
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    if err := group.removeMember(ctx, nodeID); err != nil {
+        return fmt.Errorf("failed to remove node %s: %v", nodeID, err)
+    }
+
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    delete(l.Nodes, nodeID)
+    return nil
+}
+
+// nodeGroup returns the zone group of a node and the proposal timeout
+func (l *LHRaftConsensus) nodeGroup(nodeID string) (*zoneGroup, time.Duration, error) {
     l.mu.RLock()
     defer l.mu.RUnlock()
 
-    candidates := make([]string, 0)
+    node, exists := l.Nodes[nodeID]
+    if !exists {
+        return nil, 0, fmt.Errorf("node not found: %s", nodeID)
+    }
+    group, exists := l.groups[node.Location]
+    if !exists {
+        return nil, 0, fmt.Errorf("no consensus group for zone: %s", node.Location)
+    }
+    return group, l.ProposalTimeout, nil
+}
+
+// observeMembership records a zone group's committed membership on its nodes
+func (l *LHRaftConsensus) observeMembership(zoneID string, membership Membership) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    members := membership.members()
     for id, node := range l.Nodes {
-        if node.Location == location && node.Reputation >= l.Threshold {
-            candidates = append(candidates, id)
+        if node.Location != zoneID {
+            continue
         }
+        if membership.isMember(id) {
+            node.GroupMembers = members
+        } else {
+            node.GroupMembers = make([]string, 0)
+        }
+        node.IsLearner = membership.isLearner(id)
     }
-    return candidates
 }
 
-// ElectZoneLeader implements the leader election for a specific zone
-func (l *LHRaftConsensus) ElectZoneLeader(zoneID string) (string, error) {
+// SetDataDir makes nodes registered from now on persist their Raft log and
+// votes in write-ahead logs under dir. Re-registering a node after a restart
+// recovers its state and replays its committed entries.
+func (l *LHRaftConsensus) SetDataDir(dir string) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    l.dataDir = dir
+}
+
+// openStorage opens the WAL of a local replica, or returns nil storage when
+// no data directory is set
+func (l *LHRaftConsensus) openStorage(zoneID, nodeID string) (Storage, error) {
+    l.mu.RLock()
+    dir := l.dataDir
+    l.mu.RUnlock()
+
+    if dir == "" {
+        return nil, nil
+    }
+    return NewFileStorage(filepath.Join(dir, url.PathEscape(zoneID), url.PathEscape(nodeID)+".wal"))
+}
+
+// SetZoneTiming configures the heartbeat interval and election timeout of a zone
+func (l *LHRaftConsensus) SetZoneTiming(zoneID string, timing ZoneTiming) error {
+    if timing.TickInterval <= 0 || timing.HeartbeatTicks <= 0 {
+        return fmt.Errorf("tick interval and heartbeat ticks must be positive")
+    }
+    if timing.ElectionTicks <= timing.HeartbeatTicks {
+        return fmt.Errorf("election timeout must exceed the heartbeat interval")
+    }
+
+    l.mu.Lock()
+    l.zoneTimings[zoneID] = timing
+    group, bft := l.groups[zoneID], l.bftGroups[zoneID]
+    l.mu.Unlock()
+
+    if group != nil {
+        group.setTiming(timing)
+    }
+    if bft != nil {
+        bft.setTiming(timing)
+    }
+    return nil
+}
+
+// zoneTiming returns the timing of a zone. Callers hold l.mu.
+func (l *LHRaftConsensus) zoneTiming(zoneID string) ZoneTiming {
+    if timing, exists := l.zoneTimings[zoneID]; exists {
+        return timing
+    }
+    return DefaultZoneTiming
+}
+
+// observeHeartbeat records that a node was heard from
+func (l *LHRaftConsensus) observeHeartbeat(nodeID string, at time.Time) {
     l.mu.Lock()
     defer l.mu.Unlock()
 
-    var bestCandidate string
-    var highestRep float64 = -1
+    if node, exists := l.Nodes[nodeID]; exists && at.After(node.LastHeartbeat) {
+        node.LastHeartbeat = at
+    }
+}
+
+// SilentNodes returns the nodes of a zone not heard from within the zone's
+// election timeout, which are presumed to have failed
+func (l *LHRaftConsensus) SilentNodes(zoneID string) []string {
+    l.mu.RLock()
+    defer l.mu.RUnlock()
 
-    // Find the node with highest reputation in the zone
+    deadline := time.Now().Add(-l.zoneTiming(zoneID).electionTimeout())
+    silent := make([]string, 0)
     for id, node := range l.Nodes {
-        if node.Location == zoneID && node.Reputation > highestRep {
-            highestRep = node.Reputation
-            bestCandidate = id
+        if node.Location == zoneID && node.LastHeartbeat.Before(deadline) {
+            silent = append(silent, id)
         }
     }
+    sort.Strings(silent)
+    return silent
+}
+
+// SetRankingMetric chooses whether candidates are ranked by reputation or trust score
+func (l *LHRaftConsensus) SetRankingMetric(metric RankingMetric) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    l.Ranking = metric
+}
+
+// UpdateNodeTrustScore records the global trust score computed on the ledger for a node
+func (l *LHRaftConsensus) UpdateNodeTrustScore(nodeID string, trustScore float64) error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    node, exists := l.Nodes[nodeID]
+    if !exists {
+        return fmt.Errorf("node not found: %s", nodeID)
+    }
+    node.TrustScore = trustScore
+    return nil
+}
 
-    if bestCandidate != "" {
-        l.ZoneLeaders[zoneID] = bestCandidate
-        l.Nodes[bestCandidate].IsLeader = true
-        l.Nodes[bestCandidate].State = Leader
+// SetNodeDisputed flags a node whose reputation is under dispute on the ledger.
+// Disputed nodes cannot lead; a disputed leader hosted here hands leadership
+// to the best eligible node before SetNodeDisputed returns, or steps down
+// if there is none, leaving the zone leaderless until one becomes eligible.
+func (l *LHRaftConsensus) SetNodeDisputed(nodeID string, disputed bool) error {
+    l.mu.Lock()
+    node, exists := l.Nodes[nodeID]
+    if !exists {
+        l.mu.Unlock()
+        return fmt.Errorf("node not found: %s", nodeID)
     }
+    node.UnderDispute = disputed
+    zoneID := node.Location
+    leading := disputed && l.ZoneLeaders[zoneID] == nodeID
+    group := l.groups[zoneID]
+    l.mu.Unlock()
 
-    return bestCandidate, nil
+    if !leading || group == nil {
+        return nil
+    }
+    leaderID, err := l.ElectZoneLeader(zoneID)
+    if err != nil {
+        return err
+    }
+    if leaderID == "" {
+        group.stepDown(nodeID)
+    }
+    return nil
 }
 
-// UpdateNodeReputation updates a node's reputation and triggers re-election if needed
-func (l *LHRaftConsensus) UpdateNodeReputation(nodeID string, newReputation float64) error {
+// SetLeadershipRequirements sets the probation new nodes serve before they
+// may lead. It should match the ledger's bootstrap policy.
+func (l *LHRaftConsensus) SetLeadershipRequirements(minAge time.Duration, minTransactions int) {
     l.mu.Lock()
     defer l.mu.Unlock()
 
-    if node, exists := l.Nodes[nodeID]; exists {
-        oldRep := node.Reputation
-        node.Reputation = newReputation
+    l.MinLeaderAge = minAge
+    l.MinLeaderTransactions = minTransactions
+}
+
+// SyncNodeRecord updates a node's probation and key from its device's ledger
+// record. Until it is synced a node has no recorded transactions and cannot
+// lead while any are required. Messages from a revoked node are dropped.
+func (l *LHRaftConsensus) SyncNodeRecord(nodeID string, record LedgerRecord) error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    node, exists := l.Nodes[nodeID]
+    if !exists {
+        return fmt.Errorf("node not found: %s", nodeID)
+    }
+    if record.PublicKey != "" {
+        key, err := ParseNodePublicKey(record.PublicKey)
+        if err != nil {
+            return fmt.Errorf("ledger record of node %s: %v", nodeID, err)
+        }
+        if err := l.keys.setPublic(nodeID, key); err != nil {
+            return err
+        }
+    }
+    l.keys.setRevoked(nodeID, record.Revoked)
+    node.RegisteredAt = record.RegisteredAt
+    node.TransactionCount = record.TransactionCount
+    node.LedgerTime = record.AsOf
+    return nil
+}
+
+// canLead reports whether a node is eligible for zone leadership. Age is
+// measured in ledger time, not this process's clock, so every process
+// agrees.
+func (l *LHRaftConsensus) canLead(node *ConsensusNode) bool {
+    if node.UnderDispute {
+        return false
+    }
+    return node.LedgerTime.Sub(node.RegisteredAt) >= l.MinLeaderAge && node.TransactionCount >= l.MinLeaderTransactions
+}
+
+// canVoteFor reports whether a node's reputation qualifies it to lead its
+// zone. Replicas grant votes only to such candidates.
+func (l *LHRaftConsensus) canVoteFor(nodeID string) bool {
+    l.mu.RLock()
+    defer l.mu.RUnlock()
+
+    node, exists := l.Nodes[nodeID]
+    return exists && node.Reputation >= l.Threshold && l.canLead(node)
+}
+
+// rankScore returns the score a node is ranked by under the current metric
+func (l *LHRaftConsensus) rankScore(node *ConsensusNode) float64 {
+    if l.Ranking == RankByTrust {
+        return node.TrustScore
+    }
+    return node.Reputation
+}
+
+// FormCandidateGroups creates location-based consensus groups, best scored
+// first. It matches Location labels exactly; FormGeoCandidateGroups groups
+// nodes by position instead.
+func (l *LHRaftConsensus) FormCandidateGroups(location string) []string {
+    l.mu.RLock()
+    defer l.mu.RUnlock()
+
+    candidates := make([]string, 0)
+    for _, score := range l.candidateScores(location) {
+        candidates = append(candidates, score.NodeID)
+    }
+    return candidates
+}
+
+// ElectZoneLeader has the best scored eligible node hosted in this process
+// campaign for leadership of the zone, and returns the leader the zone's
+// members elect. The leader is only established once a majority of the zone
+// votes for it in a new term. A BFT zone holds no election; its leader is the
+// primary of its current view.
+func (l *LHRaftConsensus) ElectZoneLeader(zoneID string) (string, error) {
+    l.mu.RLock()
+    group, bft := l.groups[zoneID], l.bftGroups[zoneID]
+    timeout := l.ProposalTimeout
+    l.mu.RUnlock()
+
+    if bft != nil {
+        return l.electPrimary(bft)
+    }
+    if group == nil {
+        return "", fmt.Errorf("no consensus group for zone: %s", zoneID)
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+
+    for {
+        // A sitting leader that is still the best candidate keeps its seat,
+        // wherever it is hosted; campaigning would only disrupt the zone
+        leaderID, term := group.leader()
+        bestCandidate := l.bestCandidate(zoneID, leaderID)
+        if bestCandidate == "" {
+            return "", nil
+        }
+        if leaderID == bestCandidate {
+            return leaderID, nil
+        }
+
+        campaigned, err := group.campaign(ctx, bestCandidate)
+        if err != nil {
+            return "", err
+        }
+        if !campaigned {
+            // The candidate became ineligible since it was chosen; choose again
+            select {
+            case <-time.After(proposalRetryInterval):
+                continue
+            case <-ctx.Done():
+                return "", fmt.Errorf("no leader elected in zone: %s: %v", zoneID, ctx.Err())
+            }
+        }
+        leaderID, _, err = group.waitForLeader(ctx, term)
+        if err != nil {
+            return "", fmt.Errorf("no leader elected in zone: %s: %v", zoneID, err)
+        }
+        return leaderID, nil
+    }
+}
+
+// bestCandidate returns the best scored eligible voter of the zone hosted in
+// this process, if there is one. Candidates are ranked among all members of
+// the zone, so the sitting leader is returned instead if it outranks them,
+// even when another process hosts it.
+func (l *LHRaftConsensus) bestCandidate(zoneID, leaderID string) string {
+    l.mu.RLock()
+    defer l.mu.RUnlock()
 
-        // If this is a leader and reputation dropped below threshold
-        if node.IsLeader && newReputation < l.Threshold {
-            node.IsLeader = false
+    for _, score := range l.candidateScores(zoneID) {
+        node := l.Nodes[score.NodeID]
+        if node.IsLearner {
+            continue
+        }
+        if node.ID == leaderID || !node.Remote {
+            return score.NodeID
+        }
+    }
+    return ""
+}
+
+// observeLeader records a zone's leader as reported by its local replicas.
+// The zone's leader and every member's leadership flags change together
+// under l.mu, and the change is published to SubscribeLeaderChanges.
+func (l *LHRaftConsensus) observeLeader(zoneID, leaderID string, term uint64) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    if l.groups[zoneID] == nil && l.bftGroups[zoneID] == nil {
+        // Merged into another zone; its replicas are winding down
+        return
+    }
+    previous := l.ZoneLeaders[zoneID]
+    if leaderID == "" {
+        delete(l.ZoneLeaders, zoneID)
+    } else {
+        l.ZoneLeaders[zoneID] = leaderID
+    }
+    if l.global != nil {
+        // The zone's seat in the global group follows its leader
+        l.global.wake()
+    }
+    for id, node := range l.Nodes {
+        if node.Location != zoneID {
+            continue
+        }
+        node.IsLeader = id == leaderID
+        if node.IsLeader {
+            node.State = Leader
+        } else {
             node.State = Follower
-            // Trigger re-election for the zone
-            go l.ElectZoneLeader(node.Location)
         }
+    }
+    if previous != leaderID {
+        l.leaderChanges.publish(LeaderChange{ZoneID: zoneID, Previous: previous, Leader: leaderID, Term: term})
+    }
+}
+
+// UpdateNodeReputation updates a node's reputation. A node whose reputation
+// drops below the threshold is removed from its zone group; if it was
+// leading, the zone elects a new leader. Members of BFT zones are kept.
+func (l *LHRaftConsensus) UpdateNodeReputation(nodeID string, newReputation float64) error {
+    l.mu.Lock()
+    node, exists := l.Nodes[nodeID]
+    if !exists {
+        l.mu.Unlock()
+        return fmt.Errorf("node not found: %s", nodeID)
+    }
+    node.Reputation = newReputation
+    belowThreshold := newReputation < l.Threshold
+    zoneID := node.Location
+    wasLeader := l.ZoneLeaders[zoneID] == nodeID
+    // A BFT zone keeps its members and tolerates the faulty ones
+    bft := l.zoneModes[zoneID] == ZoneBFT
+    l.mu.Unlock()
+
+    if !belowThreshold || bft {
+        return nil
+    }
+    group, _, err := l.nodeGroup(nodeID)
+    if err != nil {
+        return err
+    }
+    if view := group.view(); view.isVoter(nodeID) && len(view.Voters) == 1 {
+        // The zone's only voter stays; without it the zone could not commit
         return nil
     }
-    return fmt.Errorf("node not found: %s", nodeID)
+
+    // Hand leadership over before removing a leader, so the zone is never
+    // left waiting for an election timeout
+    if wasLeader {
+        if _, err := l.ElectZoneLeader(zoneID); err != nil {
+            return err
+        }
+    }
+    return l.RemoveNode(nodeID)
 }
 
-// PropagateTransaction handles transaction propagation in the hierarchy
+// PropagateTransaction handles transaction propagation in the hierarchy: the
+// zone commits the transaction, then forwards it upward in a batch for the
+// global group to order, when a global cluster is set
 func (l *LHRaftConsensus) PropagateTransaction(transaction []byte, zoneID string) error {
     l.mu.RLock()
-    leaderID, exists := l.ZoneLeaders[zoneID]
+    _, exists := l.ZoneLeaders[zoneID]
     l.mu.RUnlock()
 
     if !exists {
         return fmt.Errorf("no leader found for zone: %s", zoneID)
     }
 
-    // Simulate local consensus
-    success := l.achieveLocalConsensus(leaderID, transaction)
-    if !success {
-        return fmt.Errorf("failed to achieve local consensus in zone: %s", zoneID)
+    if err := l.achieveLocalConsensus(zoneID, transaction); err != nil {
+        return fmt.Errorf("failed to achieve local consensus in zone: %s: %v", zoneID, err)
     }
 
-    // Simulate global consensus propagation
-    return l.propagateToGlobalConsensus(transaction)
+    return l.propagateToGlobalConsensus(zoneID, transaction)
 }
 
-func (l *LHRaftConsensus) achieveLocalConsensus(leaderID string, transaction []byte) bool {
+// achieveLocalConsensus replicates a transaction through the zone's Raft group,
+// succeeding only once a majority of the zone's members have stored it. The
+// leader may be hosted by another process. A BFT zone succeeds once a local
+// member has executed the transaction, which a quorum has committed.
+func (l *LHRaftConsensus) achieveLocalConsensus(zoneID string, transaction []byte) error {
     l.mu.RLock()
-    leader := l.Nodes[leaderID]
+    group, bft := l.groups[zoneID], l.bftGroups[zoneID]
+    timeout := l.ProposalTimeout
     l.mu.RUnlock()
 
-    if leader == nil {
-        return false
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    if bft != nil {
+        return bft.replicate(ctx, transaction)
     }
-
-    // Simulate consensus achievement (In real implementation, this would involve
-    // actual communication between nodes)
-    return true
+    if group == nil {
+        return fmt.Errorf("no consensus group for zone: %s", zoneID)
+    }
+    return group.replicate(ctx, transaction)
 }
-
-func (l *LHRaftConsensus) propagateToGlobalConsensus(transaction []byte) error {
-    // In real implementation, this would coordinate with other zone leaders
-    return nil
-}
\ No newline at end of file
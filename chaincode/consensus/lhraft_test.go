@@ -0,0 +1,737 @@
+package consensus
+
+import (
+    "encoding/json"
+    "sort"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// testStateMachine records the entries applied on each node
+type testStateMachine struct {
+    applied map[string][]string
+    mu      sync.Mutex
+}
+
+func newTestStateMachine() *testStateMachine {
+    return &testStateMachine{applied: make(map[string][]string)}
+}
+
+func (sm *testStateMachine) apply(zoneID, nodeID string, entry LogEntry) {
+    if entry.Data == nil {
+        return
+    }
+    sm.mu.Lock()
+    defer sm.mu.Unlock()
+
+    sm.applied[nodeID] = append(sm.applied[nodeID], string(entry.Data))
+}
+
+func (sm *testStateMachine) snapshot(zoneID, nodeID string) ([]byte, error) {
+    sm.mu.Lock()
+    defer sm.mu.Unlock()
+
+    return json.Marshal(sm.applied[nodeID])
+}
+
+func (sm *testStateMachine) restore(zoneID, nodeID string, data []byte) error {
+    var applied []string
+    if err := json.Unmarshal(data, &applied); err != nil {
+        return err
+    }
+
+    sm.mu.Lock()
+    defer sm.mu.Unlock()
+
+    sm.applied[nodeID] = applied
+    return nil
+}
+
+// waitFor waits until nodeID has applied exactly the given entries
+func (sm *testStateMachine) waitFor(t *testing.T, nodeID string, want ...string) {
+    t.Helper()
+
+    deadline := time.Now().Add(2 * time.Second)
+    for {
+        sm.mu.Lock()
+        got := append([]string{}, sm.applied[nodeID]...)
+        sm.mu.Unlock()
+
+        if equalStrings(got, want) {
+            return
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("node %s applied %q, want %q", nodeID, got, want)
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+}
+
+// waitForLeader waits until the replica has won an election
+func waitForLeader(t *testing.T, replica *Replica) {
+    t.Helper()
+
+    deadline := time.Now().Add(2 * time.Second)
+    for replica.Status().State != Leader {
+        if time.Now().After(deadline) {
+            t.Fatalf("node %s did not become leader", replica.ID())
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+}
+
+// testOption configures the consensus newTestConsensus returns. Options are
+// applied in the order given.
+type testOption func(t *testing.T, l *LHRaftConsensus)
+
+// newTestConsensus returns a consensus whose zone Z1 starts with the given
+// members, if any, and is stopped when the test ends. Its nodes may lead
+// without serving a probation and need no keys to send unsigned messages,
+// since tests have no ledger records to sync.
+func newTestConsensus(t *testing.T, initialCluster []string, options ...testOption) *LHRaftConsensus {
+    t.Helper()
+
+    l := NewLHRaftConsensus(0.5)
+    t.Cleanup(l.Stop)
+    l.SetLeadershipRequirements(0, 0)
+    l.RequireSignedMessages(false)
+    if len(initialCluster) > 0 {
+        if err := l.SetInitialCluster("Z1", initialCluster); err != nil {
+            t.Fatalf("SetInitialCluster: %v", err)
+        }
+    }
+    for _, option := range options {
+        option(t, l)
+    }
+    return l
+}
+
+// testZones returns the zones given an initial cluster, sorted
+func testZones(l *LHRaftConsensus) []string {
+    l.mu.RLock()
+    defer l.mu.RUnlock()
+
+    zones := make([]string, 0, len(l.initialClusters))
+    for zoneID := range l.initialClusters {
+        zones = append(zones, zoneID)
+    }
+    sort.Strings(zones)
+    return zones
+}
+
+// withZones starts further zones from their listed members
+func withZones(zones map[string][]string) testOption {
+    return func(t *testing.T, l *LHRaftConsensus) {
+        t.Helper()
+        for zoneID, members := range zones {
+            if err := l.SetInitialCluster(zoneID, members); err != nil {
+                t.Fatalf("SetInitialCluster(%s): %v", zoneID, err)
+            }
+        }
+    }
+}
+
+// withGlobalCluster seats the first member of every zone in a global group
+func withGlobalCluster() testOption {
+    return func(t *testing.T, l *LHRaftConsensus) {
+        t.Helper()
+        seats := make(map[string]string)
+        for _, zoneID := range testZones(l) {
+            seats[zoneID] = l.initialClusters[zoneID][0]
+        }
+        if err := l.SetZoneTiming(GlobalGroupID, fastTiming); err != nil {
+            t.Fatalf("SetZoneTiming: %v", err)
+        }
+        if err := l.SetGlobalCluster(seats); err != nil {
+            t.Fatalf("SetGlobalCluster: %v", err)
+        }
+    }
+}
+
+// withPositions adds a node at each position, all eligible to lead, without
+// starting zone groups. Nodes without a location are placed in Z1.
+func withPositions(positions map[string]GeoPoint, locations map[string]string) testOption {
+    return func(t *testing.T, l *LHRaftConsensus) {
+        t.Helper()
+        for id, p := range positions {
+            location := locations[id]
+            if location == "" {
+                location = "Z1"
+            }
+            l.Nodes[id] = &ConsensusNode{ID: id, Location: location, Reputation: 0.9}
+            if err := l.SetNodePosition(id, p.Latitude, p.Longitude); err != nil {
+                t.Fatalf("SetNodePosition(%s): %v", id, err)
+            }
+        }
+    }
+}
+
+// withBFT runs Z1 in ZoneBFT mode, with a signing key for each member
+func withBFT() testOption {
+    return func(t *testing.T, l *LHRaftConsensus) {
+        t.Helper()
+        if err := l.SetZoneMode("Z1", ZoneBFT); err != nil {
+            t.Fatalf("SetZoneMode: %v", err)
+        }
+        for _, id := range l.initialClusters["Z1"] {
+            if err := l.SetNodeKey(id, testKey(id)); err != nil {
+                t.Fatalf("SetNodeKey(%s): %v", id, err)
+            }
+        }
+    }
+}
+
+// withFastTiming lets every zone detect a failed leader quickly
+func withFastTiming() testOption {
+    return func(t *testing.T, l *LHRaftConsensus) {
+        t.Helper()
+        for _, zoneID := range testZones(l) {
+            if err := l.SetZoneTiming(zoneID, fastTiming); err != nil {
+                t.Fatalf("SetZoneTiming(%s): %v", zoneID, err)
+            }
+        }
+    }
+}
+
+// withReadPolicy sets how zones serve reads
+func withReadPolicy(policy ReadPolicy) testOption {
+    return func(t *testing.T, l *LHRaftConsensus) {
+        t.Helper()
+        if err := l.SetReadPolicy(policy); err != nil {
+            t.Fatalf("SetReadPolicy: %v", err)
+        }
+    }
+}
+
+// withApply registers the state machine committed entries are applied to
+func withApply(apply ApplyFunc) testOption {
+    return func(t *testing.T, l *LHRaftConsensus) {
+        l.SetApplyFunc(apply)
+    }
+}
+
+// withRegisteredMembers registers every member of every zone in this process
+func withRegisteredMembers() testOption {
+    return func(t *testing.T, l *LHRaftConsensus) {
+        t.Helper()
+        for _, zoneID := range testZones(l) {
+            for _, id := range l.initialClusters[zoneID] {
+                if err := l.RegisterNode(id, zoneID, 0.9); err != nil {
+                    t.Fatalf("RegisterNode(%s): %v", id, err)
+                }
+            }
+        }
+    }
+}
+
+// withElectedLeaders elects a leader in every zone
+func withElectedLeaders() testOption {
+    return func(t *testing.T, l *LHRaftConsensus) {
+        t.Helper()
+        for _, zoneID := range testZones(l) {
+            if _, err := l.ElectZoneLeader(zoneID); err != nil {
+                t.Fatalf("ElectZoneLeader(%s): %v", zoneID, err)
+            }
+        }
+    }
+}
+
+func equalStrings(a, b []string) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for i := range a {
+        if a[i] != b[i] {
+            return false
+        }
+    }
+    return true
+}
+
+func TestPropagateTransactionReplicatesToZone(t *testing.T) {
+    l := newTestConsensus(t, []string{"n1", "n2", "n3"})
+    defer l.Stop()
+    for _, id := range []string{"n1", "n2", "n3"} {
+        if err := l.RegisterNode(id, "Z1", 0.9); err != nil {
+            t.Fatalf("RegisterNode(%s): %v", id, err)
+        }
+    }
+
+    sm := newTestStateMachine()
+    l.SetApplyFunc(sm.apply)
+
+    if _, err := l.ElectZoneLeader("Z1"); err != nil {
+        t.Fatalf("ElectZoneLeader: %v", err)
+    }
+    if err := l.PropagateTransaction([]byte("tx1"), "Z1"); err != nil {
+        t.Fatalf("PropagateTransaction: %v", err)
+    }
+    if err := l.PropagateTransaction([]byte("tx2"), "Z1"); err != nil {
+        t.Fatalf("PropagateTransaction: %v", err)
+    }
+
+    for _, id := range []string{"n1", "n2", "n3"} {
+        sm.waitFor(t, id, "tx1", "tx2")
+    }
+}
+
+func TestPropagateTransactionWithoutLeader(t *testing.T) {
+    l := newTestConsensus(t, []string{"n1"})
+    defer l.Stop()
+    if err := l.RegisterNode("n1", "Z1", 0.9); err != nil {
+        t.Fatalf("RegisterNode: %v", err)
+    }
+
+    if err := l.PropagateTransaction([]byte("tx"), "Z1"); err == nil {
+        t.Fatal("expected an error without a zone leader")
+    }
+}
+
+func TestRaftLogTruncatesConflictingEntries(t *testing.T) {
+    rl := newRaftLog()
+    rl.append(LogEntry{Term: 1, Index: 1}, LogEntry{Term: 1, Index: 2}, LogEntry{Term: 1, Index: 3})
+    rl.stabled = 3
+
+    rl.append(LogEntry{Term: 1, Index: 2}, LogEntry{Term: 2, Index: 3}, LogEntry{Term: 2, Index: 4})
+
+    if rl.lastIndex() != 4 {
+        t.Fatalf("lastIndex = %d, want 4", rl.lastIndex())
+    }
+    if term, _ := rl.term(3); term != 2 {
+        t.Errorf("term(3) = %d, want 2", term)
+    }
+    if rl.stabled != 2 {
+        t.Errorf("stabled = %d, want 2 after truncation", rl.stabled)
+    }
+}
+
+func TestElectZoneLeaderPicksBestRankedCandidate(t *testing.T) {
+    l := newTestConsensus(t, []string{"n1", "n2", "n3"})
+    defer l.Stop()
+    for id, reputation := range map[string]float64{"n1": 0.7, "n2": 0.9, "n3": 0.3} {
+        if err := l.RegisterNode(id, "Z1", reputation); err != nil {
+            t.Fatalf("RegisterNode(%s): %v", id, err)
+        }
+    }
+
+    leaderID, err := l.ElectZoneLeader("Z1")
+    if err != nil {
+        t.Fatalf("ElectZoneLeader: %v", err)
+    }
+    if leaderID != "n2" {
+        t.Fatalf("leader = %s, want n2", leaderID)
+    }
+    if !l.Nodes["n2"].IsLeader || l.ZoneLeaders["Z1"] != "n2" {
+        t.Errorf("n2 not recorded as zone leader")
+    }
+}
+
+func TestElectZoneLeaderKeepsSittingLeader(t *testing.T) {
+    l := newTestConsensus(t, []string{"n1", "n2", "n3"})
+    defer l.Stop()
+    for id, reputation := range map[string]float64{"n1": 0.9, "n2": 0.8, "n3": 0.7} {
+        if err := l.RegisterNode(id, "Z1", reputation); err != nil {
+            t.Fatalf("RegisterNode(%s): %v", id, err)
+        }
+    }
+    if leaderID, err := l.ElectZoneLeader("Z1"); err != nil || leaderID != "n1" {
+        t.Fatalf("ElectZoneLeader = %s, %v; want n1", leaderID, err)
+    }
+    _, term := l.groups["Z1"].leader()
+
+    start := time.Now()
+    leaderID, err := l.ElectZoneLeader("Z1")
+    if err != nil || leaderID != "n1" {
+        t.Fatalf("ElectZoneLeader again = %s, %v; want n1", leaderID, err)
+    }
+    if elapsed := time.Since(start); elapsed > time.Second {
+        t.Errorf("re-electing the sitting leader took %s", elapsed)
+    }
+    if _, now := l.groups["Z1"].leader(); now != term {
+        t.Errorf("term moved from %d to %d for a leader that kept its seat", term, now)
+    }
+}
+
+func TestElectZoneLeaderKeepsRemoteSittingLeader(t *testing.T) {
+    // Process a hosts n1, the best rated member; process b hosts the others
+    transport := NewInMemoryTransport()
+    defer transport.Close()
+    hosts := map[string][]string{"a": {"n1"}, "b": {"n2", "n3"}}
+    processes := make(map[string]*LHRaftConsensus)
+    for host, local := range hosts {
+        l := NewLHRaftConsensusWithTransport(0.5, transport)
+        defer l.Stop()
+        l.SetLeadershipRequirements(0, 0)
+        l.RequireSignedMessages(false)
+        if err := l.SetInitialCluster("Z1", []string{"n1", "n2", "n3"}); err != nil {
+            t.Fatalf("SetInitialCluster: %v", err)
+        }
+        for id, reputation := range map[string]float64{"n1": 0.9, "n2": 0.8, "n3": 0.7} {
+            var err error
+            if containsString(local, id) {
+                err = l.RegisterNode(id, "Z1", reputation)
+            } else {
+                err = l.RegisterRemoteNode(id, "Z1", reputation)
+            }
+            if err != nil {
+                t.Fatalf("%s: registering %s: %v", host, id, err)
+            }
+        }
+        processes[host] = l
+    }
+    if leaderID, err := processes["a"].ElectZoneLeader("Z1"); err != nil || leaderID != "n1" {
+        t.Fatalf("ElectZoneLeader on process a = %s, %v; want n1", leaderID, err)
+    }
+    group := processes["b"].groups["Z1"]
+    deadline := time.Now().Add(2 * time.Second)
+    for {
+        if leaderID, _ := group.leader(); leaderID == "n1" {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatal("process b never learnt the leader")
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+    _, term := group.leader()
+
+    // n2 is the best candidate process b hosts, but n1 outranks it
+    leaderID, err := processes["b"].ElectZoneLeader("Z1")
+    if err != nil || leaderID != "n1" {
+        t.Fatalf("ElectZoneLeader on process b = %s, %v; want n1", leaderID, err)
+    }
+    if _, now := group.leader(); now != term {
+        t.Errorf("term moved from %d to %d for a leader that kept its seat", term, now)
+    }
+}
+
+func TestVoteRequiresEligibleCandidate(t *testing.T) {
+    peers := []string{"n1", "n2", "n3"}
+    voter := newRaftNode("n2", Membership{Voters: peers})
+    voter.eligible = func(nodeID string) bool { return nodeID != "n3" }
+
+    voter.step(Message{Type: MsgRequestVote, From: "n3", To: "n2", Term: 1})
+    if resp := voter.msgs[len(voter.msgs)-1]; resp.Success {
+        t.Fatal("vote granted to an ineligible candidate")
+    }
+
+    voter.step(Message{Type: MsgRequestVote, From: "n1", To: "n2", Term: 1})
+    if resp := voter.msgs[len(voter.msgs)-1]; !resp.Success {
+        t.Fatal("vote refused to an eligible candidate")
+    }
+
+    // One vote per term
+    voter.step(Message{Type: MsgRequestVote, From: "n3", To: "n2", Term: 1})
+    if resp := voter.msgs[len(voter.msgs)-1]; resp.Success {
+        t.Fatal("voted twice in one term")
+    }
+}
+
+func TestVoteRequiresUpToDateLog(t *testing.T) {
+    voter := newRaftNode("n2", Membership{Voters: []string{"n1", "n2", "n3"}})
+    voter.log.append(LogEntry{Term: 2, Index: 1})
+
+    voter.step(Message{Type: MsgRequestVote, From: "n1", To: "n2", Term: 3, LastLogIndex: 5, LastLogTerm: 1})
+    if resp := voter.msgs[len(voter.msgs)-1]; resp.Success {
+        t.Fatal("vote granted to a candidate with a stale log")
+    }
+}
+
+func TestZoneReelectsWhenLeaderGoesSilent(t *testing.T) {
+    l := newTestConsensus(t, []string{"n1", "n2", "n3"})
+    defer l.Stop()
+    timing := ZoneTiming{TickInterval: 5 * time.Millisecond, HeartbeatTicks: 1, ElectionTicks: 10}
+    if err := l.SetZoneTiming("Z1", timing); err != nil {
+        t.Fatalf("SetZoneTiming: %v", err)
+    }
+    for _, id := range []string{"n1", "n2", "n3"} {
+        if err := l.RegisterNode(id, "Z1", 0.9); err != nil {
+            t.Fatalf("RegisterNode(%s): %v", id, err)
+        }
+    }
+
+    oldLeader, err := l.ElectZoneLeader("Z1")
+    if err != nil {
+        t.Fatalf("ElectZoneLeader: %v", err)
+    }
+    time.Sleep(10 * timing.TickInterval)
+    if silent := l.SilentNodes("Z1"); len(silent) != 0 {
+        t.Fatalf("silent nodes %q while every node is up", silent)
+    }
+
+    // The leader crashes; the followers stop hearing heartbeats and elect a new one
+    l.groups["Z1"].replicas[oldLeader].Stop()
+
+    deadline := time.Now().Add(2 * time.Second)
+    for {
+        l.mu.RLock()
+        leaderID := l.ZoneLeaders["Z1"]
+        l.mu.RUnlock()
+        if leaderID != "" && leaderID != oldLeader {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("no new leader after %s went silent", oldLeader)
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+
+    time.Sleep(timing.electionTimeout() + 10*timing.TickInterval)
+    if silent := l.SilentNodes("Z1"); !equalStrings(silent, []string{oldLeader}) {
+        t.Errorf("silent nodes = %q, want [%s]", silent, oldLeader)
+    }
+}
+
+func TestProbationFollowsLedgerRecord(t *testing.T) {
+    l := NewLHRaftConsensus(0.5)
+    defer l.Stop()
+    if err := l.SetInitialCluster("Z1", []string{"n1"}); err != nil {
+        t.Fatalf("SetInitialCluster: %v", err)
+    }
+    if err := l.RegisterNode("n1", "Z1", 0.9); err == nil || !strings.Contains(err.Error(), ErrNoNodeKey.Error()) {
+        t.Fatalf("RegisterNode without a key = %v, want %v", err, ErrNoNodeKey)
+    }
+    if err := l.SetNodeKey("n1", testKey("n1")); err != nil {
+        t.Fatalf("SetNodeKey: %v", err)
+    }
+    if err := l.RegisterNode("n1", "Z1", 0.9); err != nil {
+        t.Fatalf("RegisterNode: %v", err)
+    }
+    if candidates := l.FormCandidateGroups("Z1"); len(candidates) != 0 {
+        t.Fatalf("candidates = %q before the ledger record was synced", candidates)
+    }
+
+    registered := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+    record := LedgerRecord{RegisteredAt: registered, TransactionCount: DefaultMinLeaderTransactions, AsOf: registered.Add(24 * time.Hour)}
+    if err := l.SyncNodeRecord("n1", record); err != nil {
+        t.Fatalf("SyncNodeRecord: %v", err)
+    }
+    if candidates := l.FormCandidateGroups("Z1"); len(candidates) != 0 {
+        t.Fatalf("candidates = %q one day after registration", candidates)
+    }
+
+    record.AsOf = registered.Add(DefaultMinLeaderAge)
+    if err := l.SyncNodeRecord("n1", record); err != nil {
+        t.Fatalf("SyncNodeRecord: %v", err)
+    }
+    if candidates := l.FormCandidateGroups("Z1"); !equalStrings(candidates, []string{"n1"}) {
+        t.Fatalf("candidates = %q once probation is served, want [n1]", candidates)
+    }
+}
+
+func TestRegisterNodeRequiresInitialCluster(t *testing.T) {
+    l := NewLHRaftConsensus(0.5)
+    defer l.Stop()
+    if err := l.RegisterNode("n1", "Z1", 0.9); err == nil {
+        t.Fatal("registered a node in a zone without an initial cluster")
+    }
+    if _, exists := l.Nodes["n1"]; exists {
+        t.Error("rejected node is still registered")
+    }
+}
+
+// leaderChain receives leader changes for zoneID until its leader is want,
+// failing if a change does not start from the leader the previous one ended at
+func leaderChain(t *testing.T, changes <-chan LeaderChange, zoneID, from, want string) {
+    t.Helper()
+
+    current := from
+    timeout := time.After(2 * time.Second)
+    for current != want {
+        select {
+        case change := <-changes:
+            if change.ZoneID != zoneID {
+                continue
+            }
+            if change.Previous != current {
+                t.Fatalf("change %+v does not follow leader %q", change, current)
+            }
+            current = change.Leader
+        case <-timeout:
+            t.Fatalf("leader of %s is %q, want %q", zoneID, current, want)
+        }
+    }
+}
+
+// checkLeaderFlags fails unless the zone's recorded leader is the only node
+// of the zone flagged as leading
+func checkLeaderFlags(t *testing.T, l *LHRaftConsensus, zoneID string) {
+    t.Helper()
+
+    l.mu.RLock()
+    defer l.mu.RUnlock()
+
+    leaderID := l.ZoneLeaders[zoneID]
+    for id, node := range l.Nodes {
+        if node.Location != zoneID {
+            continue
+        }
+        if node.IsLeader != (id == leaderID) || (node.State == Leader) != node.IsLeader {
+            t.Errorf("node %s IsLeader = %v, State = %v; zone leader is %q", id, node.IsLeader, node.State, leaderID)
+        }
+    }
+}
+
+func TestDisputedLeaderHandsOverBeforeReturning(t *testing.T) {
+    l := newTestConsensus(t, []string{"n1", "n2", "n3"})
+    defer l.Stop()
+    for id, reputation := range map[string]float64{"n1": 0.9, "n2": 0.8, "n3": 0.7} {
+        if err := l.RegisterNode(id, "Z1", reputation); err != nil {
+            t.Fatalf("RegisterNode(%s): %v", id, err)
+        }
+    }
+    if leaderID, err := l.ElectZoneLeader("Z1"); err != nil || leaderID != "n1" {
+        t.Fatalf("ElectZoneLeader = %s, %v; want n1", leaderID, err)
+    }
+    changes, unsubscribe := l.SubscribeLeaderChanges()
+    defer unsubscribe()
+
+    if err := l.SetNodeDisputed("n1", true); err != nil {
+        t.Fatalf("SetNodeDisputed: %v", err)
+    }
+    l.mu.RLock()
+    leaderID := l.ZoneLeaders["Z1"]
+    l.mu.RUnlock()
+    if leaderID != "n2" {
+        t.Fatalf("zone leader = %q after dispute, want n2", leaderID)
+    }
+    checkLeaderFlags(t, l, "Z1")
+    leaderChain(t, changes, "Z1", "n1", "n2")
+}
+
+func TestDisputedLeaderStepsDownWithoutSuccessor(t *testing.T) {
+    l := newTestConsensus(t, []string{"n1", "n2"})
+    defer l.Stop()
+    if err := l.SetZoneTiming("Z1", fastTiming); err != nil {
+        t.Fatalf("SetZoneTiming: %v", err)
+    }
+    // n2 votes but its reputation keeps it from leading
+    for id, reputation := range map[string]float64{"n1": 0.9, "n2": 0.3} {
+        if err := l.RegisterNode(id, "Z1", reputation); err != nil {
+            t.Fatalf("RegisterNode(%s): %v", id, err)
+        }
+    }
+    if leaderID, err := l.ElectZoneLeader("Z1"); err != nil || leaderID != "n1" {
+        t.Fatalf("ElectZoneLeader = %s, %v; want n1", leaderID, err)
+    }
+
+    if err := l.SetNodeDisputed("n1", true); err != nil {
+        t.Fatalf("SetNodeDisputed: %v", err)
+    }
+    time.Sleep(4 * fastTiming.electionTimeout())
+    l.mu.RLock()
+    leaderID, leading := l.ZoneLeaders["Z1"]
+    l.mu.RUnlock()
+    if leading {
+        t.Fatalf("zone led by %s while its only candidate is disputed", leaderID)
+    }
+    checkLeaderFlags(t, l, "Z1")
+
+    if err := l.SetNodeDisputed("n1", false); err != nil {
+        t.Fatalf("SetNodeDisputed: %v", err)
+    }
+    if leaderID, err := l.ElectZoneLeader("Z1"); err != nil || leaderID != "n1" {
+        t.Fatalf("ElectZoneLeader after dispute = %s, %v; want n1", leaderID, err)
+    }
+}
+
+func TestConcurrentReputationUpdatesAndElections(t *testing.T) {
+    ids := []string{"n1", "n2", "n3", "n4", "n5"}
+    l := newTestConsensus(t, ids)
+    defer l.Stop()
+    if err := l.SetZoneTiming("Z1", fastTiming); err != nil {
+        t.Fatalf("SetZoneTiming: %v", err)
+    }
+    for i, id := range ids {
+        if err := l.RegisterNode(id, "Z1", 0.9-0.05*float64(i)); err != nil {
+            t.Fatalf("RegisterNode(%s): %v", id, err)
+        }
+    }
+    if _, err := l.ElectZoneLeader("Z1"); err != nil {
+        t.Fatalf("ElectZoneLeader: %v", err)
+    }
+    changes, unsubscribe := l.SubscribeLeaderChanges()
+    defer unsubscribe()
+
+    // Every published change starts where the previous one ended
+    l.mu.RLock()
+    first := l.ZoneLeaders["Z1"]
+    l.mu.RUnlock()
+    var chainMu sync.Mutex
+    current := first
+    go func() {
+        for change := range changes {
+            if change.ZoneID != "Z1" {
+                continue
+            }
+            chainMu.Lock()
+            if change.Previous != current {
+                t.Errorf("change %+v does not follow leader %q", change, current)
+            }
+            current = change.Leader
+            chainMu.Unlock()
+        }
+    }()
+
+    var wg sync.WaitGroup
+    for w := 0; w < 4; w++ {
+        wg.Add(1)
+        go func(w int) {
+            defer wg.Done()
+            for i := 0; i < 20; i++ {
+                id := ids[(w+i)%len(ids)]
+                switch i % 4 {
+                case 0:
+                    // Stays above the threshold, so the node keeps its place
+                    if err := l.UpdateNodeReputation(id, 0.5+float64((w*7+i)%10)/20); err != nil {
+                        t.Errorf("UpdateNodeReputation(%s): %v", id, err)
+                    }
+                case 1:
+                    // n5 is never disputed, so the zone always has a candidate
+                    if id != "n5" {
+                        if err := l.SetNodeDisputed(id, w%2 == 0); err != nil {
+                            t.Errorf("SetNodeDisputed(%s): %v", id, err)
+                        }
+                    }
+                case 2:
+                    if _, err := l.ElectZoneLeader("Z1"); err != nil {
+                        t.Errorf("ElectZoneLeader: %v", err)
+                    }
+                case 3:
+                    checkLeaderFlags(t, l, "Z1")
+                }
+            }
+        }(w)
+    }
+    wg.Wait()
+
+    for _, id := range ids {
+        if err := l.SetNodeDisputed(id, false); err != nil {
+            t.Fatalf("SetNodeDisputed(%s): %v", id, err)
+        }
+    }
+    leaderID, err := l.ElectZoneLeader("Z1")
+    if err != nil || leaderID == "" {
+        t.Fatalf("ElectZoneLeader = %q, %v", leaderID, err)
+    }
+    if groupLeader, _ := l.groups["Z1"].leader(); groupLeader != leaderID {
+        t.Errorf("group leader = %s, consensus reports %s", groupLeader, leaderID)
+    }
+    checkLeaderFlags(t, l, "Z1")
+
+    deadline := time.Now().Add(2 * time.Second)
+    for {
+        chainMu.Lock()
+        last := current
+        chainMu.Unlock()
+        if last == leaderID {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("last published leader = %q, want %s", last, leaderID)
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+}
@@ -0,0 +1,543 @@
+package consensus
+
+import (
+    "encoding/json"
+    "fmt"
+    "math"
+    "sort"
+    "strings"
+    "testing"
+    "time"
+)
+
+// simPending is the return time of an operation whose outcome its client
+// never learnt. It may have taken effect at any point after its call, or not
+// at all.
+const simPending = time.Duration(math.MaxInt64)
+
+// kvOp is one client operation in a history against a key-value store. Value
+// is what a put wrote or what a get read.
+type kvOp struct {
+    Client int
+    Kind   string // "put" or "get"
+    Key    string
+    Value  string
+    Call   time.Duration
+    Return time.Duration
+}
+
+func (op kvOp) String() string {
+    ret := "pending"
+    if op.Return != simPending {
+        ret = op.Return.String()
+    }
+    return fmt.Sprintf("client %d %s(%s)=%q [%v, %s]", op.Client, op.Kind, op.Key, op.Value, op.Call, ret)
+}
+
+// kvCommand is the log entry a client operation is replicated as
+type kvCommand struct {
+    Op    int
+    Kind  string
+    Key   string
+    Value string
+}
+
+// kvHistory records the calls and returns of client operations
+type kvHistory struct {
+    ops []kvOp
+}
+
+// invoke records the call of an operation and returns its ID
+func (h *kvHistory) invoke(client int, kind, key, value string, at time.Duration) int {
+    h.ops = append(h.ops, kvOp{Client: client, Kind: kind, Key: key, Value: value, Call: at, Return: simPending})
+    return len(h.ops) - 1
+}
+
+// complete records the return of an operation and, for a get, what it read
+func (h *kvHistory) complete(id int, value string, at time.Duration) {
+    h.ops[id].Return = at
+    if h.ops[id].Kind == "get" {
+        h.ops[id].Value = value
+    }
+}
+
+// checkLinearizable reports whether a history is linearizable against a
+// key-value store in which every key starts empty. Keys are independent, so
+// each is checked on its own; the first key that is not linearizable is
+// returned.
+func checkLinearizable(ops []kvOp) (bool, string) {
+    byKey := make(map[string][]kvOp)
+    for _, op := range ops {
+        byKey[op.Key] = append(byKey[op.Key], op)
+    }
+    keys := make([]string, 0, len(byKey))
+    for key := range byKey {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+
+    for _, key := range keys {
+        if !checkRegister(byKey[key]) {
+            return false, key
+        }
+    }
+    return true, ""
+}
+
+// linEntry is the call or return of an operation in the search's event list
+type linEntry struct {
+    id    int
+    call  bool
+    op    kvOp
+    match *linEntry // The call's return
+    prev  *linEntry
+    next  *linEntry
+}
+
+// checkRegister searches for a linearization of the operations on one key,
+// after Wing and Gong with Lowe's memoization of visited states: an
+// operation is linearized as soon as every operation that returned before
+// its call has been, backtracking when a return is reached first.
+func checkRegister(ops []kvOp) bool {
+    // A get whose result was never seen constrains nothing
+    kept := make([]kvOp, 0, len(ops))
+    for _, op := range ops {
+        if op.Kind == "put" || op.Return != simPending {
+            kept = append(kept, op)
+        }
+    }
+
+    type event struct {
+        at   time.Duration
+        call bool
+        id   int
+    }
+    events := make([]event, 0, 2*len(kept))
+    for id, op := range kept {
+        events = append(events, event{op.Call, true, id}, event{op.Return, false, id})
+    }
+    // An operation returning at the instant another is called precedes it
+    sort.SliceStable(events, func(i, j int) bool {
+        a, b := events[i], events[j]
+        if a.at != b.at {
+            return a.at < b.at
+        }
+        if a.id == b.id {
+            return a.call
+        }
+        return !a.call && b.call
+    })
+
+    head := &linEntry{}
+    calls := make([]*linEntry, len(kept))
+    tail := head
+    for _, ev := range events {
+        entry := &linEntry{id: ev.id, call: ev.call, op: kept[ev.id], prev: tail}
+        if ev.call {
+            calls[ev.id] = entry
+        } else {
+            calls[ev.id].match = entry
+        }
+        tail.next = entry
+        tail = entry
+    }
+
+    type frame struct {
+        entry *linEntry
+        state string
+    }
+    var stack []frame
+    linearized := make([]byte, (len(kept)+7)/8)
+    visited := make(map[string]bool)
+    state := ""
+
+    entry := head.next
+    for head.next != nil {
+        if entry.call {
+            next, ok := state, true
+            switch entry.op.Kind {
+            case "put":
+                next = entry.op.Value
+            case "get":
+                ok = entry.op.Value == state
+            }
+            if ok {
+                linearized[entry.id/8] |= 1 << (entry.id % 8)
+                key := string(linearized) + "\x00" + next
+                if !visited[key] {
+                    visited[key] = true
+                    stack = append(stack, frame{entry, state})
+                    state = next
+                    entry.lift()
+                    entry = head.next
+                    continue
+                }
+                linearized[entry.id/8] &^= 1 << (entry.id % 8)
+            }
+            entry = entry.next
+            continue
+        }
+
+        // A return reached before its call was linearized: undo the last choice
+        if len(stack) == 0 {
+            return false
+        }
+        top := stack[len(stack)-1]
+        stack = stack[:len(stack)-1]
+        entry, state = top.entry, top.state
+        linearized[entry.id/8] &^= 1 << (entry.id % 8)
+        entry.unlift()
+        entry = entry.next
+    }
+    return true
+}
+
+// lift takes a call and its return out of the list
+func (e *linEntry) lift() {
+    e.prev.next = e.next
+    e.next.prev = e.prev
+    m := e.match
+    m.prev.next = m.next
+    if m.next != nil {
+        m.next.prev = m.prev
+    }
+}
+
+// unlift puts back a call and its return taken out by lift
+func (e *linEntry) unlift() {
+    m := e.match
+    m.prev.next = m
+    if m.next != nil {
+        m.next.prev = m
+    }
+    e.prev.next = e
+    e.next.prev = e
+}
+
+// kvClient is a client with at most one operation outstanding
+type kvClient struct {
+    id        int
+    op        int // Outstanding operation, -1 when idle
+    node      string
+    index     uint64
+    term      uint64
+    read      uint64 // ID of the read the client waits on, zero for a proposal
+    confirmed bool   // Whether the read's index is known
+    timeout   time.Duration
+}
+
+// kvReadMode is how a workload's gets are served
+type kvReadMode int
+
+const (
+    kvReadLog   kvReadMode = iota // Proposed through the log like puts
+    kvReadIndex                   // Confirmed by the leader, by lease or heartbeats, at any node
+    kvReadStale                   // From any node's applied state, which is not linearizable
+)
+
+// kvWorkload drives clients against a simulated group and records their
+// history
+type kvWorkload struct {
+    s       *simulator
+    history kvHistory
+    clients []*kvClient
+    keys    []string
+    written int
+    reads   kvReadMode
+    instant int // Reads confirmed the moment they were requested
+}
+
+const kvClientTimeout = 300 * time.Millisecond
+
+func newKVWorkload(s *simulator, clients int, keys ...string) *kvWorkload {
+    w := &kvWorkload{s: s, keys: keys}
+    for i := 0; i < clients; i++ {
+        w.clients = append(w.clients, &kvClient{id: i, op: -1})
+    }
+    s.onApply = w.applied
+    s.onRead = w.confirmed
+    return w
+}
+
+// step lets every idle client invoke an operation and gives up on those
+// that have waited too long, leaving their outcome unknown
+func (w *kvWorkload) step() {
+    s := w.s
+    for _, c := range w.clients {
+        if c.op >= 0 && c.read != 0 && c.confirmed {
+            // The node may have caught up by installing a snapshot
+            w.maybeRead(c)
+        }
+        if c.op >= 0 {
+            if s.now >= c.timeout {
+                c.op = -1
+            }
+            continue
+        }
+
+        key := w.keys[s.rand.Intn(len(w.keys))]
+        if s.rand.Intn(2) == 0 {
+            w.written++
+            w.submit(c, "put", key, fmt.Sprintf("v%d", w.written))
+        } else if w.reads == kvReadStale {
+            n := s.nodes[s.ids[s.rand.Intn(len(s.ids))]]
+            id := w.history.invoke(c.id, "get", key, "", s.now)
+            w.history.complete(id, readKey(n.applied, key), s.now)
+        } else if w.reads == kvReadIndex {
+            w.requestRead(c, key)
+        } else {
+            w.submit(c, "get", key, "")
+        }
+    }
+}
+
+// requestRead asks a random running node to confirm a get; followers ask
+// their leader
+func (w *kvWorkload) requestRead(c *kvClient, key string) {
+    s := w.s
+    n := s.nodes[s.ids[s.rand.Intn(len(s.ids))]]
+    if n.down {
+        return
+    }
+    id := w.history.invoke(c.id, "get", key, "", s.now)
+    if err := n.raft.requestRead(uint64(id) + 1); err != nil {
+        w.history.ops = w.history.ops[:id]
+        return
+    }
+    s.record("%s requests read %d", n.id, id+1)
+    c.op, c.node, c.read, c.confirmed = id, n.id, uint64(id)+1, false
+    c.timeout = s.now + kvClientTimeout
+    s.process(n)
+    s.check(n)
+}
+
+// confirmed learns the index a client's read waits for, completing it once
+// the node it asked has applied that far
+func (w *kvWorkload) confirmed(nodeID string, id, index uint64, reject string) {
+    for _, c := range w.clients {
+        if c.op < 0 || c.read != id || c.node != nodeID || c.confirmed {
+            continue
+        }
+        if reject != "" {
+            c.op = -1
+            continue
+        }
+        if w.history.ops[c.op].Call == w.s.now {
+            w.instant++
+        }
+        c.index, c.confirmed = index, true
+        w.maybeRead(c)
+    }
+}
+
+// maybeRead completes a confirmed read once its node has applied its index
+func (w *kvWorkload) maybeRead(c *kvClient) {
+    n := w.s.nodes[c.node]
+    if uint64(len(n.applied)) < c.index {
+        return
+    }
+    w.history.complete(c.op, readKey(n.applied, w.history.ops[c.op].Key), w.s.now)
+    c.op = -1
+}
+
+// submit proposes an operation at the leader; without one the client tries
+// again later
+func (w *kvWorkload) submit(c *kvClient, kind, key, value string) {
+    s := w.s
+    leader := s.leader()
+    if leader == nil {
+        return
+    }
+    id := w.history.invoke(c.id, kind, key, value, s.now)
+    data, _ := json.Marshal(kvCommand{Op: id, Kind: kind, Key: key, Value: value})
+    index, term, ok := s.propose(data)
+    if !ok {
+        w.history.ops = w.history.ops[:id]
+        return
+    }
+    c.op, c.node, c.index, c.term = id, leader.id, index, term
+    c.read, c.confirmed = 0, false
+    c.timeout = s.now + kvClientTimeout
+}
+
+// applied completes a client's operation once the node it was proposed to
+// applies it where it was appended
+func (w *kvWorkload) applied(nodeID string, entry LogEntry) {
+    for _, c := range w.clients {
+        if c.op >= 0 && c.read != 0 && c.confirmed && c.node == nodeID {
+            w.maybeRead(c)
+            continue
+        }
+        if c.op < 0 || c.read != 0 || c.node != nodeID || c.index != entry.Index {
+            continue
+        }
+        if entry.Term == c.term {
+            n := w.s.nodes[nodeID]
+            op := w.history.ops[c.op]
+            w.history.complete(c.op, readKey(n.applied[:len(n.applied)-1], op.Key), w.s.now)
+        }
+        // Overwritten by another leader's entry: the outcome stays unknown
+        c.op = -1
+    }
+}
+
+// readKey returns a key's value after the given entries
+func readKey(applied []LogEntry, key string) string {
+    for i := len(applied) - 1; i >= 0; i-- {
+        var cmd kvCommand
+        if applied[i].Type != EntryNormal || json.Unmarshal(applied[i].Data, &cmd) != nil {
+            continue
+        }
+        if cmd.Kind == "put" && cmd.Key == key {
+            return cmd.Value
+        }
+    }
+    return ""
+}
+
+// runKVSimulation records a history of clients using a five node group
+// through random faults, then heals the network and lets it settle. Leaders
+// hold leases of the given length.
+func runKVSimulation(seed int64, reads kvReadMode, lease time.Duration) (*simulator, *kvWorkload) {
+    s := newSimulator(seed, []string{"n1", "n2", "n3", "n4", "n5"}, defaultSimFaults)
+    s.snapshotEvery = 16
+    s.setLease(lease)
+    w := newKVWorkload(s, 3, "a", "b")
+    w.reads = reads
+
+    for round := 0; round < 30; round++ {
+        s.nemesis()
+        for i := 0; i < 10; i++ {
+            w.step()
+            s.run(10 * time.Millisecond)
+        }
+    }
+    s.heal()
+    for _, id := range s.ids {
+        if s.nodes[id].down {
+            s.restart(id)
+        }
+    }
+    s.run(time.Second)
+    return s, w
+}
+
+// checkKVHistory fails the test unless the run kept Raft's invariants and
+// its clients completed gets and puts in a linearizable history
+func checkKVHistory(t *testing.T, s *simulator, w *kvWorkload) {
+    t.Helper()
+
+    if s.violation != nil {
+        s.report(t, s.violation)
+    }
+    completed := make(map[string]int)
+    for _, op := range w.history.ops {
+        if op.Return != simPending {
+            completed[op.Kind]++
+        }
+    }
+    if completed["get"] == 0 || completed["put"] == 0 {
+        s.report(t, fmt.Errorf("completed %d gets and %d puts, want some of each", completed["get"], completed["put"]))
+    }
+    if ok, key := checkLinearizable(w.history.ops); !ok {
+        s.report(t, fmt.Errorf("history of key %s is not linearizable:\n%s", key, formatOps(w.history.ops, key)))
+    }
+}
+
+func TestHistoriesUnderFaultsAreLinearizable(t *testing.T) {
+    for _, seed := range simSeeds() {
+        s, w := runKVSimulation(seed, kvReadLog, 0)
+        checkKVHistory(t, s, w)
+    }
+}
+
+func TestReadIndexHistoriesAreLinearizable(t *testing.T) {
+    for _, seed := range simSeeds() {
+        s, w := runKVSimulation(seed, kvReadIndex, 0)
+        checkKVHistory(t, s, w)
+        if w.instant != 0 {
+            s.report(t, fmt.Errorf("%d reads confirmed without a round of heartbeats", w.instant))
+        }
+    }
+}
+
+func TestLeaseHistoriesAreLinearizable(t *testing.T) {
+    lease := ReadPolicy{Leases: true}.lease(simTickInterval, simElectionTicks)
+    instant := 0
+    for _, seed := range simSeeds() {
+        s, w := runKVSimulation(seed, kvReadIndex, lease)
+        checkKVHistory(t, s, w)
+        instant += w.instant
+    }
+    if instant == 0 {
+        t.Fatal("no read was served on the strength of a lease")
+    }
+}
+
+func TestLinearizabilityCheckerCatchesStaleReads(t *testing.T) {
+    caught := 0
+    for seed := int64(1); seed <= 20; seed++ {
+        _, w := runKVSimulation(seed, kvReadStale, 0)
+        if ok, _ := checkLinearizable(w.history.ops); !ok {
+            caught++
+        }
+    }
+    if caught == 0 {
+        t.Fatal("reads from any node's state passed as linearizable under every seed")
+    }
+}
+
+func TestCheckRegister(t *testing.T) {
+    ms := time.Millisecond
+    tests := []struct {
+        name string
+        ops  []kvOp
+        want bool
+    }{
+        {"sequential", []kvOp{
+            {Kind: "put", Value: "1", Call: 0, Return: 1 * ms},
+            {Kind: "get", Value: "1", Call: 2 * ms, Return: 3 * ms},
+        }, true},
+        {"stale read", []kvOp{
+            {Kind: "put", Value: "1", Call: 0, Return: 1 * ms},
+            {Kind: "get", Value: "", Call: 2 * ms, Return: 3 * ms},
+        }, false},
+        {"concurrent read sees either", []kvOp{
+            {Kind: "put", Value: "1", Call: 0, Return: 5 * ms},
+            {Kind: "get", Value: "", Call: 1 * ms, Return: 2 * ms},
+            {Kind: "get", Value: "1", Call: 3 * ms, Return: 4 * ms},
+        }, true},
+        {"reads go back in time", []kvOp{
+            {Kind: "put", Value: "1", Call: 0, Return: 10 * ms},
+            {Kind: "get", Value: "1", Call: 1 * ms, Return: 2 * ms},
+            {Kind: "get", Value: "", Call: 3 * ms, Return: 4 * ms},
+        }, false},
+        {"pending put may take effect", []kvOp{
+            {Kind: "put", Value: "1", Call: 0, Return: simPending},
+            {Kind: "get", Value: "1", Call: 5 * ms, Return: 6 * ms},
+        }, true},
+        {"pending put may not take effect", []kvOp{
+            {Kind: "put", Value: "1", Call: 0, Return: simPending},
+            {Kind: "get", Value: "", Call: 5 * ms, Return: 6 * ms},
+        }, true},
+        {"value never written", []kvOp{
+            {Kind: "get", Value: "2", Call: 0, Return: 1 * ms},
+        }, false},
+    }
+    for _, tt := range tests {
+        if got := checkRegister(tt.ops); got != tt.want {
+            t.Errorf("%s: checkRegister = %v, want %v", tt.name, got, tt.want)
+        }
+    }
+}
+
+// formatOps lists the operations on a key, one per line
+func formatOps(ops []kvOp, key string) string {
+    var lines []string
+    for _, op := range ops {
+        if op.Key == key {
+            lines = append(lines, op.String())
+        }
+    }
+    return strings.Join(lines, "\n")
+}
@@ -0,0 +1,136 @@
+package consensus
+
+// LogEntry is a single entry in a zone group's replicated log
+type LogEntry struct {
+    Term  uint64
+    Index uint64
+    Type  EntryType
+    Data  []byte
+}
+
+// Snapshot is the applied state of a zone's state machine up to and including
+// Index. Entries it covers are dropped from the log.
+type Snapshot struct {
+    Index      uint64
+    Term       uint64 // Term of the entry at Index
+    Membership Membership
+    Data       []byte
+}
+
+// raftLog holds a node's log entries along with the commit and apply cursors
+type raftLog struct {
+    // entries[0] is a sentinel carrying the index and term the log starts after
+    entries   []LogEntry
+    stabled   uint64 // Highest index durably stored
+    committed uint64 // Highest index known to be committed
+    applied   uint64 // Highest index handed to the state machine
+}
+
+func newRaftLog() *raftLog {
+    return &raftLog{entries: []LogEntry{{}}}
+}
+
+// firstIndex returns the index of the first entry after the sentinel
+func (rl *raftLog) firstIndex() uint64 {
+    return rl.entries[0].Index + 1
+}
+
+func (rl *raftLog) lastIndex() uint64 {
+    return rl.entries[len(rl.entries)-1].Index
+}
+
+func (rl *raftLog) lastTerm() uint64 {
+    return rl.entries[len(rl.entries)-1].Term
+}
+
+// term returns the term of the entry at index, false if it is not held
+func (rl *raftLog) term(index uint64) (uint64, bool) {
+    offset := rl.entries[0].Index
+    if index < offset || index > rl.lastIndex() {
+        return 0, false
+    }
+    return rl.entries[index-offset].Term, true
+}
+
+// matchTerm reports whether the entry at index has the given term
+func (rl *raftLog) matchTerm(index, term uint64) bool {
+    t, ok := rl.term(index)
+    return ok && t == term
+}
+
+// slice returns the entries in [lo, hi)
+func (rl *raftLog) slice(lo, hi uint64) []LogEntry {
+    offset := rl.entries[0].Index
+    if lo <= offset || lo >= hi {
+        return nil
+    }
+    if max := rl.lastIndex() + 1; hi > max {
+        hi = max
+    }
+    out := make([]LogEntry, hi-lo)
+    copy(out, rl.entries[lo-offset:hi-offset])
+    return out
+}
+
+// append adds entries received from a leader, truncating any conflicting
+// suffix. Entries already held with a matching term are skipped.
+func (rl *raftLog) append(entries ...LogEntry) {
+    for i, entry := range entries {
+        if rl.matchTerm(entry.Index, entry.Term) {
+            continue
+        }
+        if entry.Index <= rl.entries[0].Index {
+            continue
+        }
+        // Conflict or new entry: drop everything from here on
+        offset := rl.entries[0].Index
+        rl.entries = append(rl.entries[:entry.Index-offset], entries[i:]...)
+        if rl.stabled >= entry.Index {
+            rl.stabled = entry.Index - 1
+        }
+        return
+    }
+}
+
+// unstable returns the entries not yet durably stored
+func (rl *raftLog) unstable() []LogEntry {
+    return rl.slice(rl.stabled+1, rl.lastIndex()+1)
+}
+
+// nextCommitted returns the committed entries not yet applied
+func (rl *raftLog) nextCommitted() []LogEntry {
+    return rl.slice(rl.applied+1, rl.committed+1)
+}
+
+// compact drops the entries up to and including index, which a snapshot
+// covers. If the log holds no matching entry at index it is discarded
+// entirely and restarts after the snapshot.
+func (rl *raftLog) compact(index, term uint64) {
+    if index <= rl.entries[0].Index {
+        return
+    }
+
+    sentinel := LogEntry{Term: term, Index: index}
+    if rl.matchTerm(index, term) {
+        offset := rl.entries[0].Index
+        rl.entries = append([]LogEntry{sentinel}, rl.entries[index-offset+1:]...)
+    } else {
+        rl.entries = []LogEntry{sentinel}
+    }
+
+    if rl.stabled < index {
+        rl.stabled = index
+    }
+    if rl.committed < index {
+        rl.committed = index
+    }
+    if rl.applied < index {
+        rl.applied = index
+    }
+}
+
+// isUpToDate reports whether a log ending at (index, term) is at least as
+// current as this one
+func (rl *raftLog) isUpToDate(index, term uint64) bool {
+    return term > rl.lastTerm() || (term == rl.lastTerm() && index >= rl.lastIndex())
+}
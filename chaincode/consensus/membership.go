@@ -0,0 +1,213 @@
+package consensus
+
+import (
+    "errors"
+    "fmt"
+    "sort"
+)
+
+// Errors returned when a membership change cannot be proposed
+var (
+    ErrConfChangePending = errors.New("a membership change is already in progress")
+    ErrLearnerBehind     = errors.New("learner has not caught up with the leader")
+)
+
+// EntryType distinguishes state machine entries from membership changes
+type EntryType int
+
+const (
+    EntryNormal EntryType = iota
+    EntryConfChange
+    EntryCrossZone  // A CrossZoneRecord of a transaction spanning zones
+    EntryZoneChange // A ZoneChange moving members to another zone
+)
+
+// ConfChangeType is the kind of a membership change
+type ConfChangeType int
+
+const (
+    ConfAddLearner ConfChangeType = iota
+    ConfPromoteLearner
+    ConfRemoveNode
+    ConfTransferSeat
+    ConfReleaseSeat
+)
+
+// ConfChange adds, promotes or removes one member of a zone group. Changes
+// are committed through the group's log one at a time and take effect on
+// each member as it applies them, so a majority of the old and the new
+// group always overlap.
+//
+// In the global group a ConfTransferSeat gives Zone's seat to NodeID, which
+// must already be a member, and retires the previous holder in the same
+// entry. A zone without a seat gains one. A ConfReleaseSeat takes away the
+// seat of Zone, which has merged into another, from its holder NodeID; a
+// holder left without a seat is retired.
+type ConfChange struct {
+    Type   ConfChangeType
+    NodeID string
+    Zone   string `json:",omitempty"`
+}
+
+// Membership is the composition of a zone group. Voters elect the leader and
+// form quorums; learners receive the log without voting until promoted. In
+// the global group every voter holds the seat of a zone.
+type Membership struct {
+    Voters   []string
+    Learners []string
+    Seats    map[string]string `json:",omitempty"` // ZoneID -> seat holder, global group only
+}
+
+func (m Membership) isVoter(nodeID string) bool {
+    return containsString(m.Voters, nodeID)
+}
+
+func (m Membership) isLearner(nodeID string) bool {
+    return containsString(m.Learners, nodeID)
+}
+
+func (m Membership) isMember(nodeID string) bool {
+    return m.isVoter(nodeID) || m.isLearner(nodeID)
+}
+
+// members returns every voter and learner, sorted
+func (m Membership) members() []string {
+    members := append(append([]string{}, m.Voters...), m.Learners...)
+    sort.Strings(members)
+    return members
+}
+
+// withLearner returns the membership with nodeID added as a learner
+func (m Membership) withLearner(nodeID string) Membership {
+    return Membership{
+        Voters:   m.Voters,
+        Learners: append(append([]string{}, m.Learners...), nodeID),
+        Seats:    m.Seats,
+    }
+}
+
+// validate checks that a change can be made to the membership
+func (m Membership) validate(cc ConfChange) error {
+    switch cc.Type {
+    case ConfAddLearner:
+        if m.isMember(cc.NodeID) {
+            return fmt.Errorf("node %s is already a member", cc.NodeID)
+        }
+    case ConfPromoteLearner:
+        if !m.isLearner(cc.NodeID) {
+            return fmt.Errorf("node %s is not a learner", cc.NodeID)
+        }
+    case ConfRemoveNode:
+        if !m.isMember(cc.NodeID) {
+            return fmt.Errorf("node %s is not a member", cc.NodeID)
+        }
+        if m.isVoter(cc.NodeID) && len(m.Voters) == 1 {
+            return fmt.Errorf("cannot remove the last voter %s", cc.NodeID)
+        }
+    case ConfTransferSeat:
+        if cc.Zone == "" {
+            return fmt.Errorf("seat transfer to %s names no zone", cc.NodeID)
+        }
+        if !m.isMember(cc.NodeID) {
+            return fmt.Errorf("node %s must join before taking a seat", cc.NodeID)
+        }
+        if m.Seats[cc.Zone] == cc.NodeID {
+            return fmt.Errorf("node %s already holds the seat of zone %s", cc.NodeID, cc.Zone)
+        }
+    case ConfReleaseSeat:
+        if holder, held := m.Seats[cc.Zone]; !held || holder != cc.NodeID {
+            return fmt.Errorf("node %s does not hold the seat of zone %s", cc.NodeID, cc.Zone)
+        }
+        if len(m.Seats) == 1 {
+            return fmt.Errorf("cannot release the last seat, of zone %s", cc.Zone)
+        }
+    default:
+        return fmt.Errorf("unknown membership change %d", cc.Type)
+    }
+    return nil
+}
+
+// apply returns the membership after a change. Applying a change twice has
+// no further effect, so committed changes can be replayed after a restart.
+func (m Membership) apply(cc ConfChange) Membership {
+    voters := removeString(m.Voters, cc.NodeID)
+    learners := removeString(m.Learners, cc.NodeID)
+    seats := copySeats(m.Seats)
+
+    switch cc.Type {
+    case ConfAddLearner:
+        if m.isVoter(cc.NodeID) {
+            voters = append(voters, cc.NodeID)
+        } else {
+            learners = append(learners, cc.NodeID)
+        }
+    case ConfPromoteLearner:
+        voters = append(voters, cc.NodeID)
+    case ConfRemoveNode:
+        for zoneID, holder := range seats {
+            if holder == cc.NodeID {
+                delete(seats, zoneID)
+            }
+        }
+    case ConfTransferSeat:
+        voters = append(voters, cc.NodeID)
+        previous, held := seats[cc.Zone]
+        if seats == nil {
+            seats = make(map[string]string)
+        }
+        seats[cc.Zone] = cc.NodeID
+        if held && previous != cc.NodeID && !holdsSeat(seats, previous) {
+            voters = removeString(voters, previous)
+        }
+    case ConfReleaseSeat:
+        delete(seats, cc.Zone)
+        if holdsSeat(seats, cc.NodeID) {
+            voters = append(voters, cc.NodeID)
+        }
+    }
+
+    sort.Strings(voters)
+    sort.Strings(learners)
+    return Membership{Voters: voters, Learners: learners, Seats: seats}
+}
+
+// copySeats returns a copy of a seat map, nil if it is empty
+func copySeats(seats map[string]string) map[string]string {
+    if len(seats) == 0 {
+        return nil
+    }
+    out := make(map[string]string, len(seats))
+    for zoneID, holder := range seats {
+        out[zoneID] = holder
+    }
+    return out
+}
+
+func holdsSeat(seats map[string]string, nodeID string) bool {
+    for _, holder := range seats {
+        if holder == nodeID {
+            return true
+        }
+    }
+    return false
+}
+
+func containsString(values []string, value string) bool {
+    for _, v := range values {
+        if v == value {
+            return true
+        }
+    }
+    return false
+}
+
+// removeString returns a copy of values without value
+func removeString(values []string, value string) []string {
+    out := make([]string, 0, len(values))
+    for _, v := range values {
+        if v != value {
+            out = append(out, v)
+        }
+    }
+    return out
+}
@@ -0,0 +1,140 @@
+package consensus
+
+import (
+    "testing"
+    "time"
+)
+
+// waitForVoters waits until every local replica of a zone has applied a
+// membership with the given voters
+func waitForVoters(t *testing.T, l *LHRaftConsensus, zoneID string, want ...string) {
+    t.Helper()
+
+    deadline := time.Now().Add(2 * time.Second)
+    for {
+        agreed := true
+        l.groups[zoneID].mu.Lock()
+        for _, replica := range l.groups[zoneID].replicas {
+            if !equalStrings(replica.Status().Membership.Voters, want) {
+                agreed = false
+            }
+        }
+        l.groups[zoneID].mu.Unlock()
+
+        if agreed {
+            return
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("zone %s voters never became %q", zoneID, want)
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+}
+
+func TestMembershipChangesCommitThroughLog(t *testing.T) {
+    l := newTestConsensus(t, []string{"n1", "n2", "n3"})
+    defer l.Stop()
+    sm := newTestStateMachine()
+    l.SetApplyFunc(sm.apply)
+    for _, id := range []string{"n1", "n2", "n3"} {
+        if err := l.RegisterNode(id, "Z1", 0.9); err != nil {
+            t.Fatalf("RegisterNode(%s): %v", id, err)
+        }
+    }
+    if _, err := l.ElectZoneLeader("Z1"); err != nil {
+        t.Fatalf("ElectZoneLeader: %v", err)
+    }
+    if err := l.PropagateTransaction([]byte("tx1"), "Z1"); err != nil {
+        t.Fatalf("PropagateTransaction: %v", err)
+    }
+
+    // A node joining a running zone starts as a learner and catches up
+    if err := l.RegisterNode("n4", "Z1", 0.9); err != nil {
+        t.Fatalf("RegisterNode(n4): %v", err)
+    }
+    l.mu.RLock()
+    learner := l.Nodes["n4"].IsLearner
+    l.mu.RUnlock()
+    if !learner {
+        t.Fatal("n4 joined as a voter, want a learner")
+    }
+    sm.waitFor(t, "n4", "tx1")
+
+    deadline := time.Now().Add(2 * time.Second)
+    for {
+        err := l.PromoteNode("n4")
+        if err == nil {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("PromoteNode: %v", err)
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+    waitForVoters(t, l, "Z1", "n1", "n2", "n3", "n4")
+
+    // A node falling below the threshold is removed automatically
+    if err := l.UpdateNodeReputation("n2", 0.1); err != nil {
+        t.Fatalf("UpdateNodeReputation: %v", err)
+    }
+    waitForVoters(t, l, "Z1", "n1", "n3", "n4")
+
+    l.mu.RLock()
+    _, stillRegistered := l.Nodes["n2"]
+    members := append([]string{}, l.Nodes["n1"].GroupMembers...)
+    l.mu.RUnlock()
+    if stillRegistered {
+        t.Error("n2 is still registered after removal")
+    }
+    if !equalStrings(members, []string{"n1", "n3", "n4"}) {
+        t.Errorf("n1 group members = %q, want [n1 n3 n4]", members)
+    }
+
+    if err := l.PropagateTransaction([]byte("tx2"), "Z1"); err != nil {
+        t.Fatalf("PropagateTransaction after removal: %v", err)
+    }
+    for _, id := range []string{"n1", "n3", "n4"} {
+        sm.waitFor(t, id, "tx1", "tx2")
+    }
+}
+
+func TestRemovedLeaderIsReplaced(t *testing.T) {
+    l := newTestConsensus(t, []string{"n1", "n2", "n3"})
+    defer l.Stop()
+    for id, reputation := range map[string]float64{"n1": 0.9, "n2": 0.8, "n3": 0.7} {
+        if err := l.RegisterNode(id, "Z1", reputation); err != nil {
+            t.Fatalf("RegisterNode(%s): %v", id, err)
+        }
+    }
+    if leaderID, err := l.ElectZoneLeader("Z1"); err != nil || leaderID != "n1" {
+        t.Fatalf("ElectZoneLeader = %s, %v; want n1", leaderID, err)
+    }
+
+    if err := l.UpdateNodeReputation("n1", 0.1); err != nil {
+        t.Fatalf("UpdateNodeReputation: %v", err)
+    }
+
+    l.mu.RLock()
+    leaderID := l.ZoneLeaders["Z1"]
+    l.mu.RUnlock()
+    if leaderID != "n2" {
+        t.Fatalf("zone leader = %q, want n2", leaderID)
+    }
+    if err := l.PropagateTransaction([]byte("tx"), "Z1"); err != nil {
+        t.Fatalf("PropagateTransaction: %v", err)
+    }
+}
+
+func TestLearnerDoesNotCampaign(t *testing.T) {
+    node := newRaftNode("n3", Membership{Voters: []string{"n1", "n2"}, Learners: []string{"n3"}})
+    node.campaign()
+    if node.state != Follower || node.currentTerm != 0 {
+        t.Fatalf("learner campaigned: state %d, term %d", node.state, node.currentTerm)
+    }
+
+    voter := newRaftNode("n1", Membership{Voters: []string{"n1", "n2"}, Learners: []string{"n3"}})
+    voter.step(Message{Type: MsgRequestVote, From: "n3", To: "n1", Term: 5})
+    if voter.currentTerm != 0 || len(voter.msgs) != 0 {
+        t.Fatal("a learner's vote request disrupted a voter")
+    }
+}
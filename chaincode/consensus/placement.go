@@ -0,0 +1,164 @@
+package consensus
+
+import (
+    "fmt"
+    "math"
+    "sort"
+    "time"
+)
+
+// latencySmoothing is the weight a new round trip carries in a pair's
+// smoothed latency
+const latencySmoothing = 0.2
+
+// LeaderWeights sets how much each factor counts towards a candidate's
+// leadership score. Every factor is scaled to [0, 1], higher being better,
+// and the score is their average weighted by these weights.
+type LeaderWeights struct {
+    Reputation float64 // The candidate's rank under the ranking metric
+    Latency    float64 // Round trips to the zone's other members, fastest best
+    Centrality float64 // Distance to the zone's other members, nearest best
+}
+
+// DefaultLeaderWeights ranks candidates by reputation alone
+var DefaultLeaderWeights = LeaderWeights{Reputation: 1}
+
+// CandidateScore is the breakdown of a candidate's leadership score. A
+// candidate with no measured round trips, or without a position, gets no
+// credit for latency or centrality.
+type CandidateScore struct {
+    NodeID       string
+    Reputation   float64       // Rank under the ranking metric
+    MeanRTT      time.Duration // Mean smoothed round trip to the members it was measured to
+    MeanDistance float64       // Mean distance to the positioned members in metres, -1 if unknown
+    Latency      float64       // Fastest MeanRTT among the candidates over this one's
+    Centrality   float64       // Smallest MeanDistance among the candidates over this one's
+    Score        float64
+}
+
+// SetLeaderWeights changes how candidates for leadership are scored
+func (l *LHRaftConsensus) SetLeaderWeights(weights LeaderWeights) error {
+    if weights.Reputation < 0 || weights.Latency < 0 || weights.Centrality < 0 {
+        return fmt.Errorf("leader weights must not be negative: %+v", weights)
+    }
+    if weights.Reputation+weights.Latency+weights.Centrality == 0 {
+        return fmt.Errorf("leader weights must not all be zero")
+    }
+
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    l.leaderWeights = weights
+    return nil
+}
+
+// observeLatency records a round trip a local replica timed to a peer.
+// l.latencies keeps a smoothed round trip for each node and peer.
+func (l *LHRaftConsensus) observeLatency(nodeID, peerID string, rtt time.Duration) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    peers, exists := l.latencies[nodeID]
+    if !exists {
+        peers = make(map[string]time.Duration)
+        l.latencies[nodeID] = peers
+    }
+    if previous, measured := peers[peerID]; measured {
+        rtt = previous + time.Duration(latencySmoothing*float64(rtt-previous))
+    }
+    peers[peerID] = rtt
+}
+
+// latency returns the smoothed round trip between two nodes, as timed by
+// either of them
+func (l *LHRaftConsensus) latency(a, b string) (time.Duration, bool) {
+    if rtt, measured := l.latencies[a][b]; measured {
+        return rtt, true
+    }
+    rtt, measured := l.latencies[b][a]
+    return rtt, measured
+}
+
+// CandidateScores returns the score of each node eligible to lead the zone,
+// best first
+func (l *LHRaftConsensus) CandidateScores(zoneID string) []CandidateScore {
+    l.mu.RLock()
+    defer l.mu.RUnlock()
+
+    return l.candidateScores(zoneID)
+}
+
+// candidateScores scores the zone's eligible nodes, best first. Callers hold l.mu.
+func (l *LHRaftConsensus) candidateScores(zoneID string) []CandidateScore {
+    members := make([]*ConsensusNode, 0)
+    for _, node := range l.Nodes {
+        if node.Location == zoneID {
+            members = append(members, node)
+        }
+    }
+
+    scores := make([]CandidateScore, 0)
+    timed := make([]bool, 0)
+    fastest, nearest := time.Duration(math.MaxInt64), math.Inf(1)
+    for _, node := range members {
+        if node.Reputation < l.Threshold || !l.canLead(node) {
+            continue
+        }
+        score := CandidateScore{NodeID: node.ID, Reputation: l.rankScore(node), MeanDistance: -1}
+
+        var total time.Duration
+        var count int
+        var distance float64
+        var positioned int
+        for _, peer := range members {
+            if peer == node {
+                continue
+            }
+            if rtt, measured := l.latency(node.ID, peer.ID); measured {
+                total += rtt
+                count++
+            }
+            if node.Positioned && peer.Positioned {
+                distance += geoDistance(GeoPoint{node.Latitude, node.Longitude}, GeoPoint{peer.Latitude, peer.Longitude})
+                positioned++
+            }
+        }
+        if count > 0 {
+            score.MeanRTT = total / time.Duration(count)
+            if score.MeanRTT < fastest {
+                fastest = score.MeanRTT
+            }
+        }
+        if positioned > 0 {
+            score.MeanDistance = distance / float64(positioned)
+            nearest = math.Min(nearest, score.MeanDistance)
+        }
+        scores = append(scores, score)
+        timed = append(timed, count > 0)
+    }
+
+    w := l.leaderWeights
+    for i := range scores {
+        s := &scores[i]
+        if timed[i] {
+            s.Latency = 1
+            if s.MeanRTT > 0 {
+                s.Latency = float64(fastest) / float64(s.MeanRTT)
+            }
+        }
+        if s.MeanDistance == 0 {
+            s.Centrality = 1
+        } else if s.MeanDistance > 0 {
+            s.Centrality = nearest / s.MeanDistance
+        }
+        s.Score = (w.Reputation*s.Reputation + w.Latency*s.Latency + w.Centrality*s.Centrality) /
+            (w.Reputation + w.Latency + w.Centrality)
+    }
+    sort.Slice(scores, func(i, j int) bool {
+        if scores[i].Score != scores[j].Score {
+            return scores[i].Score > scores[j].Score
+        }
+        return scores[i].NodeID < scores[j].NodeID
+    })
+    return scores
+}
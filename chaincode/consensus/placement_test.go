@@ -0,0 +1,98 @@
+package consensus
+
+import (
+    "math"
+    "testing"
+    "time"
+)
+
+// slowBestNode places a zone of three eligible nodes: n1 is the best rated
+// but sits behind a slow link far from the others
+func slowBestNode(t *testing.T, l *LHRaftConsensus) {
+    withPositions(map[string]GeoPoint{
+        "n1": {10, 10},
+        "n2": {0, 0.01},
+        "n3": {0, 0},
+    }, nil)(t, l)
+    for id, reputation := range map[string]float64{"n1": 0.95, "n2": 0.85, "n3": 0.8} {
+        l.Nodes[id].Reputation = reputation
+    }
+    l.observeLatency("n1", "n2", 600*time.Millisecond)
+    l.observeLatency("n3", "n1", 600*time.Millisecond)
+    l.observeLatency("n2", "n3", 20*time.Millisecond)
+}
+
+func TestCandidateScoresBreakDownEachFactor(t *testing.T) {
+    l := newTestConsensus(t, nil, slowBestNode)
+
+    scores := l.CandidateScores("Z1")
+    if len(scores) != 3 || scores[0].NodeID != "n1" {
+        t.Fatalf("scores = %+v, want n1 first by reputation alone", scores)
+    }
+
+    if err := l.SetLeaderWeights(LeaderWeights{Reputation: 1, Latency: 1, Centrality: 1}); err != nil {
+        t.Fatalf("SetLeaderWeights: %v", err)
+    }
+    byID := make(map[string]CandidateScore)
+    for _, s := range l.CandidateScores("Z1") {
+        byID[s.NodeID] = s
+    }
+    n1, n2 := byID["n1"], byID["n2"]
+    if n1.MeanRTT != 600*time.Millisecond || n2.MeanRTT != 310*time.Millisecond {
+        t.Errorf("mean RTTs = %v and %v, want 600ms and 310ms", n1.MeanRTT, n2.MeanRTT)
+    }
+    if n2.Latency != 1 || math.Abs(n1.Latency-310.0/600) > 1e-9 {
+        t.Errorf("latency scores = %v and %v, want %v and 1", n1.Latency, n2.Latency, 310.0/600)
+    }
+    if n1.Centrality >= n2.Centrality || n2.Centrality > 1 {
+        t.Errorf("centrality = %v for n1 and %v for n2, want n2 more central", n1.Centrality, n2.Centrality)
+    }
+    want := (n2.Reputation + n2.Latency + n2.Centrality) / 3
+    if math.Abs(n2.Score-want) > 1e-9 {
+        t.Errorf("n2 score = %v, want the mean of its factors %v", n2.Score, want)
+    }
+    if best := l.bestCandidate("Z1", ""); best != "n2" {
+        t.Errorf("best candidate = %s, want n2 once latency and centrality count", best)
+    }
+}
+
+func TestSetLeaderWeightsRejectsInvalidWeights(t *testing.T) {
+    l := newTestConsensus(t, nil, slowBestNode)
+    for _, weights := range []LeaderWeights{{}, {Reputation: 1, Latency: -1}} {
+        if err := l.SetLeaderWeights(weights); err == nil {
+            t.Errorf("weights %+v accepted", weights)
+        }
+    }
+}
+
+func TestReplicasMeasureRoundTrips(t *testing.T) {
+    l := newTestConsensus(t, []string{"n1", "n2", "n3"})
+    defer l.Stop()
+    if err := l.SetZoneTiming("Z1", fastTiming); err != nil {
+        t.Fatalf("SetZoneTiming: %v", err)
+    }
+    for _, id := range []string{"n1", "n2", "n3"} {
+        if err := l.RegisterNode(id, "Z1", 0.9); err != nil {
+            t.Fatalf("RegisterNode(%s): %v", id, err)
+        }
+    }
+    if _, err := l.ElectZoneLeader("Z1"); err != nil {
+        t.Fatalf("ElectZoneLeader: %v", err)
+    }
+
+    // The leader times its heartbeats and the followers probe each other
+    deadline := time.Now().Add(2 * time.Second)
+    for {
+        l.mu.RLock()
+        _, followers := l.latency("n2", "n3")
+        _, leader := l.latency("n1", "n2")
+        l.mu.RUnlock()
+        if followers && leader {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("round trips measured: leader %v, followers %v", leader, followers)
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+}
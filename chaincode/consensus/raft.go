@@ -0,0 +1,1256 @@
+package consensus
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "hash/fnv"
+    "math/rand"
+    "sort"
+    "time"
+)
+
+// Default timing, in ticks. Each follower waits a random number of ticks
+// between the election timeout and twice that before campaigning; leaders
+// send a heartbeat every heartbeat timeout.
+const (
+    defaultElectionTicks  = 10
+    defaultHeartbeatTicks = 1
+)
+
+// ErrNotLeader is returned when a proposal reaches a node that is not leading its zone
+var ErrNotLeader = errors.New("node is not the zone leader")
+
+// ErrNotEligible is returned when leadership is handed to a node that may not lead
+var ErrNotEligible = errors.New("node is not eligible to lead")
+
+// MessageType identifies the RPC carried by a Message
+type MessageType int
+
+const (
+    MsgAppendEntries MessageType = iota
+    MsgAppendEntriesResponse
+    MsgRequestVote
+    MsgRequestVoteResponse
+    MsgInstallSnapshot
+    MsgInstallSnapshotResponse
+    MsgHeartbeat
+    MsgHeartbeatResponse
+    MsgPropose
+    MsgProposeResponse
+    MsgProbe
+    MsgProbeResponse
+    MsgReadIndex
+    MsgReadIndexResponse
+    MsgPreVote
+    MsgPreVoteResponse
+    MsgTransferLeader
+    MsgTimeoutNow
+    MsgRequest
+    MsgPrePrepare
+    MsgPrepare
+    MsgCommit
+    MsgCheckpoint
+    MsgViewChange
+    MsgNewView
+    MsgFetch
+    MsgFetchResponse
+)
+
+var messageTypeNames = map[MessageType]string{
+    MsgAppendEntries:           "AppendEntries",
+    MsgAppendEntriesResponse:   "AppendEntriesResponse",
+    MsgRequestVote:             "RequestVote",
+    MsgRequestVoteResponse:     "RequestVoteResponse",
+    MsgInstallSnapshot:         "InstallSnapshot",
+    MsgInstallSnapshotResponse: "InstallSnapshotResponse",
+    MsgHeartbeat:               "Heartbeat",
+    MsgHeartbeatResponse:       "HeartbeatResponse",
+    MsgPropose:                 "Propose",
+    MsgProposeResponse:         "ProposeResponse",
+    MsgProbe:                   "Probe",
+    MsgProbeResponse:           "ProbeResponse",
+    MsgReadIndex:               "ReadIndex",
+    MsgReadIndexResponse:       "ReadIndexResponse",
+    MsgPreVote:                 "PreVote",
+    MsgPreVoteResponse:         "PreVoteResponse",
+    MsgTransferLeader:          "TransferLeader",
+    MsgTimeoutNow:              "TimeoutNow",
+    MsgRequest:                 "Request",
+    MsgPrePrepare:              "PrePrepare",
+    MsgPrepare:                 "Prepare",
+    MsgCommit:                  "Commit",
+    MsgCheckpoint:              "Checkpoint",
+    MsgViewChange:              "ViewChange",
+    MsgNewView:                 "NewView",
+    MsgFetch:                   "Fetch",
+    MsgFetchResponse:           "FetchResponse",
+}
+
+func (t MessageType) String() string {
+    if name, ok := messageTypeNames[t]; ok {
+        return name
+    }
+    return fmt.Sprintf("MessageType(%d)", int(t))
+}
+
+// Message is an RPC exchanged between members of a zone group
+type Message struct {
+    Type         MessageType
+    Group        string // Zone group the message belongs to
+    From         string
+    To           string
+    Term         uint64
+    PrevLogIndex uint64
+    PrevLogTerm  uint64
+    LastLogIndex uint64 // On RequestVote and PreVote: the candidate's last log entry
+    LastLogTerm  uint64
+    Entries      []LogEntry
+    Snapshot     *Snapshot // On InstallSnapshot: the leader's latest snapshot
+    LeaderCommit uint64
+    Success      bool   // On responses: whether the request (or vote) was granted
+    MatchIndex   uint64 // On responses: the follower's last matching index, or a hint when rejecting
+    Proposal     uint64 // On Propose, ReadIndex and their responses: the requester's ID for the request
+    Reject       string // On ProposeResponse and ReadIndexResponse: why the leader refused the request
+    Sent         int64  // On Heartbeat and Probe, echoed by their responses: the sender's clock, in nanoseconds since it started
+    Force        bool   // On RequestVote: the sitting leader is handing over, so voters need not wait out its lease
+    Transferee   string // On TransferLeader: the member to hand leadership to
+    Signature    []byte // The sender's signature over the rest of the message, see signingBytes
+
+    // Fields of the messages exchanged by BFT zones, see bftNode
+    View     uint64    // The view the sender is in, or is moving to on ViewChange
+    Sequence uint64    // The sequence number agreed on or checkpointed; on Fetch, the last one the sender executed
+    Digest   []byte    // On PrePrepare, Prepare and Commit: the request's digest; on Checkpoint: the executed state's
+    Requests []Message // On PrePrepare: the request assigned the sequence number, none for a null request; on FetchResponse: the requests executed up to Sequence
+    Proof    []Message // On ViewChange, NewView and FetchResponse: the signed messages that justify it
+}
+
+// ReadState tells a node's driver that a read it requested may be served
+// once the node has applied the entry at Index
+type ReadState struct {
+    ID    uint64
+    Index uint64
+}
+
+// Ready is the work a node's driver must carry out after a state change, in
+// order: durably store and restore Snapshot, durably store HardState and
+// Entries, send Messages, then apply CommittedEntries. Reads in ReadStates
+// are served once their index has been applied.
+type Ready struct {
+    Snapshot         *Snapshot  // Snapshot received from the leader, if any
+    HardState        *HardState // Nil when unchanged
+    Entries          []LogEntry
+    CommittedEntries []LogEntry
+    Messages         []Message
+    ReadStates       []ReadState
+}
+
+func (rd Ready) isEmpty() bool {
+    return rd.Snapshot == nil && rd.HardState == nil && len(rd.Entries) == 0 && len(rd.CommittedEntries) == 0 && len(rd.Messages) == 0 && len(rd.ReadStates) == 0
+}
+
+// readRequest is a read the leader is confirming it may serve: no other
+// leader can have committed entries past index once a quorum has
+// acknowledged a heartbeat sent at or after at
+type readRequest struct {
+    id    uint64
+    from  string // Member that requested the read
+    index uint64 // Commit index when the read arrived
+    at    time.Duration
+}
+
+// raftNode is the Raft state of one member of a zone group. It is a pure state
+// machine: input arrives through step and propose, output leaves through ready.
+type raftNode struct {
+    id          string
+    peers       []string // Other voting members, sorted
+    learners    []string // Other non-voting members, sorted
+    membership  Membership
+    state       NodeState
+    currentTerm uint64
+    votedFor    string
+    leaderID    string
+    log         *raftLog
+    nextIndex   map[string]uint64
+    matchIndex  map[string]uint64
+    votes       map[string]bool
+    msgs        []Message
+    prevHard    HardState // Hard state as of the last Ready
+    pendingConf uint64    // Index of the last membership or zone change proposed as leader
+    merged      uint64    // Index of a merge into another zone; nothing is appended after it
+    transferee  string    // Member a leader is handing leadership to, if any
+    snapshot    Snapshot  // Latest snapshot, sent to followers the log no longer covers
+    received    *Snapshot // Snapshot installed from the leader, awaiting the driver
+
+    electionTicks             int // Base election timeout
+    electionElapsed           int // Ticks since the leader was last heard from
+    randomizedElectionTimeout int
+    heartbeatTicks            int
+    heartbeatElapsed          int // Ticks since the leader last sent heartbeats
+    transferElapsed           int // Ticks since the leader started handing over
+    probeElapsed              int // Ticks since a member not leading last probed the others
+    rand                      *rand.Rand
+
+    // now is the node's monotonic clock. Heartbeats carry it so that the
+    // leader knows how recently each follower has acknowledged it.
+    now           func() time.Duration
+    leaseDuration time.Duration            // How long a quorum's acknowledgement lets the leader serve reads alone; zero disables leases
+    leaderSince   time.Duration            // When this node last became leader
+    ackedAt       map[string]time.Duration // Peer -> send time of the latest heartbeat it acknowledged this term
+    pendingReads  []readRequest            // Reads waiting for a quorum to acknowledge a heartbeat, oldest first
+    readStates    []ReadState
+    booting       bool // Started within the election timeout, so may have granted a lease it no longer knows of
+
+    // recentActive holds the voters a leader has heard from since it last
+    // checked that it can still reach a quorum
+    recentActive map[string]bool
+
+    // eligible reports whether a node may lead; votes go only to eligible candidates
+    eligible func(nodeID string) bool
+}
+
+func newRaftNode(id string, membership Membership) *raftNode {
+    seed := fnv.New64a()
+    seed.Write([]byte(id))
+    start := time.Now()
+
+    r := &raftNode{
+        id:             id,
+        state:          Follower,
+        log:            newRaftLog(),
+        nextIndex:      make(map[string]uint64),
+        matchIndex:     make(map[string]uint64),
+        votes:          make(map[string]bool),
+        electionTicks:  defaultElectionTicks,
+        heartbeatTicks: defaultHeartbeatTicks,
+        rand:           rand.New(rand.NewSource(time.Now().UnixNano() ^ int64(seed.Sum64()))),
+        now:            func() time.Duration { return time.Since(start) },
+        ackedAt:        make(map[string]time.Duration),
+        booting:        true,
+        recentActive:   make(map[string]bool),
+    }
+    r.setMembership(membership)
+    r.resetElectionTimer()
+    return r
+}
+
+// resetElectionTimer restarts the election timeout with a fresh random length
+// so that candidates in the same zone rarely split the vote
+func (r *raftNode) resetElectionTimer() {
+    r.electionElapsed = 0
+    r.randomizedElectionTimeout = r.electionTicks + r.rand.Intn(r.electionTicks)
+}
+
+// restore loads state recovered from storage into a new node. Entries up to
+// the commit index are applied again from the snapshot onwards.
+func (r *raftNode) restore(state HardState, snapshot Snapshot, entries []LogEntry) {
+    r.currentTerm = state.Term
+    r.votedFor = state.Vote
+    r.snapshot = snapshot
+    if snapshot.Index > 0 {
+        r.setMembership(snapshot.Membership)
+    }
+    r.log.compact(snapshot.Index, snapshot.Term)
+    r.log.append(entries...)
+    r.log.stabled = r.log.lastIndex()
+    if commit := minIndex(state.Commit, r.log.lastIndex()); commit > r.log.committed {
+        r.log.committed = commit
+    }
+    r.prevHard = r.hardState()
+}
+
+// compact records a snapshot of the applied state and drops the entries it covers
+func (r *raftNode) compact(snapshot Snapshot) {
+    if snapshot.Index <= r.snapshot.Index || snapshot.Index > r.log.applied {
+        return
+    }
+    r.snapshot = snapshot
+    r.log.compact(snapshot.Index, snapshot.Term)
+}
+
+// hardState returns the state that must be persisted before messages are sent
+func (r *raftNode) hardState() HardState {
+    return HardState{Term: r.currentTerm, Vote: r.votedFor, Commit: r.log.committed}
+}
+
+// setTiming changes the election and heartbeat timeouts, in ticks
+func (r *raftNode) setTiming(electionTicks, heartbeatTicks int) {
+    if electionTicks > 0 {
+        r.electionTicks = electionTicks
+    }
+    if heartbeatTicks > 0 {
+        r.heartbeatTicks = heartbeatTicks
+    }
+    r.resetElectionTimer()
+}
+
+// isEligible reports whether nodeID may become leader
+func (r *raftNode) isEligible(nodeID string) bool {
+    return r.eligible == nil || r.eligible(nodeID)
+}
+
+// setMembership replaces the group's voters and learners
+func (r *raftNode) setMembership(m Membership) {
+    r.membership = Membership{Voters: append([]string{}, m.Voters...), Learners: append([]string{}, m.Learners...), Seats: copySeats(m.Seats)}
+    r.peers = removeString(m.Voters, r.id)
+    r.learners = removeString(m.Learners, r.id)
+    sort.Strings(r.peers)
+    sort.Strings(r.learners)
+
+    members := make(map[string]bool)
+    for _, peer := range r.replicas() {
+        members[peer] = true
+        if _, ok := r.nextIndex[peer]; !ok {
+            r.nextIndex[peer] = r.log.lastIndex() + 1
+            r.matchIndex[peer] = 0
+        }
+    }
+    for peer := range r.nextIndex {
+        if !members[peer] {
+            delete(r.nextIndex, peer)
+            delete(r.matchIndex, peer)
+        }
+    }
+}
+
+// replicas returns every other member the log is replicated to
+func (r *raftNode) replicas() []string {
+    return append(append([]string{}, r.peers...), r.learners...)
+}
+
+// quorum is the number of voters that form a majority
+func (r *raftNode) quorum() int {
+    return len(r.membership.Voters)/2 + 1
+}
+
+func (r *raftNode) becomeFollower(term uint64, leaderID string) {
+    r.dropReads()
+    r.transferee = ""
+    if term != r.currentTerm {
+        r.currentTerm = term
+        r.votedFor = ""
+    }
+    r.state = Follower
+    r.leaderID = leaderID
+    // Only hearing from a leader (or granting a vote) holds off an election;
+    // a higher term alone must not, or a lagging candidate could stall the
+    // zone by repeatedly resetting everyone's timer
+    if leaderID != "" {
+        r.resetElectionTimer()
+    }
+}
+
+// becomeCandidate starts a new term and votes for itself
+func (r *raftNode) becomeCandidate() {
+    r.dropReads()
+    r.currentTerm++
+    r.votedFor = r.id
+    r.state = Candidate
+    r.leaderID = ""
+    r.votes = map[string]bool{r.id: true}
+    r.resetElectionTimer()
+}
+
+// becomeLeader takes leadership of the current term and appends an empty
+// entry so that entries from earlier terms can be committed
+func (r *raftNode) becomeLeader() {
+    r.state = Leader
+    r.leaderID = r.id
+    r.heartbeatElapsed = 0
+    r.transferee = ""
+    r.leaderSince = r.now()
+    r.ackedAt = make(map[string]time.Duration)
+    r.recentActive = make(map[string]bool)
+    r.resetElectionTimer()
+
+    for _, peer := range r.replicas() {
+        r.nextIndex[peer] = r.log.lastIndex() + 1
+        r.matchIndex[peer] = 0
+    }
+
+    r.appendEntry(EntryNormal, nil)
+    // Changes proposed by earlier leaders may still be uncommitted
+    r.pendingConf = r.log.lastIndex()
+    if r.merged > r.log.applied {
+        // Appended while leading before, and possibly overwritten since
+        r.merged = 0
+    }
+    if r.merged == 0 {
+        r.merged = r.pendingMerge()
+    }
+    r.broadcastAppend()
+}
+
+// tick advances the node's logical clock by one tick. Leaders send
+// heartbeats and step down if a quorum stops answering them; followers that
+// stop hearing from their leader campaign.
+func (r *raftNode) tick() {
+    if r.state == Leader {
+        r.electionElapsed++
+        if r.electionElapsed >= r.electionTicks {
+            r.electionElapsed = 0
+            if !r.checkQuorum() {
+                // The rest of the zone has most likely elected another
+                // leader; stop accepting proposals that cannot commit
+                r.becomeFollower(r.currentTerm, "")
+                return
+            }
+        }
+        if r.transferee != "" {
+            r.transferElapsed++
+            if r.transferElapsed >= r.electionTicks {
+                // The member did not catch up in time; carry on leading
+                r.transferee = ""
+            }
+        }
+        r.heartbeatElapsed++
+        if r.heartbeatElapsed >= r.heartbeatTicks {
+            r.heartbeatElapsed = 0
+            r.broadcastHeartbeat()
+        }
+        return
+    }
+
+    // Members that send no heartbeats measure their latency to the others
+    // with a probe every election timeout
+    r.probeElapsed++
+    if r.probeElapsed >= r.electionTicks {
+        r.probeElapsed = 0
+        r.broadcastProbe()
+    }
+
+    r.electionElapsed++
+    if r.electionElapsed >= r.electionTicks {
+        r.booting = false
+    }
+    if r.electionElapsed >= r.randomizedElectionTimeout {
+        r.preCampaign()
+    }
+}
+
+// checkQuorum reports whether a quorum of voters, the leader included, has
+// been heard from since the last check, and starts the next one
+func (r *raftNode) checkQuorum() bool {
+    active := 0
+    for _, id := range r.membership.Voters {
+        if id == r.id || r.recentActive[id] {
+            active++
+        }
+    }
+    r.recentActive = make(map[string]bool)
+    return active >= r.quorum()
+}
+
+// preCampaign asks the other members whether they would elect this node
+// before it starts a new term. A node cut off from its zone never wins a
+// pre-vote, so it does not inflate its term and depose a healthy leader
+// when it rejoins.
+func (r *raftNode) preCampaign() {
+    if r.state == Leader {
+        return
+    }
+    if !r.membership.isVoter(r.id) || !r.isEligible(r.id) {
+        r.resetElectionTimer()
+        return
+    }
+    if r.quorum() == 1 {
+        r.campaign()
+        return
+    }
+
+    r.dropReads()
+    r.state = PreCandidate
+    r.leaderID = ""
+    r.votes = map[string]bool{r.id: true}
+    r.resetElectionTimer()
+    for _, peer := range r.peers {
+        r.send(Message{
+            Type:         MsgPreVote,
+            To:           peer,
+            Term:         r.currentTerm + 1,
+            LastLogIndex: r.log.lastIndex(),
+            LastLogTerm:  r.log.lastTerm(),
+        })
+    }
+}
+
+// campaign asks the other members to elect this node for a new term at
+// once. It is used when the zone chooses its leader deliberately, so the
+// sitting leader's followers must not refuse it as they would a pre-vote.
+func (r *raftNode) campaign() {
+    r.startCampaign(false)
+}
+
+// forceCampaign is campaign for a node its leader is handing over to: voters
+// grant their votes even while they would otherwise wait out the leader's
+// lease, which it gave up when it started handing over
+func (r *raftNode) forceCampaign() {
+    r.startCampaign(true)
+}
+
+func (r *raftNode) startCampaign(force bool) {
+    if r.state == Leader {
+        return
+    }
+    if !r.membership.isVoter(r.id) || !r.isEligible(r.id) {
+        // Nobody would vote for us; wait for an eligible node to campaign
+        r.resetElectionTimer()
+        return
+    }
+
+    r.becomeCandidate()
+    if r.quorum() == 1 {
+        r.becomeLeader()
+        return
+    }
+    for _, peer := range r.peers {
+        r.send(Message{
+            Type:         MsgRequestVote,
+            To:           peer,
+            LastLogIndex: r.log.lastIndex(),
+            LastLogTerm:  r.log.lastTerm(),
+            Force:        force,
+        })
+    }
+}
+
+// propose appends data to the leader's log and starts replicating it
+func (r *raftNode) propose(data []byte) (uint64, uint64, error) {
+    return r.proposeEntry(EntryNormal, data)
+}
+
+// proposeEntry is propose for an entry of any type but a membership change
+func (r *raftNode) proposeEntry(entryType EntryType, data []byte) (uint64, uint64, error) {
+    if r.state != Leader || r.transferee != "" {
+        return 0, 0, ErrNotLeader
+    }
+    if r.merged != 0 {
+        return 0, 0, ErrZoneMerged
+    }
+
+    entry := r.appendEntry(entryType, data)
+    r.broadcastAppend()
+    return entry.Index, entry.Term, nil
+}
+
+// proposeConfChange appends a membership change to the leader's log. Only one
+// change may be in flight; a learner is promoted only once it has caught up.
+func (r *raftNode) proposeConfChange(cc ConfChange) (uint64, uint64, error) {
+    if r.state != Leader || r.transferee != "" {
+        return 0, 0, ErrNotLeader
+    }
+    if r.merged != 0 {
+        return 0, 0, ErrZoneMerged
+    }
+    if r.pendingConf > r.log.applied {
+        return 0, 0, ErrConfChangePending
+    }
+    if err := r.membership.validate(cc); err != nil {
+        return 0, 0, err
+    }
+    if cc.Type == ConfPromoteLearner && r.matchIndex[cc.NodeID] < r.log.committed {
+        return 0, 0, ErrLearnerBehind
+    }
+
+    data, err := json.Marshal(cc)
+    if err != nil {
+        return 0, 0, err
+    }
+    entry := r.appendEntry(EntryConfChange, data)
+    r.pendingConf = entry.Index
+    r.broadcastAppend()
+    return entry.Index, entry.Term, nil
+}
+
+// applyConfChange makes a committed membership change take effect. A leader
+// that is no longer a voter steps down.
+func (r *raftNode) applyConfChange(cc ConfChange) {
+    r.setMembership(r.membership.apply(cc))
+
+    if r.state != Leader {
+        return
+    }
+    if !r.membership.isVoter(r.id) {
+        // The others only act on the change once they learn it committed
+        r.broadcastAppend()
+        r.becomeFollower(r.currentTerm, "")
+        return
+    }
+    // A smaller quorum may already hold later entries
+    if r.maybeCommit() {
+        r.broadcastAppend()
+    }
+}
+
+// proposeZoneChange appends a zone change to the leader's log. Zone changes
+// are made one at a time, like membership changes, and a merge is the last
+// entry the leader appends.
+func (r *raftNode) proposeZoneChange(zc ZoneChange) (uint64, uint64, error) {
+    if r.state != Leader || r.transferee != "" {
+        return 0, 0, ErrNotLeader
+    }
+    if r.merged != 0 {
+        return 0, 0, ErrZoneMerged
+    }
+    if r.pendingConf > r.log.applied {
+        return 0, 0, ErrConfChangePending
+    }
+    if err := r.membership.validateZoneChange(zc); err != nil {
+        return 0, 0, err
+    }
+
+    data, err := json.Marshal(zc)
+    if err != nil {
+        return 0, 0, err
+    }
+    entry := r.appendEntry(EntryZoneChange, data)
+    r.pendingConf = entry.Index
+    if zc.Type == ZoneMerge {
+        r.merged = entry.Index
+    }
+    r.broadcastAppend()
+    return entry.Index, entry.Term, nil
+}
+
+// applyZoneChange records a committed zone change. A zone that has merged
+// away accepts no more proposals, whichever member leads it.
+func (r *raftNode) applyZoneChange(index uint64, zc ZoneChange) {
+    if zc.Type == ZoneMerge {
+        r.merged = index
+    }
+}
+
+// pendingMerge returns the index of a merge appended but not yet applied, or
+// zero if there is none
+func (r *raftNode) pendingMerge() uint64 {
+    for _, entry := range r.log.slice(r.log.applied+1, r.log.lastIndex()+1) {
+        if entry.Type != EntryZoneChange {
+            continue
+        }
+        if zc, err := DecodeZoneChange(entry.Data); err == nil && zc.Type == ZoneMerge {
+            return entry.Index
+        }
+    }
+    return 0
+}
+
+func (r *raftNode) appendEntry(entryType EntryType, data []byte) LogEntry {
+    entry := LogEntry{
+        Term:  r.currentTerm,
+        Index: r.log.lastIndex() + 1,
+        Type:  entryType,
+        Data:  data,
+    }
+    r.log.append(entry)
+    r.maybeCommit()
+    return entry
+}
+
+// forward sends a proposal to the leader on behalf of a local proposer, who
+// is told where the leader appended it by a ProposeResponse
+func (r *raftNode) forward(id uint64, entry LogEntry) error {
+    if r.leaderID == "" || r.leaderID == r.id {
+        return ErrNotLeader
+    }
+    r.send(Message{Type: MsgPropose, To: r.leaderID, Proposal: id, Entries: []LogEntry{{Type: entry.Type, Data: entry.Data}}})
+    return nil
+}
+
+// transferLeadership hands leadership to another voter. The leader stops
+// accepting proposals and, once the voter's log has caught up, tells it to
+// campaign at once; it carries on leading if that takes longer than an
+// election timeout. A member not leading forwards the request to its leader.
+func (r *raftNode) transferLeadership(to string) error {
+    if r.state != Leader {
+        if r.leaderID == "" {
+            return ErrNotLeader
+        }
+        r.send(Message{Type: MsgTransferLeader, To: r.leaderID, Transferee: to})
+        return nil
+    }
+    if to == r.id {
+        r.transferee = ""
+        return nil
+    }
+    if !r.membership.isVoter(to) {
+        return fmt.Errorf("node %s is not a voter", to)
+    }
+    if !r.isEligible(to) {
+        return ErrNotEligible
+    }
+    if r.transferee == to {
+        return nil
+    }
+
+    r.transferee = to
+    r.transferElapsed = 0
+    if r.matchIndex[to] == r.log.lastIndex() {
+        r.send(Message{Type: MsgTimeoutNow, To: to})
+    } else {
+        r.sendAppend(to)
+    }
+    return nil
+}
+
+// requestRead asks for the index a linearizable read must wait to be applied
+// at. The leader answers through a ReadState; other members ask the leader,
+// whose ReadIndexResponse goes to the driver.
+func (r *raftNode) requestRead(id uint64) error {
+    if r.state == Leader {
+        return r.confirmRead(readRequest{id: id, from: r.id})
+    }
+    if r.leaderID == "" {
+        return ErrNotLeader
+    }
+    r.send(Message{Type: MsgReadIndex, To: r.leaderID, Proposal: id})
+    return nil
+}
+
+// handleReadIndex confirms a read requested by another member
+func (r *raftNode) handleReadIndex(m Message) {
+    err := ErrNotLeader
+    if r.state == Leader && r.membership.isMember(m.From) {
+        err = r.confirmRead(readRequest{id: m.Proposal, from: m.From})
+    }
+    if err != nil {
+        r.send(Message{Type: MsgReadIndexResponse, To: m.From, Proposal: m.Proposal, Reject: err.Error()})
+    }
+}
+
+// confirmRead serves a read at the commit index once this node is sure it
+// still leads: at once while its lease holds, otherwise once a quorum has
+// acknowledged a heartbeat sent after the read arrived. Until the leader has
+// committed an entry of its own term, its commit index may trail entries
+// earlier leaders committed, so it cannot serve reads yet.
+func (r *raftNode) confirmRead(req readRequest) error {
+    if term, _ := r.log.term(r.log.committed); term != r.currentTerm {
+        return ErrNotLeader
+    }
+    req.index = r.log.committed
+    req.at = r.now()
+    if r.quorum() == 1 || r.leaseValid() {
+        r.readDone(req)
+        return nil
+    }
+    r.pendingReads = append(r.pendingReads, req)
+    r.broadcastHeartbeat()
+    return nil
+}
+
+// leaseValid reports whether the leader may serve reads without contacting
+// the others. Voters that acknowledged a heartbeat refuse to elect another
+// leader for at least leaseDuration after it was sent, so the lease runs
+// from the heartbeat a quorum has most recently acknowledged.
+func (r *raftNode) leaseValid() bool {
+    // A member told to campaign is elected without waiting out the lease
+    if r.leaseDuration <= 0 || r.state != Leader || r.transferee != "" {
+        return false
+    }
+    now := r.now()
+    acked := make([]time.Duration, 0, len(r.membership.Voters))
+    for _, id := range r.membership.Voters {
+        if id == r.id {
+            acked = append(acked, now)
+        } else if at, ok := r.ackedAt[id]; ok {
+            acked = append(acked, at)
+        }
+    }
+    if len(acked) < r.quorum() {
+        return false
+    }
+    sort.Slice(acked, func(i, j int) bool { return acked[i] > acked[j] })
+    return now < acked[r.quorum()-1]+r.leaseDuration
+}
+
+// inLease reports whether a leader may be relying on this node not to vote:
+// it has heard from the leader within the election timeout, or has started
+// within it and cannot tell what it acknowledged before
+func (r *raftNode) inLease() bool {
+    return r.leaseDuration > 0 && r.electionElapsed < r.electionTicks && (r.leaderID != "" || r.booting)
+}
+
+// advanceReads serves the pending reads a quorum has acknowledged a
+// heartbeat for
+func (r *raftNode) advanceReads() {
+    served := 0
+    for _, req := range r.pendingReads {
+        acks := 0
+        for _, id := range r.membership.Voters {
+            if id == r.id || r.ackedAt[id] >= req.at {
+                acks++
+            }
+        }
+        if acks < r.quorum() {
+            break
+        }
+        r.readDone(req)
+        served++
+    }
+    r.pendingReads = r.pendingReads[served:]
+}
+
+// readDone hands a confirmed read to its requester
+func (r *raftNode) readDone(req readRequest) {
+    if req.from == r.id {
+        r.readStates = append(r.readStates, ReadState{ID: req.id, Index: req.index})
+        return
+    }
+    r.send(Message{Type: MsgReadIndexResponse, To: req.from, Proposal: req.id, Success: true, MatchIndex: req.index})
+}
+
+// dropReads refuses the reads a leader was confirming when it stops leading
+func (r *raftNode) dropReads() {
+    for _, req := range r.pendingReads {
+        if req.from != r.id {
+            r.send(Message{Type: MsgReadIndexResponse, To: req.from, Proposal: req.id, Reject: ErrNotLeader.Error()})
+        }
+    }
+    r.pendingReads = nil
+}
+
+// step processes a message from another member
+func (r *raftNode) step(m Message) {
+    switch m.Type {
+    case MsgPropose:
+        // Proposals carry no Raft state and are answered whatever their term
+        r.handlePropose(m)
+        return
+    case MsgProposeResponse, MsgProbeResponse, MsgReadIndexResponse:
+        // Consumed by the driver, which tracks requesters and measures latency
+        return
+    case MsgProbe:
+        // Probes carry no Raft state and are answered whatever their term
+        r.send(Message{Type: MsgProbeResponse, To: m.From, Sent: m.Sent})
+        return
+    case MsgReadIndex:
+        r.handleReadIndex(m)
+        return
+    case MsgTransferLeader:
+        // Forwarded by a member on behalf of its driver; only the leader acts
+        if r.state == Leader {
+            r.transferLeadership(m.Transferee)
+        }
+        return
+    }
+    if (m.Type == MsgRequestVote || m.Type == MsgPreVote) && !r.membership.isVoter(m.From) {
+        // Removed or not yet promoted nodes must not disrupt the group
+        return
+    }
+    // Pre-votes are for the term the candidate would start; they change
+    // nobody's term unless refused by a member that is further ahead
+    if m.Type == MsgPreVote {
+        r.handlePreVote(m)
+        return
+    }
+    if m.Type == MsgPreVoteResponse && m.Success {
+        r.handlePreVoteResponse(m)
+        return
+    }
+    if m.Type == MsgRequestVote && !m.Force && r.inLease() {
+        // A leader may be serving reads on the strength of our
+        // acknowledgement; electing another now could make them stale
+        return
+    }
+
+    switch {
+    case m.Term > r.currentTerm:
+        leaderID := ""
+        if m.Type == MsgAppendEntries || m.Type == MsgHeartbeat || m.Type == MsgInstallSnapshot {
+            leaderID = m.From
+        }
+        r.becomeFollower(m.Term, leaderID)
+    case m.Term < r.currentTerm:
+        // Stale sender; let it learn the current term
+        switch m.Type {
+        case MsgAppendEntries, MsgHeartbeat, MsgInstallSnapshot:
+            r.send(Message{Type: MsgAppendEntriesResponse, To: m.From, MatchIndex: r.log.lastIndex()})
+        case MsgRequestVote:
+            r.send(Message{Type: MsgRequestVoteResponse, To: m.From})
+        }
+        return
+    }
+    if r.state == Leader {
+        r.recentActive[m.From] = true
+    }
+
+    switch m.Type {
+    case MsgAppendEntries:
+        r.handleAppendEntries(m)
+    case MsgAppendEntriesResponse:
+        r.handleAppendEntriesResponse(m)
+    case MsgRequestVote:
+        r.handleRequestVote(m)
+    case MsgRequestVoteResponse:
+        r.handleRequestVoteResponse(m)
+    case MsgPreVoteResponse:
+        r.handlePreVoteResponse(m)
+    case MsgInstallSnapshot:
+        r.handleInstallSnapshot(m)
+    case MsgInstallSnapshotResponse:
+        // Installing a snapshot brings the follower's log up to its index
+        m.Success = true
+        r.handleAppendEntriesResponse(m)
+    case MsgHeartbeat:
+        r.handleHeartbeat(m)
+    case MsgHeartbeatResponse:
+        r.handleHeartbeatResponse(m)
+    case MsgTimeoutNow:
+        // The leader of our term is handing over to us and has stopped
+        // accepting proposals, so our log is as long as its own
+        r.forceCampaign()
+    }
+}
+
+// handlePropose appends an entry forwarded by another member of the group.
+// The response carries the entry's index in MatchIndex and its term in Term,
+// or why it was refused.
+func (r *raftNode) handlePropose(m Message) {
+    var err error
+    var index uint64
+    switch {
+    case !r.membership.isMember(m.From):
+        err = fmt.Errorf("node %s is not a member", m.From)
+    case len(m.Entries) != 1:
+        err = fmt.Errorf("a proposal carries exactly one entry")
+    case m.Entries[0].Type == EntryConfChange:
+        var cc ConfChange
+        if err = json.Unmarshal(m.Entries[0].Data, &cc); err == nil {
+            index, _, err = r.proposeConfChange(cc)
+        }
+    case m.Entries[0].Type == EntryZoneChange:
+        var zc ZoneChange
+        if zc, err = DecodeZoneChange(m.Entries[0].Data); err == nil {
+            index, _, err = r.proposeZoneChange(zc)
+        }
+    default:
+        index, _, err = r.proposeEntry(m.Entries[0].Type, m.Entries[0].Data)
+    }
+
+    resp := Message{Type: MsgProposeResponse, To: m.From, Proposal: m.Proposal, Success: err == nil, MatchIndex: index}
+    if err != nil {
+        resp.Reject = err.Error()
+    }
+    r.send(resp)
+}
+
+// handleRequestVote grants a vote to a candidate whose log is at least as up
+// to date as ours and whose reputation qualifies it to lead, at most once per term
+func (r *raftNode) handleRequestVote(m Message) {
+    canVote := r.votedFor == "" || r.votedFor == m.From
+    grant := canVote && r.log.isUpToDate(m.LastLogIndex, m.LastLogTerm) && r.isEligible(m.From)
+    if grant {
+        r.votedFor = m.From
+        r.resetElectionTimer()
+    }
+    r.send(Message{Type: MsgRequestVoteResponse, To: m.From, Success: grant})
+}
+
+func (r *raftNode) handleRequestVoteResponse(m Message) {
+    if r.state != Candidate {
+        return
+    }
+
+    r.votes[m.From] = m.Success
+    switch granted, rejected := r.tally(); {
+    case granted >= r.quorum():
+        r.becomeLeader()
+    case rejected >= r.quorum():
+        r.becomeFollower(r.currentTerm, "")
+    }
+}
+
+// handlePreVote tells a candidate whether it would get our vote in the term
+// it means to start. Members that have heard from a leader within the
+// election timeout refuse, so that a node rejoining the zone cannot force
+// an election while the leader is healthy.
+func (r *raftNode) handlePreVote(m Message) {
+    heardLeader := r.leaderID != "" && r.electionElapsed < r.electionTicks
+    grant := m.Term > r.currentTerm && !heardLeader && !r.inLease() &&
+        r.log.isUpToDate(m.LastLogIndex, m.LastLogTerm) && r.isEligible(m.From)
+    resp := Message{Type: MsgPreVoteResponse, To: m.From, Term: r.currentTerm, Success: grant}
+    if grant {
+        resp.Term = m.Term
+    }
+    r.send(resp)
+}
+
+// handlePreVoteResponse starts a real campaign once a quorum would vote for
+// this node, and gives up once a quorum would not
+func (r *raftNode) handlePreVoteResponse(m Message) {
+    if r.state != PreCandidate || (m.Success && m.Term != r.currentTerm+1) {
+        return
+    }
+
+    r.votes[m.From] = m.Success
+    switch granted, rejected := r.tally(); {
+    case granted >= r.quorum():
+        r.campaign()
+    case rejected >= r.quorum():
+        r.becomeFollower(r.currentTerm, "")
+    }
+}
+
+// tally counts the votes granted and refused by voters in this election
+func (r *raftNode) tally() (granted, rejected int) {
+    for id, vote := range r.votes {
+        if !r.membership.isVoter(id) {
+            continue
+        }
+        if vote {
+            granted++
+        } else {
+            rejected++
+        }
+    }
+    return granted, rejected
+}
+
+func (r *raftNode) handleAppendEntries(m Message) {
+    // Any AppendEntries of the current term comes from its elected leader
+    r.becomeFollower(m.Term, m.From)
+
+    if !r.log.matchTerm(m.PrevLogIndex, m.PrevLogTerm) {
+        r.send(Message{Type: MsgAppendEntriesResponse, To: m.From, MatchIndex: r.log.lastIndex()})
+        return
+    }
+
+    r.log.append(m.Entries...)
+    lastNew := m.PrevLogIndex + uint64(len(m.Entries))
+    if commit := minIndex(m.LeaderCommit, lastNew); commit > r.log.committed {
+        r.log.committed = commit
+    }
+    r.send(Message{Type: MsgAppendEntriesResponse, To: m.From, Success: true, MatchIndex: lastNew})
+}
+
+// handleInstallSnapshot replaces a lagging follower's log with the leader's
+// snapshot, keeping any later entries the follower already holds
+func (r *raftNode) handleInstallSnapshot(m Message) {
+    r.becomeFollower(m.Term, m.From)
+
+    if m.Snapshot == nil || m.Snapshot.Index <= r.log.committed {
+        // Already covered; report how far we are
+        r.send(Message{Type: MsgInstallSnapshotResponse, To: m.From, MatchIndex: r.log.committed})
+        return
+    }
+
+    snapshot := *m.Snapshot
+    r.log.compact(snapshot.Index, snapshot.Term)
+    r.setMembership(snapshot.Membership)
+    r.snapshot = snapshot
+    r.received = &snapshot
+    r.send(Message{Type: MsgInstallSnapshotResponse, To: m.From, MatchIndex: snapshot.Index})
+}
+
+// handleHeartbeat keeps a follower from campaigning and passes on the commit
+// index, which the leader caps at what the follower is known to store
+func (r *raftNode) handleHeartbeat(m Message) {
+    r.becomeFollower(m.Term, m.From)
+
+    if m.LeaderCommit > r.log.committed {
+        r.log.committed = m.LeaderCommit
+    }
+    r.send(Message{Type: MsgHeartbeatResponse, To: m.From, MatchIndex: r.log.lastIndex(), Sent: m.Sent})
+}
+
+// handleHeartbeatResponse resends entries a follower has not acknowledged,
+// recovering from lost AppendEntries, and confirms reads waiting for the
+// follower's acknowledgement
+func (r *raftNode) handleHeartbeatResponse(m Message) {
+    if r.state != Leader {
+        return
+    }
+    // Heartbeats sent in an earlier leadership of ours do not count
+    if sent := time.Duration(m.Sent); sent >= r.leaderSince && sent > r.ackedAt[m.From] {
+        r.ackedAt[m.From] = sent
+        r.advanceReads()
+    }
+    if match, ok := r.matchIndex[m.From]; ok && match < r.log.lastIndex() {
+        r.sendAppend(m.From)
+    }
+}
+
+func (r *raftNode) handleAppendEntriesResponse(m Message) {
+    if r.state != Leader {
+        return
+    }
+    if _, ok := r.nextIndex[m.From]; !ok {
+        return
+    }
+
+    if !m.Success {
+        // Back off towards the follower's log end and retry
+        next := r.nextIndex[m.From] - 1
+        if hint := m.MatchIndex + 1; hint < next {
+            next = hint
+        }
+        if next < 1 {
+            next = 1
+        }
+        r.nextIndex[m.From] = next
+        r.sendAppend(m.From)
+        return
+    }
+
+    if m.MatchIndex > r.matchIndex[m.From] {
+        r.matchIndex[m.From] = m.MatchIndex
+    }
+    if r.nextIndex[m.From] <= m.MatchIndex {
+        r.nextIndex[m.From] = m.MatchIndex + 1
+    }
+    if m.From == r.transferee && r.matchIndex[m.From] == r.log.lastIndex() {
+        r.send(Message{Type: MsgTimeoutNow, To: m.From})
+    }
+
+    if r.maybeCommit() {
+        // Tell followers about the new commit index
+        r.broadcastAppend()
+    } else if r.nextIndex[m.From] <= r.log.lastIndex() {
+        r.sendAppend(m.From)
+    }
+}
+
+// maybeCommit advances the commit index to the highest entry of the current
+// term stored on a majority
+func (r *raftNode) maybeCommit() bool {
+    index := r.quorumIndex(r.membership.Voters)
+    // A seat transfer swaps one voter for another, so like a joint change it
+    // only commits once a majority of the voters after the swap hold it too
+    for i := r.log.committed + 1; i <= index; i++ {
+        if cc, ok := r.seatTransferAt(i); ok && r.quorumIndex(r.membership.apply(cc).Voters) < i {
+            index = i - 1
+            break
+        }
+    }
+
+    if index > r.log.committed && r.log.matchTerm(index, r.currentTerm) {
+        r.log.committed = index
+        return true
+    }
+    return false
+}
+
+// quorumIndex returns the highest index stored on a majority of voters
+func (r *raftNode) quorumIndex(voters []string) uint64 {
+    if len(voters) == 0 {
+        return 0
+    }
+    matched := make([]uint64, 0, len(voters))
+    for _, id := range voters {
+        if id == r.id {
+            matched = append(matched, r.log.lastIndex())
+        } else {
+            matched = append(matched, r.matchIndex[id])
+        }
+    }
+    sort.Slice(matched, func(i, j int) bool { return matched[i] > matched[j] })
+    return matched[len(voters)/2]
+}
+
+// seatTransferAt returns the seat transfer at index, if the entry there is one
+func (r *raftNode) seatTransferAt(index uint64) (ConfChange, bool) {
+    entries := r.log.slice(index, index+1)
+    if len(entries) != 1 || entries[0].Type != EntryConfChange {
+        return ConfChange{}, false
+    }
+    var cc ConfChange
+    if err := json.Unmarshal(entries[0].Data, &cc); err != nil || cc.Type != ConfTransferSeat {
+        return ConfChange{}, false
+    }
+    return cc, true
+}
+
+func (r *raftNode) broadcastAppend() {
+    for _, peer := range r.replicas() {
+        r.sendAppend(peer)
+    }
+}
+
+func (r *raftNode) broadcastHeartbeat() {
+    for _, peer := range r.replicas() {
+        r.send(Message{
+            Type:         MsgHeartbeat,
+            To:           peer,
+            LeaderCommit: minIndex(r.matchIndex[peer], r.log.committed),
+            Sent:         int64(r.now()),
+        })
+    }
+}
+
+// broadcastProbe asks every other member to answer at once, so the driver
+// can time the round trip
+func (r *raftNode) broadcastProbe() {
+    for _, peer := range r.replicas() {
+        r.send(Message{Type: MsgProbe, To: peer, Sent: int64(r.now())})
+    }
+}
+
+// sendAppend sends a peer every entry from its next index onwards, or the
+// latest snapshot if those entries have been compacted away
+func (r *raftNode) sendAppend(to string) {
+    next := r.nextIndex[to]
+    if next <= r.log.entries[0].Index {
+        snapshot := r.snapshot
+        r.send(Message{Type: MsgInstallSnapshot, To: to, Snapshot: &snapshot})
+        return
+    }
+
+    prevTerm, _ := r.log.term(next - 1)
+    r.send(Message{
+        Type:         MsgAppendEntries,
+        To:           to,
+        PrevLogIndex: next - 1,
+        PrevLogTerm:  prevTerm,
+        Entries:      r.log.slice(next, r.log.lastIndex()+1),
+        LeaderCommit: r.log.committed,
+    })
+}
+
+// send queues a message stamped with our term; pre-votes and their
+// responses already carry the term they are for
+func (r *raftNode) send(m Message) {
+    m.From = r.id
+    if m.Type != MsgPreVote && m.Type != MsgPreVoteResponse {
+        m.Term = r.currentTerm
+    }
+    r.msgs = append(r.msgs, m)
+}
+
+// ready collects the outstanding work for the driver
+func (r *raftNode) ready() Ready {
+    rd := Ready{
+        Snapshot:         r.received,
+        Entries:          r.log.unstable(),
+        CommittedEntries: r.log.nextCommitted(),
+        Messages:         r.msgs,
+        ReadStates:       r.readStates,
+    }
+    if hs := r.hardState(); hs != r.prevHard {
+        rd.HardState = &hs
+    }
+    return rd
+}
+
+// advance acknowledges that the driver has carried out a Ready
+func (r *raftNode) advance(rd Ready) {
+    if rd.Snapshot != nil && rd.Snapshot == r.received {
+        r.received = nil
+    }
+    if rd.HardState != nil {
+        r.prevHard = *rd.HardState
+    }
+    if n := len(rd.Entries); n > 0 {
+        r.log.stabled = rd.Entries[n-1].Index
+    }
+    if n := len(rd.CommittedEntries); n > 0 {
+        r.log.applied = rd.CommittedEntries[n-1].Index
+    }
+    r.msgs = r.msgs[len(rd.Messages):]
+    r.readStates = r.readStates[len(rd.ReadStates):]
+}
+
+func minIndex(a, b uint64) uint64 {
+    if a < b {
+        return a
+    }
+    return b
+}
@@ -0,0 +1,81 @@
+package consensus
+
+import (
+    "context"
+    "fmt"
+    "time"
+)
+
+// ReadPolicy sets how ReadZone makes sure a zone's leader still leads before
+// serving a read. With Leases, a leader whose heartbeat a quorum has
+// acknowledged serves reads alone until its lease runs out; otherwise, or
+// once it has, every read waits for a quorum to acknowledge a fresh
+// heartbeat (ReadIndex). Voters holding a lease for their leader refuse to
+// elect another, so every process hosting a zone must share its policy.
+// MaxClockDrift bounds how far the rates of members' clocks may differ, as a
+// fraction of elapsed time; the lease shrinks to stay safe within it.
+type ReadPolicy struct {
+    Leases        bool
+    MaxClockDrift float64
+}
+
+// DefaultReadPolicy confirms every read with a round of heartbeats, and
+// allows for clocks drifting apart by a tenth should leases be enabled
+var DefaultReadPolicy = ReadPolicy{MaxClockDrift: 0.1}
+
+// validate checks that the clock drift bound is a fraction
+func (p ReadPolicy) validate() error {
+    if !(p.MaxClockDrift >= 0 && p.MaxClockDrift < 1) {
+        return fmt.Errorf("maximum clock drift must be in [0, 1): %v", p.MaxClockDrift)
+    }
+    return nil
+}
+
+// lease returns how long a leader may serve reads alone after sending a
+// heartbeat a quorum acknowledged, zero when leases are disabled. A voter
+// refuses to vote for electionTicks of its ticks after hearing from its
+// leader, which is at least electionTicks-2 tick intervals: a tick held up
+// can be followed almost at once by the next. Drift in either clock shortens
+// the lease further.
+func (p ReadPolicy) lease(interval time.Duration, electionTicks int) time.Duration {
+    if !p.Leases || interval <= 0 || electionTicks <= 2 {
+        return 0
+    }
+    hold := time.Duration(electionTicks-2) * interval
+    return time.Duration(float64(hold) * (1 - p.MaxClockDrift) / (1 + p.MaxClockDrift))
+}
+
+// SetReadPolicy sets how every zone confirms reads
+func (l *LHRaftConsensus) SetReadPolicy(policy ReadPolicy) error {
+    if err := policy.validate(); err != nil {
+        return err
+    }
+
+    l.mu.Lock()
+    l.readPolicy = policy
+    l.mu.Unlock()
+
+    for _, group := range l.zoneGroups() {
+        group.setReadPolicy(policy)
+    }
+    return nil
+}
+
+// ReadZone calls read with the zone's state as applied by a member hosted in
+// this process, once that member has applied every entry the zone committed
+// before ReadZone was called. Reads are linearizable without a round of
+// consensus; ReadPolicy sets how the leader confirms it still leads.
+func (l *LHRaftConsensus) ReadZone(zoneID string, read ReadFunc) error {
+    l.mu.RLock()
+    group := l.groups[zoneID]
+    timeout := l.ProposalTimeout
+    l.mu.RUnlock()
+
+    if group == nil {
+        return fmt.Errorf("no consensus group for zone: %s", zoneID)
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    return group.read(ctx, read)
+}
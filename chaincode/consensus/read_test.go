@@ -0,0 +1,301 @@
+package consensus
+
+import (
+    "context"
+    "fmt"
+    "sync"
+    "testing"
+    "time"
+)
+
+// newReadLeader returns n1 leading a group of three and having committed an
+// entry of its term, with a clock the test sets
+func newReadLeader(t *testing.T, lease time.Duration) (*raftNode, *time.Duration) {
+    t.Helper()
+
+    now := new(time.Duration)
+    r := newRaftNode("n1", Membership{Voters: []string{"n1", "n2", "n3"}})
+    r.now = func() time.Duration { return *now }
+    r.leaseDuration = lease
+    r.campaign()
+    r.step(Message{Type: MsgRequestVoteResponse, From: "n2", To: "n1", Term: r.currentTerm, Success: true})
+    r.step(Message{Type: MsgAppendEntriesResponse, From: "n2", To: "n1", Term: r.currentTerm, Success: true, MatchIndex: r.log.lastIndex()})
+    if r.state != Leader || r.log.committed != r.log.lastIndex() {
+        t.Fatalf("n1 is %v with %d of %d entries committed, want a leader with all committed", r.state, r.log.committed, r.log.lastIndex())
+    }
+    r.msgs = nil
+    return r, now
+}
+
+// heartbeatsSent counts the heartbeats a node has queued and clears its messages
+func heartbeatsSent(r *raftNode) int {
+    sent := 0
+    for _, m := range r.msgs {
+        if m.Type == MsgHeartbeat {
+            sent++
+        }
+    }
+    r.msgs = nil
+    return sent
+}
+
+func TestReadIndexWaitsForHeartbeatQuorum(t *testing.T) {
+    r, now := newReadLeader(t, 0)
+    *now = 10 * time.Millisecond
+
+    if err := r.requestRead(1); err != nil {
+        t.Fatalf("requestRead: %v", err)
+    }
+    if len(r.readStates) != 0 || heartbeatsSent(r) != 2 {
+        t.Fatalf("read served at once or no heartbeats sent to confirm it")
+    }
+
+    // An acknowledgement of an earlier heartbeat proves nothing about now
+    r.step(Message{Type: MsgHeartbeatResponse, From: "n2", To: "n1", Term: r.currentTerm, Sent: int64(5 * time.Millisecond)})
+    if len(r.readStates) != 0 {
+        t.Fatal("read served on a heartbeat sent before it arrived")
+    }
+    r.step(Message{Type: MsgHeartbeatResponse, From: "n2", To: "n1", Term: r.currentTerm, Sent: int64(10 * time.Millisecond)})
+    if len(r.readStates) != 1 || r.readStates[0] != (ReadState{ID: 1, Index: r.log.committed}) {
+        t.Fatalf("read states = %+v, want read 1 at %d", r.readStates, r.log.committed)
+    }
+}
+
+func TestLeaseServesReadsUntilItExpires(t *testing.T) {
+    r, now := newReadLeader(t, 50*time.Millisecond)
+    *now = 10 * time.Millisecond
+
+    // No quorum has acknowledged the leader yet
+    r.requestRead(1)
+    heartbeatsSent(r)
+    r.step(Message{Type: MsgHeartbeatResponse, From: "n3", To: "n1", Term: r.currentTerm, Sent: int64(10 * time.Millisecond)})
+    if len(r.readStates) != 1 {
+        t.Fatalf("read states = %+v, want the first read served", r.readStates)
+    }
+
+    *now = 40 * time.Millisecond
+    r.requestRead(2)
+    if len(r.readStates) != 2 || heartbeatsSent(r) != 0 {
+        t.Fatalf("read within the lease waited for heartbeats")
+    }
+
+    *now = 60 * time.Millisecond
+    r.requestRead(3)
+    if len(r.readStates) != 2 || heartbeatsSent(r) != 2 {
+        t.Fatalf("read after the lease expired was served without heartbeats")
+    }
+}
+
+func TestLeaderRefusesReadsItCannotServe(t *testing.T) {
+    r, _ := newReadLeader(t, 0)
+
+    // A read forwarded by n3 is refused once the leader is deposed
+    r.step(Message{Type: MsgReadIndex, From: "n3", To: "n1", Term: r.currentTerm, Proposal: 7})
+    r.msgs = nil
+    r.step(Message{Type: MsgAppendEntries, From: "n2", To: "n1", Term: r.currentTerm + 1})
+    refused := false
+    for _, m := range r.msgs {
+        if m.Type == MsgReadIndexResponse && m.To == "n3" && m.Proposal == 7 && m.Reject == ErrNotLeader.Error() {
+            refused = true
+        }
+    }
+    if !refused {
+        t.Fatalf("messages = %+v, want read 7 refused", r.msgs)
+    }
+
+    // A new leader cannot serve reads before committing an entry of its term
+    r.becomeCandidate()
+    r.becomeLeader()
+    if err := r.requestRead(8); err != ErrNotLeader {
+        t.Fatalf("requestRead = %v, want ErrNotLeader", err)
+    }
+}
+
+func TestVotersWaitOutLeaderLease(t *testing.T) {
+    voter := newRaftNode("n2", Membership{Voters: []string{"n1", "n2", "n3"}})
+    voter.leaseDuration = 50 * time.Millisecond
+
+    // A node that has just started may have acknowledged a leader before
+    voter.step(Message{Type: MsgRequestVote, From: "n3", To: "n2", Term: 1})
+    if len(voter.msgs) != 0 || voter.currentTerm != 0 {
+        t.Fatalf("booting voter answered a vote request: %+v", voter.msgs)
+    }
+    voter.step(Message{Type: MsgHeartbeat, From: "n1", To: "n2", Term: 1})
+    voter.msgs = nil
+
+    voter.step(Message{Type: MsgRequestVote, From: "n3", To: "n2", Term: 2})
+    if len(voter.msgs) != 0 || voter.currentTerm != 1 {
+        t.Fatalf("voter answered a vote request while its leader's lease may hold: %+v", voter.msgs)
+    }
+    voter.step(Message{Type: MsgRequestVote, From: "n3", To: "n2", Term: 2, Force: true})
+    if resp := voter.msgs[len(voter.msgs)-1]; !resp.Success {
+        t.Fatal("vote refused to a candidate its leader is handing over to")
+    }
+
+    // Once the leader has been silent for an election timeout, candidates
+    // need not force
+    voter.step(Message{Type: MsgHeartbeat, From: "n3", To: "n2", Term: 2})
+    for i := 0; i < voter.electionTicks; i++ {
+        voter.electionElapsed++
+    }
+    voter.msgs = nil
+    voter.step(Message{Type: MsgRequestVote, From: "n1", To: "n2", Term: 3})
+    if len(voter.msgs) != 1 || !voter.msgs[0].Success {
+        t.Fatalf("messages = %+v, want the vote granted", voter.msgs)
+    }
+}
+
+func TestReadPolicyLease(t *testing.T) {
+    tick := 10 * time.Millisecond
+    tests := []struct {
+        policy ReadPolicy
+        ticks  int
+        want   time.Duration
+    }{
+        {ReadPolicy{}, 10, 0},
+        {ReadPolicy{Leases: true}, 10, 80 * time.Millisecond},
+        {ReadPolicy{Leases: true, MaxClockDrift: 0.2}, 10, 80 * time.Millisecond * 8 / 12},
+        {ReadPolicy{Leases: true}, 2, 0},
+    }
+    for _, tt := range tests {
+        if got := tt.policy.lease(tick, tt.ticks); got != tt.want {
+            t.Errorf("%+v.lease(%v, %d) = %v, want %v", tt.policy, tick, tt.ticks, got, tt.want)
+        }
+    }
+
+    l := NewLHRaftConsensus(0.5)
+    for _, drift := range []float64{-0.1, 1} {
+        if err := l.SetReadPolicy(ReadPolicy{Leases: true, MaxClockDrift: drift}); err == nil {
+            t.Errorf("clock drift %v accepted", drift)
+        }
+    }
+}
+
+func TestLeaseOutlivesLeaderIsolation(t *testing.T) {
+    s := newSimulator(1, []string{"n1", "n2", "n3", "n4", "n5"}, simFaults{MinDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond})
+    s.setLease(ReadPolicy{Leases: true}.lease(simTickInterval, simElectionTicks))
+    s.run(time.Second)
+    leader := s.leader()
+    if leader == nil || !leader.raft.leaseValid() {
+        t.Fatal("no leader holding a lease")
+    }
+
+    // A follower cut off until it times out rejoins, campaigning, just as
+    // the leader is cut off in its place; the others must not elect it while
+    // the leader may still serve reads
+    var rival string
+    for _, id := range s.ids {
+        if id != leader.id {
+            rival = id
+            break
+        }
+    }
+    s.isolate([]string{rival})
+    s.run(500 * time.Millisecond)
+    s.isolate([]string{leader.id})
+    s.nodes[rival].raft.campaign()
+    s.process(s.nodes[rival])
+    s.run(time.Second)
+    if s.violation != nil {
+        s.report(t, s.violation)
+    }
+    if next := s.leader(); next == nil || next == leader {
+        s.report(t, fmt.Errorf("no new leader elected"))
+    }
+}
+
+// read returns the entries nodeID has applied
+func (sm *testStateMachine) read(nodeID string) []string {
+    sm.mu.Lock()
+    defer sm.mu.Unlock()
+
+    return append([]string{}, sm.applied[nodeID]...)
+}
+
+func TestReadZoneSeesCommittedTransactions(t *testing.T) {
+    for _, policy := range []ReadPolicy{DefaultReadPolicy, {Leases: true, MaxClockDrift: 0.1}} {
+        sm := newTestStateMachine()
+        l := newTestConsensus(t, []string{"n1", "n2", "n3"}, withApply(sm.apply),
+            withReadPolicy(policy), withFastTiming(), withRegisteredMembers(), withElectedLeaders())
+
+        for i := 0; i < 5; i++ {
+            tx := fmt.Sprintf("tx%d", i)
+            if err := l.PropagateTransaction([]byte(tx), "Z1"); err != nil {
+                t.Fatalf("PropagateTransaction: %v", err)
+            }
+            var read []string
+            err := l.ReadZone("Z1", func(zoneID, nodeID string) error {
+                read = sm.read(nodeID)
+                return nil
+            })
+            if err != nil {
+                t.Fatalf("leases %v: ReadZone: %v", policy.Leases, err)
+            }
+            if len(read) != i+1 || read[i] != tx {
+                t.Fatalf("leases %v: read %q after committing %s", policy.Leases, read, tx)
+            }
+        }
+        l.Stop()
+    }
+}
+
+func TestFollowerReadsThroughLeader(t *testing.T) {
+    sm := newTestStateMachine()
+    l := newTestConsensus(t, []string{"n1", "n2", "n3"}, withApply(sm.apply),
+        withReadPolicy(DefaultReadPolicy), withFastTiming(), withRegisteredMembers(), withElectedLeaders())
+    defer l.Stop()
+
+    leaderID, _ := l.groups["Z1"].leader()
+    var follower *Replica
+    for id, replica := range l.groups["Z1"].replicas {
+        if id != leaderID {
+            follower = replica
+            break
+        }
+    }
+
+    // Readers on the follower see every write that completed before them
+    var wg sync.WaitGroup
+    for i := 0; i < 4; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            tx := fmt.Sprintf("tx%d", i)
+            if err := l.PropagateTransaction([]byte(tx), "Z1"); err != nil {
+                t.Errorf("PropagateTransaction: %v", err)
+                return
+            }
+            err := follower.Read(context.Background(), func() error {
+                for _, applied := range sm.read(follower.ID()) {
+                    if applied == tx {
+                        return nil
+                    }
+                }
+                return fmt.Errorf("%s has not applied %s", follower.ID(), tx)
+            })
+            if err != nil {
+                t.Errorf("Read: %v", err)
+            }
+        }(i)
+    }
+    wg.Wait()
+}
+
+func TestElectZoneLeaderHandsOverLease(t *testing.T) {
+    l := newTestConsensus(t, []string{"n1", "n2", "n3"},
+        withReadPolicy(ReadPolicy{Leases: true, MaxClockDrift: 0.1}),
+        withFastTiming(), withRegisteredMembers(), withElectedLeaders())
+    defer l.Stop()
+
+    oldLeader, _ := l.groups["Z1"].leader()
+    if err := l.SetNodeDisputed(oldLeader, true); err != nil {
+        t.Fatalf("SetNodeDisputed: %v", err)
+    }
+    newLeader, _ := l.groups["Z1"].leader()
+    if newLeader == "" || newLeader == oldLeader {
+        t.Fatalf("leader = %q, want a successor to %s", newLeader, oldLeader)
+    }
+    if err := l.ReadZone("Z1", func(zoneID, nodeID string) error { return nil }); err != nil {
+        t.Fatalf("ReadZone after the handover: %v", err)
+    }
+}
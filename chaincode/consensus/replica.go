@@ -0,0 +1,801 @@
+package consensus
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "sync"
+    "time"
+)
+
+// Errors reported to proposers
+var (
+    ErrReplicaStopped  = errors.New("replica stopped")
+    ErrProposalDropped = errors.New("proposal was overwritten by a new leader")
+)
+
+// ReplicaConfig configures a Replica
+type ReplicaConfig struct {
+    NodeID    string
+    ZoneID    string
+    Peers     []string          // Voting members of the zone, this node included
+    Learners  []string          // Non-voting members of the zone
+    Seats     map[string]string // Seat holders, global group only
+    Transport Transport
+    Apply     ApplyFunc
+    Storage   Storage // Where the log and vote are persisted; nil keeps them in memory
+
+    // Snapshot captures the applied state so the log can be compacted; nil
+    // disables compaction. Restore installs a snapshot's state. Both run with
+    // the replica locked.
+    Snapshot SnapshotFunc
+    Restore  RestoreFunc
+    Policy   SnapshotPolicy // When to snapshot; the zero value never does
+    Reads    ReadPolicy     // How reads are confirmed; the zero value uses ReadIndex
+
+    // Eligible reports whether a node may lead the zone; nil allows every node
+    Eligible func(nodeID string) bool
+    // OnStateChange is called whenever the replica's state, term or leader
+    // changes. It runs with the replica locked and must not call back into it.
+    OnStateChange func(status ReplicaStatus)
+    // OnHeartbeat is called when the replica hears from a live member: a
+    // follower from its leader, a leader from its followers and itself. Like
+    // OnStateChange it runs with the replica locked.
+    OnHeartbeat func(nodeID string, at time.Time)
+    // OnConfChange is called with the zone's membership each time the replica
+    // applies a membership change. Like OnStateChange it runs with the
+    // replica locked.
+    OnConfChange func(index uint64, membership Membership)
+    // OnLatency is called with each round trip the replica times to another
+    // member, by its heartbeats as leader and its probes otherwise. Like
+    // OnStateChange it runs with the replica locked.
+    OnLatency func(nodeID, peerID string, rtt time.Duration)
+
+    // TickInterval is the length of a tick; zero leaves ticking to the caller
+    TickInterval   time.Duration
+    ElectionTicks  int // Election timeout in ticks; zero uses the default
+    HeartbeatTicks int // Heartbeat interval in ticks; zero uses the default
+}
+
+// ReplicaStatus is a point-in-time view of a replica's Raft state
+type ReplicaStatus struct {
+    NodeID        string
+    ZoneID        string
+    State         NodeState
+    Term          uint64
+    LeaderID      string
+    LastIndex     uint64
+    CommitIndex   uint64
+    AppliedIndex  uint64
+    LastHeartbeat time.Time // When a follower last heard from its leader
+    Membership    Membership
+}
+
+// Replica runs one member of a zone group. It feeds messages from the
+// transport and local proposals into the Raft state machine and carries out
+// the resulting Ready. Replicas of a group may live in separate processes.
+type Replica struct {
+    zoneID    string
+    node      *raftNode
+    transport Transport
+    storage   Storage
+    apply     ApplyFunc
+    onChange  func(status ReplicaStatus)
+    last      ReplicaStatus          // Last status reported to onChange
+    pending   map[uint64][]*proposal // Log index -> waiting proposers
+    forwarded map[uint64]*proposal   // Proposal ID -> proposer waiting for the leader to append
+    reads     map[uint64]*readWaiter // Read ID -> reader waiting for its index to be applied
+    nextID    uint64                 // Last proposal or read ID issued
+    stopped   bool
+    mu        sync.Mutex
+
+    onHeartbeat   func(nodeID string, at time.Time)
+    onConfChange  func(index uint64, membership Membership)
+    onLatency     func(nodeID, peerID string, rtt time.Duration)
+    lastHeartbeat time.Time
+    tickStop      chan struct{} // Closed to stop the ticker, nil when not ticking
+    tickInterval  time.Duration
+    readPolicy    ReadPolicy
+
+    snapshot     SnapshotFunc
+    restore      RestoreFunc
+    policy       SnapshotPolicy
+    appliedBytes int // Bytes applied since the last snapshot
+}
+
+// proposal tracks a proposer waiting for its entry to commit
+type proposal struct {
+    id     uint64 // Set while forwarded to the leader
+    leader string // Leader the proposal was forwarded to
+    index  uint64 // Set once the entry is appended
+    term   uint64
+    done   chan error
+}
+
+// readWaiter tracks a reader waiting for its read to be confirmed and for the
+// replica to apply the entries committed before it
+type readWaiter struct {
+    leader    string // Leader asked to confirm the read
+    index     uint64 // Set once confirmed
+    confirmed bool
+    done      chan error
+}
+
+// NewReplica creates a replica and registers it with its transport
+func NewReplica(cfg ReplicaConfig) (*Replica, error) {
+    if cfg.Transport == nil {
+        return nil, fmt.Errorf("replica %s has no transport", cfg.NodeID)
+    }
+
+    storage := cfg.Storage
+    if storage == nil {
+        storage = NewMemoryStorage()
+    }
+    state, snapshot, entries, err := storage.Load()
+    if err != nil {
+        return nil, fmt.Errorf("failed to load state of replica %s: %v", cfg.NodeID, err)
+    }
+
+    rp := &Replica{
+        zoneID:    cfg.ZoneID,
+        node:      newRaftNode(cfg.NodeID, Membership{Voters: cfg.Peers, Learners: cfg.Learners, Seats: cfg.Seats}),
+        transport: cfg.Transport,
+        storage:   storage,
+        apply:     cfg.Apply,
+        onChange:  cfg.OnStateChange,
+        pending:   make(map[uint64][]*proposal),
+        forwarded: make(map[uint64]*proposal),
+        reads:     make(map[uint64]*readWaiter),
+
+        onHeartbeat:  cfg.OnHeartbeat,
+        onConfChange: cfg.OnConfChange,
+        onLatency:    cfg.OnLatency,
+        snapshot:     cfg.Snapshot,
+        restore:      cfg.Restore,
+        policy:       cfg.Policy,
+        tickInterval: cfg.TickInterval,
+        readPolicy:   cfg.Reads,
+    }
+    if snapshot.Index > 0 {
+        if rp.restore == nil {
+            return nil, fmt.Errorf("replica %s has a snapshot but nothing to restore it into", cfg.NodeID)
+        }
+        if err := rp.restore(cfg.ZoneID, cfg.NodeID, snapshot.Data); err != nil {
+            return nil, fmt.Errorf("failed to restore snapshot of replica %s: %v", cfg.NodeID, err)
+        }
+    }
+    rp.node.restore(state, snapshot, entries)
+    rp.node.eligible = cfg.Eligible
+    rp.node.setTiming(cfg.ElectionTicks, cfg.HeartbeatTicks)
+    rp.updateLease()
+    if err := cfg.Transport.Register(cfg.NodeID, rp.handle); err != nil {
+        return nil, err
+    }
+
+    rp.mu.Lock()
+    defer rp.mu.Unlock()
+
+    // Report the recovered term and replay committed entries into the state machine
+    rp.processReady()
+    rp.startTicker(cfg.TickInterval)
+    return rp, nil
+}
+
+// ID returns the node ID of the replica
+func (rp *Replica) ID() string {
+    return rp.node.id
+}
+
+// Propose replicates data through the zone and returns once a majority of the
+// zone has stored it and it has been applied locally. A follower forwards the
+// proposal to the leader it knows of; ErrNotLeader is returned when there is
+// none or the leader has since stepped down.
+func (rp *Replica) Propose(ctx context.Context, data []byte) error {
+    return rp.proposeEntry(ctx, EntryNormal, data)
+}
+
+// proposeEntry is Propose for an entry of any type but a membership change
+func (rp *Replica) proposeEntry(ctx context.Context, entryType EntryType, data []byte) error {
+    return rp.proposeAndWait(ctx, LogEntry{Type: entryType, Data: data}, func() (uint64, uint64, error) {
+        return rp.node.proposeEntry(entryType, data)
+    })
+}
+
+// ProposeConfChange commits a membership change through the zone's log and
+// returns once it has been applied locally. Like proposals, changes are
+// forwarded to the leader, which accepts them one at a time.
+func (rp *Replica) ProposeConfChange(ctx context.Context, cc ConfChange) error {
+    data, err := json.Marshal(cc)
+    if err != nil {
+        return err
+    }
+    return rp.proposeAndWait(ctx, LogEntry{Type: EntryConfChange, Data: data}, func() (uint64, uint64, error) {
+        return rp.node.proposeConfChange(cc)
+    })
+}
+
+// ProposeZoneChange commits a zone change through the zone's log and returns
+// once it has been applied locally
+func (rp *Replica) ProposeZoneChange(ctx context.Context, zc ZoneChange) error {
+    data, err := json.Marshal(zc)
+    if err != nil {
+        return err
+    }
+    return rp.proposeAndWait(ctx, LogEntry{Type: EntryZoneChange, Data: data}, func() (uint64, uint64, error) {
+        return rp.node.proposeZoneChange(zc)
+    })
+}
+
+// proposeAndWait appends an entry with propose, or forwards it to the leader
+// when this replica is not leading, and waits for it to be applied
+func (rp *Replica) proposeAndWait(ctx context.Context, entry LogEntry, propose func() (uint64, uint64, error)) error {
+    rp.mu.Lock()
+    if rp.stopped {
+        rp.mu.Unlock()
+        return ErrReplicaStopped
+    }
+    p := &proposal{done: make(chan error, 1)}
+    index, term, err := propose()
+    if err == ErrNotLeader {
+        rp.nextID++
+        p.id = rp.nextID
+        p.leader = rp.node.leaderID
+        err = rp.node.forward(p.id, entry)
+        if err == nil {
+            rp.forwarded[p.id] = p
+        }
+    } else if err == nil {
+        p.term = term
+        rp.track(index, p)
+    }
+    if err != nil {
+        rp.mu.Unlock()
+        return err
+    }
+    rp.processReady()
+    rp.mu.Unlock()
+
+    select {
+    case err := <-p.done:
+        return err
+    case <-ctx.Done():
+        rp.mu.Lock()
+        rp.untrack(p)
+        rp.mu.Unlock()
+        return ctx.Err()
+    }
+}
+
+// track waits for the entry at index to be applied. Callers hold rp.mu.
+func (rp *Replica) track(index uint64, p *proposal) {
+    p.index = index
+    rp.pending[index] = append(rp.pending[index], p)
+}
+
+// untrack gives up on a proposal. Callers hold rp.mu.
+func (rp *Replica) untrack(p *proposal) {
+    if rp.forwarded[p.id] == p {
+        delete(rp.forwarded, p.id)
+    }
+    waiting := rp.pending[p.index]
+    for i, q := range waiting {
+        if q == p {
+            waiting = append(waiting[:i], waiting[i+1:]...)
+            break
+        }
+    }
+    if len(waiting) == 0 {
+        delete(rp.pending, p.index)
+    } else {
+        rp.pending[p.index] = waiting
+    }
+}
+
+// handleProposeResponse moves a forwarded proposal the leader has appended
+// on to waiting for its entry to be applied. Callers hold rp.mu.
+func (rp *Replica) handleProposeResponse(m Message) {
+    p, exists := rp.forwarded[m.Proposal]
+    if !exists {
+        return
+    }
+    delete(rp.forwarded, m.Proposal)
+
+    if !m.Success {
+        p.done <- proposalError(m.Reject)
+        return
+    }
+    p.term = m.Term
+    if m.MatchIndex <= rp.node.log.applied {
+        // Applied before the response arrived; the entry now at its index
+        // tells whether it survived
+        if term, ok := rp.node.log.term(m.MatchIndex); ok && term == m.Term {
+            p.done <- nil
+        } else {
+            p.done <- ErrProposalDropped
+        }
+        return
+    }
+    rp.track(m.MatchIndex, p)
+}
+
+// proposalError recovers the error a leader refused a forwarded proposal with
+func proposalError(reason string) error {
+    for _, err := range []error{ErrNotLeader, ErrConfChangePending, ErrLearnerBehind, ErrZoneMerged} {
+        if err.Error() == reason {
+            return err
+        }
+    }
+    return errors.New(reason)
+}
+
+// Campaign starts an election with this replica as candidate
+func (rp *Replica) Campaign() {
+    rp.mu.Lock()
+    defer rp.mu.Unlock()
+
+    if rp.stopped {
+        return
+    }
+    rp.node.campaign()
+    rp.processReady()
+}
+
+// TransferLeadership asks the zone's leader to hand leadership to nodeID once
+// its log has caught up; a replica not leading forwards the request. The
+// leader refuses proposals meanwhile, and carries on leading if nodeID does
+// not catch up within an election timeout.
+func (rp *Replica) TransferLeadership(nodeID string) error {
+    rp.mu.Lock()
+    defer rp.mu.Unlock()
+
+    if rp.stopped {
+        return ErrReplicaStopped
+    }
+    err := rp.node.transferLeadership(nodeID)
+    rp.processReady()
+    return err
+}
+
+// abortTransfer has a leader handing over carry on leading
+func (rp *Replica) abortTransfer() {
+    rp.mu.Lock()
+    defer rp.mu.Unlock()
+
+    if !rp.stopped && rp.node.state == Leader {
+        rp.node.transferee = ""
+    }
+}
+
+// Read calls fn once the replica has applied every entry the zone committed
+// before Read was called, so that what fn reads is linearizable. The leader
+// confirms that it still leads, by its lease or a round of heartbeats; a
+// follower asks the leader it knows of. ErrNotLeader is returned when there
+// is none or it stopped leading before confirming. fn runs with the replica
+// locked and must not call back into it.
+func (rp *Replica) Read(ctx context.Context, fn func() error) error {
+    rp.mu.Lock()
+    if rp.stopped {
+        rp.mu.Unlock()
+        return ErrReplicaStopped
+    }
+    rp.nextID++
+    id := rp.nextID
+    w := &readWaiter{leader: rp.node.leaderID, done: make(chan error, 1)}
+    if err := rp.node.requestRead(id); err != nil {
+        rp.mu.Unlock()
+        return err
+    }
+    rp.reads[id] = w
+    rp.processReady()
+    rp.mu.Unlock()
+
+    select {
+    case err := <-w.done:
+        if err != nil {
+            return err
+        }
+    case <-ctx.Done():
+        rp.mu.Lock()
+        delete(rp.reads, id)
+        rp.mu.Unlock()
+        return ctx.Err()
+    }
+
+    rp.mu.Lock()
+    defer rp.mu.Unlock()
+
+    if rp.stopped {
+        return ErrReplicaStopped
+    }
+    return fn()
+}
+
+// confirmRead records the index a read waits for, or fails it if the leader
+// refused it. Callers hold rp.mu.
+func (rp *Replica) confirmRead(id, index uint64, reject string) {
+    w, exists := rp.reads[id]
+    if !exists || w.confirmed {
+        return
+    }
+    if reject != "" {
+        w.done <- proposalError(reject)
+        delete(rp.reads, id)
+        return
+    }
+    w.index = index
+    w.confirmed = true
+    rp.releaseReads()
+}
+
+// releaseReads lets through the confirmed reads whose index has been
+// applied. Callers hold rp.mu.
+func (rp *Replica) releaseReads() {
+    for id, w := range rp.reads {
+        if w.confirmed && w.index <= rp.node.log.applied {
+            w.done <- nil
+            delete(rp.reads, id)
+        }
+    }
+}
+
+// StepDown gives up leadership of the current term. The replica campaigns
+// again only if it is still eligible once its election timeout elapses.
+func (rp *Replica) StepDown() {
+    rp.mu.Lock()
+    defer rp.mu.Unlock()
+
+    if rp.stopped || rp.node.state != Leader {
+        return
+    }
+    rp.node.becomeFollower(rp.node.currentTerm, "")
+    rp.processReady()
+}
+
+// Tick advances the replica's logical clock, campaigning once the election
+// timeout elapses without hearing from a leader
+func (rp *Replica) Tick() {
+    rp.mu.Lock()
+    defer rp.mu.Unlock()
+
+    if rp.stopped {
+        return
+    }
+    rp.node.tick()
+    if rp.node.state == Leader && rp.node.heartbeatElapsed == 0 {
+        // The leader has just sent heartbeats
+        rp.heard(rp.node.id)
+    }
+    rp.processReady()
+}
+
+// Status returns the replica's current Raft state
+func (rp *Replica) Status() ReplicaStatus {
+    rp.mu.Lock()
+    defer rp.mu.Unlock()
+
+    return rp.status()
+}
+
+func (rp *Replica) status() ReplicaStatus {
+    return ReplicaStatus{
+        NodeID:        rp.node.id,
+        ZoneID:        rp.zoneID,
+        State:         rp.node.state,
+        Term:          rp.node.currentTerm,
+        LeaderID:      rp.node.leaderID,
+        LastIndex:     rp.node.log.lastIndex(),
+        CommitIndex:   rp.node.log.committed,
+        AppliedIndex:  rp.node.log.applied,
+        LastHeartbeat: rp.lastHeartbeat,
+        Membership:    rp.node.membership,
+    }
+}
+
+// Stop detaches the replica from its transport, fails pending proposals and
+// closes its storage
+func (rp *Replica) Stop() {
+    rp.mu.Lock()
+    defer rp.mu.Unlock()
+
+    rp.halt(ErrReplicaStopped)
+}
+
+// halt stops the replica, failing pending proposals with err. Callers hold rp.mu.
+func (rp *Replica) halt(err error) {
+    if rp.stopped {
+        return
+    }
+    rp.stopped = true
+    rp.startTicker(0)
+    rp.transport.Unregister(rp.node.id)
+    rp.storage.Close()
+    for index, waiting := range rp.pending {
+        for _, p := range waiting {
+            p.done <- err
+        }
+        delete(rp.pending, index)
+    }
+    for id, p := range rp.forwarded {
+        p.done <- err
+        delete(rp.forwarded, id)
+    }
+    for id, w := range rp.reads {
+        w.done <- err
+        delete(rp.reads, id)
+    }
+}
+
+// setTiming changes how often the replica ticks and its timeouts in ticks
+func (rp *Replica) setTiming(interval time.Duration, electionTicks, heartbeatTicks int) {
+    rp.mu.Lock()
+    defer rp.mu.Unlock()
+
+    if rp.stopped {
+        return
+    }
+    rp.node.setTiming(electionTicks, heartbeatTicks)
+    rp.tickInterval = interval
+    rp.updateLease()
+    rp.startTicker(interval)
+}
+
+// setSnapshotPolicy changes when the replica takes snapshots
+func (rp *Replica) setSnapshotPolicy(policy SnapshotPolicy) {
+    rp.mu.Lock()
+    defer rp.mu.Unlock()
+
+    rp.policy = policy
+}
+
+// setReadPolicy changes how the replica confirms reads
+func (rp *Replica) setReadPolicy(policy ReadPolicy) {
+    rp.mu.Lock()
+    defer rp.mu.Unlock()
+
+    rp.readPolicy = policy
+    rp.updateLease()
+}
+
+// updateLease sets the lease the node holds as leader from the read policy
+// and the replica's timing. Callers hold rp.mu.
+func (rp *Replica) updateLease() {
+    rp.node.leaseDuration = rp.readPolicy.lease(rp.tickInterval, rp.node.electionTicks)
+}
+
+// maybeSnapshot snapshots the applied state and compacts the log once the
+// entries or bytes applied since the last snapshot reach the policy's
+// thresholds. Callers hold rp.mu.
+func (rp *Replica) maybeSnapshot() {
+    applied := rp.node.log.applied
+    since := applied - rp.node.snapshot.Index
+    if rp.snapshot == nil || since == 0 || !rp.policy.due(int(since), rp.appliedBytes) {
+        return
+    }
+
+    data, err := rp.snapshot(rp.zoneID, rp.node.id)
+    if err != nil {
+        // Keep the log and try again after the next entry
+        return
+    }
+    term, _ := rp.node.log.term(applied)
+    snapshot := Snapshot{Index: applied, Term: term, Membership: rp.node.membership, Data: data}
+    if err := rp.storage.SaveSnapshot(snapshot); err != nil {
+        rp.halt(fmt.Errorf("failed to persist snapshot of replica %s: %v", rp.node.id, err))
+        return
+    }
+    rp.node.compact(snapshot)
+    rp.appliedBytes = 0
+}
+
+// startTicker replaces the replica's ticker with one firing every interval,
+// or none when interval is zero. Callers hold rp.mu.
+func (rp *Replica) startTicker(interval time.Duration) {
+    if rp.tickStop != nil {
+        close(rp.tickStop)
+        rp.tickStop = nil
+    }
+    if interval <= 0 {
+        return
+    }
+
+    stop := make(chan struct{})
+    rp.tickStop = stop
+    go func() {
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+
+        for {
+            select {
+            case <-ticker.C:
+                rp.Tick()
+            case <-stop:
+                return
+            }
+        }
+    }()
+}
+
+// heard records that nodeID was heard from
+func (rp *Replica) heard(nodeID string) {
+    now := time.Now()
+    if nodeID == rp.node.leaderID {
+        rp.lastHeartbeat = now
+    }
+    if rp.onHeartbeat != nil {
+        rp.onHeartbeat(nodeID, now)
+    }
+}
+
+// handle is the transport callback for messages addressed to this replica
+func (rp *Replica) handle(m Message) {
+    if m.Group != rp.zoneID {
+        return
+    }
+
+    rp.mu.Lock()
+    defer rp.mu.Unlock()
+
+    if rp.stopped {
+        return
+    }
+    if m.Type == MsgProposeResponse {
+        rp.handleProposeResponse(m)
+        return
+    }
+    if m.Type == MsgReadIndexResponse {
+        rp.confirmRead(m.Proposal, m.MatchIndex, m.Reject)
+        return
+    }
+    if (m.Type == MsgHeartbeatResponse || m.Type == MsgProbeResponse) && m.Sent != 0 && rp.onLatency != nil {
+        rp.onLatency(rp.node.id, m.From, rp.node.now()-time.Duration(m.Sent))
+    }
+    rp.node.step(m)
+
+    switch m.Type {
+    case MsgAppendEntries, MsgHeartbeat:
+        if m.From == rp.node.leaderID {
+            rp.heard(m.From)
+        }
+    case MsgAppendEntriesResponse, MsgHeartbeatResponse:
+        if rp.node.state == Leader && m.Term == rp.node.currentTerm {
+            rp.heard(m.From)
+        }
+    }
+    rp.processReady()
+}
+
+// processReady carries out the node's outstanding work and reports state
+// changes. Callers hold rp.mu.
+func (rp *Replica) processReady() {
+    if status := rp.status(); status.State != rp.last.State || status.Term != rp.last.Term || status.LeaderID != rp.last.LeaderID {
+        rp.last = status
+        if rp.onChange != nil {
+            rp.onChange(status)
+        }
+        // A leader that has stepped down may never answer proposals
+        // forwarded to it
+        for id, p := range rp.forwarded {
+            if p.leader != status.LeaderID {
+                p.done <- ErrNotLeader
+                delete(rp.forwarded, id)
+            }
+        }
+        // Nor confirm reads; confirmed reads only wait to be applied
+        for id, w := range rp.reads {
+            if !w.confirmed && w.leader != status.LeaderID {
+                w.done <- ErrNotLeader
+                delete(rp.reads, id)
+            }
+        }
+    }
+
+    rd := rp.node.ready()
+    if rd.isEmpty() {
+        return
+    }
+
+    // A snapshot from the leader replaces everything applied so far
+    if rd.Snapshot != nil {
+        if err := rp.installSnapshot(*rd.Snapshot); err != nil {
+            rp.halt(err)
+            return
+        }
+    }
+
+    // The vote and entries must be durable before any message relies on them
+    if rd.HardState != nil || len(rd.Entries) > 0 {
+        state := rp.node.prevHard
+        if rd.HardState != nil {
+            state = *rd.HardState
+        }
+        if err := rp.storage.Save(state, rd.Entries); err != nil {
+            // The node can no longer keep its promises; take it out of the group
+            rp.halt(fmt.Errorf("failed to persist replica %s: %v", rp.node.id, err))
+            return
+        }
+    }
+
+    for _, m := range rd.Messages {
+        m.Group = rp.zoneID
+        // Delivery is best effort; lost messages are retried by Raft
+        rp.transport.Send(m)
+    }
+
+    for _, entry := range rd.CommittedEntries {
+        if entry.Type == EntryConfChange {
+            var cc ConfChange
+            if err := json.Unmarshal(entry.Data, &cc); err != nil {
+                rp.halt(fmt.Errorf("corrupt membership change at index %d: %v", entry.Index, err))
+                return
+            }
+            rp.node.applyConfChange(cc)
+            if rp.onConfChange != nil {
+                rp.onConfChange(entry.Index, rp.node.membership)
+            }
+        } else {
+            if entry.Type == EntryZoneChange {
+                zc, err := DecodeZoneChange(entry.Data)
+                if err != nil {
+                    rp.halt(fmt.Errorf("corrupt zone change at index %d: %v", entry.Index, err))
+                    return
+                }
+                rp.node.applyZoneChange(entry.Index, zc)
+            }
+            if rp.apply != nil {
+                rp.apply(rp.zoneID, rp.node.id, entry)
+            }
+        }
+        rp.appliedBytes += len(entry.Data)
+        for _, p := range rp.pending[entry.Index] {
+            if entry.Term == p.term {
+                p.done <- nil
+            } else {
+                p.done <- ErrProposalDropped
+            }
+        }
+        delete(rp.pending, entry.Index)
+    }
+
+    rp.node.advance(rd)
+    for _, rs := range rd.ReadStates {
+        rp.confirmRead(rs.ID, rs.Index, "")
+    }
+    rp.releaseReads()
+    rp.maybeSnapshot()
+
+    // Applying a membership change can produce more work, such as stepping down
+    if !rp.stopped && !rp.node.ready().isEmpty() {
+        rp.processReady()
+    }
+}
+
+// installSnapshot persists a snapshot received from the leader and loads it
+// into the state machine. Callers hold rp.mu.
+func (rp *Replica) installSnapshot(snapshot Snapshot) error {
+    if err := rp.storage.SaveSnapshot(snapshot); err != nil {
+        return fmt.Errorf("failed to persist snapshot of replica %s: %v", rp.node.id, err)
+    }
+    if rp.restore == nil {
+        return fmt.Errorf("replica %s cannot restore a snapshot", rp.node.id)
+    }
+    if err := rp.restore(rp.zoneID, rp.node.id, snapshot.Data); err != nil {
+        return fmt.Errorf("failed to restore snapshot of replica %s: %v", rp.node.id, err)
+    }
+    rp.appliedBytes = 0
+    if rp.onConfChange != nil {
+        rp.onConfChange(snapshot.Index, snapshot.Membership)
+    }
+
+    // Proposals the snapshot covers can no longer be matched to their entries
+    for index, waiting := range rp.pending {
+        if index > snapshot.Index {
+            continue
+        }
+        for _, p := range waiting {
+            p.done <- ErrProposalDropped
+        }
+        delete(rp.pending, index)
+    }
+    return nil
+}
@@ -0,0 +1,782 @@
+package consensus
+
+import (
+    "bytes"
+    "container/heap"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "hash/fnv"
+    "math/rand"
+    "strings"
+    "testing"
+    "time"
+)
+
+// Reproduce a failing simulation with: go test -run <Test> -sim.seed=<seed>
+var (
+    simSeed = flag.Int64("sim.seed", 0, "run simulations with this seed only")
+    simRuns = flag.Int("sim.runs", 20, "number of seeds each simulation test runs")
+)
+
+// simSeeds returns the seeds a simulation test runs
+func simSeeds() []int64 {
+    if *simSeed != 0 {
+        return []int64{*simSeed}
+    }
+    seeds := make([]int64, *simRuns)
+    for i := range seeds {
+        seeds[i] = int64(i + 1)
+    }
+    return seeds
+}
+
+// simFaults sets how unreliable the simulated network is. Every message is
+// delayed by a random time in [MinDelay, MaxDelay], so messages sent close
+// together may arrive out of order.
+type simFaults struct {
+    MinDelay  time.Duration
+    MaxDelay  time.Duration
+    Drop      float64 // Probability of a message being lost
+    Duplicate float64 // Probability of a message being delivered twice
+}
+
+var defaultSimFaults = simFaults{MinDelay: time.Millisecond, MaxDelay: 20 * time.Millisecond, Drop: 0.05, Duplicate: 0.05}
+
+// Simulated timing: elections take 100-200ms of simulated time
+const (
+    simTickInterval   = 10 * time.Millisecond
+    simElectionTicks  = 10
+    simHeartbeatTicks = 1
+    simTraceLength    = 64
+)
+
+type simEventKind int
+
+const (
+    simTick simEventKind = iota
+    simDeliver
+)
+
+// simEvent is a tick of one node's clock or the delivery of a message
+type simEvent struct {
+    at   time.Duration
+    seq  uint64 // Orders events due at the same time by when they were scheduled
+    kind simEventKind
+    node string
+    msg  Message
+}
+
+// simQueue is a heap of events, earliest first
+type simQueue []*simEvent
+
+func (q simQueue) Len() int { return len(q) }
+func (q simQueue) Less(i, j int) bool {
+    if q[i].at != q[j].at {
+        return q[i].at < q[j].at
+    }
+    return q[i].seq < q[j].seq
+}
+func (q simQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *simQueue) Push(x interface{}) { *q = append(*q, x.(*simEvent)) }
+func (q *simQueue) Pop() interface{} {
+    old := *q
+    ev := old[len(old)-1]
+    *q = old[:len(old)-1]
+    return ev
+}
+
+// simNode is one simulated member: its Raft state, what it has persisted and
+// the entries it has applied, which are its state machine
+type simNode struct {
+    id      string
+    raft    *raftNode
+    storage *MemoryStorage
+    applied []LogEntry
+    checked uint64 // Highest committed index checked against the others
+    down    bool
+}
+
+// simulator runs a Raft group as a discrete-event simulation. Every choice,
+// from election timeouts to message delays and faults, is drawn from one
+// seeded source, so a run is reproduced exactly by its seed.
+type simulator struct {
+    seed          int64
+    rand          *rand.Rand
+    now           time.Duration
+    seq           uint64
+    queue         simQueue
+    ids           []string
+    nodes         map[string]*simNode
+    membership    Membership
+    faults        simFaults
+    partition     map[string]int // Side of the partition each node is on
+    snapshotEvery int            // Entries applied between snapshots; zero never compacts
+    lease         time.Duration  // Lease leaders hold; zero confirms every read with heartbeats
+
+    // What the invariant checkers have seen
+    leaders   map[uint64]string   // Term -> leader elected in it
+    committed map[uint64]LogEntry // Index -> entry committed there
+    commitIn  map[uint64]uint64   // Index -> term of the first node seen to commit it
+    lastIndex uint64              // Highest committed index seen
+    lastTerm  uint64              // Highest term an entry was committed in
+    violation error
+
+    trace       []string // Most recent events, for failure reports
+    fingerprint uint64   // Hash of every event, to compare runs
+    onApply     func(nodeID string, entry LogEntry)
+    onRead      func(nodeID string, id, index uint64, reject string)
+}
+
+func newSimulator(seed int64, ids []string, faults simFaults) *simulator {
+    s := &simulator{
+        seed:       seed,
+        rand:       rand.New(rand.NewSource(seed)),
+        ids:        append([]string{}, ids...),
+        nodes:      make(map[string]*simNode),
+        membership: Membership{Voters: append([]string{}, ids...)},
+        faults:     faults,
+        partition:  make(map[string]int),
+        leaders:    make(map[uint64]string),
+        committed:  make(map[uint64]LogEntry),
+        commitIn:   make(map[uint64]uint64),
+    }
+    for _, id := range s.ids {
+        s.nodes[id] = &simNode{id: id, storage: NewMemoryStorage()}
+        s.boot(s.nodes[id])
+        // Clocks start out of phase
+        s.schedule(&simEvent{at: time.Duration(s.rand.Int63n(int64(simTickInterval))), kind: simTick, node: id})
+    }
+    return s
+}
+
+// boot starts a node from what it has persisted
+func (s *simulator) boot(n *simNode) {
+    state, snapshot, entries, _ := n.storage.Load()
+    n.raft = newRaftNode(n.id, s.membership)
+    n.raft.rand = rand.New(rand.NewSource(s.rand.Int63()))
+    n.raft.now = func() time.Duration { return s.now }
+    n.raft.setTiming(simElectionTicks, simHeartbeatTicks)
+    n.raft.leaseDuration = s.lease
+    n.raft.restore(state, snapshot, entries)
+    n.applied = decodeSimState(snapshot.Data)
+    n.checked = 0
+    n.down = false
+}
+
+// setLease has every node hold leases of d while leading
+func (s *simulator) setLease(d time.Duration) {
+    s.lease = d
+    for _, n := range s.nodes {
+        n.raft.leaseDuration = d
+    }
+}
+
+func (s *simulator) schedule(ev *simEvent) {
+    s.seq++
+    ev.seq = s.seq
+    heap.Push(&s.queue, ev)
+}
+
+// record adds an event to the trace and the run's fingerprint
+func (s *simulator) record(format string, args ...interface{}) {
+    line := fmt.Sprintf("%v ", s.now) + fmt.Sprintf(format, args...)
+    h := fnv.New64a()
+    fmt.Fprintf(h, "%d %s", s.fingerprint, line)
+    s.fingerprint = h.Sum64()
+
+    s.trace = append(s.trace, line)
+    if len(s.trace) > simTraceLength {
+        s.trace = s.trace[1:]
+    }
+}
+
+// fail records the first invariant violation
+func (s *simulator) fail(format string, args ...interface{}) {
+    if s.violation == nil {
+        s.violation = fmt.Errorf(format, args...)
+    }
+}
+
+// run processes events for d of simulated time, stopping at the first
+// invariant violation
+func (s *simulator) run(d time.Duration) {
+    end := s.now + d
+    for s.violation == nil && len(s.queue) > 0 && s.queue[0].at <= end {
+        ev := heap.Pop(&s.queue).(*simEvent)
+        s.now = ev.at
+        n := s.nodes[ev.node]
+
+        switch ev.kind {
+        case simTick:
+            s.schedule(&simEvent{at: s.now + simTickInterval, kind: simTick, node: ev.node})
+            if n.down {
+                continue
+            }
+            n.raft.tick()
+        case simDeliver:
+            if n.down {
+                continue
+            }
+            s.record("%s -> %s %v term %d", ev.msg.From, ev.msg.To, ev.msg.Type, ev.msg.Term)
+            n.raft.step(ev.msg)
+            if ev.msg.Type == MsgReadIndexResponse && s.onRead != nil {
+                s.onRead(n.id, ev.msg.Proposal, ev.msg.MatchIndex, ev.msg.Reject)
+            }
+        }
+        s.process(n)
+        s.check(n)
+    }
+    if s.now < end {
+        s.now = end
+    }
+}
+
+// process carries out a node's outstanding work the way a Replica does:
+// persist, send, apply, then hand over confirmed reads
+func (s *simulator) process(n *simNode) {
+    for {
+        rd := n.raft.ready()
+        if rd.isEmpty() {
+            return
+        }
+        if rd.Snapshot != nil {
+            n.storage.SaveSnapshot(*rd.Snapshot)
+            n.applied = decodeSimState(rd.Snapshot.Data)
+            s.record("%s installs snapshot at %d", n.id, rd.Snapshot.Index)
+        }
+        if rd.HardState != nil || len(rd.Entries) > 0 {
+            state := n.raft.prevHard
+            if rd.HardState != nil {
+                state = *rd.HardState
+            }
+            n.storage.Save(state, rd.Entries)
+        }
+        for _, m := range rd.Messages {
+            s.send(m)
+        }
+        for _, entry := range rd.CommittedEntries {
+            s.apply(n, entry)
+        }
+        n.raft.advance(rd)
+        for _, rs := range rd.ReadStates {
+            if s.onRead != nil {
+                s.onRead(n.id, rs.ID, rs.Index, "")
+            }
+        }
+        s.maybeSnapshot(n)
+    }
+}
+
+// send puts a message on the simulated network, which may lose, delay or
+// duplicate it
+func (s *simulator) send(m Message) {
+    if s.partition[m.From] != s.partition[m.To] {
+        return
+    }
+    copies := 1
+    if s.rand.Float64() < s.faults.Drop {
+        copies = 0
+    } else if s.rand.Float64() < s.faults.Duplicate {
+        copies = 2
+    }
+    for i := 0; i < copies; i++ {
+        delay := s.faults.MinDelay
+        if spread := s.faults.MaxDelay - s.faults.MinDelay; spread > 0 {
+            delay += time.Duration(s.rand.Int63n(int64(spread)))
+        }
+        s.schedule(&simEvent{at: s.now + delay, kind: simDeliver, node: m.To, msg: m})
+    }
+}
+
+func (s *simulator) apply(n *simNode, entry LogEntry) {
+    if entry.Type == EntryConfChange {
+        var cc ConfChange
+        if err := json.Unmarshal(entry.Data, &cc); err == nil {
+            n.raft.applyConfChange(cc)
+        }
+    }
+    s.commit(n.id, n.raft.currentTerm, entry)
+    if want := uint64(len(n.applied)) + 1; entry.Index != want {
+        s.fail("%s applied index %d, want %d", n.id, entry.Index, want)
+    }
+    n.applied = append(n.applied, entry)
+    if s.onApply != nil {
+        s.onApply(n.id, entry)
+    }
+}
+
+// maybeSnapshot compacts a node's log every snapshotEvery applied entries
+func (s *simulator) maybeSnapshot(n *simNode) {
+    applied := n.raft.log.applied
+    if s.snapshotEvery == 0 || applied-n.raft.snapshot.Index < uint64(s.snapshotEvery) {
+        return
+    }
+    term, _ := n.raft.log.term(applied)
+    data, _ := json.Marshal(n.applied)
+    snapshot := Snapshot{Index: applied, Term: term, Membership: n.raft.membership, Data: data}
+    n.storage.SaveSnapshot(snapshot)
+    n.raft.compact(snapshot)
+}
+
+// decodeSimState returns the entries a snapshot's state machine had applied
+func decodeSimState(data []byte) []LogEntry {
+    var applied []LogEntry
+    if len(data) > 0 {
+        json.Unmarshal(data, &applied)
+    }
+    return applied
+}
+
+// propose appends data at the leader of the highest term, if any node leads
+func (s *simulator) propose(data []byte) (uint64, uint64, bool) {
+    leader := s.leader()
+    if leader == nil {
+        return 0, 0, false
+    }
+    index, term, err := leader.raft.propose(data)
+    if err != nil {
+        return 0, 0, false
+    }
+    s.record("%s proposes %q at %d", leader.id, data, index)
+    s.process(leader)
+    s.check(leader)
+    return index, term, true
+}
+
+// leader returns the running node leading the highest term, if any
+func (s *simulator) leader() *simNode {
+    var leader *simNode
+    for _, id := range s.ids {
+        n := s.nodes[id]
+        if !n.down && n.raft.state == Leader && (leader == nil || n.raft.currentTerm > leader.raft.currentTerm) {
+            leader = n
+        }
+    }
+    return leader
+}
+
+// isolate splits the nodes into two sides that cannot reach each other
+func (s *simulator) isolate(side []string) {
+    s.partition = make(map[string]int)
+    for _, id := range side {
+        s.partition[id] = 1
+    }
+    s.record("partition %v", side)
+}
+
+// heal reconnects every node
+func (s *simulator) heal() {
+    s.partition = make(map[string]int)
+    s.record("heal")
+}
+
+// crash stops a node, keeping only what it persisted
+func (s *simulator) crash(id string) {
+    s.nodes[id].down = true
+    s.record("crash %s", id)
+}
+
+// restart starts a crashed node again from its storage
+func (s *simulator) restart(id string) {
+    s.boot(s.nodes[id])
+    s.record("restart %s", id)
+}
+
+// nemesis injects a random fault, keeping at most two nodes down
+func (s *simulator) nemesis() {
+    var up, down []string
+    for _, id := range s.ids {
+        if s.nodes[id].down {
+            down = append(down, id)
+        } else {
+            up = append(up, id)
+        }
+    }
+
+    switch s.rand.Intn(5) {
+    case 0:
+        order := s.rand.Perm(len(s.ids))
+        side := make([]string, 1+s.rand.Intn(len(s.ids)-1))
+        for i := range side {
+            side[i] = s.ids[order[i]]
+        }
+        s.isolate(side)
+    case 1:
+        s.heal()
+    case 2:
+        if len(down) < 2 {
+            s.crash(up[s.rand.Intn(len(up))])
+        }
+    case 3:
+        if len(down) > 0 {
+            s.restart(down[s.rand.Intn(len(down))])
+        }
+    }
+}
+
+// check verifies the safety invariants after a node has acted
+func (s *simulator) check(n *simNode) {
+    s.checkElectionSafety(n)
+    s.checkCommitted(n)
+    for _, id := range s.ids {
+        if other := s.nodes[id]; other != n {
+            s.checkLogMatching(n, other)
+        }
+    }
+    s.checkLeaderCompleteness()
+    s.checkLeaseSafety()
+}
+
+// checkElectionSafety: at most one leader is elected in a term
+func (s *simulator) checkElectionSafety(n *simNode) {
+    if n.raft.state != Leader {
+        return
+    }
+    term := n.raft.currentTerm
+    if leader, exists := s.leaders[term]; exists && leader != n.id {
+        s.fail("election safety: %s and %s both lead term %d", leader, n.id, term)
+        return
+    }
+    s.leaders[term] = n.id
+}
+
+// checkCommitted records the entries a node knows to be committed; no two
+// nodes may commit different entries at the same index
+func (s *simulator) checkCommitted(n *simNode) {
+    for index := n.checked + 1; index <= n.raft.log.committed; index++ {
+        if entries := n.raft.log.slice(index, index+1); len(entries) == 1 {
+            s.commit(n.id, n.raft.currentTerm, entries[0])
+        }
+    }
+    n.checked = n.raft.log.committed
+}
+
+// commit records an entry a node in the given term knows to be committed.
+// Nodes learn of commits from leaders no later than their own term, so the
+// first node to know commits it no earlier than the term the entry was
+// committed in.
+func (s *simulator) commit(nodeID string, term uint64, entry LogEntry) {
+    if previous, exists := s.committed[entry.Index]; exists {
+        if !sameEntry(previous, entry) {
+            s.fail("state machine safety: %s committed term %d at index %d, previously term %d", nodeID, entry.Term, entry.Index, previous.Term)
+        }
+        return
+    }
+    s.committed[entry.Index] = entry
+    s.commitIn[entry.Index] = term
+    if entry.Index > s.lastIndex {
+        s.lastIndex = entry.Index
+    }
+    if entry.Term > s.lastTerm {
+        s.lastTerm = entry.Term
+    }
+}
+
+// checkLogMatching: if two logs hold an entry with the same index and term,
+// they hold the same entries up to it
+func (s *simulator) checkLogMatching(a, b *simNode) {
+    first := a.raft.log.firstIndex()
+    if f := b.raft.log.firstIndex(); f > first {
+        first = f
+    }
+    last := minIndex(a.raft.log.lastIndex(), b.raft.log.lastIndex())
+
+    matched := false
+    for index := last; index >= first && index > 0; index-- {
+        ea, eb := a.raft.log.slice(index, index+1), b.raft.log.slice(index, index+1)
+        if len(ea) == 0 || len(eb) == 0 {
+            return
+        }
+        if !matched {
+            matched = ea[0].Term == eb[0].Term
+            if !matched {
+                continue
+            }
+        }
+        if !sameEntry(ea[0], eb[0]) {
+            s.fail("log matching: %s and %s differ at index %d below a matching entry", a.id, b.id, index)
+            return
+        }
+    }
+}
+
+// checkLeaderCompleteness: a leader holds every entry committed in earlier
+// terms. An entry from an earlier term may be committed after a leader of a
+// later term was elected without it, so it is measured by when it committed.
+func (s *simulator) checkLeaderCompleteness() {
+    for _, id := range s.ids {
+        n := s.nodes[id]
+        if n.down || n.raft.state != Leader {
+            continue
+        }
+        for index := n.raft.log.firstIndex(); index <= s.lastIndex; index++ {
+            entry, exists := s.committed[index]
+            if !exists || s.commitIn[index] >= n.raft.currentTerm {
+                continue
+            }
+            held := n.raft.log.slice(index, index+1)
+            if len(held) == 0 || !sameEntry(held[0], entry) {
+                s.fail("leader completeness: %s leads term %d without entry %d committed by term %d", n.id, n.raft.currentTerm, index, s.commitIn[index])
+                return
+            }
+        }
+    }
+}
+
+// checkLeaseSafety: no entry is committed in a later term while a leader
+// holds its lease, or the leader could serve reads that miss it
+func (s *simulator) checkLeaseSafety() {
+    for _, id := range s.ids {
+        n := s.nodes[id]
+        if !n.down && n.raft.leaseValid() && s.lastTerm > n.raft.currentTerm {
+            s.fail("lease safety: %s holds a lease in term %d after an entry committed in term %d", n.id, n.raft.currentTerm, s.lastTerm)
+            return
+        }
+    }
+}
+
+func sameEntry(a, b LogEntry) bool {
+    return a.Index == b.Index && a.Term == b.Term && a.Type == b.Type && bytes.Equal(a.Data, b.Data)
+}
+
+// report fails the test with the seed that reproduces the run and its trace
+func (s *simulator) report(t *testing.T, err error) {
+    t.Helper()
+    t.Fatalf("seed %d: %v\nreproduce with -sim.seed=%d; last events:\n%s", s.seed, err, s.seed, strings.Join(s.trace, "\n"))
+}
+
+// runFaultySimulation runs five nodes through rounds of client proposals and
+// random faults, then heals the network and checks the group recovers
+func runFaultySimulation(t *testing.T, seed int64) *simulator {
+    t.Helper()
+
+    s := newSimulator(seed, []string{"n1", "n2", "n3", "n4", "n5"}, defaultSimFaults)
+    s.snapshotEvery = 16
+    proposed := 0
+    for round := 0; round < 30; round++ {
+        s.nemesis()
+        for i := 0; i < 5; i++ {
+            if _, _, ok := s.propose([]byte(fmt.Sprintf("tx%d", proposed))); ok {
+                proposed++
+            }
+            s.run(20 * time.Millisecond)
+        }
+    }
+    if s.violation != nil {
+        s.report(t, s.violation)
+    }
+
+    s.heal()
+    for _, id := range s.ids {
+        if s.nodes[id].down {
+            s.restart(id)
+        }
+    }
+    s.run(2 * time.Second)
+    if _, _, ok := s.propose([]byte("final")); !ok {
+        s.report(t, fmt.Errorf("no leader after the network healed"))
+    }
+    s.run(2 * time.Second)
+    if s.violation != nil {
+        s.report(t, s.violation)
+    }
+
+    for _, id := range s.ids {
+        n := s.nodes[id]
+        if uint64(len(n.applied)) != s.lastIndex || string(n.applied[len(n.applied)-1].Data) != "final" {
+            s.report(t, fmt.Errorf("%s applied %d entries, want %d ending with the final proposal", id, len(n.applied), s.lastIndex))
+        }
+    }
+    return s
+}
+
+func TestSimulationKeepsRaftInvariants(t *testing.T) {
+    for _, seed := range simSeeds() {
+        runFaultySimulation(t, seed)
+    }
+}
+
+func TestSimulationIsReproducible(t *testing.T) {
+    a := runFaultySimulation(t, 7)
+    b := runFaultySimulation(t, 7)
+    if a.fingerprint != b.fingerprint {
+        t.Fatalf("seed 7 ran differently twice")
+    }
+    if c := runFaultySimulation(t, 8); c.fingerprint == a.fingerprint {
+        t.Fatalf("seeds 7 and 8 ran identically")
+    }
+}
+
+func TestSimulationCheckersCatchViolations(t *testing.T) {
+    s := newSimulator(1, []string{"n1", "n2", "n3"}, simFaults{MinDelay: time.Millisecond, MaxDelay: time.Millisecond})
+    s.run(time.Second)
+    if s.leader() == nil || s.violation != nil {
+        t.Fatalf("no clean election: %v", s.violation)
+    }
+
+    // A second leader in the same term
+    leader := s.leader()
+    var rival *simNode
+    for _, id := range s.ids {
+        if s.nodes[id] != leader {
+            rival = s.nodes[id]
+            break
+        }
+    }
+    rival.raft.state = Leader
+    rival.raft.currentTerm = leader.raft.currentTerm
+    s.check(rival)
+    if s.violation == nil || !strings.Contains(s.violation.Error(), "election safety") {
+        t.Errorf("violation = %v, want election safety", s.violation)
+    }
+
+    // Logs that agree at an index but not below it
+    s.violation = nil
+    rival.raft.state = Follower
+    a := []LogEntry{{Term: 1, Index: 1, Data: []byte("x")}, {Term: 2, Index: 2}}
+    b := []LogEntry{{Term: 1, Index: 1, Data: []byte("y")}, {Term: 2, Index: 2}}
+    leader.raft.log = newRaftLog()
+    leader.raft.log.append(a...)
+    rival.raft.log = newRaftLog()
+    rival.raft.log.append(b...)
+    s.checkLogMatching(leader, rival)
+    if s.violation == nil || !strings.Contains(s.violation.Error(), "log matching") {
+        t.Errorf("violation = %v, want log matching", s.violation)
+    }
+
+    // A leader missing a committed entry
+    s.violation = nil
+    s.commit("n1", 1, LogEntry{Term: 1, Index: 3, Data: []byte("z")})
+    leader.raft.currentTerm = 3
+    s.checkLeaderCompleteness()
+    if s.violation == nil || !strings.Contains(s.violation.Error(), "leader completeness") {
+        t.Errorf("violation = %v, want leader completeness", s.violation)
+    }
+}
+
+// electStably runs the group until it has a leader, failing the test if it
+// does not elect one
+func electStably(t *testing.T, s *simulator) *simNode {
+    t.Helper()
+    s.run(time.Second)
+    leader := s.leader()
+    if leader == nil {
+        s.report(t, fmt.Errorf("no leader elected"))
+    }
+    return leader
+}
+
+// flap cuts a node off from the rest of the group and reconnects it, again
+// and again, for spells of random length while clients keep proposing
+func (s *simulator) flap(id string, rounds int) {
+    proposed := 0
+    for round := 0; round < rounds; round++ {
+        for _, connected := range []bool{false, true} {
+            if connected {
+                s.heal()
+            } else {
+                s.isolate([]string{id})
+            }
+            spell := 50*time.Millisecond + time.Duration(s.rand.Int63n(int64(300*time.Millisecond)))
+            for end := s.now + spell; s.now < end; {
+                if _, _, ok := s.propose([]byte(fmt.Sprintf("flap%d", proposed))); ok {
+                    proposed++
+                }
+                s.run(20 * time.Millisecond)
+            }
+        }
+    }
+}
+
+func TestFlappingFollowerDoesNotDeposeLeader(t *testing.T) {
+    for _, seed := range simSeeds() {
+        s := newSimulator(seed, []string{"n1", "n2", "n3", "n4", "n5"}, defaultSimFaults)
+        s.snapshotEvery = 16
+        leader := electStably(t, s)
+        term := leader.raft.currentTerm
+
+        flapper := s.ids[0]
+        if flapper == leader.id {
+            flapper = s.ids[1]
+        }
+        s.flap(flapper, 6)
+        s.run(time.Second)
+        if s.violation != nil {
+            s.report(t, s.violation)
+        }
+        if current := s.leader(); current != leader || leader.raft.currentTerm != term {
+            s.report(t, fmt.Errorf("%s flapping deposed leader %s of term %d", flapper, leader.id, term))
+        }
+
+        // The flapping node catches up once its link settles
+        if _, _, ok := s.propose([]byte("final")); !ok {
+            s.report(t, fmt.Errorf("no leader after the link settled"))
+        }
+        s.run(time.Second)
+        if n := s.nodes[flapper]; uint64(len(n.applied)) != s.lastIndex {
+            s.report(t, fmt.Errorf("%s applied %d entries, want %d", flapper, len(n.applied), s.lastIndex))
+        }
+    }
+}
+
+func TestLeaderWithoutQuorumStepsDown(t *testing.T) {
+    for _, seed := range simSeeds() {
+        s := newSimulator(seed, []string{"n1", "n2", "n3", "n4", "n5"}, defaultSimFaults)
+        old := electStably(t, s)
+        term := old.raft.currentTerm
+
+        minority := []string{old.id}
+        for _, id := range s.ids {
+            if id != old.id {
+                minority = append(minority, id)
+                break
+            }
+        }
+        s.isolate(minority)
+        // The leader checks its quorum every election timeout, and messages
+        // in flight when the partition started may see it through one check
+        s.run(3 * simElectionTicks * simTickInterval)
+        if old.raft.state == Leader {
+            s.report(t, fmt.Errorf("%s still leads term %d without a quorum", old.id, term))
+        }
+        s.run(time.Second)
+        leader := s.leader()
+        if leader == nil || leader == old || leader.raft.currentTerm <= term {
+            s.report(t, fmt.Errorf("majority elected no new leader"))
+        }
+
+        s.heal()
+        s.run(time.Second)
+        if old.raft.leaderID != leader.id {
+            s.report(t, fmt.Errorf("%s follows %q after the partition healed, want %s", old.id, old.raft.leaderID, leader.id))
+        }
+        if s.violation != nil {
+            s.report(t, s.violation)
+        }
+    }
+}
+
+func TestFlappingConnectivityKeepsRaftInvariants(t *testing.T) {
+    for _, seed := range simSeeds() {
+        s := newSimulator(seed, []string{"n1", "n2", "n3", "n4", "n5"}, defaultSimFaults)
+        s.snapshotEvery = 16
+        for round := 0; round < 4; round++ {
+            s.flap(s.ids[s.rand.Intn(len(s.ids))], 2)
+        }
+        s.heal()
+        s.run(2 * time.Second)
+        if _, _, ok := s.propose([]byte("final")); !ok {
+            s.report(t, fmt.Errorf("no leader after the network settled"))
+        }
+        s.run(2 * time.Second)
+        if s.violation != nil {
+            s.report(t, s.violation)
+        }
+        for _, id := range s.ids {
+            if n := s.nodes[id]; uint64(len(n.applied)) != s.lastIndex {
+                s.report(t, fmt.Errorf("%s applied %d entries, want %d", id, len(n.applied), s.lastIndex))
+            }
+        }
+    }
+}
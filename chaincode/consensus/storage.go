@@ -0,0 +1,518 @@
+package consensus
+
+import (
+    "bufio"
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "io"
+    "os"
+    "path/filepath"
+    "sync"
+)
+
+// HardState is the Raft state that must survive a restart. Persisting the
+// vote before answering a candidate stops a restarted node voting twice in
+// one term.
+type HardState struct {
+    Term   uint64
+    Vote   string
+    Commit uint64
+}
+
+// Storage durably stores a replica's hard state, snapshot and log
+type Storage interface {
+    // Load returns the persisted hard state, latest snapshot and the log
+    // entries after it
+    Load() (HardState, Snapshot, []LogEntry, error)
+    // Save durably stores the hard state and entries before returning.
+    // Entries replace any stored entries from the first one's index onwards.
+    Save(state HardState, entries []LogEntry) error
+    // SaveSnapshot durably stores a snapshot and discards the entries it covers
+    SaveSnapshot(snapshot Snapshot) error
+    // Close releases the storage's resources
+    Close() error
+}
+
+// MemoryStorage keeps a replica's state in memory, for nodes that need not
+// survive a restart
+type MemoryStorage struct {
+    state    HardState
+    snapshot Snapshot
+    entries  []LogEntry
+    mu       sync.Mutex
+}
+
+// NewMemoryStorage creates an empty in-memory storage
+func NewMemoryStorage() *MemoryStorage {
+    return &MemoryStorage{entries: make([]LogEntry, 0)}
+}
+
+// Load returns the stored hard state, snapshot and log entries
+func (s *MemoryStorage) Load() (HardState, Snapshot, []LogEntry, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return s.state, s.snapshot, append([]LogEntry{}, s.entries...), nil
+}
+
+// Save stores the hard state and entries
+func (s *MemoryStorage) Save(state HardState, entries []LogEntry) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.state = state
+    s.entries = appendEntries(s.entries, entries)
+    return nil
+}
+
+// SaveSnapshot stores a snapshot and discards the entries it covers
+func (s *MemoryStorage) SaveSnapshot(snapshot Snapshot) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if snapshot.Index > s.snapshot.Index {
+        s.snapshot = snapshot
+        s.entries = entriesAfter(s.entries, snapshot)
+    }
+    return nil
+}
+
+// Close does nothing
+func (s *MemoryStorage) Close() error {
+    return nil
+}
+
+// appendEntries adds entries to a log, replacing any from the first new index on
+func appendEntries(log []LogEntry, entries []LogEntry) []LogEntry {
+    if len(entries) == 0 {
+        return log
+    }
+    first := entries[0].Index
+    for len(log) > 0 && log[len(log)-1].Index >= first {
+        log = log[:len(log)-1]
+    }
+    return append(log, entries...)
+}
+
+// entriesAfter returns the entries a snapshot leaves in the log. Entries
+// after the snapshot are only kept when the log holds the snapshot's last
+// entry; otherwise they may conflict with the leader's log and are dropped.
+func entriesAfter(log []LogEntry, snapshot Snapshot) []LogEntry {
+    for i, entry := range log {
+        if entry.Index == snapshot.Index {
+            if entry.Term != snapshot.Term {
+                break
+            }
+            return append([]LogEntry{}, log[i+1:]...)
+        }
+    }
+    return make([]LogEntry, 0)
+}
+
+// WAL record types
+const (
+    recordState byte = iota + 1
+    recordEntry
+    recordSnapshot
+)
+
+// walHeaderSize is the length and CRC preceding each record's body
+const walHeaderSize = 8
+
+// maxRecordSize bounds a record's length, so a damaged header cannot make
+// recovery allocate an arbitrary amount of memory
+const maxRecordSize = 1 << 30
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errCorruptRecord marks a record whose checksum or framing does not match
+var errCorruptRecord = errors.New("corrupt WAL record")
+
+// FileStorage is a write-ahead log in a single file. Each record is framed by
+// its length and a CRC-32C checksum, and every Save is fsynced. On open the
+// log is replayed; a torn record at the tail, left by a crash mid-write, is
+// truncated away, but a damaged record followed by others fails recovery
+// rather than silently dropping what follows it. The latest snapshot is kept beside the log
+// in path.snap, and the log is rewritten without the entries it covers.
+type FileStorage struct {
+    path     string
+    file     *os.File
+    state    HardState
+    snapshot Snapshot
+    entries  []LogEntry
+    mu       sync.Mutex
+}
+
+// NewFileStorage opens the WAL at path, creating it if needed, and recovers
+// the state it holds
+func NewFileStorage(path string) (*FileStorage, error) {
+    dir := filepath.Dir(path)
+    if err := os.MkdirAll(dir, 0o755); err != nil {
+        return nil, fmt.Errorf("failed to create WAL directory %s: %v", dir, err)
+    }
+    file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+    if err != nil {
+        return nil, fmt.Errorf("failed to open WAL %s: %v", path, err)
+    }
+    // Make the file's directory entry durable too
+    if err := syncDir(dir); err != nil {
+        file.Close()
+        return nil, err
+    }
+
+    s := &FileStorage{path: path, file: file, entries: make([]LogEntry, 0)}
+    if err := s.loadSnapshot(); err != nil {
+        file.Close()
+        return nil, err
+    }
+    if err := s.recover(); err != nil {
+        file.Close()
+        return nil, fmt.Errorf("failed to recover WAL %s: %v", path, err)
+    }
+    return s, nil
+}
+
+// Load returns the recovered hard state, snapshot and log entries
+func (s *FileStorage) Load() (HardState, Snapshot, []LogEntry, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return s.state, s.snapshot, append([]LogEntry{}, s.entries...), nil
+}
+
+// Save appends the hard state and entries to the log and fsyncs it
+func (s *FileStorage) Save(state HardState, entries []LogEntry) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    buf := make([]byte, 0)
+    for _, entry := range entries {
+        buf = appendRecord(buf, recordEntry, encodeEntry(entry))
+    }
+    buf = appendRecord(buf, recordState, encodeState(state))
+
+    if _, err := s.file.Write(buf); err != nil {
+        return fmt.Errorf("failed to write WAL: %v", err)
+    }
+    if err := s.file.Sync(); err != nil {
+        return fmt.Errorf("failed to sync WAL: %v", err)
+    }
+
+    s.state = state
+    s.entries = appendEntries(s.entries, entries)
+    return nil
+}
+
+// SaveSnapshot writes the snapshot file, then rewrites the log without the
+// entries the snapshot covers. Each file is replaced atomically, so a crash
+// part way through leaves a snapshot and a log that still agree.
+func (s *FileStorage) SaveSnapshot(snapshot Snapshot) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if snapshot.Index <= s.snapshot.Index {
+        return nil
+    }
+    body, err := encodeSnapshot(snapshot)
+    if err != nil {
+        return fmt.Errorf("failed to encode snapshot: %v", err)
+    }
+    if err := writeFileAtomic(s.path+".snap", appendRecord(nil, recordSnapshot, body)); err != nil {
+        return fmt.Errorf("failed to write snapshot: %v", err)
+    }
+    s.snapshot = snapshot
+    s.entries = entriesAfter(s.entries, snapshot)
+
+    buf := make([]byte, 0)
+    for _, entry := range s.entries {
+        buf = appendRecord(buf, recordEntry, encodeEntry(entry))
+    }
+    buf = appendRecord(buf, recordState, encodeState(s.state))
+    if err := writeFileAtomic(s.path, buf); err != nil {
+        return fmt.Errorf("failed to compact WAL: %v", err)
+    }
+
+    file, err := os.OpenFile(s.path, os.O_RDWR|os.O_APPEND, 0o644)
+    if err != nil {
+        return fmt.Errorf("failed to reopen WAL: %v", err)
+    }
+    s.file.Close()
+    s.file = file
+    return nil
+}
+
+// Close closes the log file
+func (s *FileStorage) Close() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return s.file.Close()
+}
+
+// loadSnapshot reads the snapshot file, if any
+func (s *FileStorage) loadSnapshot() error {
+    file, err := os.Open(s.path + ".snap")
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return fmt.Errorf("failed to open snapshot: %v", err)
+    }
+    defer file.Close()
+
+    info, err := file.Stat()
+    if err != nil {
+        return fmt.Errorf("failed to open snapshot: %v", err)
+    }
+
+    // The snapshot file is replaced atomically, so a bad record is real damage
+    kind, body, _, err := readRecord(bufio.NewReader(file), info.Size())
+    if err != nil || kind != recordSnapshot {
+        return fmt.Errorf("corrupt snapshot %s.snap", s.path)
+    }
+    snapshot, err := decodeSnapshot(body)
+    if err != nil {
+        return err
+    }
+    s.snapshot = snapshot
+    return nil
+}
+
+// recover replays the log and truncates a torn record at its end. A record
+// is torn when the file ends part way through it and no whole record follows
+// its header, or when it fails its checksum and nothing follows it.
+func (s *FileStorage) recover() error {
+    info, err := s.file.Stat()
+    if err != nil {
+        return err
+    }
+    size := info.Size()
+    if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+        return err
+    }
+
+    reader := bufio.NewReader(s.file)
+    var offset int64
+    for {
+        kind, body, n, err := readRecord(reader, size-offset)
+        if err == io.EOF || err == io.ErrUnexpectedEOF {
+            break
+        }
+        if err == errCorruptRecord {
+            if offset+int64(n) < size {
+                return fmt.Errorf("%v at offset %d, followed by %d more bytes", err, offset, size-offset-int64(n))
+            }
+            break
+        }
+        if err != nil {
+            return err
+        }
+
+        switch kind {
+        case recordState:
+            state, err := decodeState(body)
+            if err != nil {
+                return err
+            }
+            s.state = state
+        case recordEntry:
+            entry, err := decodeEntry(body)
+            if err != nil {
+                return err
+            }
+            if entry.Index > s.snapshot.Index {
+                s.entries = appendEntries(s.entries, []LogEntry{entry})
+            }
+        default:
+            return fmt.Errorf("unknown WAL record type %d", kind)
+        }
+        offset += int64(n)
+    }
+
+    if err := s.file.Truncate(offset); err != nil {
+        return err
+    }
+    _, err = s.file.Seek(offset, io.SeekStart)
+    return err
+}
+
+// appendRecord frames a record as length, CRC, type and body
+func appendRecord(buf []byte, kind byte, body []byte) []byte {
+    payload := append([]byte{kind}, body...)
+
+    var header [walHeaderSize]byte
+    binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+    binary.BigEndian.PutUint32(header[4:8], crc32.Checksum(payload, crcTable))
+    return append(append(buf, header[:]...), payload...)
+}
+
+// readRecord reads one record from at most available bytes, returning its
+// type, body and size on disk. A record the bytes end part way through
+// reports io.ErrUnexpectedEOF; a damaged one reports errCorruptRecord with
+// its size as framed, or just the header's if the length is implausible.
+// A length running past the end is only taken for a torn write when no
+// whole record follows the header, as none can follow the last one written.
+func readRecord(r io.Reader, available int64) (byte, []byte, int, error) {
+    var header [walHeaderSize]byte
+    if _, err := io.ReadFull(r, header[:]); err != nil {
+        return 0, nil, 0, err
+    }
+
+    length := binary.BigEndian.Uint32(header[0:4])
+    if length == 0 || length > maxRecordSize {
+        return 0, nil, walHeaderSize, errCorruptRecord
+    }
+    if int64(walHeaderSize)+int64(length) > available {
+        rest, err := io.ReadAll(io.LimitReader(r, available-walHeaderSize))
+        if err != nil {
+            return 0, nil, 0, err
+        }
+        if containsRecord(rest) {
+            return 0, nil, walHeaderSize, errCorruptRecord
+        }
+        return 0, nil, 0, io.ErrUnexpectedEOF
+    }
+    payload := make([]byte, length)
+    if _, err := io.ReadFull(r, payload); err != nil {
+        return 0, nil, 0, err
+    }
+    if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+        return 0, nil, walHeaderSize + int(length), errCorruptRecord
+    }
+    return payload[0], payload[1:], walHeaderSize + int(length), nil
+}
+
+// containsRecord reports whether a whole record with a valid checksum starts
+// anywhere in data
+func containsRecord(data []byte) bool {
+    for start := 0; start+walHeaderSize < len(data); start++ {
+        length := binary.BigEndian.Uint32(data[start : start+4])
+        end := int64(start) + walHeaderSize + int64(length)
+        if length == 0 || end > int64(len(data)) {
+            continue
+        }
+        payload := data[start+walHeaderSize : end]
+        if payload[0] >= recordState && payload[0] <= recordSnapshot && crc32.Checksum(payload, crcTable) == binary.BigEndian.Uint32(data[start+4:start+8]) {
+            return true
+        }
+    }
+    return false
+}
+
+func encodeState(state HardState) []byte {
+    buf := make([]byte, 16, 16+len(state.Vote))
+    binary.BigEndian.PutUint64(buf[0:8], state.Term)
+    binary.BigEndian.PutUint64(buf[8:16], state.Commit)
+    return append(buf, state.Vote...)
+}
+
+func decodeState(body []byte) (HardState, error) {
+    if len(body) < 16 {
+        return HardState{}, fmt.Errorf("short hard state record")
+    }
+    return HardState{
+        Term:   binary.BigEndian.Uint64(body[0:8]),
+        Commit: binary.BigEndian.Uint64(body[8:16]),
+        Vote:   string(body[16:]),
+    }, nil
+}
+
+func encodeEntry(entry LogEntry) []byte {
+    buf := make([]byte, 17, 17+len(entry.Data))
+    binary.BigEndian.PutUint64(buf[0:8], entry.Term)
+    binary.BigEndian.PutUint64(buf[8:16], entry.Index)
+    buf[16] = byte(entry.Type)
+    return append(buf, entry.Data...)
+}
+
+func decodeEntry(body []byte) (LogEntry, error) {
+    if len(body) < 17 {
+        return LogEntry{}, fmt.Errorf("short log entry record")
+    }
+    entry := LogEntry{
+        Term:  binary.BigEndian.Uint64(body[0:8]),
+        Index: binary.BigEndian.Uint64(body[8:16]),
+        Type:  EntryType(body[16]),
+    }
+    if len(body) > 17 {
+        entry.Data = append([]byte{}, body[17:]...)
+    }
+    return entry, nil
+}
+
+// encodeSnapshot lays out a snapshot as term, index, the length of the
+// JSON-encoded membership, the membership and the state machine's data
+func encodeSnapshot(snapshot Snapshot) ([]byte, error) {
+    membership, err := json.Marshal(snapshot.Membership)
+    if err != nil {
+        return nil, err
+    }
+
+    buf := make([]byte, 20, 20+len(membership)+len(snapshot.Data))
+    binary.BigEndian.PutUint64(buf[0:8], snapshot.Term)
+    binary.BigEndian.PutUint64(buf[8:16], snapshot.Index)
+    binary.BigEndian.PutUint32(buf[16:20], uint32(len(membership)))
+    buf = append(buf, membership...)
+    return append(buf, snapshot.Data...), nil
+}
+
+func decodeSnapshot(body []byte) (Snapshot, error) {
+    if len(body) < 20 {
+        return Snapshot{}, fmt.Errorf("short snapshot record")
+    }
+    length := int(binary.BigEndian.Uint32(body[16:20]))
+    if len(body) < 20+length {
+        return Snapshot{}, fmt.Errorf("short snapshot record")
+    }
+
+    snapshot := Snapshot{
+        Term:  binary.BigEndian.Uint64(body[0:8]),
+        Index: binary.BigEndian.Uint64(body[8:16]),
+        Data:  append([]byte{}, body[20+length:]...),
+    }
+    if err := json.Unmarshal(body[20:20+length], &snapshot.Membership); err != nil {
+        return Snapshot{}, fmt.Errorf("corrupt snapshot membership: %v", err)
+    }
+    return snapshot, nil
+}
+
+// writeFileAtomic replaces path with data via a synced temporary file
+func writeFileAtomic(path string, data []byte) error {
+    tmp := path + ".tmp"
+    file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+    if err != nil {
+        return err
+    }
+    if _, err := file.Write(data); err != nil {
+        file.Close()
+        return err
+    }
+    if err := file.Sync(); err != nil {
+        file.Close()
+        return err
+    }
+    if err := file.Close(); err != nil {
+        return err
+    }
+    if err := os.Rename(tmp, path); err != nil {
+        return err
+    }
+    return syncDir(filepath.Dir(path))
+}
+
+// syncDir fsyncs a directory so that files created in it survive a crash
+func syncDir(dir string) error {
+    d, err := os.Open(dir)
+    if err != nil {
+        return fmt.Errorf("failed to open directory %s: %v", dir, err)
+    }
+    defer d.Close()
+
+    if err := d.Sync(); err != nil {
+        return fmt.Errorf("failed to sync directory %s: %v", dir, err)
+    }
+    return nil
+}
@@ -0,0 +1,319 @@
+package consensus
+
+import (
+    "context"
+    "encoding/binary"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func TestFileStorageRecoversAndDropsTornRecord(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "n1.wal")
+    storage, err := NewFileStorage(path)
+    if err != nil {
+        t.Fatalf("NewFileStorage: %v", err)
+    }
+
+    entries := []LogEntry{{Term: 1, Index: 1, Data: []byte("a")}, {Term: 1, Index: 2, Data: []byte("b")}}
+    if err := storage.Save(HardState{Term: 1, Vote: "n1", Commit: 1}, entries); err != nil {
+        t.Fatalf("Save: %v", err)
+    }
+    // A new leader overwrites entry 2
+    if err := storage.Save(HardState{Term: 2, Vote: "n2", Commit: 2}, []LogEntry{{Term: 2, Index: 2, Data: []byte("c")}}); err != nil {
+        t.Fatalf("Save: %v", err)
+    }
+    storage.Close()
+
+    // Simulate a crash part way through writing a record
+    file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+    if err != nil {
+        t.Fatalf("OpenFile: %v", err)
+    }
+    file.Write(appendRecord(nil, recordEntry, encodeEntry(LogEntry{Term: 2, Index: 3}))[:10])
+    file.Close()
+
+    storage, err = NewFileStorage(path)
+    if err != nil {
+        t.Fatalf("NewFileStorage after crash: %v", err)
+    }
+    defer storage.Close()
+
+    state, _, recovered, err := storage.Load()
+    if err != nil {
+        t.Fatalf("Load: %v", err)
+    }
+    if state != (HardState{Term: 2, Vote: "n2", Commit: 2}) {
+        t.Errorf("state = %+v, want term 2, vote n2, commit 2", state)
+    }
+    if len(recovered) != 2 || string(recovered[1].Data) != "c" || recovered[1].Term != 2 {
+        t.Fatalf("entries = %+v, want a@1 then c@2", recovered)
+    }
+
+    // The torn tail is gone, so later records are readable
+    if err := storage.Save(state, []LogEntry{{Term: 2, Index: 3, Data: []byte("d")}}); err != nil {
+        t.Fatalf("Save after recovery: %v", err)
+    }
+}
+
+func TestFileStorageRejectsCorruptionMidLog(t *testing.T) {
+    tests := []struct {
+        name    string
+        corrupt func(wal []byte, second int)
+    }{
+        {
+            // A flipped bit in the first entry's data
+            name:    "Checksum",
+            corrupt: func(wal []byte, second int) { wal[second-1] ^= 0xff },
+        },
+        {
+            // A length far beyond the file, which must not be allocated
+            name:    "Length",
+            corrupt: func(wal []byte, second int) { binary.BigEndian.PutUint32(wal[0:4], 0xfffffff0) },
+        },
+        {
+            // A plausible length that runs past the end of the file, as a
+            // torn last record's would, though whole records follow it
+            name:    "LengthPastEnd",
+            corrupt: func(wal []byte, second int) { binary.BigEndian.PutUint32(wal[0:4], uint32(len(wal))) },
+        },
+        {
+            // The same in the middle of the log
+            name:    "MidLogLengthPastEnd",
+            corrupt: func(wal []byte, second int) { binary.BigEndian.PutUint32(wal[second:second+4], uint32(len(wal))) },
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            path := filepath.Join(t.TempDir(), "n1.wal")
+            storage, err := NewFileStorage(path)
+            if err != nil {
+                t.Fatalf("NewFileStorage: %v", err)
+            }
+            entries := []LogEntry{{Term: 1, Index: 1, Data: []byte("a")}, {Term: 1, Index: 2, Data: []byte("b")}}
+            if err := storage.Save(HardState{Term: 1, Commit: 2}, entries); err != nil {
+                t.Fatalf("Save: %v", err)
+            }
+            storage.Close()
+
+            wal, err := os.ReadFile(path)
+            if err != nil {
+                t.Fatalf("ReadFile: %v", err)
+            }
+            second := len(appendRecord(nil, recordEntry, encodeEntry(entries[0])))
+            tt.corrupt(wal, second)
+            if err := os.WriteFile(path, wal, 0o644); err != nil {
+                t.Fatalf("WriteFile: %v", err)
+            }
+
+            if storage, err := NewFileStorage(path); err == nil {
+                storage.Close()
+                t.Fatal("recovered a WAL damaged before its last record")
+            }
+        })
+    }
+}
+
+func TestRestartedNodeDoesNotVoteTwice(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "n2.wal")
+    storage, err := NewFileStorage(path)
+    if err != nil {
+        t.Fatalf("NewFileStorage: %v", err)
+    }
+
+    transport := NewInMemoryTransport()
+    defer transport.Close()
+    replica, err := NewReplica(ReplicaConfig{
+        NodeID:    "n2",
+        ZoneID:    "Z1",
+        Peers:     []string{"n1", "n2", "n3"},
+        Transport: transport,
+        Storage:   storage,
+    })
+    if err != nil {
+        t.Fatalf("NewReplica: %v", err)
+    }
+
+    replica.mu.Lock()
+    replica.node.step(Message{Type: MsgRequestVote, From: "n1", To: "n2", Term: 1})
+    replica.processReady()
+    replica.mu.Unlock()
+    // Crash before the election completes
+    replica.Stop()
+
+    storage, err = NewFileStorage(path)
+    if err != nil {
+        t.Fatalf("NewFileStorage: %v", err)
+    }
+    state, _, _, _ := storage.Load()
+    node := newRaftNode("n2", Membership{Voters: []string{"n1", "n2", "n3"}})
+    node.restore(state, Snapshot{}, nil)
+    storage.Close()
+
+    node.step(Message{Type: MsgRequestVote, From: "n3", To: "n2", Term: 1})
+    if resp := node.msgs[len(node.msgs)-1]; resp.Success {
+        t.Fatal("restarted node voted twice in term 1")
+    }
+}
+
+func TestConsensusReplaysLogAfterRestart(t *testing.T) {
+    dir := t.TempDir()
+
+    l := newTestConsensus(t, []string{"n1"})
+    l.SetDataDir(dir)
+    if err := l.RegisterNode("n1", "Z1", 0.9); err != nil {
+        t.Fatalf("RegisterNode: %v", err)
+    }
+    if _, err := l.ElectZoneLeader("Z1"); err != nil {
+        t.Fatalf("ElectZoneLeader: %v", err)
+    }
+    if err := l.PropagateTransaction([]byte("tx1"), "Z1"); err != nil {
+        t.Fatalf("PropagateTransaction: %v", err)
+    }
+    l.Stop()
+
+    restarted := newTestConsensus(t, []string{"n1"})
+    defer restarted.Stop()
+    restarted.SetDataDir(dir)
+    sm := newTestStateMachine()
+    restarted.SetApplyFunc(sm.apply)
+    if err := restarted.RegisterNode("n1", "Z1", 0.9); err != nil {
+        t.Fatalf("RegisterNode after restart: %v", err)
+    }
+    sm.waitFor(t, "n1", "tx1")
+}
+
+func TestFileStorageSnapshotCompactsLog(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "n1.wal")
+    storage, err := NewFileStorage(path)
+    if err != nil {
+        t.Fatalf("NewFileStorage: %v", err)
+    }
+
+    entries := []LogEntry{{Term: 1, Index: 1}, {Term: 1, Index: 2}, {Term: 1, Index: 3}}
+    if err := storage.Save(HardState{Term: 1, Commit: 3}, entries); err != nil {
+        t.Fatalf("Save: %v", err)
+    }
+    if err := storage.SaveSnapshot(Snapshot{Index: 2, Term: 1, Data: []byte("state")}); err != nil {
+        t.Fatalf("SaveSnapshot: %v", err)
+    }
+    if err := storage.Save(HardState{Term: 1, Commit: 4}, []LogEntry{{Term: 1, Index: 4}}); err != nil {
+        t.Fatalf("Save after snapshot: %v", err)
+    }
+    storage.Close()
+
+    storage, err = NewFileStorage(path)
+    if err != nil {
+        t.Fatalf("NewFileStorage: %v", err)
+    }
+    defer storage.Close()
+
+    state, snapshot, recovered, _ := storage.Load()
+    if snapshot.Index != 2 || string(snapshot.Data) != "state" {
+        t.Errorf("snapshot = %+v, want index 2 with its state", snapshot)
+    }
+    if len(recovered) != 2 || recovered[0].Index != 3 || recovered[1].Index != 4 {
+        t.Errorf("entries = %+v, want indexes 3 and 4", recovered)
+    }
+    if state.Commit != 4 {
+        t.Errorf("commit = %d, want 4", state.Commit)
+    }
+}
+
+func TestSnapshotDropsConflictingEntries(t *testing.T) {
+    entries := []LogEntry{{Term: 1, Index: 1}, {Term: 1, Index: 2}, {Term: 1, Index: 3}, {Term: 1, Index: 4}}
+    tests := []struct {
+        name     string
+        snapshot Snapshot
+        want     []uint64
+    }{
+        {name: "Matching", snapshot: Snapshot{Index: 2, Term: 1}, want: []uint64{3, 4}},
+        {name: "ConflictingTerm", snapshot: Snapshot{Index: 2, Term: 2}, want: nil},
+        {name: "BeyondLog", snapshot: Snapshot{Index: 6, Term: 2}, want: nil},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            fileStorage, err := NewFileStorage(filepath.Join(t.TempDir(), "n1.wal"))
+            if err != nil {
+                t.Fatalf("NewFileStorage: %v", err)
+            }
+            defer fileStorage.Close()
+
+            for _, storage := range []Storage{NewMemoryStorage(), fileStorage} {
+                if err := storage.Save(HardState{Term: 1, Commit: 4}, entries); err != nil {
+                    t.Fatalf("Save: %v", err)
+                }
+                if err := storage.SaveSnapshot(tt.snapshot); err != nil {
+                    t.Fatalf("SaveSnapshot: %v", err)
+                }
+                _, _, kept, _ := storage.Load()
+                indexes := make([]uint64, 0)
+                for _, entry := range kept {
+                    indexes = append(indexes, entry.Index)
+                }
+                if len(indexes) != len(tt.want) {
+                    t.Fatalf("%T kept %v, want %v", storage, indexes, tt.want)
+                }
+                for i := range indexes {
+                    if indexes[i] != tt.want[i] {
+                        t.Fatalf("%T kept %v, want %v", storage, indexes, tt.want)
+                    }
+                }
+            }
+        })
+    }
+}
+
+func TestLaggingFollowerInstallsSnapshot(t *testing.T) {
+    transport := NewInMemoryTransport()
+    defer transport.Close()
+    sm := newTestStateMachine()
+    peers := []string{"n1", "n2", "n3"}
+
+    newReplica := func(id string) *Replica {
+        replica, err := NewReplica(ReplicaConfig{
+            NodeID:       id,
+            ZoneID:       "Z1",
+            Peers:        peers,
+            Transport:    transport,
+            Apply:        sm.apply,
+            Snapshot:     sm.snapshot,
+            Restore:      sm.restore,
+            Policy:       SnapshotPolicy{MaxEntries: 2},
+            TickInterval: 5 * time.Millisecond,
+        })
+        if err != nil {
+            t.Fatalf("NewReplica(%s): %v", id, err)
+        }
+        return replica
+    }
+
+    // n3 is down while the others commit and compact
+    leader := newReplica("n1")
+    defer leader.Stop()
+    defer newReplica("n2").Stop()
+    leader.Campaign()
+    waitForLeader(t, leader)
+
+    ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+    defer cancel()
+    for _, tx := range []string{"tx1", "tx2", "tx3", "tx4"} {
+        if err := leader.Propose(ctx, []byte(tx)); err != nil {
+            t.Fatalf("Propose(%s): %v", tx, err)
+        }
+    }
+    leader.mu.Lock()
+    firstIndex := leader.node.log.firstIndex()
+    leader.mu.Unlock()
+    if firstIndex == 1 {
+        t.Fatal("leader did not compact its log")
+    }
+
+    // n3 comes up with an empty log and is sent the snapshot
+    follower := newReplica("n3")
+    defer follower.Stop()
+    sm.waitFor(t, "n3", "tx1", "tx2", "tx3", "tx4")
+}
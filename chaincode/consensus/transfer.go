@@ -0,0 +1,34 @@
+package consensus
+
+import (
+    "context"
+    "fmt"
+)
+
+// TransferLeadership hands leadership of a zone to one of its voters, so that
+// a gateway can be taken down for maintenance or a better placed node can
+// lead without waiting for the current leader to fail. The leader, wherever
+// it is hosted, stops accepting proposals, brings the target's log up to date
+// and has it campaign at once. It fails if the target does not lead within
+// the proposal timeout, and the leader carries on as before.
+func (l *LHRaftConsensus) TransferLeadership(zoneID, targetNodeID string) error {
+    l.mu.RLock()
+    group := l.groups[zoneID]
+    timeout := l.ProposalTimeout
+    _, known := l.Nodes[targetNodeID]
+    l.mu.RUnlock()
+
+    if group == nil {
+        return fmt.Errorf("no consensus group for zone: %s", zoneID)
+    }
+    if !known {
+        return fmt.Errorf("node not found: %s", targetNodeID)
+    }
+    if !l.canVoteFor(targetNodeID) {
+        return ErrNotEligible
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    return group.transferLeadership(ctx, targetNodeID)
+}
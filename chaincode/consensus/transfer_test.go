@@ -0,0 +1,302 @@
+package consensus
+
+import (
+    "fmt"
+    "sync"
+    "testing"
+    "time"
+)
+
+// sentTo returns the messages of a type a node has queued for a member
+func sentTo(r *raftNode, msgType MessageType, to string) []Message {
+    var sent []Message
+    for _, m := range r.msgs {
+        if m.Type == msgType && m.To == to {
+            sent = append(sent, m)
+        }
+    }
+    return sent
+}
+
+func TestTransferWaitsForTargetToCatchUp(t *testing.T) {
+    r, now := newReadLeader(t, time.Second)
+    *now = 10 * time.Millisecond
+    r.step(Message{Type: MsgHeartbeatResponse, From: "n2", To: "n1", Term: r.currentTerm, Sent: int64(*now)})
+    if !r.leaseValid() {
+        t.Fatal("leader holds no lease after a quorum acknowledged it")
+    }
+    r.msgs = nil
+
+    // n3 has acknowledged nothing, so it is sent the log first
+    if err := r.transferLeadership("n3"); err != nil {
+        t.Fatalf("transferLeadership: %v", err)
+    }
+    if len(sentTo(r, MsgTimeoutNow, "n3")) != 0 || len(sentTo(r, MsgAppendEntries, "n3")) != 1 {
+        t.Fatalf("messages = %+v, want n3 sent the log and not yet told to campaign", r.msgs)
+    }
+    if _, _, err := r.propose([]byte("tx")); err != ErrNotLeader {
+        t.Fatalf("propose while handing over = %v, want ErrNotLeader", err)
+    }
+    if r.leaseValid() {
+        t.Fatal("leader kept serving reads on its lease while handing over")
+    }
+
+    r.step(Message{Type: MsgAppendEntriesResponse, From: "n3", To: "n1", Term: r.currentTerm, Success: true, MatchIndex: r.log.lastIndex()})
+    if len(sentTo(r, MsgTimeoutNow, "n3")) != 1 {
+        t.Fatalf("messages = %+v, want n3 told to campaign once caught up", r.msgs)
+    }
+}
+
+func TestTransferGivesUpAfterElectionTimeout(t *testing.T) {
+    r, _ := newReadLeader(t, 0)
+    if err := r.transferLeadership("n3"); err != nil {
+        t.Fatalf("transferLeadership: %v", err)
+    }
+    for i := 0; i < r.electionTicks; i++ {
+        // n2 keeps answering, so the leader keeps its quorum
+        r.step(Message{Type: MsgHeartbeatResponse, From: "n2", To: "n1", Term: r.currentTerm})
+        r.tick()
+    }
+    if r.state != Leader || r.transferee != "" {
+        t.Fatalf("n1 is %v handing over to %q, want a leader that gave up", r.state, r.transferee)
+    }
+    if _, _, err := r.propose([]byte("tx")); err != nil {
+        t.Fatalf("propose after giving up: %v", err)
+    }
+}
+
+func TestTransferRequests(t *testing.T) {
+    r, _ := newReadLeader(t, 0)
+    r.eligible = func(nodeID string) bool { return nodeID != "n2" }
+    if err := r.transferLeadership("n2"); err != ErrNotEligible {
+        t.Errorf("transfer to an ineligible node = %v, want ErrNotEligible", err)
+    }
+    if err := r.transferLeadership("n4"); err == nil {
+        t.Error("transfer to a node outside the zone accepted")
+    }
+
+    // A follower forwards the request to its leader, which acts on it
+    follower := newRaftNode("n2", Membership{Voters: []string{"n1", "n2", "n3"}})
+    follower.step(Message{Type: MsgHeartbeat, From: "n1", To: "n2", Term: r.currentTerm})
+    follower.msgs = nil
+    if err := follower.transferLeadership("n3"); err != nil {
+        t.Fatalf("follower transferLeadership: %v", err)
+    }
+    forwarded := sentTo(follower, MsgTransferLeader, "n1")
+    if len(forwarded) != 1 || forwarded[0].Transferee != "n3" {
+        t.Fatalf("messages = %+v, want the request forwarded to n1", follower.msgs)
+    }
+    r.step(forwarded[0])
+    if r.transferee != "n3" {
+        t.Fatalf("leader hands over to %q, want n3", r.transferee)
+    }
+
+    // The target campaigns through its leader's lease when told to
+    target := newRaftNode("n3", Membership{Voters: []string{"n1", "n2", "n3"}})
+    target.leaseDuration = time.Second
+    target.step(Message{Type: MsgHeartbeat, From: "n1", To: "n3", Term: r.currentTerm})
+    target.msgs = nil
+    target.step(Message{Type: MsgTimeoutNow, From: "n1", To: "n3", Term: r.currentTerm})
+    votes := sentTo(target, MsgRequestVote, "n2")
+    if target.state != Candidate || len(votes) != 1 || !votes[0].Force {
+        t.Fatalf("n3 is %v having sent %+v, want a forced campaign", target.state, target.msgs)
+    }
+}
+
+func TestTransferLeadershipMovesLeader(t *testing.T) {
+    sm := newTestStateMachine()
+    l := newTestConsensus(t, []string{"n1", "n2", "n3"}, withApply(sm.apply),
+        withReadPolicy(ReadPolicy{Leases: true, MaxClockDrift: 0.1}),
+        withFastTiming(), withRegisteredMembers(), withElectedLeaders())
+    defer l.Stop()
+
+    oldLeader, _ := l.groups["Z1"].leader()
+    target := "n1"
+    if target == oldLeader {
+        target = "n2"
+    }
+
+    // Transactions the zone is committing during the handover wait for the
+    // new leader
+    var wg sync.WaitGroup
+    for i := 0; i < 4; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            if err := l.achieveLocalConsensus("Z1", []byte(fmt.Sprintf("tx%d", i))); err != nil {
+                t.Errorf("achieveLocalConsensus: %v", err)
+            }
+        }(i)
+    }
+    if err := l.TransferLeadership("Z1", target); err != nil {
+        t.Fatalf("TransferLeadership: %v", err)
+    }
+    wg.Wait()
+
+    l.mu.RLock()
+    leaderID := l.ZoneLeaders["Z1"]
+    l.mu.RUnlock()
+    if leaderID != target {
+        t.Fatalf("zone leader = %q, want %s", leaderID, target)
+    }
+    err := l.ReadZone("Z1", func(zoneID, nodeID string) error {
+        if applied := sm.read(nodeID); len(applied) != 4 {
+            return fmt.Errorf("%s applied %q, want 4 transactions", nodeID, applied)
+        }
+        return nil
+    })
+    if err != nil {
+        t.Fatalf("ReadZone after the handover: %v", err)
+    }
+    if err := l.TransferLeadership("Z1", "n9"); err == nil {
+        t.Error("transfer to an unknown node accepted")
+    }
+}
+
+func TestTransferLeadershipTimesOut(t *testing.T) {
+    sm := newTestStateMachine()
+    l := newTestConsensus(t, []string{"n1", "n2", "n3"}, withApply(sm.apply),
+        withReadPolicy(DefaultReadPolicy), withFastTiming(), withRegisteredMembers(), withElectedLeaders())
+    defer l.Stop()
+    l.ProposalTimeout = 300 * time.Millisecond
+
+    oldLeader, _ := l.groups["Z1"].leader()
+    target := "n1"
+    if target == oldLeader {
+        target = "n2"
+    }
+    l.groups["Z1"].replicas[target].Stop()
+
+    start := time.Now()
+    if err := l.TransferLeadership("Z1", target); err == nil {
+        t.Fatal("TransferLeadership to a stopped node succeeded")
+    }
+    if elapsed := time.Since(start); elapsed > time.Second {
+        t.Fatalf("TransferLeadership took %v to time out", elapsed)
+    }
+
+    // The leader carries on as before
+    if leaderID, _ := l.groups["Z1"].leader(); leaderID != oldLeader {
+        t.Fatalf("leader = %q, want %s", leaderID, oldLeader)
+    }
+    if err := l.PropagateTransaction([]byte("tx"), "Z1"); err != nil {
+        t.Fatalf("PropagateTransaction after the timeout: %v", err)
+    }
+    sm.waitFor(t, oldLeader, "tx")
+}
+
+func TestTransferLeadershipToRemoteNode(t *testing.T) {
+    // Process a hosts n1 and n2, which leads; process b hosts n3 and asks
+    // for leadership, which a leader holding a lease must hand over
+    hosts := map[string][]string{"a": {"n1", "n2"}, "b": {"n3"}}
+    transports := make(map[string]*TCPTransport)
+    for host := range hosts {
+        transport, err := NewTCPTransport("127.0.0.1:0")
+        if err != nil {
+            t.Fatalf("NewTCPTransport: %v", err)
+        }
+        defer transport.Close()
+        transports[host] = transport
+    }
+    for _, transport := range transports {
+        for host, ids := range hosts {
+            for _, id := range ids {
+                transport.AddPeer(id, transports[host].Addr().String())
+            }
+        }
+    }
+
+    processes := make(map[string]*LHRaftConsensus)
+    for host, local := range hosts {
+        l := NewLHRaftConsensusWithTransport(0.5, transports[host])
+        defer l.Stop()
+        // Each process signs for the nodes it hosts and checks the others
+        for _, ids := range hosts {
+            for _, id := range ids {
+                var err error
+                if containsString(local, id) {
+                    err = l.SetNodeKey(id, testKey(id))
+                } else {
+                    err = l.SetNodePublicKey(id, testKey(id).Public())
+                }
+                if err != nil {
+                    t.Fatalf("%s: key of %s: %v", host, id, err)
+                }
+            }
+        }
+        l.SetLeadershipRequirements(0, 0)
+        if err := l.SetReadPolicy(ReadPolicy{Leases: true, MaxClockDrift: 0.1}); err != nil {
+            t.Fatalf("SetReadPolicy: %v", err)
+        }
+        if err := l.SetZoneTiming("Z1", fastTiming); err != nil {
+            t.Fatalf("SetZoneTiming: %v", err)
+        }
+        if err := l.SetInitialCluster("Z1", []string{"n1", "n2", "n3"}); err != nil {
+            t.Fatalf("SetInitialCluster: %v", err)
+        }
+        for _, id := range []string{"n1", "n2", "n3"} {
+            var err error
+            if containsString(local, id) {
+                err = l.RegisterNode(id, "Z1", 0.9)
+            } else {
+                err = l.RegisterRemoteNode(id, "Z1", 0.9)
+            }
+            if err != nil {
+                t.Fatalf("%s: registering %s: %v", host, id, err)
+            }
+        }
+        processes[host] = l
+    }
+
+    if err := processes["a"].TransferLeadership("Z1", "n2"); err != nil {
+        t.Fatalf("TransferLeadership to n2: %v", err)
+    }
+    if err := processes["b"].TransferLeadership("Z1", "n3"); err != nil {
+        t.Fatalf("TransferLeadership to n3 from process b: %v", err)
+    }
+    if err := processes["b"].ReadZone("Z1", func(zoneID, nodeID string) error { return nil }); err != nil {
+        t.Fatalf("ReadZone on the new leader: %v", err)
+    }
+}
+
+func TestSimulatedTransfersKeepLeaseSafety(t *testing.T) {
+    for _, seed := range simSeeds() {
+        s := newSimulator(seed, []string{"n1", "n2", "n3"}, defaultSimFaults)
+        s.setLease(8 * simTickInterval)
+        electStably(t, s)
+
+        handovers := 0
+        for round := 0; round < 20; round++ {
+            leader := s.leader()
+            if leader == nil {
+                s.run(100 * time.Millisecond)
+                continue
+            }
+            target := s.ids[s.rand.Intn(len(s.ids))]
+            if err := leader.raft.transferLeadership(target); err != nil {
+                s.report(t, fmt.Errorf("%s transferLeadership(%s): %v", leader.id, target, err))
+            }
+            s.process(leader)
+            isolated := s.rand.Intn(2) == 0
+            if isolated {
+                // The successor may commit before the old leader hears of it
+                s.isolate([]string{leader.id})
+            }
+            s.propose([]byte(fmt.Sprintf("tx%d", round)))
+            s.run(100 * time.Millisecond)
+            if current := s.leader(); current != nil && current.id == target && current != leader {
+                handovers++
+            }
+            if isolated {
+                s.heal()
+                s.run(100 * time.Millisecond)
+            }
+        }
+        if s.violation != nil {
+            s.report(t, s.violation)
+        }
+        if handovers == 0 {
+            s.report(t, fmt.Errorf("no leadership handed over in 20 attempts"))
+        }
+    }
+}
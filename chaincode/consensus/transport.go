@@ -0,0 +1,269 @@
+package consensus
+
+import (
+    "errors"
+    "fmt"
+    "sync"
+)
+
+// ErrUnknownNode is returned when a message is addressed to a node the transport cannot reach
+var ErrUnknownNode = errors.New("unknown node")
+
+// mailboxSize bounds the messages queued for a node before further ones are dropped
+const mailboxSize = 1024
+
+// MessageHandler receives messages delivered to a registered node
+type MessageHandler func(m Message)
+
+// Transport carries consensus messages between nodes. Delivery is
+// asynchronous and best effort; Raft tolerates lost, delayed and duplicated
+// messages, so Send never waits for the receiver.
+type Transport interface {
+    // Register routes messages addressed to nodeID to handler
+    Register(nodeID string, handler MessageHandler) error
+    // Unregister stops delivery to nodeID
+    Unregister(nodeID string)
+    // Send queues m for delivery to m.To
+    Send(m Message) error
+    // Close releases the transport's resources
+    Close() error
+}
+
+// mailbox serializes delivery to one handler
+type mailbox struct {
+    msgs chan Message
+    done chan struct{}
+}
+
+func newMailbox(handler MessageHandler) *mailbox {
+    mb := &mailbox{
+        msgs: make(chan Message, mailboxSize),
+        done: make(chan struct{}),
+    }
+    go func() {
+        for {
+            select {
+            case m := <-mb.msgs:
+                handler(m)
+            case <-mb.done:
+                return
+            }
+        }
+    }()
+    return mb
+}
+
+// post queues a message, reporting false if the mailbox is full
+func (mb *mailbox) post(m Message) bool {
+    select {
+    case mb.msgs <- m:
+        return true
+    default:
+        return false
+    }
+}
+
+func (mb *mailbox) close() {
+    close(mb.done)
+}
+
+// InMemoryTransport delivers messages between nodes in the same process
+type InMemoryTransport struct {
+    mailboxes map[string]*mailbox
+    mu        sync.RWMutex
+}
+
+// NewInMemoryTransport creates an empty in-process transport
+func NewInMemoryTransport() *InMemoryTransport {
+    return &InMemoryTransport{
+        mailboxes: make(map[string]*mailbox),
+    }
+}
+
+// Register routes messages addressed to nodeID to handler
+func (t *InMemoryTransport) Register(nodeID string, handler MessageHandler) error {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    if _, exists := t.mailboxes[nodeID]; exists {
+        return fmt.Errorf("node already registered: %s", nodeID)
+    }
+    t.mailboxes[nodeID] = newMailbox(handler)
+    return nil
+}
+
+// Unregister stops delivery to nodeID
+func (t *InMemoryTransport) Unregister(nodeID string) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    if mb, exists := t.mailboxes[nodeID]; exists {
+        mb.close()
+        delete(t.mailboxes, nodeID)
+    }
+}
+
+// Send queues m for delivery to m.To
+func (t *InMemoryTransport) Send(m Message) error {
+    t.mu.RLock()
+    mb, exists := t.mailboxes[m.To]
+    t.mu.RUnlock()
+
+    if !exists {
+        return fmt.Errorf("%w: %s", ErrUnknownNode, m.To)
+    }
+    if !mb.post(m) {
+        return fmt.Errorf("mailbox full for node: %s", m.To)
+    }
+    return nil
+}
+
+// Close stops delivery to every node
+func (t *InMemoryTransport) Close() error {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    for id, mb := range t.mailboxes {
+        mb.close()
+        delete(t.mailboxes, id)
+    }
+    return nil
+}
+
+// groupMux lets a node belong to several groups over one transport. Each
+// node is registered with the transport once, and its messages are handed
+// to the handler of the group they belong to. Every message must be signed
+// by a node whose key is known unless authentication is turned off, as tests
+// do; a signature is checked whenever one is present. Messages of BFT zones
+// are signed and checked by their members instead.
+type groupMux struct {
+    transport    Transport
+    handlers     map[string]map[string]MessageHandler // Node ID -> group -> handler
+    keys         *keyring
+    authenticate bool // Whether every message must be signed by a known node
+    mu           sync.RWMutex
+}
+
+func newGroupMux(transport Transport, keys *keyring) *groupMux {
+    return &groupMux{
+        transport:    transport,
+        handlers:     make(map[string]map[string]MessageHandler),
+        keys:         keys,
+        authenticate: true,
+    }
+}
+
+// setAuthentication sets whether every message must be signed by a known node
+func (x *groupMux) setAuthentication(required bool) {
+    x.mu.Lock()
+    defer x.mu.Unlock()
+
+    x.authenticate = required
+}
+
+// authenticating reports whether every message must be signed by a known node
+func (x *groupMux) authenticating() bool {
+    x.mu.RLock()
+    defer x.mu.RUnlock()
+
+    return x.authenticate
+}
+
+// send signs m, if its sender's key is held here, and hands it to the
+// transport. Revoked nodes send nothing.
+func (x *groupMux) send(m Message) error {
+    if x.keys.isRevoked(m.From) {
+        return fmt.Errorf("%w: %s", ErrNodeRevoked, m.From)
+    }
+    if !m.Type.isBFT() && (x.authenticating() || x.keys.canSign(m.From)) {
+        if err := x.keys.sign(&m); err != nil {
+            return err
+        }
+    }
+    return x.transport.Send(m)
+}
+
+// group returns a transport carrying the messages of one group
+func (x *groupMux) group(groupID string) Transport {
+    return &muxTransport{mux: x, groupID: groupID}
+}
+
+func (x *groupMux) register(nodeID, groupID string, handler MessageHandler) error {
+    x.mu.Lock()
+    defer x.mu.Unlock()
+
+    groups, exists := x.handlers[nodeID]
+    if !exists {
+        if err := x.transport.Register(nodeID, func(m Message) { x.deliver(nodeID, m) }); err != nil {
+            return err
+        }
+        groups = make(map[string]MessageHandler)
+        x.handlers[nodeID] = groups
+    }
+    if _, exists := groups[groupID]; exists {
+        return fmt.Errorf("node already registered in group %s: %s", groupID, nodeID)
+    }
+    groups[groupID] = handler
+    return nil
+}
+
+func (x *groupMux) unregister(nodeID, groupID string) {
+    x.mu.Lock()
+    defer x.mu.Unlock()
+
+    groups, exists := x.handlers[nodeID]
+    if !exists {
+        return
+    }
+    delete(groups, groupID)
+    if len(groups) == 0 {
+        delete(x.handlers, nodeID)
+        x.transport.Unregister(nodeID)
+    }
+}
+
+// deliver hands a message to the handler of its group. It drops messages
+// for a group the node has left or to a revoked node, and those whose
+// signature does not verify against the key of the node they claim to be
+// from, so that a revoked node cannot be heard under its own name or another.
+// Unsigned messages are only delivered with authentication turned off.
+func (x *groupMux) deliver(nodeID string, m Message) {
+    x.mu.RLock()
+    handler := x.handlers[nodeID][m.Group]
+    required := x.authenticate
+    x.mu.RUnlock()
+
+    if handler == nil || x.keys.isRevoked(nodeID) || x.keys.isRevoked(m.From) {
+        return
+    }
+    if !m.Type.isBFT() && (required || len(m.Signature) > 0) && x.keys.verify(m) != nil {
+        return
+    }
+    handler(m)
+}
+
+// muxTransport is the transport of one group sharing a groupMux
+type muxTransport struct {
+    mux     *groupMux
+    groupID string
+}
+
+// Register routes messages of the group addressed to nodeID to handler
+func (t *muxTransport) Register(nodeID string, handler MessageHandler) error {
+    return t.mux.register(nodeID, t.groupID, handler)
+}
+
+// Unregister stops delivery of the group's messages to nodeID
+func (t *muxTransport) Unregister(nodeID string) {
+    t.mux.unregister(nodeID, t.groupID)
+}
+
+// Send signs m and queues it for delivery to m.To
+func (t *muxTransport) Send(m Message) error {
+    return t.mux.send(m)
+}
+
+// Close does nothing; the shared transport is closed by its owner
+func (t *muxTransport) Close() error {
+    return nil
+}
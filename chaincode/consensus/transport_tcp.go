@@ -0,0 +1,302 @@
+package consensus
+
+import (
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "sync"
+    "time"
+)
+
+// Timeouts for outbound connections
+const (
+    tcpDialTimeout  = 2 * time.Second
+    tcpWriteTimeout = 2 * time.Second
+)
+
+// DefaultTCPMaxMessageSize bounds the encoding of one message, leaving room
+// for a snapshot of DefaultSnapshotPolicy.MaxBytes
+const DefaultTCPMaxMessageSize = 128 << 20
+
+// errMessageTooLarge is returned for a message longer than MaxMessageSize
+var errMessageTooLarge = errors.New("message exceeds the maximum size")
+
+// TCPTransport carries messages between processes over TCP, each a JSON
+// document preceded by its length as four big-endian bytes. Each peer gets
+// one outbound connection, redialled on failure; messages queued while a peer
+// is unreachable are dropped.
+//
+// Anyone able to connect may send, so only signed messages are delivered:
+// the consensus checks each against its sender's key, see
+// RequireSignedMessages. A connection announcing a message larger than
+// MaxMessageSize is closed; set it before any messages are sent.
+type TCPTransport struct {
+    MaxMessageSize int // Largest encoded message sent or accepted
+
+    listener net.Listener
+    local    map[string]*mailbox // Local node ID -> delivery queue
+    peers    map[string]string   // Remote node ID -> address
+    outbound map[string]*tcpPeer // Address -> connection
+    inbound  map[net.Conn]struct{}
+    closed   bool
+    mu       sync.RWMutex
+    wg       sync.WaitGroup
+}
+
+// tcpPeer owns the outbound connection to one address
+type tcpPeer struct {
+    addr string
+    msgs chan Message
+    done chan struct{}
+}
+
+// NewTCPTransport listens for peers on listenAddr, e.g. ":7050"
+func NewTCPTransport(listenAddr string) (*TCPTransport, error) {
+    listener, err := net.Listen("tcp", listenAddr)
+    if err != nil {
+        return nil, fmt.Errorf("failed to listen on %s: %v", listenAddr, err)
+    }
+
+    t := &TCPTransport{
+        listener: listener,
+        local:    make(map[string]*mailbox),
+        peers:    make(map[string]string),
+        outbound: make(map[string]*tcpPeer),
+        inbound:  make(map[net.Conn]struct{}),
+
+        MaxMessageSize: DefaultTCPMaxMessageSize,
+    }
+    t.wg.Add(1)
+    go t.accept()
+    return t, nil
+}
+
+// Addr returns the address the transport listens on
+func (t *TCPTransport) Addr() net.Addr {
+    return t.listener.Addr()
+}
+
+// AddPeer records the address a remote node is reachable at
+func (t *TCPTransport) AddPeer(nodeID, addr string) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    t.peers[nodeID] = addr
+}
+
+// Register routes messages addressed to nodeID to handler
+func (t *TCPTransport) Register(nodeID string, handler MessageHandler) error {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    if _, exists := t.local[nodeID]; exists {
+        return fmt.Errorf("node already registered: %s", nodeID)
+    }
+    t.local[nodeID] = newMailbox(handler)
+    return nil
+}
+
+// Unregister stops delivery to nodeID
+func (t *TCPTransport) Unregister(nodeID string) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    if mb, exists := t.local[nodeID]; exists {
+        mb.close()
+        delete(t.local, nodeID)
+    }
+}
+
+// Send queues m for delivery to m.To, locally or over the network
+func (t *TCPTransport) Send(m Message) error {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    if t.closed {
+        return fmt.Errorf("transport closed")
+    }
+    if mb, local := t.local[m.To]; local {
+        if !mb.post(m) {
+            return fmt.Errorf("mailbox full for node: %s", m.To)
+        }
+        return nil
+    }
+
+    addr, exists := t.peers[m.To]
+    if !exists {
+        return fmt.Errorf("%w: %s", ErrUnknownNode, m.To)
+    }
+    peer, exists := t.outbound[addr]
+    if !exists {
+        peer = &tcpPeer{
+            addr: addr,
+            msgs: make(chan Message, mailboxSize),
+            done: make(chan struct{}),
+        }
+        t.outbound[addr] = peer
+        t.wg.Add(1)
+        go t.writeLoop(peer)
+    }
+
+    select {
+    case peer.msgs <- m:
+        return nil
+    default:
+        return fmt.Errorf("send queue full for node: %s", m.To)
+    }
+}
+
+// Close stops listening and closes every connection
+func (t *TCPTransport) Close() error {
+    t.mu.Lock()
+    if t.closed {
+        t.mu.Unlock()
+        return nil
+    }
+    t.closed = true
+    err := t.listener.Close()
+    for _, peer := range t.outbound {
+        close(peer.done)
+    }
+    for conn := range t.inbound {
+        conn.Close()
+    }
+    for id, mb := range t.local {
+        mb.close()
+        delete(t.local, id)
+    }
+    t.mu.Unlock()
+
+    t.wg.Wait()
+    return err
+}
+
+func (t *TCPTransport) accept() {
+    defer t.wg.Done()
+
+    for {
+        conn, err := t.listener.Accept()
+        if err != nil {
+            return
+        }
+
+        t.mu.Lock()
+        if t.closed {
+            t.mu.Unlock()
+            conn.Close()
+            return
+        }
+        t.inbound[conn] = struct{}{}
+        t.wg.Add(1)
+        t.mu.Unlock()
+
+        go t.readLoop(conn)
+    }
+}
+
+// readMessage reads one length-prefixed message. Its length is checked
+// before anything is allocated for it.
+func readMessage(r io.Reader, maxSize int) (Message, error) {
+    var header [4]byte
+    if _, err := io.ReadFull(r, header[:]); err != nil {
+        return Message{}, err
+    }
+    size := binary.BigEndian.Uint32(header[:])
+    if uint64(size) > uint64(maxSize) {
+        return Message{}, fmt.Errorf("%w: %d bytes, at most %d", errMessageTooLarge, size, maxSize)
+    }
+    data, err := io.ReadAll(io.LimitReader(r, int64(size)))
+    if err != nil {
+        return Message{}, err
+    }
+    if len(data) < int(size) {
+        return Message{}, io.ErrUnexpectedEOF
+    }
+    var m Message
+    if err := json.Unmarshal(data, &m); err != nil {
+        return Message{}, fmt.Errorf("invalid message: %v", err)
+    }
+    return m, nil
+}
+
+// writeMessage writes m preceded by its length
+func writeMessage(w io.Writer, m Message, maxSize int) error {
+    data, err := json.Marshal(m)
+    if err != nil {
+        return err
+    }
+    if len(data) > maxSize {
+        return fmt.Errorf("%w: %d bytes, at most %d", errMessageTooLarge, len(data), maxSize)
+    }
+    frame := make([]byte, 4+len(data))
+    binary.BigEndian.PutUint32(frame, uint32(len(data)))
+    copy(frame[4:], data)
+    _, err = w.Write(frame)
+    return err
+}
+
+// readLoop reads messages from one inbound connection, closing it at the
+// first that is too large or malformed. Unsigned messages are dropped.
+func (t *TCPTransport) readLoop(conn net.Conn) {
+    defer t.wg.Done()
+    defer func() {
+        t.mu.Lock()
+        delete(t.inbound, conn)
+        t.mu.Unlock()
+        conn.Close()
+    }()
+
+    for {
+        m, err := readMessage(conn, t.MaxMessageSize)
+        if err != nil {
+            return
+        }
+        if len(m.Signature) == 0 {
+            continue
+        }
+
+        t.mu.RLock()
+        mb := t.local[m.To]
+        t.mu.RUnlock()
+        if mb != nil {
+            mb.post(m)
+        }
+    }
+}
+
+// writeLoop writes queued messages onto the connection to one peer
+func (t *TCPTransport) writeLoop(peer *tcpPeer) {
+    defer t.wg.Done()
+
+    var conn net.Conn
+    defer func() {
+        if conn != nil {
+            conn.Close()
+        }
+    }()
+
+    for {
+        select {
+        case m := <-peer.msgs:
+            if conn == nil {
+                c, err := net.DialTimeout("tcp", peer.addr, tcpDialTimeout)
+                if err != nil {
+                    // Peer unreachable: drop the message, Raft will retry
+                    continue
+                }
+                conn = c
+            }
+            conn.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+            // A message too large to send is dropped before anything is written
+            if err := writeMessage(conn, m, t.MaxMessageSize); err != nil && !errors.Is(err, errMessageTooLarge) {
+                conn.Close()
+                conn = nil
+            }
+        case <-peer.done:
+            return
+        }
+    }
+}
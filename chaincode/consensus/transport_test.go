@@ -0,0 +1,246 @@
+package consensus
+
+import (
+    "bytes"
+    "context"
+    "encoding/binary"
+    "errors"
+    "io"
+    "net"
+    "testing"
+    "time"
+)
+
+func TestReplicasOverTCP(t *testing.T) {
+    ids := []string{"n1", "n2", "n3"}
+    transports := make(map[string]*TCPTransport)
+    for _, id := range ids {
+        transport, err := NewTCPTransport("127.0.0.1:0")
+        if err != nil {
+            t.Fatalf("NewTCPTransport: %v", err)
+        }
+        defer transport.Close()
+        transports[id] = transport
+    }
+    for _, transport := range transports {
+        for _, id := range ids {
+            transport.AddPeer(id, transports[id].Addr().String())
+        }
+    }
+
+    // Each replica has its own transport, as it would in its own process,
+    // and signs what it sends over it
+    sm := newTestStateMachine()
+    replicas := make(map[string]*Replica)
+    for _, id := range ids {
+        keys := newTestKeyring(t, id)
+        for _, peer := range ids {
+            if err := keys.setPublic(peer, testKey(peer).Public()); err != nil {
+                t.Fatalf("setPublic(%s): %v", peer, err)
+            }
+        }
+        replica, err := NewReplica(ReplicaConfig{
+            NodeID:    id,
+            ZoneID:    "Z1",
+            Peers:     ids,
+            Transport: newGroupMux(transports[id], keys).group("Z1"),
+            Apply:     sm.apply,
+        })
+        if err != nil {
+            t.Fatalf("NewReplica(%s): %v", id, err)
+        }
+        defer replica.Stop()
+        replicas[id] = replica
+    }
+
+    replicas["n1"].Campaign()
+    waitForLeader(t, replicas["n1"])
+
+    ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+    defer cancel()
+    if err := replicas["n1"].Propose(ctx, []byte("tx1")); err != nil {
+        t.Fatalf("Propose: %v", err)
+    }
+    // A follower forwards its proposal to the leader
+    if err := replicas["n2"].Propose(ctx, []byte("tx2")); err != nil {
+        t.Fatalf("Propose on follower: %v", err)
+    }
+
+    for _, id := range ids {
+        sm.waitFor(t, id, "tx1", "tx2")
+    }
+    if status := replicas["n3"].Status(); status.LeaderID != "n1" || status.Term != 1 {
+        t.Errorf("n3 follows %s in term %d, want n1 in term 1", status.LeaderID, status.Term)
+    }
+}
+
+func TestConsensusAcrossProcesses(t *testing.T) {
+    // Two processes share zone Z1: one hosts n1 and n2, the other n3 and,
+    // later, n4
+    hosts := map[string][]string{"a": {"n1", "n2"}, "b": {"n3", "n4"}}
+    transports := make(map[string]*TCPTransport)
+    for host := range hosts {
+        transport, err := NewTCPTransport("127.0.0.1:0")
+        if err != nil {
+            t.Fatalf("NewTCPTransport: %v", err)
+        }
+        defer transport.Close()
+        transports[host] = transport
+    }
+    for _, transport := range transports {
+        for host, ids := range hosts {
+            for _, id := range ids {
+                transport.AddPeer(id, transports[host].Addr().String())
+            }
+        }
+    }
+
+    sm := newTestStateMachine()
+    processes := make(map[string]*LHRaftConsensus)
+    for host, local := range hosts {
+        l := NewLHRaftConsensusWithTransport(0.5, transports[host])
+        defer l.Stop()
+        // Each process signs for the nodes it hosts and checks the others
+        for _, ids := range hosts {
+            for _, id := range ids {
+                var err error
+                if containsString(local, id) {
+                    err = l.SetNodeKey(id, testKey(id))
+                } else {
+                    err = l.SetNodePublicKey(id, testKey(id).Public())
+                }
+                if err != nil {
+                    t.Fatalf("%s: key of %s: %v", host, id, err)
+                }
+            }
+        }
+        l.SetLeadershipRequirements(0, 0)
+        l.SetApplyFunc(sm.apply)
+        if err := l.SetInitialCluster("Z1", []string{"n1", "n2", "n3"}); err != nil {
+            t.Fatalf("SetInitialCluster: %v", err)
+        }
+        for _, id := range []string{"n1", "n2", "n3"} {
+            var err error
+            if containsString(local, id) {
+                err = l.RegisterNode(id, "Z1", 0.9)
+            } else {
+                err = l.RegisterRemoteNode(id, "Z1", 0.9)
+            }
+            if err != nil {
+                t.Fatalf("%s: registering %s: %v", host, id, err)
+            }
+        }
+        processes[host] = l
+    }
+
+    if leaderID, err := processes["a"].ElectZoneLeader("Z1"); err != nil || leaderID != "n1" {
+        t.Fatalf("ElectZoneLeader = %s, %v; want n1", leaderID, err)
+    }
+
+    // The process without the leader forwards its transaction to it
+    deadline := time.Now().Add(2 * time.Second)
+    for {
+        processes["b"].mu.RLock()
+        leaderID := processes["b"].ZoneLeaders["Z1"]
+        processes["b"].mu.RUnlock()
+        if leaderID == "n1" {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("process b never learnt the leader, has %q", leaderID)
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+    if err := processes["b"].PropagateTransaction([]byte("tx1"), "Z1"); err != nil {
+        t.Fatalf("PropagateTransaction from process b: %v", err)
+    }
+    for _, id := range []string{"n1", "n2", "n3"} {
+        sm.waitFor(t, id, "tx1")
+    }
+
+    // So is its membership change when a new node joins there
+    if err := processes["b"].RegisterNode("n4", "Z1", 0.9); err != nil {
+        t.Fatalf("RegisterNode(n4) on process b: %v", err)
+    }
+    sm.waitFor(t, "n4", "tx1")
+}
+
+func TestInMemoryTransportUnknownNode(t *testing.T) {
+    transport := NewInMemoryTransport()
+    defer transport.Close()
+
+    if err := transport.Send(Message{To: "missing"}); err == nil {
+        t.Fatal("expected an error sending to an unregistered node")
+    }
+}
+
+func TestTCPFramesBoundMessageSize(t *testing.T) {
+    m := Message{Type: MsgAppendEntries, From: "n1", To: "n2", Term: 2, Signature: []byte("sig")}
+    var buf bytes.Buffer
+    if err := writeMessage(&buf, m, DefaultTCPMaxMessageSize); err != nil {
+        t.Fatalf("writeMessage: %v", err)
+    }
+    size := buf.Len() - 4
+    if got, err := readMessage(bytes.NewReader(buf.Bytes()), size); err != nil || got.Term != 2 || got.From != "n1" {
+        t.Errorf("readMessage = %+v, %v", got, err)
+    }
+    if _, err := readMessage(bytes.NewReader(buf.Bytes()), size-1); !errors.Is(err, errMessageTooLarge) {
+        t.Errorf("message over the limit read: %v", err)
+    }
+    if err := writeMessage(io.Discard, m, size-1); !errors.Is(err, errMessageTooLarge) {
+        t.Errorf("message over the limit written: %v", err)
+    }
+    if _, err := readMessage(bytes.NewReader(buf.Bytes()[:buf.Len()-1]), size); !errors.Is(err, io.ErrUnexpectedEOF) {
+        t.Errorf("truncated message = %v, want io.ErrUnexpectedEOF", err)
+    }
+}
+
+func TestTCPTransportDropsUnsignedAndOversizedMessages(t *testing.T) {
+    transport, err := NewTCPTransport("127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("NewTCPTransport: %v", err)
+    }
+    defer transport.Close()
+    received := make(chan Message, 4)
+    if err := transport.Register("n1", func(m Message) { received <- m }); err != nil {
+        t.Fatalf("Register: %v", err)
+    }
+
+    conn, err := net.Dial("tcp", transport.Addr().String())
+    if err != nil {
+        t.Fatalf("Dial: %v", err)
+    }
+    defer conn.Close()
+    for _, m := range []Message{
+        {Type: MsgAppendEntries, From: "n2", To: "n1", Term: 1},
+        {Type: MsgAppendEntries, From: "n2", To: "n1", Term: 2, Signature: []byte("sig")},
+    } {
+        if err := writeMessage(conn, m, DefaultTCPMaxMessageSize); err != nil {
+            t.Fatalf("writeMessage: %v", err)
+        }
+    }
+    select {
+    case m := <-received:
+        if m.Term != 2 {
+            t.Errorf("delivered %+v, want only the signed message", m)
+        }
+    case <-time.After(2 * time.Second):
+        t.Fatal("signed message never delivered")
+    }
+
+    // A length beyond the limit ends the connection without being read
+    var header [4]byte
+    binary.BigEndian.PutUint32(header[:], DefaultTCPMaxMessageSize+1)
+    if _, err := conn.Write(header[:]); err != nil {
+        t.Fatalf("Write: %v", err)
+    }
+    conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+    if _, err := conn.Read(header[:]); err != io.EOF {
+        t.Errorf("connection after an oversized length: %v, want io.EOF", err)
+    }
+    select {
+    case m := <-received:
+        t.Errorf("delivered %+v", m)
+    default:
+    }
+}
@@ -0,0 +1,407 @@
+package consensus
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "time"
+)
+
+// ErrZoneMerged is returned when a proposal reaches a zone merged into another
+var ErrZoneMerged = errors.New("zone has merged into another")
+
+// ZoneChangeType is the kind of a zone change
+type ZoneChangeType int
+
+const (
+    ZoneSplit ZoneChangeType = iota
+    ZoneMerge
+)
+
+// ZoneChange moves members of one zone to another. It is committed through
+// the log of the zone they leave, so every member applies the entries before
+// it under the old zone, and the application can move the devices on the
+// ledger at the same point in the log. A split moves some of Zone's members
+// to the new zone Into; a merge moves all of them to the existing zone Into,
+// after which Zone commits nothing more.
+type ZoneChange struct {
+    Type    ZoneChangeType
+    Zone    string     // The zone split, or merged away
+    Into    string     // The zone split off, or merged into
+    Members []string   // Members of Zone moving to Into
+    Initial Membership // Members Into's group starts from
+}
+
+// DecodeZoneChange decodes the data of an EntryZoneChange. The application
+// moves the devices of Members to Into on the ledger when it applies one,
+// see MoveDevicesToZone in the chaincode.
+func DecodeZoneChange(data []byte) (ZoneChange, error) {
+    var zc ZoneChange
+    if err := json.Unmarshal(data, &zc); err != nil {
+        return ZoneChange{}, fmt.Errorf("corrupt zone change: %v", err)
+    }
+    return zc, nil
+}
+
+// ZoneBoundary is the area split off a zone into the new zone ZoneID.
+// Longitudes run east from SouthWest to NorthEast, so a boundary may cross
+// the antimeridian.
+type ZoneBoundary struct {
+    ZoneID    string
+    SouthWest GeoPoint
+    NorthEast GeoPoint
+}
+
+// contains reports whether a position lies within the boundary
+func (b ZoneBoundary) contains(p GeoPoint) bool {
+    if p.Latitude < b.SouthWest.Latitude || p.Latitude > b.NorthEast.Latitude {
+        return false
+    }
+    if b.SouthWest.Longitude <= b.NorthEast.Longitude {
+        return p.Longitude >= b.SouthWest.Longitude && p.Longitude <= b.NorthEast.Longitude
+    }
+    return p.Longitude >= b.SouthWest.Longitude || p.Longitude <= b.NorthEast.Longitude
+}
+
+// validateZoneChange checks that a zone change can be made to the membership:
+// it moves members of the zone, a split leaves voters on both sides and a
+// merge moves every member
+func (m Membership) validateZoneChange(zc ZoneChange) error {
+    if zc.Zone == zc.Into {
+        return fmt.Errorf("zone %s cannot move members to itself", zc.Zone)
+    }
+    if len(zc.Members) == 0 {
+        return fmt.Errorf("zone change of %s moves no members", zc.Zone)
+    }
+    staying := m.Voters
+    for _, id := range zc.Members {
+        if !m.isMember(id) {
+            return fmt.Errorf("node %s is not a member", id)
+        }
+        staying = removeString(staying, id)
+    }
+
+    switch zc.Type {
+    case ZoneSplit:
+        if len(staying) == 0 {
+            return fmt.Errorf("split leaves zone %s without voters", zc.Zone)
+        }
+        if len(zc.Initial.Voters) == 0 {
+            return fmt.Errorf("split leaves zone %s without voters", zc.Into)
+        }
+    case ZoneMerge:
+        if len(zc.Members) != len(m.members()) {
+            return fmt.Errorf("merge leaves members behind in zone %s", zc.Zone)
+        }
+    default:
+        return fmt.Errorf("unknown zone change %d", zc.Type)
+    }
+    return nil
+}
+
+// SplitZone moves the members of a zone positioned within boundary to a new
+// zone with a group of its own; members without a position stay. The split
+// is committed through the zone's log, and each process hosting members
+// follows it as they apply it: the moving voters form the new zone's group,
+// the moving learners join it as learners, and each moving member leaves the
+// old zone's group once it has applied every entry before the split. Both
+// zones then re-elect their leaders. It must be called in a process hosting
+// a member of the zone.
+func (l *LHRaftConsensus) SplitZone(zoneID string, boundary ZoneBoundary) error {
+    l.mu.RLock()
+    group := l.groups[zoneID]
+    _, exists := l.groups[boundary.ZoneID]
+    _, configured := l.initialClusters[boundary.ZoneID]
+    positions := make(map[string]GeoPoint)
+    for id, node := range l.Nodes {
+        if node.Positioned {
+            positions[id] = GeoPoint{node.Latitude, node.Longitude}
+        }
+    }
+    timeout := l.ProposalTimeout
+    l.mu.RUnlock()
+
+    switch {
+    case group == nil:
+        return fmt.Errorf("no consensus group for zone: %s", zoneID)
+    case boundary.ZoneID == "" || boundary.ZoneID == GlobalGroupID:
+        return fmt.Errorf("zone ID %q cannot be split off", boundary.ZoneID)
+    case exists || configured:
+        return fmt.Errorf("zone %s already exists", boundary.ZoneID)
+    }
+
+    view := group.view()
+    zc := ZoneChange{Type: ZoneSplit, Zone: zoneID, Into: boundary.ZoneID}
+    for _, id := range view.members() {
+        if position, positioned := positions[id]; !positioned || !boundary.contains(position) {
+            continue
+        }
+        zc.Members = append(zc.Members, id)
+        if view.isVoter(id) {
+            zc.Initial.Voters = append(zc.Initial.Voters, id)
+        } else {
+            zc.Initial.Learners = append(zc.Initial.Learners, id)
+        }
+    }
+    if err := view.validateZoneChange(zc); err != nil {
+        return fmt.Errorf("cannot split zone %s: %v", zoneID, err)
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    if err := group.proposeZoneChange(ctx, zc); err != nil {
+        return fmt.Errorf("failed to split zone %s: %v", zoneID, err)
+    }
+    if err := l.awaitMoved(ctx, zc); err != nil {
+        return err
+    }
+    return l.reelect(zoneID, boundary.ZoneID)
+}
+
+// MergeZones merges zone b into zone a. The merge is committed through b's
+// log as its last entry: b refuses proposals from then on, and its members
+// stop their replicas in b an election timeout after applying it, which
+// gives those behind time to catch up. Every member of b joins a as a
+// learner, b's voters are promoted once they have caught up with a, and a
+// re-elects its leader. b's seat in the global group is released. It must be
+// called in a process hosting members of both zones.
+func (l *LHRaftConsensus) MergeZones(a, b string) error {
+    l.mu.RLock()
+    into, from := l.groups[a], l.groups[b]
+    initial := append([]string{}, l.initialClusters[a]...)
+    timeout := l.ProposalTimeout
+    l.mu.RUnlock()
+
+    switch {
+    case a == GlobalGroupID || b == GlobalGroupID:
+        return fmt.Errorf("the global group cannot be merged")
+    case into == nil:
+        return fmt.Errorf("no consensus group for zone: %s", a)
+    case from == nil:
+        return fmt.Errorf("no consensus group for zone: %s", b)
+    }
+
+    view := from.view()
+    zc := ZoneChange{Type: ZoneMerge, Zone: b, Into: a, Members: view.members(), Initial: Membership{Voters: initial}}
+    if err := view.validateZoneChange(zc); err != nil {
+        return fmt.Errorf("cannot merge zone %s into %s: %v", b, a, err)
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    if err := from.proposeZoneChange(ctx, zc); err != nil {
+        return fmt.Errorf("failed to merge zone %s into %s: %v", b, a, err)
+    }
+    if err := l.awaitMoved(ctx, zc); err != nil {
+        return err
+    }
+
+    // Members join one change at a time, the voters voting once caught up
+    for _, id := range zc.Members {
+        if into.view().isMember(id) {
+            continue
+        }
+        ctx, cancel := context.WithTimeout(context.Background(), timeout)
+        err := into.proposeConfChange(ctx, ConfChange{Type: ConfAddLearner, NodeID: id})
+        cancel()
+        if err != nil {
+            return fmt.Errorf("failed to add node %s to zone %s: %v", id, a, err)
+        }
+    }
+    for _, id := range view.Voters {
+        if err := l.promoteCaughtUp(into, id); err != nil {
+            return fmt.Errorf("failed to promote node %s in zone %s: %v", id, a, err)
+        }
+    }
+    return l.reelect(a)
+}
+
+// promoteCaughtUp makes a learner a voter, waiting within the proposal
+// timeout for it to catch up
+func (l *LHRaftConsensus) promoteCaughtUp(group *zoneGroup, nodeID string) error {
+    l.mu.RLock()
+    timeout := l.ProposalTimeout
+    l.mu.RUnlock()
+
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    for !group.view().isVoter(nodeID) {
+        err := group.promoteMember(ctx, nodeID)
+        if err == nil {
+            return nil
+        }
+        if err != ErrLearnerBehind {
+            return err
+        }
+        select {
+        case <-time.After(proposalRetryInterval):
+        case <-ctx.Done():
+            return fmt.Errorf("%v: %v", ctx.Err(), err)
+        }
+    }
+    return nil
+}
+
+// reelect has each zone elect the best candidate this process hosts
+func (l *LHRaftConsensus) reelect(zoneIDs ...string) error {
+    for _, zoneID := range zoneIDs {
+        if _, err := l.ElectZoneLeader(zoneID); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// awaitMoved waits until this process runs a replica in the destination zone
+// for each of its nodes a committed zone change moves
+func (l *LHRaftConsensus) awaitMoved(ctx context.Context, zc ZoneChange) error {
+    // The local replica the change was proposed through has applied it, but
+    // a replica applying it first may still be following it
+    _, into, _ := l.followZoneChange(zc)
+
+    l.mu.RLock()
+    local := make([]string, 0)
+    for _, id := range zc.Members {
+        if node, exists := l.Nodes[id]; exists && !node.Remote {
+            local = append(local, id)
+        }
+    }
+    l.mu.RUnlock()
+
+    for _, id := range local {
+        for !into.hosts(id) {
+            select {
+            case <-time.After(proposalRetryInterval):
+            case <-ctx.Done():
+                return fmt.Errorf("node %s not moved to zone %s: %v", id, zc.Into, ctx.Err())
+            }
+        }
+    }
+    return nil
+}
+
+// applyZoneChange follows a zone change a local replica has applied. The
+// first replica in this process to apply it moves the process's nodes to
+// their new zone; a node moving out of a split zone leaves the zone's group
+// once its own replica has applied the split, so that it holds every entry
+// the zone committed before. Replicas call it while locked, so group work
+// is done in the background.
+func (l *LHRaftConsensus) applyZoneChange(nodeID string, entry LogEntry) {
+    zc, err := DecodeZoneChange(entry.Data)
+    if err != nil {
+        // Replicas halt on corrupt changes before applying them
+        return
+    }
+    from, into, hosted := l.followZoneChange(zc)
+    if len(hosted) > 0 {
+        go func() {
+            for _, id := range hosted {
+                // A replica that fails to start is reported by awaitMoved
+                // when this process split the zone
+                into.host(id)
+            }
+        }()
+    }
+    if zc.Type == ZoneSplit && from != nil && containsString(zc.Members, nodeID) {
+        go l.leaveZone(from, nodeID)
+    }
+}
+
+// followZoneChange brings this process in line with a committed zone change:
+// the moving nodes are relocated, the zone they move to gets a group here if
+// it has none, and a zone merged away is retired. It returns the groups of
+// both zones and, the first time it is called for the change, the moving
+// nodes hosted here, for which the caller starts replicas in the new zone.
+func (l *LHRaftConsensus) followZoneChange(zc ZoneChange) (from, into *zoneGroup, hosted []string) {
+    l.mu.RLock()
+    from = l.groups[zc.Zone]
+    l.mu.RUnlock()
+
+    var term uint64
+    if from != nil {
+        // Taken before l.mu, which replicas take while reporting leaders
+        _, term = from.leader()
+    }
+
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    from, into = l.groups[zc.Zone], l.groups[zc.Into]
+    first := into == nil
+    if zc.Type == ZoneMerge {
+        first = from != nil
+    }
+    if !first {
+        return from, into, nil
+    }
+
+    if into == nil {
+        if timing, exists := l.zoneTimings[zc.Zone]; exists && zc.Type == ZoneSplit {
+            if _, set := l.zoneTimings[zc.Into]; !set {
+                l.zoneTimings[zc.Into] = timing
+            }
+        }
+        if _, configured := l.initialClusters[zc.Into]; !configured {
+            l.initialClusters[zc.Into] = append([]string{}, zc.Initial.Voters...)
+        }
+        into = l.newGroup(zc.Into, l.initialClusters[zc.Into])
+        // The group has no replicas yet
+        into.membership.Learners = append([]string{}, zc.Initial.Learners...)
+    }
+
+    for _, id := range zc.Members {
+        node, exists := l.Nodes[id]
+        if !exists {
+            continue
+        }
+        node.Location = zc.Into
+        node.IsLeader = false
+        node.State = Follower
+        node.IsLearner = !zc.Initial.isVoter(id)
+        if zc.Initial.isMember(id) {
+            node.GroupMembers = zc.Initial.members()
+        } else {
+            node.GroupMembers = make([]string, 0)
+        }
+        if !node.Remote {
+            hosted = append(hosted, id)
+        }
+    }
+
+    if zc.Type == ZoneMerge {
+        // Members still behind get an election timeout to apply the merge
+        time.AfterFunc(l.zoneTiming(zc.Zone).electionTimeout(), from.stop)
+        previous := l.ZoneLeaders[zc.Zone]
+        delete(l.groups, zc.Zone)
+        delete(l.initialClusters, zc.Zone)
+        delete(l.zoneTimings, zc.Zone)
+        delete(l.ZoneLeaders, zc.Zone)
+        l.mergedZones[zc.Zone] = zc.Into
+        if previous != "" {
+            l.leaderChanges.publish(LeaderChange{ZoneID: zc.Zone, Previous: previous, Term: term})
+        }
+    }
+    if l.global != nil {
+        l.global.wake()
+    }
+    return from, into, hosted
+}
+
+// leaveZone takes a node that has moved to another zone out of its old
+// zone's group, retrying until the removal commits or can no longer be made
+func (l *LHRaftConsensus) leaveZone(group *zoneGroup, nodeID string) {
+    for group.view().isMember(nodeID) {
+        l.mu.RLock()
+        timeout := l.ProposalTimeout
+        l.mu.RUnlock()
+
+        ctx, cancel := context.WithTimeout(context.Background(), timeout)
+        err := group.removeMember(ctx, nodeID)
+        cancel()
+        if err != nil && ctx.Err() == nil {
+            // Removed already, or the replica has stopped
+            return
+        }
+    }
+}
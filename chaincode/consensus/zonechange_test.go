@@ -0,0 +1,265 @@
+package consensus
+
+import (
+    "fmt"
+    "testing"
+    "time"
+)
+
+// recordZones has sm record each entry with the zone that applied it, and
+// each zone change as the zones it moves members between
+func recordZones(sm *testStateMachine) ApplyFunc {
+    return func(zoneID, nodeID string, entry LogEntry) {
+        if entry.Type == EntryZoneChange {
+            zc, err := DecodeZoneChange(entry.Data)
+            if err != nil {
+                panic(err)
+            }
+            entry.Data = []byte(fmt.Sprintf("%s>%s", zc.Zone, zc.Into))
+        }
+        if entry.Data != nil {
+            entry.Data = append([]byte(zoneID+":"), entry.Data...)
+        }
+        sm.apply(zoneID, nodeID, entry)
+    }
+}
+
+func TestZoneBoundaryContains(t *testing.T) {
+    box := ZoneBoundary{SouthWest: GeoPoint{10, 20}, NorthEast: GeoPoint{30, 40}}
+    wrapped := ZoneBoundary{SouthWest: GeoPoint{-10, 170}, NorthEast: GeoPoint{10, -170}}
+    tests := []struct {
+        boundary ZoneBoundary
+        point    GeoPoint
+        want     bool
+    }{
+        {box, GeoPoint{20, 30}, true},
+        {box, GeoPoint{10, 40}, true},
+        {box, GeoPoint{31, 30}, false},
+        {box, GeoPoint{20, 19}, false},
+        {wrapped, GeoPoint{0, 175}, true},
+        {wrapped, GeoPoint{0, -175}, true},
+        {wrapped, GeoPoint{0, 0}, false},
+    }
+    for _, tt := range tests {
+        if got := tt.boundary.contains(tt.point); got != tt.want {
+            t.Errorf("%+v contains %+v = %v, want %v", tt.boundary, tt.point, got, tt.want)
+        }
+    }
+}
+
+func TestMergeIsLastEntry(t *testing.T) {
+    r, _ := newReadLeader(t, 0)
+    r.advance(r.ready())
+    r.msgs = nil
+    members := Membership{Voters: []string{"n1", "n2", "n3"}}
+
+    if _, _, err := r.proposeZoneChange(ZoneChange{Type: ZoneMerge, Zone: "Z1", Into: "Z2", Members: []string{"n1", "n2"}}); err == nil {
+        t.Error("merge leaving n3 behind accepted")
+    }
+    if _, _, err := r.proposeZoneChange(ZoneChange{Type: ZoneSplit, Zone: "Z1", Into: "Z2", Members: members.Voters, Initial: members}); err == nil {
+        t.Error("split moving every voter accepted")
+    }
+    if _, _, err := r.proposeZoneChange(ZoneChange{Type: ZoneMerge, Zone: "Z1", Into: "Z2", Members: members.Voters}); err != nil {
+        t.Fatalf("proposeZoneChange: %v", err)
+    }
+    if _, _, err := r.propose([]byte("tx")); err != ErrZoneMerged {
+        t.Errorf("propose after the merge = %v, want ErrZoneMerged", err)
+    }
+    if _, _, err := r.proposeConfChange(ConfChange{Type: ConfAddLearner, NodeID: "n4"}); err != ErrZoneMerged {
+        t.Errorf("proposeConfChange after the merge = %v, want ErrZoneMerged", err)
+    }
+
+    // A successor holding the merge uncommitted appends nothing after it either
+    successor := newRaftNode("n2", members)
+    successor.step(Message{Type: MsgAppendEntries, From: "n1", To: "n2", Term: r.currentTerm, Entries: r.log.slice(1, r.log.lastIndex()+1)})
+    successor.campaign()
+    successor.step(Message{Type: MsgRequestVoteResponse, From: "n3", To: "n2", Term: successor.currentTerm, Success: true})
+    if successor.state != Leader {
+        t.Fatalf("n2 is %v, want leader", successor.state)
+    }
+    if _, _, err := successor.propose([]byte("tx")); err != ErrZoneMerged {
+        t.Errorf("successor propose = %v, want ErrZoneMerged", err)
+    }
+}
+
+func TestSplitZone(t *testing.T) {
+    l := newTestConsensus(t, []string{"n1", "n2", "n3", "n4", "n5"})
+    defer l.Stop()
+    sm := newTestStateMachine()
+    l.SetApplyFunc(recordZones(sm))
+    if err := l.SetZoneTiming("Z1", fastTiming); err != nil {
+        t.Fatalf("SetZoneTiming: %v", err)
+    }
+    positions := map[string]GeoPoint{"n1": {10, 10}, "n2": {10.1, 10}, "n3": {10, 10.1}, "n4": {20, 20}, "n5": {20.1, 20}}
+    for _, id := range []string{"n1", "n2", "n3", "n4", "n5"} {
+        if err := l.RegisterNode(id, "Z1", 0.9); err != nil {
+            t.Fatalf("RegisterNode(%s): %v", id, err)
+        }
+        if err := l.SetNodePosition(id, positions[id].Latitude, positions[id].Longitude); err != nil {
+            t.Fatalf("SetNodePosition(%s): %v", id, err)
+        }
+    }
+    if _, err := l.ElectZoneLeader("Z1"); err != nil {
+        t.Fatalf("ElectZoneLeader: %v", err)
+    }
+    // The leader is among the members moving away
+    if err := l.TransferLeadership("Z1", "n4"); err != nil {
+        t.Fatalf("TransferLeadership: %v", err)
+    }
+    var before []string
+    for i := 0; i < 3; i++ {
+        tx := fmt.Sprintf("tx%d", i)
+        if err := l.PropagateTransaction([]byte(tx), "Z1"); err != nil {
+            t.Fatalf("PropagateTransaction: %v", err)
+        }
+        before = append(before, "Z1:"+tx)
+    }
+
+    far := ZoneBoundary{ZoneID: "Z2", SouthWest: GeoPoint{15, 15}, NorthEast: GeoPoint{25, 25}}
+    everything := ZoneBoundary{ZoneID: "Z2", SouthWest: GeoPoint{0, 0}, NorthEast: GeoPoint{30, 30}}
+    if err := l.SplitZone("Z1", everything); err == nil {
+        t.Error("split moving every voter accepted")
+    }
+    if err := l.SplitZone("Z1", ZoneBoundary{ZoneID: "Z1", SouthWest: far.SouthWest, NorthEast: far.NorthEast}); err == nil {
+        t.Error("split into an existing zone accepted")
+    }
+    if err := l.SplitZone("Z1", far); err != nil {
+        t.Fatalf("SplitZone: %v", err)
+    }
+
+    waitForVoters(t, l, "Z1", "n1", "n2", "n3")
+    waitForVoters(t, l, "Z2", "n4", "n5")
+    for zoneID, members := range map[string][]string{"Z1": {"n1", "n2", "n3"}, "Z2": {"n4", "n5"}} {
+        l.mu.RLock()
+        leaderID := l.ZoneLeaders[zoneID]
+        l.mu.RUnlock()
+        if !containsString(members, leaderID) {
+            t.Errorf("zone %s is led by %q, want one of %q", zoneID, leaderID, members)
+        }
+        for _, id := range members {
+            if location := l.Nodes[id].Location; location != zoneID {
+                t.Errorf("node %s is in zone %s, want %s", id, location, zoneID)
+            }
+        }
+        checkLeaderFlags(t, l, zoneID)
+    }
+
+    // Every member applied the entries before the split in the old zone
+    for _, tx := range []string{"Z1", "Z2"} {
+        if err := l.PropagateTransaction([]byte("after"), tx); err != nil {
+            t.Fatalf("PropagateTransaction to %s after the split: %v", tx, err)
+        }
+    }
+    split := append(append([]string{}, before...), "Z1:Z1>Z2")
+    for _, id := range []string{"n1", "n2", "n3"} {
+        sm.waitFor(t, id, append(split, "Z1:after")...)
+    }
+    for _, id := range []string{"n4", "n5"} {
+        sm.waitFor(t, id, append(split, "Z2:after")...)
+    }
+}
+
+func TestMergeZones(t *testing.T) {
+    l := newTestConsensus(t, []string{"n1", "n2", "n3"})
+    defer l.Stop()
+    sm := newTestStateMachine()
+    l.SetApplyFunc(recordZones(sm))
+    if err := l.SetInitialCluster("Z2", []string{"n4", "n5"}); err != nil {
+        t.Fatalf("SetInitialCluster: %v", err)
+    }
+    zones := map[string][]string{"Z1": {"n1", "n2", "n3"}, "Z2": {"n4", "n5"}}
+    for zoneID, members := range zones {
+        if err := l.SetZoneTiming(zoneID, fastTiming); err != nil {
+            t.Fatalf("SetZoneTiming: %v", err)
+        }
+        for _, id := range members {
+            if err := l.RegisterNode(id, zoneID, 0.9); err != nil {
+                t.Fatalf("RegisterNode(%s): %v", id, err)
+            }
+        }
+        if _, err := l.ElectZoneLeader(zoneID); err != nil {
+            t.Fatalf("ElectZoneLeader(%s): %v", zoneID, err)
+        }
+        if err := l.PropagateTransaction([]byte("tx"), zoneID); err != nil {
+            t.Fatalf("PropagateTransaction: %v", err)
+        }
+    }
+    changes, unsubscribe := l.SubscribeLeaderChanges()
+    defer unsubscribe()
+
+    if err := l.MergeZones("Z1", "Z1"); err == nil {
+        t.Error("zone merged into itself")
+    }
+    if err := l.MergeZones("Z1", "Z2"); err != nil {
+        t.Fatalf("MergeZones: %v", err)
+    }
+
+    waitForVoters(t, l, "Z1", "n1", "n2", "n3", "n4", "n5")
+    l.mu.RLock()
+    leaderID, stale := l.ZoneLeaders["Z1"], l.ZoneLeaders["Z2"]
+    _, group := l.groups["Z2"]
+    l.mu.RUnlock()
+    if leaderID == "" || stale != "" || group {
+        t.Fatalf("zone leaders Z1 = %q, Z2 = %q with a group %v; want Z1 led and Z2 gone", leaderID, stale, group)
+    }
+    checkLeaderFlags(t, l, "Z1")
+    for change := range changes {
+        if change.ZoneID == "Z2" {
+            if change.Leader != "" {
+                t.Errorf("zone Z2 reported leader %q after merging", change.Leader)
+            }
+            break
+        }
+    }
+    if err := l.PropagateTransaction([]byte("tx"), "Z2"); err == nil {
+        t.Error("transaction committed in the merged zone")
+    }
+
+    // The merged zone's members hold both zones' entries
+    if err := l.PropagateTransaction([]byte("after"), "Z1"); err != nil {
+        t.Fatalf("PropagateTransaction after the merge: %v", err)
+    }
+    for _, id := range zones["Z1"] {
+        sm.waitFor(t, id, "Z1:tx", "Z1:after")
+    }
+    for _, id := range zones["Z2"] {
+        sm.waitFor(t, id, "Z2:tx", "Z2:Z2>Z1", "Z1:tx", "Z1:after")
+    }
+}
+
+func TestMergedZoneReleasesGlobalSeat(t *testing.T) {
+    l := newTestConsensus(t, nil, withZones(map[string][]string{"Z1": {"n1"}, "Z2": {"n2"}}), withGlobalCluster())
+    defer l.Stop()
+    for id, zoneID := range map[string]string{"n1": "Z1", "n2": "Z2"} {
+        if err := l.SetZoneTiming(zoneID, fastTiming); err != nil {
+            t.Fatalf("SetZoneTiming: %v", err)
+        }
+        if err := l.RegisterNode(id, zoneID, 0.9); err != nil {
+            t.Fatalf("RegisterNode(%s): %v", id, err)
+        }
+        if _, err := l.ElectZoneLeader(zoneID); err != nil {
+            t.Fatalf("ElectZoneLeader(%s): %v", zoneID, err)
+        }
+    }
+
+    if err := l.MergeZones("Z1", "Z2"); err != nil {
+        t.Fatalf("MergeZones: %v", err)
+    }
+    deadline := time.Now().Add(2 * time.Second)
+    for {
+        l.mu.RLock()
+        leaderID := l.ZoneLeaders["Z1"]
+        l.mu.RUnlock()
+        seats := l.GlobalSeats()
+        if len(seats) == 1 && seats["Z1"] == leaderID {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("global seats = %v, want Z1's alone, held by %s", seats, leaderID)
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+    if err := l.PropagateTransaction([]byte("tx"), "Z1"); err != nil {
+        t.Fatalf("PropagateTransaction after the merge: %v", err)
+    }
+}
@@ -18,11 +18,44 @@ type DeviceState struct {
     Location        string    `json:"location"`
     ZoneID          string    `json:"zoneId"`
     Reputation      float64   `json:"reputation"`
-    Status          string    `json:"status"` // "active", "inactive", "maintenance"
+    Status          string    `json:"status"` // "active", "inactive", "maintenance", "suspended"
     LastUpdate      time.Time `json:"lastUpdate"`
     TransactionCount int      `json:"transactionCount"`
     SuccessfulTx    int      `json:"successfulTransactions"`
     FailedTx        int      `json:"failedTransactions"`
+    TrustScore      float64   `json:"trustScore"` // Global trust from peer ratings, see ComputeTrustScores
+    PublicKey       string    `json:"publicKey,omitempty"` // PEM encoded ECDSA key the device signs claims and consensus messages with
+    UnderDispute    bool      `json:"underDispute"` // Set while a reputation dispute is open; excluded from leadership
+    Sponsor         string    `json:"sponsor"` // Device that vouched for this one, empty when admin sponsored
+    RegisteredAt    int64     `json:"registeredAt"` // Transaction time of registration, in seconds
+    Owner           string    `json:"owner"` // Client identity that registered the device and acts for it
+}
+
+// UnmarshalJSON decodes a device record. Records SmartContract wrote before
+// both contracts stored DeviceState keep LastUpdate in Unix seconds.
+func (d *DeviceState) UnmarshalJSON(data []byte) error {
+    type stored DeviceState
+    record := struct {
+        *stored
+        LastUpdate json.RawMessage `json:"lastUpdate"`
+    }{stored: (*stored)(d)}
+    if err := json.Unmarshal(data, &record); err != nil {
+        return err
+    }
+
+    d.LastUpdate = time.Time{}
+    if len(record.LastUpdate) == 0 || string(record.LastUpdate) == "null" {
+        return nil
+    }
+    if record.LastUpdate[0] == '"' {
+        return json.Unmarshal(record.LastUpdate, &d.LastUpdate)
+    }
+    var seconds int64
+    if err := json.Unmarshal(record.LastUpdate, &seconds); err != nil {
+        return fmt.Errorf("invalid lastUpdate of device %s: %v", d.ID, err)
+    }
+    d.LastUpdate = time.Unix(seconds, 0).UTC()
+    return nil
 }
 
 // DeviceTransaction represents a transaction performed by a device
@@ -34,8 +67,10 @@ type DeviceTransaction struct {
     ResponseTime int64    `json:"responseTime"` // in milliseconds
 }
 
-// CreateDevice initializes a new device in the system
-func (dm *DeviceManager) CreateDevice(ctx contractapi.TransactionContextInterface, id string, location string, zoneId string) error {
+// CreateDevice initializes a new device in the system. The device must be
+// vouched for by sponsorId, or by an admin when sponsorId is empty, and starts
+// at the probationary reputation of the bootstrap policy.
+func (dm *DeviceManager) CreateDevice(ctx contractapi.TransactionContextInterface, id string, location string, zoneId string, sponsorId string) error {
     exists, err := dm.DeviceExists(ctx, id)
     if err != nil {
         return err
@@ -44,24 +79,38 @@ func (dm *DeviceManager) CreateDevice(ctx contractapi.TransactionContextInterfac
         return fmt.Errorf("device already exists: %s", id)
     }
 
+    policy, err := getBootstrapPolicy(ctx)
+    if err != nil {
+        return err
+    }
+    if err := checkSponsor(ctx, sponsorId, policy); err != nil {
+        return err
+    }
+    owner, err := callerID(ctx)
+    if err != nil {
+        return err
+    }
+    timestamp, err := ctx.GetStub().GetTxTimestamp()
+    if err != nil {
+        return err
+    }
+
     device := DeviceState{
         ID:              id,
         Location:        location,
         ZoneID:          zoneId,
-        Reputation:      1.0, // Initial reputation
+        Reputation:      policy.InitialReputation, // Probationary reputation
         Status:          "active",
         LastUpdate:      time.Now(),
         TransactionCount: 0,
         SuccessfulTx:    0,
         FailedTx:        0,
+        Sponsor:         sponsorId,
+        RegisteredAt:    timestamp.Seconds,
+        Owner:           owner,
     }
 
-    deviceJSON, err := json.Marshal(device)
-    if err != nil {
-        return err
-    }
-
-    return ctx.GetStub().PutState(id, deviceJSON)
+    return dm.putDevice(ctx, &device)
 }
 
 // DeviceExists checks if a device exists in the ledger
@@ -83,16 +132,56 @@ func (dm *DeviceManager) UpdateDeviceStatus(ctx contractapi.TransactionContextIn
     device.Status = status
     device.LastUpdate = time.Now()
 
-    deviceJSON, err := json.Marshal(device)
+    return dm.putDevice(ctx, device)
+}
+
+// RegisterDeviceKey binds the public key a device signs its claims with. The
+// first key is bound by the device's owner or an admin; once set, only an
+// admin can rotate it.
+func (dm *DeviceManager) RegisterDeviceKey(ctx contractapi.TransactionContextInterface, id string, publicKeyPEM string) error {
+    device, err := dm.GetDevice(ctx, id)
     if err != nil {
         return err
     }
 
-    return ctx.GetStub().PutState(id, deviceJSON)
+    if device.PublicKey != "" {
+        if err := assertRole(ctx, RoleAdmin); err != nil {
+            return fmt.Errorf("device %s already has a key: %v", id, err)
+        }
+    } else if err := assertDeviceOperator(ctx, device); err != nil {
+        return err
+    }
+    if _, err := parseDevicePublicKey(publicKeyPEM); err != nil {
+        return err
+    }
+
+    device.PublicKey = publicKeyPEM
+    return dm.putDevice(ctx, device)
+}
+
+// putDevice writes a device back to the world state
+func (dm *DeviceManager) putDevice(ctx contractapi.TransactionContextInterface, device *DeviceState) error {
+    return dm.putDevices(ctx, device)
+}
+
+// putDevices writes devices back to the world state and keeps their zone
+// statistics current. Devices written in the same transaction must go through
+// a single call so their statistics updates are not lost.
+func (dm *DeviceManager) putDevices(ctx contractapi.TransactionContextInterface, devices ...*DeviceState) error {
+    records := make([]deviceRecord, len(devices))
+    for i, device := range devices {
+        records[i] = device
+    }
+    return putDeviceRecords(ctx, records...)
 }
 
 // GetDevice retrieves device information
 func (dm *DeviceManager) GetDevice(ctx contractapi.TransactionContextInterface, id string) (*DeviceState, error) {
+    return getDeviceState(ctx, id)
+}
+
+// getDeviceState reads a device written by either contract
+func getDeviceState(ctx contractapi.TransactionContextInterface, id string) (*DeviceState, error) {
     deviceJSON, err := ctx.GetStub().GetState(id)
     if err != nil {
         return nil, fmt.Errorf("failed to read device: %v", err)
@@ -136,12 +225,7 @@ func (dm *DeviceManager) RecordTransaction(ctx contractapi.TransactionContextInt
     device.Reputation = (successRate * 0.7) + (responseTimeScore * 0.3)
     device.LastUpdate = time.Now()
 
-    deviceJSON, err := json.Marshal(device)
-    if err != nil {
-        return err
-    }
-
-    return ctx.GetStub().PutState(id, deviceJSON)
+    return dm.putDevice(ctx, device)
 }
 
 // QueryDevicesByZone gets all devices in a specific zone
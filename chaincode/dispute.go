@@ -0,0 +1,259 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const disputeObjectType = "dispute"
+
+// Dispute statuses
+const (
+    DisputeOpen     = "open"
+    DisputeUpheld   = "upheld"   // Reputation restored from history
+    DisputeRejected = "rejected" // Reputation left unchanged
+)
+
+// DisputeEvidence is a piece of supporting material attached to a dispute
+type DisputeEvidence struct {
+    SubmittedBy string `json:"submittedBy"`
+    Description string `json:"description"`
+    Timestamp   int64  `json:"timestamp"`
+}
+
+// Dispute records an operator contesting a device's reputation
+type Dispute struct {
+    ID                 string            `json:"id"`
+    DeviceID           string            `json:"deviceId"`
+    Reason             string            `json:"reason"`
+    OpenedBy           string            `json:"openedBy"`
+    OpenedAt           int64             `json:"openedAt"`
+    Status             string            `json:"status"`
+    Evidence           []DisputeEvidence `json:"evidence"`
+    DisputedReputation float64           `json:"disputedReputation"`
+    RestoredFromTx     string            `json:"restoredFromTx,omitempty"`
+    RestoredReputation float64           `json:"restoredReputation,omitempty"`
+    Resolution         string            `json:"resolution,omitempty"`
+    ResolvedBy         string            `json:"resolvedBy,omitempty"`
+    ResolvedAt         int64             `json:"resolvedAt,omitempty"`
+}
+
+// OpenDispute contests the current reputation of a device and flags it as
+// under dispute. Only the device's owner or an admin may open one.
+func (dm *DeviceManager) OpenDispute(ctx contractapi.TransactionContextInterface, disputeId string, deviceId string, reason string) error {
+    existing, err := dm.getDisputeState(ctx, disputeId)
+    if err != nil {
+        return err
+    }
+    if existing != nil {
+        return fmt.Errorf("dispute already exists: %s", disputeId)
+    }
+
+    device, err := dm.GetDevice(ctx, deviceId)
+    if err != nil {
+        return err
+    }
+    if err := assertDeviceOperator(ctx, device); err != nil {
+        return err
+    }
+    if device.UnderDispute {
+        return fmt.Errorf("device %s is already under dispute", deviceId)
+    }
+
+    openedBy, err := ctx.GetClientIdentity().GetID()
+    if err != nil {
+        return err
+    }
+    timestamp, err := ctx.GetStub().GetTxTimestamp()
+    if err != nil {
+        return err
+    }
+
+    dispute := Dispute{
+        ID:                 disputeId,
+        DeviceID:           deviceId,
+        Reason:             reason,
+        OpenedBy:           openedBy,
+        OpenedAt:           timestamp.Seconds,
+        Status:             DisputeOpen,
+        Evidence:           []DisputeEvidence{},
+        DisputedReputation: device.Reputation,
+    }
+
+    device.UnderDispute = true
+    if err := dm.putDevice(ctx, device); err != nil {
+        return err
+    }
+
+    return dm.putDispute(ctx, &dispute)
+}
+
+// AttachEvidence adds supporting material to an open dispute. Only the
+// disputed device's owner or an admin may add to it.
+func (dm *DeviceManager) AttachEvidence(ctx contractapi.TransactionContextInterface, disputeId string, description string) error {
+    dispute, err := dm.GetDispute(ctx, disputeId)
+    if err != nil {
+        return err
+    }
+    if dispute.Status != DisputeOpen {
+        return fmt.Errorf("dispute %s is already %s", disputeId, dispute.Status)
+    }
+    device, err := dm.GetDevice(ctx, dispute.DeviceID)
+    if err != nil {
+        return err
+    }
+    if err := assertDeviceOperator(ctx, device); err != nil {
+        return err
+    }
+
+    submittedBy, err := ctx.GetClientIdentity().GetID()
+    if err != nil {
+        return err
+    }
+    timestamp, err := ctx.GetStub().GetTxTimestamp()
+    if err != nil {
+        return err
+    }
+
+    dispute.Evidence = append(dispute.Evidence, DisputeEvidence{
+        SubmittedBy: submittedBy,
+        Description: description,
+        Timestamp:   timestamp.Seconds,
+    })
+
+    return dm.putDispute(ctx, dispute)
+}
+
+// ResolveDispute closes a dispute. When restoreTxId is given the device's
+// reputation is restored to the value written by that transaction; otherwise
+// the dispute is rejected. Resolver only.
+func (dm *DeviceManager) ResolveDispute(ctx contractapi.TransactionContextInterface, disputeId string, restoreTxId string, resolution string) error {
+    if err := assertRole(ctx, RoleResolver); err != nil {
+        return err
+    }
+
+    dispute, err := dm.GetDispute(ctx, disputeId)
+    if err != nil {
+        return err
+    }
+    if dispute.Status != DisputeOpen {
+        return fmt.Errorf("dispute %s is already %s", disputeId, dispute.Status)
+    }
+
+    device, err := dm.GetDevice(ctx, dispute.DeviceID)
+    if err != nil {
+        return err
+    }
+
+    dispute.Status = DisputeRejected
+    if restoreTxId != "" {
+        reputation, err := dm.reputationAt(ctx, dispute.DeviceID, restoreTxId)
+        if err != nil {
+            return err
+        }
+        device.Reputation = reputation
+        dispute.Status = DisputeUpheld
+        dispute.RestoredFromTx = restoreTxId
+        dispute.RestoredReputation = reputation
+    }
+
+    resolvedBy, err := ctx.GetClientIdentity().GetID()
+    if err != nil {
+        return err
+    }
+    timestamp, err := ctx.GetStub().GetTxTimestamp()
+    if err != nil {
+        return err
+    }
+    dispute.Resolution = resolution
+    dispute.ResolvedBy = resolvedBy
+    dispute.ResolvedAt = timestamp.Seconds
+
+    device.UnderDispute = false
+    if err := dm.putDevice(ctx, device); err != nil {
+        return err
+    }
+
+    return dm.putDispute(ctx, dispute)
+}
+
+// GetDispute retrieves a dispute record
+func (dm *DeviceManager) GetDispute(ctx contractapi.TransactionContextInterface, disputeId string) (*Dispute, error) {
+    dispute, err := dm.getDisputeState(ctx, disputeId)
+    if err != nil {
+        return nil, err
+    }
+    if dispute == nil {
+        return nil, fmt.Errorf("dispute does not exist: %s", disputeId)
+    }
+    return dispute, nil
+}
+
+// getDisputeState reads a dispute, returning nil when it does not exist
+func (dm *DeviceManager) getDisputeState(ctx contractapi.TransactionContextInterface, disputeId string) (*Dispute, error) {
+    key, err := ctx.GetStub().CreateCompositeKey(disputeObjectType, []string{disputeId})
+    if err != nil {
+        return nil, err
+    }
+    disputeJSON, err := ctx.GetStub().GetState(key)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read dispute: %v", err)
+    }
+    if disputeJSON == nil {
+        return nil, nil
+    }
+
+    var dispute Dispute
+    err = json.Unmarshal(disputeJSON, &dispute)
+    if err != nil {
+        return nil, err
+    }
+
+    return &dispute, nil
+}
+
+// putDispute writes a dispute to the world state
+func (dm *DeviceManager) putDispute(ctx contractapi.TransactionContextInterface, dispute *Dispute) error {
+    key, err := ctx.GetStub().CreateCompositeKey(disputeObjectType, []string{dispute.ID})
+    if err != nil {
+        return err
+    }
+    disputeJSON, err := json.Marshal(dispute)
+    if err != nil {
+        return err
+    }
+
+    return ctx.GetStub().PutState(key, disputeJSON)
+}
+
+// reputationAt returns the reputation a device had after the given transaction
+func (dm *DeviceManager) reputationAt(ctx contractapi.TransactionContextInterface, id string, txId string) (float64, error) {
+    historyIterator, err := ctx.GetStub().GetHistoryForKey(id)
+    if err != nil {
+        return 0, err
+    }
+    defer historyIterator.Close()
+
+    for historyIterator.HasNext() {
+        modification, err := historyIterator.Next()
+        if err != nil {
+            return 0, err
+        }
+        if modification.TxId != txId {
+            continue
+        }
+        if modification.IsDelete {
+            return 0, fmt.Errorf("transaction %s deleted device %s", txId, id)
+        }
+
+        var device DeviceState
+        err = json.Unmarshal(modification.Value, &device)
+        if err != nil {
+            return 0, err
+        }
+        return device.Reputation, nil
+    }
+
+    return 0, fmt.Errorf("transaction %s not found in history of device %s", txId, id)
+}
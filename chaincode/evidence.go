@@ -0,0 +1,287 @@
+package main
+
+import (
+    "crypto/ecdsa"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "encoding/pem"
+    "fmt"
+    "math"
+    "sort"
+    "github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Evidence types accepted by SubmitMisbehaviourEvidence
+const (
+    EvidenceDoubleSignedLocation = "double-signed-location"
+    EvidenceConflictingReadings  = "conflicting-readings"
+    EvidenceImpossibleTravel     = "impossible-travel"
+)
+
+const misbehaviourObjectType = "misbehaviour"
+
+// maxTravelSpeed is the fastest a device may plausibly move, in metres per second
+const maxTravelSpeed = 100.0
+
+// SlashingRule describes the penalty applied for one evidence type
+type SlashingRule struct {
+    Penalty        float64 `json:"penalty"`        // Fraction of reputation removed
+    Suspend        bool    `json:"suspend"`        // Whether the device is suspended
+    ReporterReward float64 `json:"reporterReward"` // Reputation added to the reporter
+}
+
+// slashingSchedule maps each evidence type to its penalty
+var slashingSchedule = map[string]SlashingRule{
+    EvidenceDoubleSignedLocation: {Penalty: 0.5, Suspend: true, ReporterReward: 0.05},
+    EvidenceConflictingReadings:  {Penalty: 0.3, Suspend: false, ReporterReward: 0.03},
+    EvidenceImpossibleTravel:     {Penalty: 0.3, Suspend: false, ReporterReward: 0.03},
+}
+
+// SignedClaim is a statement a device signed with its registered key
+type SignedClaim struct {
+    DeviceID  string  `json:"deviceId"`
+    Timestamp int64   `json:"timestamp"`
+    Location  string  `json:"location,omitempty"`
+    Latitude  float64 `json:"latitude,omitempty"`
+    Longitude float64 `json:"longitude,omitempty"`
+    Sensor    string  `json:"sensor,omitempty"`
+    Value     float64 `json:"value,omitempty"`
+    Signature string  `json:"signature"` // Base64 ASN.1 ECDSA signature over the claim with an empty signature
+}
+
+// MisbehaviourEvidence is a pair of signed claims that together prove misbehaviour
+type MisbehaviourEvidence struct {
+    Type   string        `json:"type"`
+    Claims []SignedClaim `json:"claims"`
+}
+
+// MisbehaviourRecord is the on-ledger outcome of accepted evidence
+type MisbehaviourRecord struct {
+    EvidenceID         string               `json:"evidenceId"`
+    DeviceID           string               `json:"deviceId"`
+    ReporterID         string               `json:"reporterId"`
+    Evidence           MisbehaviourEvidence `json:"evidence"`
+    PreviousReputation float64              `json:"previousReputation"`
+    NewReputation      float64              `json:"newReputation"`
+    Suspended          bool                 `json:"suspended"`
+    Timestamp          int64                `json:"timestamp"`
+}
+
+// SubmitMisbehaviourEvidence verifies evidence against a device and slashes its
+// reputation according to the slashing schedule. The reporter, who is
+// rewarded, must be a device the caller owns. The same claims can only be
+// applied once, whatever type of evidence they are submitted as.
+func (dm *DeviceManager) SubmitMisbehaviourEvidence(ctx contractapi.TransactionContextInterface, reporterId string, evidenceJSON string) (*MisbehaviourRecord, error) {
+    var evidence MisbehaviourEvidence
+    if err := json.Unmarshal([]byte(evidenceJSON), &evidence); err != nil {
+        return nil, fmt.Errorf("invalid evidence: %v", err)
+    }
+
+    rule, ok := slashingSchedule[evidence.Type]
+    if !ok {
+        return nil, fmt.Errorf("unknown evidence type: %s", evidence.Type)
+    }
+    if len(evidence.Claims) != 2 {
+        return nil, fmt.Errorf("evidence must contain exactly two claims")
+    }
+
+    deviceID := evidence.Claims[0].DeviceID
+    if evidence.Claims[1].DeviceID != deviceID {
+        return nil, fmt.Errorf("claims belong to different devices")
+    }
+    if reporterId == deviceID {
+        return nil, fmt.Errorf("device %s cannot report itself", deviceID)
+    }
+
+    device, err := dm.GetDevice(ctx, deviceID)
+    if err != nil {
+        return nil, err
+    }
+    reporter, err := dm.GetDevice(ctx, reporterId)
+    if err != nil {
+        return nil, err
+    }
+    if err := assertDeviceOwner(ctx, reporter); err != nil {
+        return nil, err
+    }
+
+    if err := verifyEvidence(device, evidence); err != nil {
+        return nil, err
+    }
+
+    evidenceID, err := evidenceDigest(evidence)
+    if err != nil {
+        return nil, err
+    }
+    key, err := ctx.GetStub().CreateCompositeKey(misbehaviourObjectType, []string{evidenceID})
+    if err != nil {
+        return nil, err
+    }
+    existing, err := ctx.GetStub().GetState(key)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read misbehaviour record: %v", err)
+    }
+    if existing != nil {
+        return nil, fmt.Errorf("evidence already submitted: %s", evidenceID)
+    }
+
+    timestamp, err := ctx.GetStub().GetTxTimestamp()
+    if err != nil {
+        return nil, err
+    }
+
+    record := MisbehaviourRecord{
+        EvidenceID:         evidenceID,
+        DeviceID:           deviceID,
+        ReporterID:         reporterId,
+        Evidence:           evidence,
+        PreviousReputation: device.Reputation,
+        Suspended:          rule.Suspend,
+        Timestamp:          timestamp.Seconds,
+    }
+
+    device.Reputation = device.Reputation * (1 - rule.Penalty)
+    if rule.Suspend {
+        device.Status = "suspended"
+    }
+    record.NewReputation = device.Reputation
+    reporter.Reputation = math.Min(1, reporter.Reputation+rule.ReporterReward)
+    if err := dm.putDevices(ctx, device, reporter); err != nil {
+        return nil, err
+    }
+
+    recordJSON, err := json.Marshal(record)
+    if err != nil {
+        return nil, err
+    }
+    if err := ctx.GetStub().PutState(key, recordJSON); err != nil {
+        return nil, err
+    }
+
+    return &record, nil
+}
+
+// verifyEvidence checks the claim signatures and that the claims really conflict
+func verifyEvidence(device *DeviceState, evidence MisbehaviourEvidence) error {
+    if device.PublicKey == "" {
+        return fmt.Errorf("device %s has no registered key", device.ID)
+    }
+    publicKey, err := parseDevicePublicKey(device.PublicKey)
+    if err != nil {
+        return err
+    }
+    for _, claim := range evidence.Claims {
+        if err := verifyClaimSignature(publicKey, claim); err != nil {
+            return err
+        }
+    }
+
+    a, b := evidence.Claims[0], evidence.Claims[1]
+    switch evidence.Type {
+    case EvidenceDoubleSignedLocation:
+        if a.Timestamp != b.Timestamp {
+            return fmt.Errorf("location claims are for different times")
+        }
+        if a.Location == b.Location && a.Latitude == b.Latitude && a.Longitude == b.Longitude {
+            return fmt.Errorf("location claims do not conflict")
+        }
+    case EvidenceConflictingReadings:
+        if a.Sensor == "" || a.Sensor != b.Sensor || a.Timestamp != b.Timestamp {
+            return fmt.Errorf("readings are not for the same sensor and time")
+        }
+        if a.Value == b.Value {
+            return fmt.Errorf("readings do not conflict")
+        }
+    case EvidenceImpossibleTravel:
+        elapsed := math.Abs(float64(a.Timestamp - b.Timestamp))
+        if elapsed == 0 {
+            return fmt.Errorf("travel claims must be for different times")
+        }
+        distance := haversineDistance(a.Latitude, a.Longitude, b.Latitude, b.Longitude)
+        if distance/elapsed <= maxTravelSpeed {
+            return fmt.Errorf("travel of %.0fm in %.0fs is possible", distance, elapsed)
+        }
+    }
+
+    return nil
+}
+
+// parseDevicePublicKey decodes a PEM encoded ECDSA public key
+func parseDevicePublicKey(publicKeyPEM string) (*ecdsa.PublicKey, error) {
+    block, _ := pem.Decode([]byte(publicKeyPEM))
+    if block == nil {
+        return nil, fmt.Errorf("invalid PEM public key")
+    }
+    key, err := x509.ParsePKIXPublicKey(block.Bytes)
+    if err != nil {
+        return nil, fmt.Errorf("invalid public key: %v", err)
+    }
+    publicKey, ok := key.(*ecdsa.PublicKey)
+    if !ok {
+        return nil, fmt.Errorf("public key is not ECDSA")
+    }
+    return publicKey, nil
+}
+
+// claimDigest hashes a claim with its signature cleared
+func claimDigest(claim SignedClaim) ([]byte, error) {
+    claim.Signature = ""
+    claimJSON, err := json.Marshal(claim)
+    if err != nil {
+        return nil, err
+    }
+    digest := sha256.Sum256(claimJSON)
+    return digest[:], nil
+}
+
+// verifyClaimSignature checks a claim was signed by the given key
+func verifyClaimSignature(publicKey *ecdsa.PublicKey, claim SignedClaim) error {
+    signature, err := base64.StdEncoding.DecodeString(claim.Signature)
+    if err != nil {
+        return fmt.Errorf("invalid claim signature encoding: %v", err)
+    }
+    digest, err := claimDigest(claim)
+    if err != nil {
+        return err
+    }
+    if !ecdsa.VerifyASN1(publicKey, digest, signature) {
+        return fmt.Errorf("claim signature does not verify for device %s", claim.DeviceID)
+    }
+    return nil
+}
+
+// evidenceDigest identifies evidence by its claims alone, independent of
+// their order, signature encoding and the evidence type they are submitted
+// as, so the same proof cannot be applied twice
+func evidenceDigest(evidence MisbehaviourEvidence) (string, error) {
+    digests := make([]string, 0, len(evidence.Claims))
+    for _, claim := range evidence.Claims {
+        digest, err := claimDigest(claim)
+        if err != nil {
+            return "", err
+        }
+        digests = append(digests, hex.EncodeToString(digest))
+    }
+    sort.Strings(digests)
+
+    h := sha256.New()
+    for _, digest := range digests {
+        h.Write([]byte(digest))
+    }
+    return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// haversineDistance returns the great-circle distance between two points in metres
+func haversineDistance(lat1, lon1, lat2, lon2 float64) float64 {
+    const earthRadius = 6371000.0
+
+    toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+    dLat := toRad(lat2 - lat1)
+    dLon := toRad(lon2 - lon1)
+    a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+        math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+    return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
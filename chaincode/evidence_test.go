@@ -0,0 +1,175 @@
+package main
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/pem"
+    "testing"
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+)
+
+// signClaim signs a claim with key as a device would
+func signClaim(t *testing.T, key *ecdsa.PrivateKey, claim SignedClaim) SignedClaim {
+    digest, err := claimDigest(claim)
+    require.NoError(t, err)
+    signature, err := ecdsa.SignASN1(rand.Reader, key, digest)
+    require.NoError(t, err)
+    claim.Signature = base64.StdEncoding.EncodeToString(signature)
+    return claim
+}
+
+// testDeviceKey returns a key pair and a device registered with its public half
+func testDeviceKey(t *testing.T, id string) (*ecdsa.PrivateKey, *DeviceState) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    require.NoError(t, err)
+    der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+    require.NoError(t, err)
+    publicKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+    return key, &DeviceState{ID: id, PublicKey: string(publicKeyPEM)}
+}
+
+func TestVerifyEvidence(t *testing.T) {
+    key, device := testDeviceKey(t, "d1")
+    otherKey, _ := testDeviceKey(t, "d2")
+
+    tests := []struct {
+        name      string
+        device    *DeviceState
+        signer    *ecdsa.PrivateKey
+        evidence  MisbehaviourEvidence
+        wantError string
+    }{
+        {
+            name:   "DoubleSignedLocation",
+            device: device,
+            evidence: MisbehaviourEvidence{Type: EvidenceDoubleSignedLocation, Claims: []SignedClaim{
+                {DeviceID: "d1", Timestamp: 100, Location: "zone1", Latitude: 10, Longitude: 10},
+                {DeviceID: "d1", Timestamp: 100, Location: "zone2", Latitude: 20, Longitude: 20},
+            }},
+        },
+        {
+            name:   "DoubleSignedLocationAtDifferentTimes",
+            device: device,
+            evidence: MisbehaviourEvidence{Type: EvidenceDoubleSignedLocation, Claims: []SignedClaim{
+                {DeviceID: "d1", Timestamp: 100, Location: "zone1"},
+                {DeviceID: "d1", Timestamp: 101, Location: "zone2"},
+            }},
+            wantError: "different times",
+        },
+        {
+            name:   "DoubleSignedSameLocation",
+            device: device,
+            evidence: MisbehaviourEvidence{Type: EvidenceDoubleSignedLocation, Claims: []SignedClaim{
+                {DeviceID: "d1", Timestamp: 100, Location: "zone1", Latitude: 10},
+                {DeviceID: "d1", Timestamp: 100, Location: "zone1", Latitude: 10},
+            }},
+            wantError: "do not conflict",
+        },
+        {
+            name:   "ConflictingReadings",
+            device: device,
+            evidence: MisbehaviourEvidence{Type: EvidenceConflictingReadings, Claims: []SignedClaim{
+                {DeviceID: "d1", Timestamp: 100, Sensor: "temp", Value: 20},
+                {DeviceID: "d1", Timestamp: 100, Sensor: "temp", Value: 30},
+            }},
+        },
+        {
+            name:   "ReadingsFromDifferentSensors",
+            device: device,
+            evidence: MisbehaviourEvidence{Type: EvidenceConflictingReadings, Claims: []SignedClaim{
+                {DeviceID: "d1", Timestamp: 100, Sensor: "temp", Value: 20},
+                {DeviceID: "d1", Timestamp: 100, Sensor: "humidity", Value: 30},
+            }},
+            wantError: "same sensor",
+        },
+        {
+            name:   "MatchingReadings",
+            device: device,
+            evidence: MisbehaviourEvidence{Type: EvidenceConflictingReadings, Claims: []SignedClaim{
+                {DeviceID: "d1", Timestamp: 100, Sensor: "temp", Value: 20},
+                {DeviceID: "d1", Timestamp: 100, Sensor: "temp", Value: 20},
+            }},
+            wantError: "do not conflict",
+        },
+        {
+            name:   "ImpossibleTravel",
+            device: device,
+            evidence: MisbehaviourEvidence{Type: EvidenceImpossibleTravel, Claims: []SignedClaim{
+                {DeviceID: "d1", Timestamp: 100, Latitude: 0, Longitude: 0},
+                {DeviceID: "d1", Timestamp: 160, Latitude: 1, Longitude: 0},
+            }},
+        },
+        {
+            name:   "PossibleTravel",
+            device: device,
+            evidence: MisbehaviourEvidence{Type: EvidenceImpossibleTravel, Claims: []SignedClaim{
+                {DeviceID: "d1", Timestamp: 100, Latitude: 0, Longitude: 0},
+                {DeviceID: "d1", Timestamp: 3700, Latitude: 1, Longitude: 0},
+            }},
+            wantError: "is possible",
+        },
+        {
+            name:   "TravelAtTheSameTime",
+            device: device,
+            evidence: MisbehaviourEvidence{Type: EvidenceImpossibleTravel, Claims: []SignedClaim{
+                {DeviceID: "d1", Timestamp: 100, Latitude: 0, Longitude: 0},
+                {DeviceID: "d1", Timestamp: 100, Latitude: 1, Longitude: 0},
+            }},
+            wantError: "different times",
+        },
+        {
+            name:   "SignedByAnotherKey",
+            device: device,
+            signer: otherKey,
+            evidence: MisbehaviourEvidence{Type: EvidenceConflictingReadings, Claims: []SignedClaim{
+                {DeviceID: "d1", Timestamp: 100, Sensor: "temp", Value: 20},
+                {DeviceID: "d1", Timestamp: 100, Sensor: "temp", Value: 30},
+            }},
+            wantError: "does not verify",
+        },
+        {
+            name:   "DeviceWithoutKey",
+            device: &DeviceState{ID: "d1"},
+            evidence: MisbehaviourEvidence{Type: EvidenceConflictingReadings, Claims: []SignedClaim{
+                {DeviceID: "d1", Timestamp: 100, Sensor: "temp", Value: 20},
+                {DeviceID: "d1", Timestamp: 100, Sensor: "temp", Value: 30},
+            }},
+            wantError: "no registered key",
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            signer := tt.signer
+            if signer == nil {
+                signer = key
+            }
+            for i, claim := range tt.evidence.Claims {
+                tt.evidence.Claims[i] = signClaim(t, signer, claim)
+            }
+
+            err := verifyEvidence(tt.device, tt.evidence)
+            if tt.wantError == "" {
+                assert.NoError(t, err)
+            } else {
+                assert.ErrorContains(t, err, tt.wantError)
+            }
+        })
+    }
+}
+
+func TestEvidenceDigestIgnoresTypeAndOrder(t *testing.T) {
+    key, _ := testDeviceKey(t, "d1")
+    a := signClaim(t, key, SignedClaim{DeviceID: "d1", Timestamp: 100, Latitude: 0})
+    b := signClaim(t, key, SignedClaim{DeviceID: "d1", Timestamp: 100, Latitude: 1})
+
+    first, err := evidenceDigest(MisbehaviourEvidence{Type: EvidenceDoubleSignedLocation, Claims: []SignedClaim{a, b}})
+    require.NoError(t, err)
+    second, err := evidenceDigest(MisbehaviourEvidence{Type: EvidenceImpossibleTravel, Claims: []SignedClaim{b, a}})
+    require.NoError(t, err)
+    assert.Equal(t, first, second)
+}
@@ -1,8 +1,8 @@
 package main
 
 import (
-    "encoding/json"
 	"fmt"
+    "time"
     "github.com/hyperledger/fabric-contract-api-go/contractapi"
 )
  
@@ -11,99 +11,160 @@ type SmartContract struct {
     contractapi.Contract
 }
 
-// Device represents an IoT device with location and reputation
+// Device is the summary of an IoT device SmartContract returns. Devices are
+// stored as DeviceState; records written before that have this form.
 type Device struct {
-    ID         string  `json:"id"`
-    Location   string  `json:"location"`
-    Reputation float64 `json:"reputation"`
-    LastUpdate int64   `json:"lastUpdate"`
-    ZoneID     string  `json:"zoneId"`
+    ID           string  `json:"id"`
+    Location     string  `json:"location"`
+    Reputation   float64 `json:"reputation"`
+    LastUpdate   int64   `json:"lastUpdate"`
+    ZoneID       string  `json:"zoneId"`
+    Sponsor      string  `json:"sponsor"`
+    RegisteredAt int64   `json:"registeredAt"`
+    Owner        string  `json:"owner"`
 }
 
-// InitLedger adds a base set of devices to the ledger
+// InitLedger adds a base set of devices and the default bootstrap policy to
+// the ledger. Admin only, and only on a ledger holding neither.
 func (s *SmartContract) InitLedger(ctx contractapi.TransactionContextInterface) error {
-    devices := []Device{
+    if err := assertRole(ctx, RoleAdmin); err != nil {
+        return err
+    }
+    policyKey, err := ctx.GetStub().CreateCompositeKey(configObjectType, []string{"bootstrap"})
+    if err != nil {
+        return err
+    }
+    policyJSON, err := ctx.GetStub().GetState(policyKey)
+    if err != nil {
+        return fmt.Errorf("failed to read from world state: %v", err)
+    }
+    if len(policyJSON) != 0 {
+        return fmt.Errorf("the ledger already has a bootstrap policy")
+    }
+
+    policy := defaultBootstrapPolicy
+    owner, err := callerID(ctx)
+    if err != nil {
+        return err
+    }
+    devices := []DeviceState{
         {
-            ID:         "device1",
-            Location:   "zone1",
-            Reputation: 1.0,
-            LastUpdate: 1635724800,
-            ZoneID:     "Z1",
+            ID:           "device1",
+            Location:     "zone1",
+            ZoneID:       "Z1",
+            Reputation:   policy.InitialReputation,
+            Status:       "active",
+            LastUpdate:   time.Unix(1635724800, 0).UTC(),
+            RegisteredAt: 1635724800,
+            Owner:        owner,
         },
     }
 
-    for _, device := range devices {
-        deviceJSON, err := json.Marshal(device)
+    records := make([]deviceRecord, len(devices))
+    for i := range devices {
+        existing, err := ctx.GetStub().GetState(devices[i].ID)
         if err != nil {
-            return err
+            return fmt.Errorf("failed to read from world state: %v", err)
         }
-
-        err = ctx.GetStub().PutState(device.ID, deviceJSON)
-        if err != nil {
-            return fmt.Errorf("failed to put to world state: %v", err)
+        if len(existing) != 0 {
+            return fmt.Errorf("the device %s already exists", devices[i].ID)
         }
+        records[i] = &devices[i]
+    }
+    if err := putBootstrapPolicy(ctx, &policy); err != nil {
+        return fmt.Errorf("failed to put to world state: %v", err)
+    }
+    if err := putDeviceRecords(ctx, records...); err != nil {
+        return fmt.Errorf("failed to put to world state: %v", err)
     }
 
     return nil
 }
 
-// RegisterDevice adds a new device to the world state
-func (s *SmartContract) RegisterDevice(ctx contractapi.TransactionContextInterface, id string, location string, zoneId string) error {
-    device := Device{
-        ID:         id,
-        Location:   location,
-        Reputation: 1.0, // Initial reputation
-        LastUpdate: ctx.GetStub().GetTxTimestamp().Seconds,
-        ZoneID:     zoneId,
+// RegisterDevice adds a new device to the world state. The device must be
+// vouched for by sponsorId, or by an admin when sponsorId is empty.
+func (s *SmartContract) RegisterDevice(ctx contractapi.TransactionContextInterface, id string, location string, zoneId string, sponsorId string) error {
+    existing, err := ctx.GetStub().GetState(id)
+    if err != nil {
+        return fmt.Errorf("failed to read from world state: %v", err)
+    }
+    if len(existing) != 0 {
+        return fmt.Errorf("the device %s already exists", id)
     }
 
-    deviceJSON, err := json.Marshal(device)
+    policy, err := getBootstrapPolicy(ctx)
     if err != nil {
         return err
     }
+    if err := checkSponsor(ctx, sponsorId, policy); err != nil {
+        return err
+    }
+    owner, err := callerID(ctx)
+    if err != nil {
+        return err
+    }
+    timestamp, err := ctx.GetStub().GetTxTimestamp()
+    if err != nil {
+        return err
+    }
+
+    device := DeviceState{
+        ID:           id,
+        Location:     location,
+        ZoneID:       zoneId,
+        Reputation:   policy.InitialReputation, // Probationary reputation
+        Status:       "active",
+        LastUpdate:   time.Unix(timestamp.Seconds, 0).UTC(),
+        Sponsor:      sponsorId,
+        RegisteredAt: timestamp.Seconds,
+        Owner:        owner,
+    }
 
-    return ctx.GetStub().PutState(id, deviceJSON)
+    return putDeviceRecords(ctx, &device)
 }
 
 // QueryDevice returns the device stored in the world state with given id
 func (s *SmartContract) QueryDevice(ctx contractapi.TransactionContextInterface, id string) (*Device, error) {
-    deviceJSON, err := ctx.GetStub().GetState(id)
-    if err != nil {
-        return nil, fmt.Errorf("failed to read from world state: %v", err)
-    }
-    if deviceJSON == nil {
-        return nil, fmt.Errorf("the device %s does not exist", id)
-    }
-
-    var device Device
-    err = json.Unmarshal(deviceJSON, &device)
+    device, err := getDeviceState(ctx, id)
     if err != nil {
         return nil, err
     }
 
-    return &device, nil
+    return &Device{
+        ID:           device.ID,
+        Location:     device.Location,
+        Reputation:   device.Reputation,
+        LastUpdate:   device.LastUpdate.Unix(),
+        ZoneID:       device.ZoneID,
+        Sponsor:      device.Sponsor,
+        RegisteredAt: device.RegisteredAt,
+        Owner:        device.Owner,
+    }, nil
 }
 
 // UpdateDeviceReputation updates the reputation of a device
 func (s *SmartContract) UpdateDeviceReputation(ctx contractapi.TransactionContextInterface, id string, newReputation float64) error {
-    device, err := s.QueryDevice(ctx, id)
+    if newReputation < 0 || newReputation > 1 {
+        return fmt.Errorf("reputation must be between 0 and 1")
+    }
+
+    device, err := getDeviceState(ctx, id)
     if err != nil {
         return err
     }
 
-    device.Reputation = newReputation
-    device.LastUpdate = ctx.GetStub().GetTxTimestamp().Seconds
-
-    deviceJSON, err := json.Marshal(device)
+    timestamp, err := ctx.GetStub().GetTxTimestamp()
     if err != nil {
         return err
     }
+    device.Reputation = newReputation
+    device.LastUpdate = time.Unix(timestamp.Seconds, 0).UTC()
 
-    return ctx.GetStub().PutState(id, deviceJSON)
+    return putDeviceRecords(ctx, device)
 }
 
 func main() {
-    chaincode, err := contractapi.NewChaincode(&SmartContract{})
+    chaincode, err := contractapi.NewChaincode(&SmartContract{}, &DeviceManager{})
     if err != nil {
         fmt.Printf("Error creating chaincode: %s", err.Error())
         return
@@ -2,14 +2,24 @@ package main
 
 import (
     "encoding/json"
+    "fmt"
     "testing"
     "time"
+    "github.com/golang/protobuf/ptypes/timestamp"
+    "github.com/stretchr/testify/require"
     "github.com/stretchr/testify/assert"
     "github.com/stretchr/testify/mock"
+    "github.com/hyperledger/fabric-chaincode-go/pkg/cid"
     "github.com/hyperledger/fabric-chaincode-go/shim"
     "github.com/hyperledger/fabric-contract-api-go/contractapi"
 )
 
+// testTxTime is the transaction timestamp MockStub reports
+const testTxTime = 1635724800
+
+// testOwner is the client identity tests invoke as
+const testOwner = "x509::CN=owner"
+
 // MockStub implements the chaincode stub interface
 type MockStub struct {
     mock.Mock
@@ -26,8 +36,56 @@ func (ms *MockStub) PutState(key string, value []byte) error {
     return args.Error(0)
 }
 
+func (ms *MockStub) DelState(key string) error {
+    args := ms.Called(key)
+    return args.Error(0)
+}
+
+func (ms *MockStub) CreateCompositeKey(objectType string, attributes []string) (string, error) {
+    return shim.CreateCompositeKey(objectType, attributes)
+}
+
 func (ms *MockStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
-    return &timestamp.Timestamp{Seconds: time.Now().Unix()}, nil
+    return &timestamp.Timestamp{Seconds: testTxTime}, nil
+}
+
+// MockClientIdentity is a caller with a fixed ID and role
+type MockClientIdentity struct {
+    cid.ClientIdentity
+    id   string
+    role string
+}
+
+func (mci *MockClientIdentity) GetID() (string, error) {
+    return mci.id, nil
+}
+
+func (mci *MockClientIdentity) AssertAttributeValue(attrName, attrValue string) error {
+    if attrName != "role" || attrValue != mci.role {
+        return fmt.Errorf("attribute %s is not %s", attrName, attrValue)
+    }
+    return nil
+}
+
+// newTestContext wraps a stub in a transaction context invoked by testOwner
+func newTestContext(stub *MockStub) *contractapi.TransactionContext {
+    ctx := new(contractapi.TransactionContext)
+    ctx.SetStub(stub)
+    ctx.SetClientIdentity(&MockClientIdentity{id: testOwner})
+    return ctx
+}
+
+// expectZoneEntry expects a device to be counted in its zone statistics
+func expectZoneEntry(t *testing.T, ctx *contractapi.TransactionContext, stub *MockStub, member *zoneMember) {
+    bucketKey, err := zoneBucketKey(ctx, member)
+    assert.NoError(t, err)
+    rankKeys, err := zoneRankKeys(ctx, member)
+    assert.NoError(t, err)
+    stub.On("GetState", bucketKey).Return([]byte(nil), nil)
+    stub.On("PutState", bucketKey, mock.Anything).Return(nil)
+    for _, key := range rankKeys {
+        stub.On("PutState", key, mock.Anything).Return(nil)
+    }
 }
 
 // Test cases
@@ -36,28 +94,49 @@ func TestSmartContract(t *testing.T) {
         // Test successful device registration
         t.Run("Success", func(t *testing.T) {
             contract := new(SmartContract)
-            ctx := new(MockStub)
+            stub := new(MockStub)
+            ctx := newTestContext(stub)
 
-            device := Device{
+            device := DeviceState{
                 ID: "test-device",
                 Location: "test-zone",
-                Reputation: 1.0,
                 ZoneID: "Z1",
+                Reputation: defaultBootstrapPolicy.InitialReputation,
+                Status: "active",
+                LastUpdate: time.Unix(testTxTime, 0).UTC(),
+                Sponsor: "sponsor-device",
+                RegisteredAt: testTxTime,
+                Owner: testOwner,
+            }
+            sponsor := Device{
+                ID: "sponsor-device",
+                Reputation: 0.9,
+                ZoneID: "Z1",
+                Owner: testOwner,
             }
 
             deviceJSON, _ := json.Marshal(device)
-            ctx.On("GetState", "test-device").Return([]byte{}, nil)
-            ctx.On("PutState", "test-device", deviceJSON).Return(nil)
+            sponsorJSON, _ := json.Marshal(sponsor)
+            policyKey, _ := shim.CreateCompositeKey(configObjectType, []string{"bootstrap"})
+            sponsorshipKey, _ := shim.CreateCompositeKey(sponsorshipObjectType, []string{"sponsor-device"})
+            stub.On("GetState", "test-device").Return([]byte{}, nil)
+            stub.On("GetState", policyKey).Return([]byte(nil), nil)
+            stub.On("GetState", "sponsor-device").Return(sponsorJSON, nil)
+            stub.On("GetState", sponsorshipKey).Return([]byte(nil), nil)
+            stub.On("PutState", sponsorshipKey, []byte("1")).Return(nil)
+            stub.On("PutState", "test-device", deviceJSON).Return(nil)
+            expectZoneEntry(t, ctx, stub, &zoneMember{ID: "test-device", ZoneID: "Z1", Reputation: device.Reputation})
 
-            err := contract.RegisterDevice(ctx, "test-device", "test-zone", "Z1")
+            err := contract.RegisterDevice(ctx, "test-device", "test-zone", "Z1", "sponsor-device")
             assert.NoError(t, err)
-            ctx.AssertExpectations(t)
+            stub.AssertExpectations(t)
         })
 
         // Test duplicate device registration
         t.Run("DuplicateDevice", func(t *testing.T) {
             contract := new(SmartContract)
-            ctx := new(MockStub)
+            stub := new(MockStub)
+            ctx := newTestContext(stub)
 
             existingDevice := Device{
                 ID: "test-device",
@@ -66,9 +145,9 @@ func TestSmartContract(t *testing.T) {
             }
             deviceJSON, _ := json.Marshal(existingDevice)
 
-            ctx.On("GetState", "test-device").Return(deviceJSON, nil)
+            stub.On("GetState", "test-device").Return(deviceJSON, nil)
 
-            err := contract.RegisterDevice(ctx, "test-device", "test-zone", "Z1")
+            err := contract.RegisterDevice(ctx, "test-device", "test-zone", "Z1", "sponsor-device")
             assert.Error(t, err)
             assert.Contains(t, err.Error(), "already exists")
         })
@@ -78,7 +157,8 @@ func TestSmartContract(t *testing.T) {
         // Test successful device query
         t.Run("Success", func(t *testing.T) {
             contract := new(SmartContract)
-            ctx := new(MockStub)
+            stub := new(MockStub)
+            ctx := newTestContext(stub)
 
             device := Device{
                 ID: "test-device",
@@ -87,7 +167,7 @@ func TestSmartContract(t *testing.T) {
             }
             deviceJSON, _ := json.Marshal(device)
 
-            ctx.On("GetState", "test-device").Return(deviceJSON, nil)
+            stub.On("GetState", "test-device").Return(deviceJSON, nil)
 
             result, err := contract.QueryDevice(ctx, "test-device")
             assert.NoError(t, err)
@@ -98,9 +178,10 @@ func TestSmartContract(t *testing.T) {
         // Test query non-existent device
         t.Run("DeviceNotFound", func(t *testing.T) {
             contract := new(SmartContract)
-            ctx := new(MockStub)
+            stub := new(MockStub)
+            ctx := newTestContext(stub)
 
-            ctx.On("GetState", "non-existent").Return([]byte{}, nil)
+            stub.On("GetState", "non-existent").Return([]byte{}, nil)
 
             result, err := contract.QueryDevice(ctx, "non-existent")
             assert.Error(t, err)
@@ -112,33 +193,155 @@ func TestSmartContract(t *testing.T) {
         // Test successful reputation update
         t.Run("Success", func(t *testing.T) {
             contract := new(SmartContract)
-            ctx := new(MockStub)
+            stub := new(MockStub)
+            ctx := newTestContext(stub)
 
             device := Device{
                 ID: "test-device",
                 Location: "test-zone",
                 Reputation: 1.0,
+                ZoneID: "Z1",
             }
             deviceJSON, _ := json.Marshal(device)
 
-            updatedDevice := device
-            updatedDevice.Reputation = 0.9
+            // The record is rewritten in the schema both contracts share
+            updatedDevice := DeviceState{
+                ID: "test-device",
+                Location: "test-zone",
+                ZoneID: "Z1",
+                Reputation: 0.9,
+                LastUpdate: time.Unix(testTxTime, 0).UTC(),
+            }
             updatedDeviceJSON, _ := json.Marshal(updatedDevice)
 
-            ctx.On("GetState", "test-device").Return(deviceJSON, nil)
-            ctx.On("PutState", "test-device", updatedDeviceJSON).Return(nil)
+            // The device moves from its old statistics entry to a new one
+            previous := &zoneMember{ID: "test-device", ZoneID: "Z1", Reputation: 1.0}
+            previousBucketKey, _ := zoneBucketKey(ctx, previous)
+            previousRankKeys, _ := zoneRankKeys(ctx, previous)
+            stub.On("GetState", "test-device").Return(deviceJSON, nil)
+            stub.On("PutState", "test-device", updatedDeviceJSON).Return(nil)
+            stub.On("GetState", previousBucketKey).Return([]byte(nil), nil)
+            stub.On("PutState", previousBucketKey, mock.Anything).Return(nil)
+            for _, key := range previousRankKeys {
+                stub.On("DelState", key).Return(nil)
+            }
+            expectZoneEntry(t, ctx, stub, &zoneMember{ID: "test-device", ZoneID: "Z1", Reputation: 0.9})
 
             err := contract.UpdateDeviceReputation(ctx, "test-device", 0.9)
             assert.NoError(t, err)
+            stub.AssertExpectations(t)
         })
 
         // Test invalid reputation value
         t.Run("InvalidReputation", func(t *testing.T) {
             contract := new(SmartContract)
-            ctx := new(MockStub)
+            stub := new(MockStub)
+            ctx := newTestContext(stub)
 
             err := contract.UpdateDeviceReputation(ctx, "test-device", 1.5)
             assert.Error(t, err)
         })
     })
-}
\ No newline at end of file
+}
+
+func TestDeviceContractsShareRecords(t *testing.T) {
+    ctx, stub := newZoneStatsContext()
+    ctx.SetClientIdentity(&MockClientIdentity{id: testOwner, role: RoleAdmin})
+    contract := new(SmartContract)
+    dm := new(DeviceManager)
+
+    // One device registered through SmartContract, one stored in its
+    // earlier record form
+    stub.MockTransactionStart("register")
+    require.NoError(t, contract.RegisterDevice(ctx, "a", "zone1", "Z1", ""))
+    require.NoError(t, putDeviceRecords(ctx, &Device{ID: "b", ZoneID: "Z1", Reputation: 0.6, LastUpdate: testTxTime, Owner: testOwner}))
+    stub.MockTransactionEnd("register")
+
+    stub.MockTransactionStart("rate")
+    require.NoError(t, dm.RateInteraction(ctx, "a", "b", true))
+    require.NoError(t, dm.RateInteraction(ctx, "b", "a", true))
+    require.NoError(t, dm.ComputeTrustScores(ctx))
+    stub.MockTransactionEnd("rate")
+
+    for _, id := range []string{"a", "b"} {
+        device, err := dm.GetDevice(ctx, id)
+        require.NoError(t, err)
+        assert.Greater(t, device.TrustScore, 0.0, "trust score of %s", id)
+    }
+    legacy, err := dm.GetDevice(ctx, "b")
+    require.NoError(t, err)
+    assert.Equal(t, time.Unix(testTxTime, 0).UTC(), legacy.LastUpdate)
+
+    // SmartContract keeps what DeviceManager recorded
+    stub.MockTransactionStart("update")
+    require.NoError(t, contract.UpdateDeviceReputation(ctx, "a", 0.5))
+    stub.MockTransactionEnd("update")
+    device, err := dm.GetDevice(ctx, "a")
+    require.NoError(t, err)
+    assert.Equal(t, 0.5, device.Reputation)
+    assert.Greater(t, device.TrustScore, 0.0)
+    assert.Equal(t, "active", device.Status)
+    summary, err := contract.QueryDevice(ctx, "a")
+    require.NoError(t, err)
+    assert.Equal(t, 0.5, summary.Reputation)
+}
+
+func TestInitLedger(t *testing.T) {
+    ctx, stub := newZoneStatsContext()
+    contract := new(SmartContract)
+    dm := new(DeviceManager)
+
+    stub.MockTransactionStart("init")
+    ctx.SetClientIdentity(&MockClientIdentity{id: "x509::CN=intruder"})
+    assert.Error(t, contract.InitLedger(ctx), "InitLedger by a non-admin")
+    ctx.SetClientIdentity(&MockClientIdentity{id: testOwner, role: RoleAdmin})
+    require.NoError(t, contract.InitLedger(ctx))
+    stub.MockTransactionEnd("init")
+
+    stub.MockTransactionStart("policy")
+    require.NoError(t, dm.SetBootstrapPolicy(ctx, `{"initialReputation":0.5,"minSponsorReputation":0.9,"maxSponsorships":1}`))
+    stub.MockTransactionEnd("policy")
+
+    // Running it again would restore the default policy
+    stub.MockTransactionStart("again")
+    assert.Error(t, contract.InitLedger(ctx))
+    stub.MockTransactionEnd("again")
+    policy, err := dm.GetBootstrapPolicy(ctx)
+    require.NoError(t, err)
+    assert.Equal(t, 0.5, policy.InitialReputation)
+
+    device, err := dm.GetDevice(ctx, "device1")
+    require.NoError(t, err)
+    assert.Equal(t, testOwner, device.Owner)
+}
+
+func TestSmartContractDevicesBecomeLeadershipEligible(t *testing.T) {
+    ctx, stub := newZoneStatsContext()
+    ctx.SetClientIdentity(&MockClientIdentity{id: testOwner, role: RoleAdmin})
+    contract := new(SmartContract)
+    dm := new(DeviceManager)
+
+    stub.MockTransactionStart("register")
+    require.NoError(t, dm.SetBootstrapPolicy(ctx, `{"initialReputation":0.3,"minLeaderTransactions":2,"maxSponsorships":1}`))
+    require.NoError(t, contract.RegisterDevice(ctx, "a", "zone1", "Z1", ""))
+    require.NoError(t, putDeviceRecords(ctx, &Device{ID: "b", ZoneID: "Z1", Reputation: 0.6, LastUpdate: testTxTime}))
+    stub.MockTransactionEnd("register")
+
+    for _, id := range []string{"a", "b"} {
+        stub.MockTransactionStart("check-" + id)
+        eligible, err := dm.IsLeadershipEligible(ctx, id)
+        require.NoError(t, err)
+        assert.False(t, eligible, "%s eligible before recording transactions", id)
+        for i := 0; i < 2; i++ {
+            require.NoError(t, dm.RecordTransaction(ctx, id, "read", "success", 100))
+        }
+        stub.MockTransactionEnd("check-" + id)
+
+        stub.MockTransactionStart("update-" + id)
+        require.NoError(t, contract.UpdateDeviceReputation(ctx, id, 0.7))
+        eligible, err = dm.IsLeadershipEligible(ctx, id)
+        require.NoError(t, err)
+        assert.True(t, eligible, "%s eligible after recording transactions", id)
+        stub.MockTransactionEnd("update-" + id)
+    }
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "math"
+    "sort"
+    "github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const trustEdgeObjectType = "trustEdge"
+
+// EigenTrust parameters
+const (
+    trustPreTrustWeight = 0.15 // share of trust always routed through the pre-trusted distribution
+    trustEpsilon        = 1e-6
+    trustMaxIterations  = 50
+)
+
+// TrustEdge aggregates the ratings one device has given another
+type TrustEdge struct {
+    Rater       string `json:"rater"`
+    Ratee       string `json:"ratee"`
+    Satisfied   int    `json:"satisfied"`
+    Unsatisfied int    `json:"unsatisfied"`
+    LastUpdate  int64  `json:"lastUpdate"`
+}
+
+// RateInteraction records the outcome of an interaction between two devices.
+// Only the rater's owner may rate on its behalf.
+func (dm *DeviceManager) RateInteraction(ctx contractapi.TransactionContextInterface, raterId string, rateeId string, satisfied bool) error {
+    if raterId == rateeId {
+        return fmt.Errorf("device %s cannot rate itself", raterId)
+    }
+    rater, err := dm.GetDevice(ctx, raterId)
+    if err != nil {
+        return err
+    }
+    if err := assertDeviceOwner(ctx, rater); err != nil {
+        return err
+    }
+    exists, err := dm.DeviceExists(ctx, rateeId)
+    if err != nil {
+        return err
+    }
+    if !exists {
+        return fmt.Errorf("device does not exist: %s", rateeId)
+    }
+
+    key, err := ctx.GetStub().CreateCompositeKey(trustEdgeObjectType, []string{raterId, rateeId})
+    if err != nil {
+        return err
+    }
+    edgeJSON, err := ctx.GetStub().GetState(key)
+    if err != nil {
+        return fmt.Errorf("failed to read trust edge: %v", err)
+    }
+
+    edge := TrustEdge{Rater: raterId, Ratee: rateeId}
+    if edgeJSON != nil {
+        if err := json.Unmarshal(edgeJSON, &edge); err != nil {
+            return err
+        }
+    }
+
+    if satisfied {
+        edge.Satisfied++
+    } else {
+        edge.Unsatisfied++
+    }
+    timestamp, err := ctx.GetStub().GetTxTimestamp()
+    if err != nil {
+        return err
+    }
+    edge.LastUpdate = timestamp.Seconds
+
+    edgeJSON, err = json.Marshal(edge)
+    if err != nil {
+        return err
+    }
+
+    return ctx.GetStub().PutState(key, edgeJSON)
+}
+
+// GetTrustEdges returns the ratings issued by a device, or every rating when raterId is empty
+func (dm *DeviceManager) GetTrustEdges(ctx contractapi.TransactionContextInterface, raterId string) ([]*TrustEdge, error) {
+    attributes := []string{}
+    if raterId != "" {
+        attributes = append(attributes, raterId)
+    }
+
+    resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(trustEdgeObjectType, attributes)
+    if err != nil {
+        return nil, err
+    }
+    defer resultsIterator.Close()
+
+    var edges []*TrustEdge
+    for resultsIterator.HasNext() {
+        queryResult, err := resultsIterator.Next()
+        if err != nil {
+            return nil, err
+        }
+
+        var edge TrustEdge
+        err = json.Unmarshal(queryResult.Value, &edge)
+        if err != nil {
+            return nil, err
+        }
+        edges = append(edges, &edge)
+    }
+
+    return edges, nil
+}
+
+// ComputeTrustScores runs EigenTrust over the rating graph and writes the
+// resulting TrustScore back to every rated device. Admin only; meant to be
+// invoked on a schedule.
+func (dm *DeviceManager) ComputeTrustScores(ctx contractapi.TransactionContextInterface) error {
+    if err := assertRole(ctx, RoleAdmin); err != nil {
+        return err
+    }
+
+    edges, err := dm.GetTrustEdges(ctx, "")
+    if err != nil {
+        return err
+    }
+
+    scores := computeEigenTrust(edges)
+
+    // Iterate in a fixed order so every endorser produces the same write set
+    ids := make([]string, 0, len(scores))
+    for id := range scores {
+        ids = append(ids, id)
+    }
+    sort.Strings(ids)
+
+    devices := make([]*DeviceState, 0, len(ids))
+    for _, id := range ids {
+        device, err := dm.GetDevice(ctx, id)
+        if err != nil {
+            return err
+        }
+        device.TrustScore = scores[id]
+        devices = append(devices, device)
+    }
+
+    return dm.putDevices(ctx, devices...)
+}
+
+// computeEigenTrust returns the global trust of every device in the rating
+// graph, scaled so the most trusted device scores 1.0. Local trust is the
+// positive part of satisfied minus unsatisfied ratings, normalized per rater;
+// devices without outgoing trust defer to the uniform pre-trusted distribution.
+func computeEigenTrust(edges []*TrustEdge) map[string]float64 {
+    index := make(map[string]int)
+    var peers []string
+    for _, edge := range edges {
+        for _, id := range []string{edge.Rater, edge.Ratee} {
+            if _, ok := index[id]; !ok {
+                index[id] = len(peers)
+                peers = append(peers, id)
+            }
+        }
+    }
+    n := len(peers)
+    if n == 0 {
+        return map[string]float64{}
+    }
+
+    local := make([]map[int]float64, n)
+    rowSum := make([]float64, n)
+    for _, edge := range edges {
+        i, j := index[edge.Rater], index[edge.Ratee]
+        s := float64(edge.Satisfied - edge.Unsatisfied)
+        if i == j || s <= 0 {
+            continue
+        }
+        if local[i] == nil {
+            local[i] = make(map[int]float64)
+        }
+        local[i][j] += s
+        rowSum[i] += s
+    }
+
+    preTrust := 1.0 / float64(n)
+    trust := make([]float64, n)
+    for i := range trust {
+        trust[i] = preTrust
+    }
+
+    for iter := 0; iter < trustMaxIterations; iter++ {
+        next := make([]float64, n)
+        dangling := 0.0
+        for i := 0; i < n; i++ {
+            if rowSum[i] == 0 {
+                dangling += trust[i]
+                continue
+            }
+            for j, s := range local[i] {
+                next[j] += trust[i] * s / rowSum[i]
+            }
+        }
+
+        delta := 0.0
+        for j := range next {
+            next[j] = (1-trustPreTrustWeight)*(next[j]+dangling*preTrust) + trustPreTrustWeight*preTrust
+            delta += math.Abs(next[j] - trust[j])
+        }
+        trust = next
+        if delta < trustEpsilon {
+            break
+        }
+    }
+
+    maxTrust := 0.0
+    for _, t := range trust {
+        maxTrust = math.Max(maxTrust, t)
+    }
+
+    scores := make(map[string]float64, n)
+    for i, id := range peers {
+        scores[id] = trust[i] / maxTrust
+    }
+    return scores
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+    "testing"
+    "github.com/stretchr/testify/assert"
+)
+
+func TestComputeEigenTrust(t *testing.T) {
+    tests := []struct {
+        name  string
+        edges []*TrustEdge
+        check func(t *testing.T, scores map[string]float64)
+    }{
+        {
+            name:  "NoRatings",
+            edges: nil,
+            check: func(t *testing.T, scores map[string]float64) {
+                assert.Empty(t, scores)
+            },
+        },
+        {
+            name:  "RateeIsMostTrusted",
+            edges: []*TrustEdge{{Rater: "a", Ratee: "b", Satisfied: 3}},
+            check: func(t *testing.T, scores map[string]float64) {
+                assert.InDelta(t, 1.0, scores["b"], 1e-9)
+                assert.Less(t, scores["a"], scores["b"])
+                assert.Greater(t, scores["a"], 0.0)
+            },
+        },
+        {
+            name:  "NetNegativeRatingsAreIgnored",
+            edges: []*TrustEdge{{Rater: "a", Ratee: "b", Satisfied: 1, Unsatisfied: 4}},
+            check: func(t *testing.T, scores map[string]float64) {
+                assert.InDelta(t, 1.0, scores["a"], 1e-9)
+                assert.InDelta(t, 1.0, scores["b"], 1e-9)
+            },
+        },
+        {
+            name: "SelfRatingsAreIgnored",
+            edges: []*TrustEdge{
+                {Rater: "a", Ratee: "a", Satisfied: 100},
+                {Rater: "b", Ratee: "c", Satisfied: 1},
+            },
+            check: func(t *testing.T, scores map[string]float64) {
+                assert.InDelta(t, 1.0, scores["c"], 1e-9)
+                assert.InDelta(t, scores["a"], scores["b"], 1e-9)
+            },
+        },
+        {
+            name: "MutualRatingsAreSymmetric",
+            edges: []*TrustEdge{
+                {Rater: "a", Ratee: "b", Satisfied: 2},
+                {Rater: "b", Ratee: "a", Satisfied: 2},
+            },
+            check: func(t *testing.T, scores map[string]float64) {
+                assert.InDelta(t, 1.0, scores["a"], 1e-9)
+                assert.InDelta(t, 1.0, scores["b"], 1e-9)
+            },
+        },
+        {
+            name: "TrustFlowsThroughTrustedRaters",
+            edges: []*TrustEdge{
+                {Rater: "a", Ratee: "b", Satisfied: 5},
+                {Rater: "c", Ratee: "b", Satisfied: 5},
+                {Rater: "b", Ratee: "d", Satisfied: 1},
+                {Rater: "a", Ratee: "e", Satisfied: 1},
+            },
+            check: func(t *testing.T, scores map[string]float64) {
+                assert.Greater(t, scores["d"], scores["e"])
+            },
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            scores := computeEigenTrust(tt.edges)
+            for id, score := range scores {
+                assert.GreaterOrEqual(t, score, 0.0, id)
+                assert.LessOrEqual(t, score, 1.0+1e-9, id)
+            }
+            tt.check(t, scores)
+        })
+    }
+}
@@ -0,0 +1,658 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "hash/fnv"
+    "math"
+    "sort"
+    "strconv"
+    "github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Zone statistics are kept in three kinds of record, so that a device write
+// only touches records of its own and reading a zone's statistics never
+// scans every device:
+//   - two rank entries per device, keyed by zone and reputation so that
+//     devices come back in ascending and descending reputation order
+//   - a histogram of the zone's reputations, each bucket split into shards
+//     by device so that concurrent writes rarely touch the same record, and
+//     counting the devices at each reputation so that order statistics are
+//     read from the histogram alone
+const (
+    zoneBucketObjectType   = "zoneBucket"
+    zoneRankObjectType     = "zoneRank"
+    zoneRankDescObjectType = "zoneRankDesc"
+)
+
+// zoneHistogramBuckets divides reputations in [0, 1] into buckets 0.01 wide,
+// with reputation 1.0 in a bucket of its own
+const zoneHistogramBuckets = 101
+
+// zoneBucketShards is how many records each histogram bucket is split into
+const zoneBucketShards = 8
+
+// zoneLeaderboardSize is how many devices the top and bottom lists hold
+const zoneLeaderboardSize = 10
+
+// zonePercentiles are the reputation percentiles reported for a zone
+var zonePercentiles = []int{10, 25, 75, 90, 99}
+
+// DeviceReputation pairs a device with its reputation
+type DeviceReputation struct {
+    DeviceID   string  `json:"deviceId"`
+    Reputation float64 `json:"reputation"`
+}
+
+// ZoneBucket is one shard of a zone's reputation histogram bucket
+type ZoneBucket struct {
+    Count         int            `json:"count"`
+    ReputationSum float64        `json:"reputationSum"`
+    StatusCounts  map[string]int `json:"statusCounts"`
+    Reputations   map[string]int `json:"reputations"` // Devices at each reputation, see reputationValue
+}
+
+// ZoneStatistics is the reputation summary returned for a zone
+type ZoneStatistics struct {
+    ZoneID           string             `json:"zoneId"`
+    DeviceCount      int                `json:"deviceCount"`
+    StatusCounts     map[string]int     `json:"statusCounts"`
+    MeanReputation   float64            `json:"meanReputation"`
+    MedianReputation float64            `json:"medianReputation"`
+    Percentiles      map[string]float64 `json:"percentiles"` // "p10", "p25", ...
+    TopDevices       []DeviceReputation `json:"topDevices"`
+    BottomDevices    []DeviceReputation `json:"bottomDevices"`
+}
+
+// zoneMember is the part of a device record zone statistics are kept over.
+// It decodes devices stored by either contract.
+type zoneMember struct {
+    ID         string  `json:"id"`
+    ZoneID     string  `json:"zoneId"`
+    Status     string  `json:"status"`
+    Reputation float64 `json:"reputation"`
+}
+
+// status returns the member's status; devices registered through
+// SmartContract carry none and count as active
+func (m *zoneMember) status() string {
+    if m.Status == "" {
+        return "active"
+    }
+    return m.Status
+}
+
+// zoneHistogram is a zone's reputation histogram with its shards merged
+type zoneHistogram struct {
+    counts        [zoneHistogramBuckets]int
+    reputations   [zoneHistogramBuckets]map[float64]int
+    count         int
+    reputationSum float64
+    statusCounts  map[string]int
+}
+
+// GetZoneStatistics returns device counts by status, reputation distribution
+// and the best and worst rated devices of a zone
+func (dm *DeviceManager) GetZoneStatistics(ctx contractapi.TransactionContextInterface, zoneId string) (*ZoneStatistics, error) {
+    histogram, err := getZoneHistogram(ctx, zoneId)
+    if err != nil {
+        return nil, err
+    }
+
+    count := histogram.count
+    stats := ZoneStatistics{
+        ZoneID:        zoneId,
+        DeviceCount:   count,
+        StatusCounts:  histogram.statusCounts,
+        Percentiles:   make(map[string]float64),
+        TopDevices:    []DeviceReputation{},
+        BottomDevices: []DeviceReputation{},
+    }
+    if count == 0 {
+        return &stats, nil
+    }
+
+    stats.MeanReputation = histogram.reputationSum / float64(count)
+    low, err := histogram.reputationAt((count + 1) / 2)
+    if err != nil {
+        return nil, err
+    }
+    high, err := histogram.reputationAt(count/2 + 1)
+    if err != nil {
+        return nil, err
+    }
+    if count%2 == 1 {
+        stats.MedianReputation = low
+    } else {
+        stats.MedianReputation = (low + high) / 2
+    }
+    for _, p := range zonePercentiles {
+        reputation, err := histogram.reputationAt(percentileRank(p, count))
+        if err != nil {
+            return nil, err
+        }
+        stats.Percentiles[fmt.Sprintf("p%d", p)] = reputation
+    }
+
+    n := zoneLeaderboardSize
+    if n > count {
+        n = count
+    }
+    if stats.TopDevices, err = getZoneRanks(ctx, zoneRankDescObjectType, zoneId, n); err != nil {
+        return nil, err
+    }
+    if stats.BottomDevices, err = getZoneRanks(ctx, zoneRankObjectType, zoneId, n); err != nil {
+        return nil, err
+    }
+
+    return &stats, nil
+}
+
+// RebuildZoneStatistics recomputes a zone's statistics from its devices, for
+// zones populated before statistics were maintained. Admin only.
+func (dm *DeviceManager) RebuildZoneStatistics(ctx contractapi.TransactionContextInterface, zoneId string) error {
+    if err := assertRole(ctx, RoleAdmin); err != nil {
+        return err
+    }
+
+    for _, objectType := range []string{zoneBucketObjectType, zoneRankObjectType, zoneRankDescObjectType} {
+        if err := deleteByPartialKey(ctx, objectType, []string{zoneId}); err != nil {
+            return err
+        }
+    }
+
+    // Devices are decoded as zone members, since the zone holds devices of
+    // both contracts
+    queryString := fmt.Sprintf(`{"selector":{"zoneId":"%s"}}`, zoneId)
+    resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+    if err != nil {
+        return err
+    }
+    defer resultsIterator.Close()
+
+    var members []*zoneMember
+    for resultsIterator.HasNext() {
+        queryResult, err := resultsIterator.Next()
+        if err != nil {
+            return err
+        }
+        var member zoneMember
+        if err := json.Unmarshal(queryResult.Value, &member); err != nil {
+            return err
+        }
+        members = append(members, &member)
+    }
+
+    // The deletes above are not visible to this transaction, so the
+    // histogram is rebuilt from empty shards rather than the stored ones
+    empty := func(key string) (*ZoneBucket, error) {
+        return &ZoneBucket{StatusCounts: make(map[string]int)}, nil
+    }
+    return applyZoneAggregates(ctx, make([]*zoneMember, len(members)), members, empty)
+}
+
+// MoveDevicesToZone moves devices to another zone, as the consensus does when
+// it splits or merges zones: the application calls it for each zone change
+// it applies, with the members moved and the zone they moved to. Devices of
+// either contract keep every other field. Admin only.
+func (dm *DeviceManager) MoveDevicesToZone(ctx contractapi.TransactionContextInterface, zoneId string, deviceIdsJSON string) error {
+    if err := assertRole(ctx, RoleAdmin); err != nil {
+        return err
+    }
+    if zoneId == "" {
+        return fmt.Errorf("zone ID must not be empty")
+    }
+    var ids []string
+    if err := json.Unmarshal([]byte(deviceIdsJSON), &ids); err != nil {
+        return fmt.Errorf("failed to parse device IDs: %v", err)
+    }
+    zoneJSON, err := json.Marshal(zoneId)
+    if err != nil {
+        return err
+    }
+
+    seen := make(map[string]bool)
+    records := make([]deviceRecord, 0, len(ids))
+    for _, id := range ids {
+        if seen[id] {
+            return fmt.Errorf("device %s listed twice", id)
+        }
+        seen[id] = true
+
+        deviceJSON, err := ctx.GetStub().GetState(id)
+        if err != nil {
+            return fmt.Errorf("failed to read device: %v", err)
+        }
+        if deviceJSON == nil {
+            return fmt.Errorf("device does not exist: %s", id)
+        }
+        var fields map[string]json.RawMessage
+        if err := json.Unmarshal(deviceJSON, &fields); err != nil {
+            return err
+        }
+        fields["zoneId"] = zoneJSON
+        records = append(records, &movedDevice{id: id, fields: fields})
+    }
+    return putDeviceRecords(ctx, records...)
+}
+
+// movedDevice is a device of either contract with its zone changed and its
+// other fields as stored
+type movedDevice struct {
+    id     string
+    fields map[string]json.RawMessage
+}
+
+func (d *movedDevice) deviceID() string {
+    return d.id
+}
+
+func (d *movedDevice) MarshalJSON() ([]byte, error) {
+    return json.Marshal(d.fields)
+}
+
+// deviceRecord is a device as stored under its ID, by either contract
+type deviceRecord interface {
+    deviceID() string
+}
+
+func (d *Device) deviceID() string {
+    return d.ID
+}
+
+func (d *DeviceState) deviceID() string {
+    return d.ID
+}
+
+// putDeviceRecords writes devices to the world state and keeps their zone
+// statistics current. Devices written in the same transaction must go
+// through a single call, since a transaction cannot read its own writes.
+func putDeviceRecords(ctx contractapi.TransactionContextInterface, records ...deviceRecord) error {
+    previous := make([]*zoneMember, len(records))
+    current := make([]*zoneMember, len(records))
+    for i, record := range records {
+        deviceJSON, err := ctx.GetStub().GetState(record.deviceID())
+        if err != nil {
+            return fmt.Errorf("failed to read device: %v", err)
+        }
+        if len(deviceJSON) != 0 {
+            var old zoneMember
+            if err := json.Unmarshal(deviceJSON, &old); err != nil {
+                return err
+            }
+            previous[i] = &old
+        }
+    }
+
+    for i, record := range records {
+        deviceJSON, err := json.Marshal(record)
+        if err != nil {
+            return err
+        }
+        if err := ctx.GetStub().PutState(record.deviceID(), deviceJSON); err != nil {
+            return err
+        }
+        var member zoneMember
+        if err := json.Unmarshal(deviceJSON, &member); err != nil {
+            return err
+        }
+        current[i] = &member
+    }
+
+    return updateZoneAggregates(ctx, previous, current)
+}
+
+// updateZoneAggregates moves each changed device's rank entry and histogram
+// count. previous holds the committed state of each device, nil if new.
+// Histogram shards are read and written once each.
+func updateZoneAggregates(ctx contractapi.TransactionContextInterface, previous []*zoneMember, current []*zoneMember) error {
+    return applyZoneAggregates(ctx, previous, current, func(key string) (*ZoneBucket, error) {
+        return getZoneBucket(ctx, key)
+    })
+}
+
+// applyZoneAggregates is updateZoneAggregates with the histogram shards read
+// through readBucket
+func applyZoneAggregates(ctx contractapi.TransactionContextInterface, previous []*zoneMember, current []*zoneMember, readBucket func(string) (*ZoneBucket, error)) error {
+    buckets := make(map[string]*ZoneBucket)
+    var keys []string
+    load := func(member *zoneMember) (*ZoneBucket, error) {
+        key, err := zoneBucketKey(ctx, member)
+        if err != nil {
+            return nil, err
+        }
+        if bucket, ok := buckets[key]; ok {
+            return bucket, nil
+        }
+        bucket, err := readBucket(key)
+        if err != nil {
+            return nil, err
+        }
+        buckets[key] = bucket
+        keys = append(keys, key)
+        return bucket, nil
+    }
+
+    var added []*zoneMember
+    for i, member := range current {
+        old := previous[i]
+        if old != nil && old.ZoneID == member.ZoneID && old.status() == member.status() && old.Reputation == member.Reputation {
+            continue
+        }
+        if old != nil {
+            bucket, err := load(old)
+            if err != nil {
+                return err
+            }
+            bucket.remove(old)
+            keys, err := zoneRankKeys(ctx, old)
+            if err != nil {
+                return err
+            }
+            for _, key := range keys {
+                if err := ctx.GetStub().DelState(key); err != nil {
+                    return err
+                }
+            }
+        }
+        bucket, err := load(member)
+        if err != nil {
+            return err
+        }
+        bucket.add(member)
+        added = append(added, member)
+    }
+
+    // Rank entries are written after every removal, which may share their key
+    for _, member := range added {
+        keys, err := zoneRankKeys(ctx, member)
+        if err != nil {
+            return err
+        }
+        entryJSON, err := json.Marshal(DeviceReputation{DeviceID: member.ID, Reputation: member.Reputation})
+        if err != nil {
+            return err
+        }
+        for _, key := range keys {
+            if err := ctx.GetStub().PutState(key, entryJSON); err != nil {
+                return err
+            }
+        }
+    }
+
+    for _, key := range keys {
+        bucketJSON, err := json.Marshal(buckets[key])
+        if err != nil {
+            return err
+        }
+        if err := ctx.GetStub().PutState(key, bucketJSON); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// reputationBucket returns the histogram bucket a reputation falls in
+func reputationBucket(reputation float64) int {
+    bucket := int(math.Floor(reputation * (zoneHistogramBuckets - 1)))
+    if bucket < 0 {
+        return 0
+    }
+    if bucket >= zoneHistogramBuckets {
+        return zoneHistogramBuckets - 1
+    }
+    return bucket
+}
+
+// bucketAttribute formats a bucket so composite keys sort numerically
+func bucketAttribute(bucket int) string {
+    return fmt.Sprintf("%03d", bucket)
+}
+
+// reputationAttribute formats a reputation so composite keys sort numerically
+// within a bucket
+func reputationAttribute(reputation float64) string {
+    return fmt.Sprintf("%013.10f", math.Max(0, reputation))
+}
+
+// reputationValue formats a reputation as a histogram shard counts it, in
+// the shortest form that reads back as the same value
+func reputationValue(reputation float64) string {
+    return strconv.FormatFloat(reputation, 'g', -1, 64)
+}
+
+// bucketShard spreads a zone's devices over the shards of each bucket
+func bucketShard(deviceID string) string {
+    h := fnv.New32a()
+    h.Write([]byte(deviceID))
+    return fmt.Sprintf("%d", h.Sum32()%zoneBucketShards)
+}
+
+func zoneBucketKey(ctx contractapi.TransactionContextInterface, member *zoneMember) (string, error) {
+    bucket := bucketAttribute(reputationBucket(member.Reputation))
+    return ctx.GetStub().CreateCompositeKey(zoneBucketObjectType, []string{member.ZoneID, bucket, bucketShard(member.ID)})
+}
+
+func zoneRankKey(ctx contractapi.TransactionContextInterface, member *zoneMember) (string, error) {
+    bucket := bucketAttribute(reputationBucket(member.Reputation))
+    return ctx.GetStub().CreateCompositeKey(zoneRankObjectType, []string{member.ZoneID, bucket, reputationAttribute(member.Reputation), member.ID})
+}
+
+// zoneRankDescKey orders a zone's devices from the highest reputation down
+func zoneRankDescKey(ctx contractapi.TransactionContextInterface, member *zoneMember) (string, error) {
+    inverted := reputationAttribute(1 - math.Min(1, member.Reputation))
+    return ctx.GetStub().CreateCompositeKey(zoneRankDescObjectType, []string{member.ZoneID, inverted, member.ID})
+}
+
+// zoneRankKeys returns both rank entry keys of a device
+func zoneRankKeys(ctx contractapi.TransactionContextInterface, member *zoneMember) ([]string, error) {
+    ascending, err := zoneRankKey(ctx, member)
+    if err != nil {
+        return nil, err
+    }
+    descending, err := zoneRankDescKey(ctx, member)
+    if err != nil {
+        return nil, err
+    }
+    return []string{ascending, descending}, nil
+}
+
+// add counts a device in the bucket
+func (zb *ZoneBucket) add(member *zoneMember) {
+    zb.Count++
+    zb.ReputationSum += member.Reputation
+    zb.StatusCounts[member.status()]++
+    if zb.Reputations == nil {
+        zb.Reputations = make(map[string]int)
+    }
+    zb.Reputations[reputationValue(member.Reputation)]++
+}
+
+// remove uncounts a device as it was last recorded
+func (zb *ZoneBucket) remove(member *zoneMember) {
+    if zb.Count == 0 {
+        return
+    }
+    zb.Count--
+    zb.ReputationSum -= member.Reputation
+    zb.StatusCounts[member.status()]--
+    if zb.StatusCounts[member.status()] <= 0 {
+        delete(zb.StatusCounts, member.status())
+    }
+    value := reputationValue(member.Reputation)
+    zb.Reputations[value]--
+    if zb.Reputations[value] <= 0 {
+        delete(zb.Reputations, value)
+    }
+}
+
+// getZoneBucket reads a histogram shard, returning an empty one when absent
+func getZoneBucket(ctx contractapi.TransactionContextInterface, key string) (*ZoneBucket, error) {
+    bucketJSON, err := ctx.GetStub().GetState(key)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read zone statistics: %v", err)
+    }
+
+    bucket := &ZoneBucket{StatusCounts: make(map[string]int)}
+    if len(bucketJSON) != 0 {
+        if err := json.Unmarshal(bucketJSON, bucket); err != nil {
+            return nil, err
+        }
+        if bucket.StatusCounts == nil {
+            bucket.StatusCounts = make(map[string]int)
+        }
+    }
+    return bucket, nil
+}
+
+// getZoneHistogram merges the histogram shards of a zone. It reads a bounded
+// number of records however many devices the zone holds.
+func getZoneHistogram(ctx contractapi.TransactionContextInterface, zoneId string) (*zoneHistogram, error) {
+    resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(zoneBucketObjectType, []string{zoneId})
+    if err != nil {
+        return nil, err
+    }
+    defer resultsIterator.Close()
+
+    histogram := newZoneHistogram()
+    for resultsIterator.HasNext() {
+        queryResult, err := resultsIterator.Next()
+        if err != nil {
+            return nil, err
+        }
+        _, attributes, err := ctx.GetStub().SplitCompositeKey(queryResult.Key)
+        if err != nil {
+            return nil, err
+        }
+        var bucket ZoneBucket
+        if err := json.Unmarshal(queryResult.Value, &bucket); err != nil {
+            return nil, err
+        }
+        var index int
+        if len(attributes) < 2 {
+            return nil, fmt.Errorf("malformed zone statistics key %q", queryResult.Key)
+        }
+        if _, err := fmt.Sscanf(attributes[1], "%d", &index); err != nil {
+            return nil, fmt.Errorf("malformed zone statistics key %q: %v", queryResult.Key, err)
+        }
+        histogram.merge(index, &bucket)
+    }
+
+    return histogram, nil
+}
+
+// getZoneRanks returns the first n entries of one of a zone's rank indexes
+func getZoneRanks(ctx contractapi.TransactionContextInterface, objectType string, zoneId string, n int) ([]DeviceReputation, error) {
+    resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(objectType, []string{zoneId})
+    if err != nil {
+        return nil, err
+    }
+    defer resultsIterator.Close()
+
+    entries := make([]DeviceReputation, 0, n)
+    for len(entries) < n && resultsIterator.HasNext() {
+        queryResult, err := resultsIterator.Next()
+        if err != nil {
+            return nil, err
+        }
+        var entry DeviceReputation
+        if err := json.Unmarshal(queryResult.Value, &entry); err != nil {
+            return nil, err
+        }
+        entries = append(entries, entry)
+    }
+    if len(entries) < n {
+        return nil, fmt.Errorf("zone %s statistics are inconsistent; rebuild them", zoneId)
+    }
+    return entries, nil
+}
+
+// deleteByPartialKey deletes every record under a partial composite key
+func deleteByPartialKey(ctx contractapi.TransactionContextInterface, objectType string, attributes []string) error {
+    resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(objectType, attributes)
+    if err != nil {
+        return err
+    }
+    defer resultsIterator.Close()
+
+    for resultsIterator.HasNext() {
+        queryResult, err := resultsIterator.Next()
+        if err != nil {
+            return err
+        }
+        if err := ctx.GetStub().DelState(queryResult.Key); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func newZoneHistogram() *zoneHistogram {
+    return &zoneHistogram{statusCounts: make(map[string]int)}
+}
+
+// merge adds one shard of a bucket to the histogram
+func (h *zoneHistogram) merge(index int, bucket *ZoneBucket) {
+    if index < 0 || index >= zoneHistogramBuckets {
+        return
+    }
+    h.counts[index] += bucket.Count
+    h.count += bucket.Count
+    h.reputationSum += bucket.ReputationSum
+    for status, n := range bucket.StatusCounts {
+        h.statusCounts[status] += n
+    }
+    for value, n := range bucket.Reputations {
+        reputation, err := strconv.ParseFloat(value, 64)
+        if err != nil {
+            continue
+        }
+        if h.reputations[index] == nil {
+            h.reputations[index] = make(map[float64]int)
+        }
+        h.reputations[index][reputation] += n
+    }
+}
+
+// locate returns the bucket holding the device of the given 1-based rank,
+// counting from the lowest reputation, and its rank within that bucket
+func (h *zoneHistogram) locate(rank int) (int, int) {
+    for bucket, n := range h.counts {
+        if rank <= n {
+            return bucket, rank
+        }
+        rank -= n
+    }
+    return zoneHistogramBuckets - 1, rank
+}
+
+// reputationAt returns the reputation of the device of the given 1-based
+// rank, counting from the lowest reputation
+func (h *zoneHistogram) reputationAt(rank int) (float64, error) {
+    bucket, offset := h.locate(rank)
+    reputations := make([]float64, 0, len(h.reputations[bucket]))
+    for reputation := range h.reputations[bucket] {
+        reputations = append(reputations, reputation)
+    }
+    sort.Float64s(reputations)
+    for _, reputation := range reputations {
+        if offset <= h.reputations[bucket][reputation] {
+            return reputation, nil
+        }
+        offset -= h.reputations[bucket][reputation]
+    }
+    // Only shards written before reputations were counted fall short
+    return 0, fmt.Errorf("zone statistics are inconsistent; rebuild them")
+}
+
+// percentileRank returns the nearest-rank position of percentile p among count values
+func percentileRank(p int, count int) int {
+    rank := int(math.Ceil(float64(p) / 100 * float64(count)))
+    if rank < 1 {
+        return 1
+    }
+    if rank > count {
+        return count
+    }
+    return rank
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+    "fmt"
+    "math"
+    "sort"
+    "testing"
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+    "github.com/hyperledger/fabric-chaincode-go/shimtest"
+    "github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+func TestReputationBucket(t *testing.T) {
+    tests := []struct {
+        reputation float64
+        bucket     int
+    }{
+        {-0.5, 0},
+        {0, 0},
+        {0.009, 0},
+        {0.01, 1},
+        {0.5, 50},
+        {0.999, 99},
+        {1.0, 100},
+        {1.5, 100},
+    }
+
+    for _, tt := range tests {
+        assert.Equal(t, tt.bucket, reputationBucket(tt.reputation), "reputation %v", tt.reputation)
+    }
+}
+
+func TestPercentileRank(t *testing.T) {
+    tests := []struct {
+        p     int
+        count int
+        rank  int
+    }{
+        {10, 1, 1},
+        {99, 1, 1},
+        {10, 10, 1},
+        {25, 10, 3},
+        {75, 10, 8},
+        {90, 10, 9},
+        {99, 10, 10},
+        {50, 4, 2},
+        {100, 7, 7},
+        {0, 7, 1},
+    }
+
+    for _, tt := range tests {
+        assert.Equal(t, tt.rank, percentileRank(tt.p, tt.count), "p%d of %d", tt.p, tt.count)
+    }
+}
+
+func TestZoneBucketAddRemove(t *testing.T) {
+    bucket := &ZoneBucket{StatusCounts: make(map[string]int)}
+    a := &zoneMember{ID: "a", Status: "active", Reputation: 0.5}
+    b := &zoneMember{ID: "b", Reputation: 0.52}
+    c := &zoneMember{ID: "c", Status: "suspended", Reputation: 0.55}
+
+    bucket.add(a)
+    bucket.add(b)
+    bucket.add(c)
+    assert.Equal(t, 3, bucket.Count)
+    assert.InDelta(t, 1.57, bucket.ReputationSum, 1e-9)
+    assert.Equal(t, map[string]int{"active": 2, "suspended": 1}, bucket.StatusCounts)
+    assert.Equal(t, map[string]int{"0.5": 1, "0.52": 1, "0.55": 1}, bucket.Reputations)
+
+    bucket.remove(c)
+    assert.Equal(t, 2, bucket.Count)
+    assert.Equal(t, map[string]int{"active": 2}, bucket.StatusCounts)
+
+    bucket.remove(a)
+    bucket.remove(b)
+    bucket.remove(b)
+    assert.Equal(t, 0, bucket.Count)
+    assert.Empty(t, bucket.StatusCounts)
+    assert.Empty(t, bucket.Reputations)
+}
+
+func TestZoneHistogramLocate(t *testing.T) {
+    histogram := newZoneHistogram()
+    histogram.merge(3, &ZoneBucket{Count: 2})
+    histogram.merge(3, &ZoneBucket{Count: 1})
+    histogram.merge(50, &ZoneBucket{Count: 4})
+    histogram.merge(100, &ZoneBucket{Count: 1})
+
+    tests := []struct {
+        rank   int
+        bucket int
+        offset int
+    }{
+        {1, 3, 1},
+        {3, 3, 3},
+        {4, 50, 1},
+        {7, 50, 4},
+        {8, 100, 1},
+    }
+
+    assert.Equal(t, 8, histogram.count)
+    for _, tt := range tests {
+        bucket, offset := histogram.locate(tt.rank)
+        assert.Equal(t, tt.bucket, bucket, "rank %d", tt.rank)
+        assert.Equal(t, tt.offset, offset, "rank %d", tt.rank)
+    }
+}
+
+func TestZoneHistogramReputationAt(t *testing.T) {
+    histogram := newZoneHistogram()
+    histogram.merge(30, &ZoneBucket{Count: 3, Reputations: map[string]int{"0.3": 2, "0.305": 1}})
+    histogram.merge(30, &ZoneBucket{Count: 2, Reputations: map[string]int{"0.3": 1, "0.301": 1}})
+    histogram.merge(90, &ZoneBucket{Count: 1, Reputations: map[string]int{"0.9": 1}})
+
+    for rank, want := range []float64{0.3, 0.3, 0.3, 0.301, 0.305, 0.9} {
+        got, err := histogram.reputationAt(rank + 1)
+        require.NoError(t, err)
+        assert.Equal(t, want, got, "rank %d", rank+1)
+    }
+
+    // Shards without reputation counts cannot answer
+    histogram.merge(50, &ZoneBucket{Count: 1})
+    _, err := histogram.reputationAt(6)
+    assert.Error(t, err)
+}
+
+// newZoneStatsContext returns a transaction context over an in-memory ledger
+func newZoneStatsContext() (*contractapi.TransactionContext, *shimtest.MockStub) {
+    stub := shimtest.NewMockStub("zonestats", nil)
+    ctx := new(contractapi.TransactionContext)
+    ctx.SetStub(stub)
+    return ctx, stub
+}
+
+func TestGetZoneStatistics(t *testing.T) {
+    ctx, stub := newZoneStatsContext()
+    dm := new(DeviceManager)
+
+    // Devices of both contracts share the zone, with ties across and within buckets
+    reputations := []float64{0.91, 0.2, 0.5, 0.5, 0.05, 1.0, 0.33, 0.71, 0.12, 0.505, 0.64, 0.0}
+    for i, reputation := range reputations {
+        var record deviceRecord = &Device{ID: fmt.Sprintf("device%02d", i), ZoneID: "Z1", Reputation: reputation}
+        if i%2 == 1 {
+            record = &DeviceState{ID: fmt.Sprintf("device%02d", i), ZoneID: "Z1", Status: "active", Reputation: reputation}
+        }
+        stub.MockTransactionStart(fmt.Sprintf("tx%d", i))
+        require.NoError(t, putDeviceRecords(ctx, record))
+        stub.MockTransactionEnd(fmt.Sprintf("tx%d", i))
+    }
+    stub.MockTransactionStart("other-zone")
+    require.NoError(t, putDeviceRecords(ctx, &Device{ID: "elsewhere", ZoneID: "Z2", Reputation: 0.99}))
+    stub.MockTransactionEnd("other-zone")
+
+    // Moving a device updates its bucket, rank entry and status
+    stub.MockTransactionStart("update")
+    require.NoError(t, putDeviceRecords(ctx, &DeviceState{ID: "device05", ZoneID: "Z1", Status: "suspended", Reputation: 0.4}))
+    stub.MockTransactionEnd("update")
+    reputations[5] = 0.4
+
+    stats, err := dm.GetZoneStatistics(ctx, "Z1")
+    require.NoError(t, err)
+
+    sorted := append([]float64(nil), reputations...)
+    sort.Float64s(sorted)
+    n := len(sorted)
+    sum := 0.0
+    for _, reputation := range sorted {
+        sum += reputation
+    }
+
+    assert.Equal(t, n, stats.DeviceCount)
+    assert.Equal(t, map[string]int{"active": n - 1, "suspended": 1}, stats.StatusCounts)
+    assert.InDelta(t, sum/float64(n), stats.MeanReputation, 1e-9)
+    assert.InDelta(t, (sorted[n/2-1]+sorted[n/2])/2, stats.MedianReputation, 1e-9)
+    for _, p := range zonePercentiles {
+        rank := int(math.Ceil(float64(p) / 100 * float64(n)))
+        assert.Equal(t, sorted[rank-1], stats.Percentiles[fmt.Sprintf("p%d", p)], "p%d", p)
+    }
+
+    require.Len(t, stats.TopDevices, zoneLeaderboardSize)
+    require.Len(t, stats.BottomDevices, zoneLeaderboardSize)
+    for i := 0; i < zoneLeaderboardSize; i++ {
+        assert.Equal(t, sorted[n-1-i], stats.TopDevices[i].Reputation)
+        assert.Equal(t, sorted[i], stats.BottomDevices[i].Reputation)
+    }
+    assert.Equal(t, "device11", stats.BottomDevices[0].DeviceID)
+    assert.Equal(t, "device00", stats.TopDevices[0].DeviceID)
+
+    empty, err := dm.GetZoneStatistics(ctx, "Z3")
+    require.NoError(t, err)
+    assert.Equal(t, 0, empty.DeviceCount)
+    assert.Empty(t, empty.TopDevices)
+}
+
+func TestMoveDevicesToZone(t *testing.T) {
+    ctx, stub := newZoneStatsContext()
+    ctx.SetClientIdentity(&MockClientIdentity{id: testOwner, role: RoleAdmin})
+    dm := new(DeviceManager)
+
+    stub.MockTransactionStart("register")
+    require.NoError(t, putDeviceRecords(ctx,
+        &Device{ID: "a", ZoneID: "Z1", Reputation: 0.7, Owner: "alice"},
+        &DeviceState{ID: "b", ZoneID: "Z1", Status: "active", Reputation: 0.4, Owner: testOwner},
+        &DeviceState{ID: "c", ZoneID: "Z1", Status: "active", Reputation: 0.9}))
+    stub.MockTransactionEnd("register")
+
+    stub.MockTransactionStart("move")
+    require.NoError(t, dm.MoveDevicesToZone(ctx, "Z2", `["a", "b"]`))
+    stub.MockTransactionEnd("move")
+
+    for zoneID, count := range map[string]int{"Z1": 1, "Z2": 2} {
+        stats, err := dm.GetZoneStatistics(ctx, zoneID)
+        require.NoError(t, err)
+        assert.Equal(t, count, stats.DeviceCount, "devices in %s", zoneID)
+    }
+    device, err := dm.GetDevice(ctx, "b")
+    require.NoError(t, err)
+    assert.Equal(t, "Z2", device.ZoneID)
+    assert.Equal(t, "active", device.Status)
+    assert.Equal(t, testOwner, device.Owner)
+    assert.Equal(t, 0.4, device.Reputation)
+
+    stub.MockTransactionStart("rejected")
+    assert.Error(t, dm.MoveDevicesToZone(ctx, "Z2", `["c", "missing"]`))
+    assert.Error(t, dm.MoveDevicesToZone(ctx, "Z2", `["c", "c"]`))
+    ctx.SetClientIdentity(&MockClientIdentity{id: testOwner})
+    assert.Error(t, dm.MoveDevicesToZone(ctx, "Z2", `["c"]`))
+    stub.MockTransactionEnd("rejected")
+}
+
+func TestGetZoneStatisticsClusteredZone(t *testing.T) {
+    ctx, stub := newZoneStatsContext()
+    dm := new(DeviceManager)
+
+    // Most devices sit at the probationary reputation
+    stub.MockTransactionStart("register")
+    var records []deviceRecord
+    for i := 0; i < 40; i++ {
+        records = append(records, &DeviceState{ID: fmt.Sprintf("new%02d", i), ZoneID: "Z1", Status: "active", Reputation: 0.3})
+    }
+    records = append(records,
+        &DeviceState{ID: "low", ZoneID: "Z1", Status: "active", Reputation: 0.1},
+        &DeviceState{ID: "high", ZoneID: "Z1", Status: "active", Reputation: 0.95})
+    require.NoError(t, putDeviceRecords(ctx, records...))
+    stub.MockTransactionEnd("register")
+
+    stats, err := dm.GetZoneStatistics(ctx, "Z1")
+    require.NoError(t, err)
+    assert.Equal(t, 42, stats.DeviceCount)
+    assert.Equal(t, 0.3, stats.MedianReputation)
+    assert.Equal(t, 0.3, stats.Percentiles["p90"])
+    assert.Equal(t, 0.95, stats.Percentiles["p99"])
+    assert.Equal(t, DeviceReputation{DeviceID: "high", Reputation: 0.95}, stats.TopDevices[0])
+    assert.Equal(t, DeviceReputation{DeviceID: "low", Reputation: 0.1}, stats.BottomDevices[0])
+    for i := 1; i < zoneLeaderboardSize; i++ {
+        assert.Equal(t, 0.3, stats.TopDevices[i].Reputation)
+        assert.Equal(t, 0.3, stats.BottomDevices[i].Reputation)
+    }
+}